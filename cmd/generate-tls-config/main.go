@@ -0,0 +1,77 @@
+// Command generate-tls-config generates the TLS config tree (service,
+// bootstrap and device CAs, certificates and bundles) used by the tests.
+//
+// Usage:
+//
+//	generate-tls-config [-dir tls] [-key RSA|ECDSA|Ed25519] [-bits 2048]
+//	                    [-days 42] [-devices news,communique,...]
+//	                    [-passphrase-file path]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/tls/pki"
+)
+
+func main() {
+	dir := flag.String("dir", "tls", "TLS config directory")
+	algorithm := flag.String("key", ptls.KEY_ALGORITHM_RSA,
+		"key algorithm (RSA, ECDSA or Ed25519)")
+	bits := flag.Int("bits", pki.DEFAULT_RSA_BITS, "RSA key size in bits")
+	days := flag.Int("days", 42, "validity in days")
+	devices := flag.String("devices", strings.Join(pki.DEVICE_NAMES, ","),
+		"comma separated device names")
+	passphraseFile := flag.String("passphrase-file", "",
+		"file with the passphrase to encrypt the private keys with")
+
+	flag.Parse()
+
+	opts := pki.Options{
+		KeyAlgorithm: *algorithm,
+		RSABits:      *bits,
+		Validity:     time.Duration(*days*24) * time.Hour,
+	}
+
+	if len(*passphraseFile) > 0 {
+		passphrase, err := ptls.PassphraseFromFile(*passphraseFile)("")
+		if err != nil {
+			slog.Error("reading passphrase", "error", err)
+			os.Exit(1)
+		}
+
+		opts.Passphrase = passphrase
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(*devices, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	tree, err := pki.Generate(*dir, opts, names...)
+	if err != nil {
+		slog.Error("generating TLS config", "dir", *dir, "error", err)
+		os.Exit(1)
+	}
+
+	sets := []*pki.CertificateSet{tree.Service, tree.Bootstrap}
+	for _, name := range names {
+		sets = append(sets, tree.Devices[name])
+	}
+
+	for _, set := range sets {
+		fmt.Printf("  - %v\n", set.Cert.Subject)
+		fmt.Printf("      CA certificate = %v\n", set.CACertPath)
+		fmt.Printf("      certificate    = %v\n", set.CertPath)
+		fmt.Printf("      bundle         = %v\n", set.BundlePath)
+	}
+
+} //  End of function  main.
@@ -51,9 +51,16 @@ const (
 	// Default file pattern for device CA certificates.
 	DEFAULT_DEVICE_CACERTS_PATTERN = ""
 
+	// Default file pattern for the CRLs of the bootstrap and device CAs.
+	DEFAULT_CRL_PATTERN = ""
+
 	// Default service CA certificate.
 	DEFAULT_SERVICE_CACERT = ""
 
+	// Default CA certificate the service certificate is issued by - empty
+	// means the service certificate chain is not validated.
+	DEFAULT_CACERT = ""
+
 	// Default disable subscriptions.
 	DEFAULT_DISABLE_SUBSCRIPTIONS = false
 
@@ -67,6 +74,10 @@ const (
 	DEFAULT_MAX_CONCURRENT_STREAMS = uint32(256)
 	DEFAULT_NUM_STREAM_WORKERS     = uint32(8)
 
+	// Default max number of relay hops a communique can take before a
+	// service rejects it (protects against misconfigured tower chains).
+	DEFAULT_MAX_HOPS = uint32(8)
+
 	// Max queue size for retries due to failures (example if service is
 	// down - we can cache these many messages and resend them when we
 	// regain connectivity). The rest we just drop on the floor.
@@ -77,6 +88,66 @@ const (
 	//
 	DEFAULT_RETRY_QUEUE_SIZE = uint32(1024)
 
+	// Default outbox directory - empty means no persistent outbox.
+	DEFAULT_OUTBOX_DIR = ""
+
+	// Default max size of the persistent outbox and of each of the outbox
+	// segment files. Same as the retry queue, 1k messages x 64kb.
+	DEFAULT_OUTBOX_MAX_BYTES    = uint64(64 * 1024 * 1024) // 64mb
+	DEFAULT_OUTBOX_SEGMENT_SIZE = uint32(1024 * 1024)      // 1mb
+
+	// Default membership file - empty means the device doesn't register.
+	DEFAULT_MEMBERSHIP_FILE = ""
+
+	// Default enrolled device certificate and private key - empty means
+	// the device doesn't enroll for a device certificate.
+	DEFAULT_ENROLLED_CERTIFICATE = ""
+	DEFAULT_ENROLLED_PRIVATE_KEY = ""
+
+	// Default CA certificate and key the service signs enrolled device
+	// certificates with - empty means no enrollment.
+	DEFAULT_SIGNING_CACERT = ""
+	DEFAULT_SIGNING_CAKEY  = ""
+
+	// Default private key passphrase and passphrase file - for keys in
+	// encrypted PKCS#8 format.
+	DEFAULT_KEY_PASSPHRASE      = ""
+	DEFAULT_KEY_PASSPHRASE_FILE = ""
+
+	// Default window before certificates expire to start warning about
+	// them - zero turns the warnings off.
+	DEFAULT_CERT_EXPIRY_WARNING = time.Duration(30*24) * time.Hour
+
+	// Default lifetime of enrolled device certificates.
+	DEFAULT_DEVICE_CERT_LIFETIME = time.Duration(365*24) * time.Hour
+
+	// Default peer identity source (cn, uri, dns or oid) and subject
+	// attribute or extension OID - empty means devices are not bound to
+	// their client certificates.
+	DEFAULT_PEER_IDENTITY     = ""
+	DEFAULT_PEER_IDENTITY_OID = ""
+
+	// Default static token file and HMAC token key file the service
+	// authenticates the communique credentials with - empty means no
+	// authentication.
+	DEFAULT_AUTH_TOKEN_FILE    = ""
+	DEFAULT_AUTH_HMAC_KEY_FILE = ""
+
+	// Default key file (Ed25519 private key or HMAC secret) the service
+	// signs membership tokens with - empty means the registrar permits
+	// are used as is. Default token lifetime and (comma separated) topic
+	// and category scopes - empty scopes mean no restrictions.
+	DEFAULT_TOKEN_SIGNING_KEY = ""
+	DEFAULT_TOKEN_LIFETIME    = time.Duration(24) * time.Hour
+	DEFAULT_TOKEN_TOPICS      = ""
+	DEFAULT_TOKEN_CATEGORIES  = ""
+
+	// Default access policy file - empty means no access control. The
+	// policy file is checked for changes at most every reload interval,
+	// zero turns reloading off.
+	DEFAULT_POLICY_FILE            = ""
+	DEFAULT_POLICY_RELOAD_INTERVAL = time.Duration(60) * time.Second
+
 	// Default Timeouts.
 	DEFAULT_CONNECT_TIMEOUT    = time.Duration(20) * time.Second
 	DEFAULT_SEND_TIMEOUT       = time.Duration(300) * time.Second
@@ -86,6 +157,10 @@ const (
 	// Default max subscription delay.
 	DEFAULT_MAX_SUBSCRIPTION_DELAY = time.Duration(300) * time.Second
 
+	// Default interval for checking the TLS certificate, key and CA
+	// files for changes - zero turns reloading off.
+	DEFAULT_TLS_RELOAD_INTERVAL = time.Duration(60) * time.Second
+
 	// Struct env tag.
 	STRUCT_ENV_TAG = "env"
 )
@@ -98,6 +173,11 @@ type Settings struct {
 	ValidateTLS bool   `env:"VALIDATE_TLS_CONFIG"`
 	Cert        string `env:"CERT"`
 	Key         string `env:"KEY"`
+
+	KeyPassphrase     string `env:"KEY_PASSPHRASE"`
+	KeyPassphraseFile string `env:"KEY_PASSPHRASE_FILE"`
+
+	CertExpiryWarning time.Duration `env:"CERT_EXPIRY_WARNING"`
 }
 
 // Timeout settings.
@@ -106,6 +186,7 @@ type TimeoutSettings struct {
 	Send                 time.Duration `env:"SEND_TIMEOUT"`
 	KeepAlive            time.Duration `env:"KEEP_ALIVE_TIMEOUT"`
 	MaxSubscriptionDelay time.Duration `env:"MAX_SUBSCRIPTION_DELAY"`
+	TLSReload            time.Duration `env:"TLS_RELOAD_INTERVAL"`
 }
 
 // Device settings.
@@ -115,12 +196,22 @@ type DeviceSettings struct {
 	ServicePort    int    `env:"SERVICE_PORT"`
 	ServiceCACert  string `env:"SERVICE_CACERT"`
 	RetryQueueSize uint32 `env:"RETRY_QUEUE_SIZE"`
+
+	OutboxDir         string `env:"OUTBOX_DIR"`
+	OutboxMaxBytes    uint64 `env:"OUTBOX_MAX_BYTES"`
+	OutboxSegmentSize uint32 `env:"OUTBOX_SEGMENT_SIZE"`
+
+	MembershipFile string `env:"MEMBERSHIP_FILE"`
+	EnrolledCert   string `env:"ENROLLED_CERT"`
+	EnrolledKey    string `env:"ENROLLED_KEY"`
 }
 
-// CA certificates pattern for bootstrap and device CAs.
+// CA certificates pattern for bootstrap and device CAs and their
+// certificate revocation lists.
 type CACertificatesPattern struct {
 	Bootstrap string `env:"BOOTSTRAP_CACERTS_PATTERN"`
 	Device    string `env:"DEVICE_CACERTS_PATTERN"`
+	CRL       string `env:"CRL_PATTERN"`
 }
 
 // Service settings.
@@ -129,13 +220,33 @@ type ServiceSettings struct {
 	BindAddress string `env:"BIND_ADDRESS"`
 	BindPort    int    `env:"BIND_PORT"`
 
+	CACert         string `env:"CACERT"`
 	CACertPatterns CACertificatesPattern
 
+	SigningCACert      string        `env:"SIGNING_CACERT"`
+	SigningCAKey       string        `env:"SIGNING_CAKEY"`
+	DeviceCertLifetime time.Duration `env:"DEVICE_CERT_LIFETIME"`
+
+	PeerIdentity    string `env:"PEER_IDENTITY"`
+	PeerIdentityOID string `env:"PEER_IDENTITY_OID"`
+
+	AuthTokenFile   string `env:"AUTH_TOKEN_FILE"`
+	AuthHMACKeyFile string `env:"AUTH_HMAC_KEY_FILE"`
+
+	TokenSigningKey string        `env:"TOKEN_SIGNING_KEY"`
+	TokenLifetime   time.Duration `env:"TOKEN_LIFETIME"`
+	TokenTopics     string        `env:"TOKEN_TOPICS"`
+	TokenCategories string        `env:"TOKEN_CATEGORIES"`
+
+	PolicyFile   string        `env:"POLICY_FILE"`
+	PolicyReload time.Duration `env:"POLICY_RELOAD_INTERVAL"`
+
 	DisableSubscriptions bool   `env:"DISABLE_SUBSCRIPTIONS"`
 	BufferSize           uint32 `env:"BUFFER_SIZE"`
 	MaxMessageSize       uint32 `env:"MAX_MESSAGE_SIZE"`
 	MaxConcurrentStreams uint32 `env:"MAX_STREAMS"`
 	NumStreamWorkers     uint32 `env:"NUM_STREAM_WORKERS"`
+	MaxHops              uint32 `env:"MAX_HOPS"`
 }
 
 // Telegraph configuration loaded from defaults/environment/settings file.
@@ -160,6 +271,11 @@ func makeDefaultSettings() Settings {
 		ValidateTLS: DEFAULT_VALIDATE_TLS_CONFIG,
 		Cert:        DEFAULT_CERTIFICATE,
 		Key:         DEFAULT_PRIVATE_KEY,
+
+		KeyPassphrase:     DEFAULT_KEY_PASSPHRASE,
+		KeyPassphraseFile: DEFAULT_KEY_PASSPHRASE_FILE,
+
+		CertExpiryWarning: DEFAULT_CERT_EXPIRY_WARNING,
 	}
 
 } //  End of function  makeDefaultSettings.
@@ -171,6 +287,7 @@ func makeDefaultTimeoutSettings() TimeoutSettings {
 		Send:                 DEFAULT_SEND_TIMEOUT,
 		KeepAlive:            DEFAULT_KEEP_ALIVE_TIMEOUT,
 		MaxSubscriptionDelay: DEFAULT_MAX_SUBSCRIPTION_DELAY,
+		TLSReload:            DEFAULT_TLS_RELOAD_INTERVAL,
 	}
 
 } //  End of function  makeDefaultTimeoutSettings.
@@ -183,6 +300,14 @@ func makeDefaultDeviceSettings() DeviceSettings {
 		ServicePort:    DEFAULT_SERVICE_PORT_NUMBER,
 		ServiceCACert:  DEFAULT_SERVICE_CACERT,
 		RetryQueueSize: DEFAULT_RETRY_QUEUE_SIZE,
+
+		OutboxDir:         DEFAULT_OUTBOX_DIR,
+		OutboxMaxBytes:    DEFAULT_OUTBOX_MAX_BYTES,
+		OutboxSegmentSize: DEFAULT_OUTBOX_SEGMENT_SIZE,
+
+		MembershipFile: DEFAULT_MEMBERSHIP_FILE,
+		EnrolledCert:   DEFAULT_ENROLLED_CERTIFICATE,
+		EnrolledKey:    DEFAULT_ENROLLED_PRIVATE_KEY,
 	}
 
 } //  End of function  makeDefaultDeviceSettings.
@@ -192,6 +317,7 @@ func makeDefaultCACertificatesPattern() CACertificatesPattern {
 	return CACertificatesPattern{
 		Bootstrap: DEFAULT_BOOTSTRAP_CACERTS_PATTERN,
 		Device:    DEFAULT_DEVICE_CACERTS_PATTERN,
+		CRL:       DEFAULT_CRL_PATTERN,
 	}
 
 } // End of function  makeDefaultCACertificatesPattern.
@@ -204,12 +330,27 @@ func makeDefaultServiceSettings() ServiceSettings {
 		Kind:                 DEFAULT_SERVICE_TYPE,
 		BindAddress:          DEFAULT_BIND_ADDRESS,
 		BindPort:             DEFAULT_BIND_PORT_NUMBER,
+		CACert:               DEFAULT_CACERT,
 		CACertPatterns:       caCertPatterns,
+		SigningCACert:        DEFAULT_SIGNING_CACERT,
+		SigningCAKey:         DEFAULT_SIGNING_CAKEY,
+		DeviceCertLifetime:   DEFAULT_DEVICE_CERT_LIFETIME,
+		PeerIdentity:         DEFAULT_PEER_IDENTITY,
+		PeerIdentityOID:      DEFAULT_PEER_IDENTITY_OID,
+		AuthTokenFile:        DEFAULT_AUTH_TOKEN_FILE,
+		AuthHMACKeyFile:      DEFAULT_AUTH_HMAC_KEY_FILE,
+		TokenSigningKey:      DEFAULT_TOKEN_SIGNING_KEY,
+		TokenLifetime:        DEFAULT_TOKEN_LIFETIME,
+		TokenTopics:          DEFAULT_TOKEN_TOPICS,
+		TokenCategories:      DEFAULT_TOKEN_CATEGORIES,
+		PolicyFile:           DEFAULT_POLICY_FILE,
+		PolicyReload:         DEFAULT_POLICY_RELOAD_INTERVAL,
 		DisableSubscriptions: DEFAULT_DISABLE_SUBSCRIPTIONS,
 		BufferSize:           DEFAULT_READ_BUFFER_SIZE,
 		MaxMessageSize:       DEFAULT_MAX_MESSAGE_SIZE,
 		MaxConcurrentStreams: DEFAULT_MAX_CONCURRENT_STREAMS,
 		NumStreamWorkers:     DEFAULT_NUM_STREAM_WORKERS,
+		MaxHops:              DEFAULT_MAX_HOPS,
 	}
 
 } //  End of function  makeDefaultServiceSettings.
@@ -266,6 +407,19 @@ func (c *Config) updateSettings(name, value string) error {
 
 	case "KEY":
 		c.Settings.Key = value
+
+	case "KEY_PASSPHRASE":
+		c.Settings.KeyPassphrase = value
+
+	case "KEY_PASSPHRASE_FILE":
+		c.Settings.KeyPassphraseFile = value
+
+	case "CERT_EXPIRY_WARNING":
+		if v, err := util.ToTimeDuration(value); err == nil {
+			c.Settings.CertExpiryWarning = v
+		} else {
+			return err
+		}
 	}
 
 	return nil
@@ -291,6 +445,9 @@ func (c *Config) updateTimeouts(name, value string) error {
 
 	case "MAX_SUBSCRIPTION_DELAY":
 		c.Timeouts.MaxSubscriptionDelay = v
+
+	case "TLS_RELOAD_INTERVAL":
+		c.Timeouts.TLSReload = v
 	}
 
 	return nil
@@ -322,6 +479,32 @@ func (c *Config) updateDeviceSettings(name, value string) error {
 		} else {
 			return err
 		}
+
+	case "OUTBOX_DIR":
+		c.Device.OutboxDir = value
+
+	case "OUTBOX_MAX_BYTES":
+		if v, err := util.ToUnsignedInt64(value); err == nil {
+			c.Device.OutboxMaxBytes = v
+		} else {
+			return err
+		}
+
+	case "OUTBOX_SEGMENT_SIZE":
+		if v, err := util.ToUnsignedInt32(value); err == nil {
+			c.Device.OutboxSegmentSize = v
+		} else {
+			return err
+		}
+
+	case "MEMBERSHIP_FILE":
+		c.Device.MembershipFile = value
+
+	case "ENROLLED_CERT":
+		c.Device.EnrolledCert = value
+
+	case "ENROLLED_KEY":
+		c.Device.EnrolledKey = value
 	}
 
 	return nil
@@ -344,12 +527,69 @@ func (c *Config) updateServiceSettings(name, value string) error {
 			return err
 		}
 
+	case "CACERT":
+		c.Service.CACert = value
+
 	case "BOOTSTRAP_CACERTS_PATTERN":
 		c.Service.CACertPatterns.Bootstrap = value
 
 	case "DEVICE_CACERTS_PATTERN":
 		c.Service.CACertPatterns.Device = value
 
+	case "CRL_PATTERN":
+		c.Service.CACertPatterns.CRL = value
+
+	case "SIGNING_CACERT":
+		c.Service.SigningCACert = value
+
+	case "SIGNING_CAKEY":
+		c.Service.SigningCAKey = value
+
+	case "DEVICE_CERT_LIFETIME":
+		if v, err := util.ToTimeDuration(value); err == nil {
+			c.Service.DeviceCertLifetime = v
+		} else {
+			return err
+		}
+
+	case "PEER_IDENTITY":
+		c.Service.PeerIdentity = value
+
+	case "PEER_IDENTITY_OID":
+		c.Service.PeerIdentityOID = value
+
+	case "AUTH_TOKEN_FILE":
+		c.Service.AuthTokenFile = value
+
+	case "AUTH_HMAC_KEY_FILE":
+		c.Service.AuthHMACKeyFile = value
+
+	case "TOKEN_SIGNING_KEY":
+		c.Service.TokenSigningKey = value
+
+	case "TOKEN_LIFETIME":
+		if v, err := util.ToTimeDuration(value); err == nil {
+			c.Service.TokenLifetime = v
+		} else {
+			return err
+		}
+
+	case "TOKEN_TOPICS":
+		c.Service.TokenTopics = value
+
+	case "TOKEN_CATEGORIES":
+		c.Service.TokenCategories = value
+
+	case "POLICY_FILE":
+		c.Service.PolicyFile = value
+
+	case "POLICY_RELOAD_INTERVAL":
+		if v, err := util.ToTimeDuration(value); err == nil {
+			c.Service.PolicyReload = v
+		} else {
+			return err
+		}
+
 	case "DISABLE_SUBSCRIPTIONS":
 		if v, err := util.ToBoolean(value); err == nil {
 			c.Service.DisableSubscriptions = v
@@ -384,6 +624,13 @@ func (c *Config) updateServiceSettings(name, value string) error {
 		} else {
 			return err
 		}
+
+	case "MAX_HOPS":
+		if v, err := util.ToUnsignedInt32(value); err == nil {
+			c.Service.MaxHops = v
+		} else {
+			return err
+		}
 	}
 
 	return nil
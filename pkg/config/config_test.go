@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Config map for various grouped settings.
@@ -54,6 +55,10 @@ func defaultSettings() SettingsMap {
 		"ValidateTLS": DEFAULT_VALIDATE_TLS_CONFIG,
 		"Cert":        DEFAULT_CERTIFICATE,
 		"Key":         DEFAULT_PRIVATE_KEY,
+
+		"KeyPassphrase":     DEFAULT_KEY_PASSPHRASE,
+		"KeyPassphraseFile": DEFAULT_KEY_PASSPHRASE_FILE,
+		"CertExpiryWarning": DEFAULT_CERT_EXPIRY_WARNING,
 	}
 
 } // End of function  defaultSettings.
@@ -76,6 +81,7 @@ func timeoutSettings() SettingsMap {
 		"Send":                 DEFAULT_SEND_TIMEOUT,
 		"KeepAlive":            DEFAULT_KEEP_ALIVE_TIMEOUT,
 		"MaxSubscriptionDelay": DEFAULT_MAX_SUBSCRIPTION_DELAY,
+		"TLSReload":            DEFAULT_TLS_RELOAD_INTERVAL,
 	}
 
 } // End of function  timeoutSettings.
@@ -99,6 +105,13 @@ func deviceSettings() SettingsMap {
 		"ServicePort":    DEFAULT_SERVICE_PORT_NUMBER,
 		"ServiceCACert":  "",
 		"RetryQueueSize": DEFAULT_RETRY_QUEUE_SIZE,
+
+		"OutboxDir":         "",
+		"OutboxMaxBytes":    DEFAULT_OUTBOX_MAX_BYTES,
+		"OutboxSegmentSize": DEFAULT_OUTBOX_SEGMENT_SIZE,
+		"MembershipFile":    "",
+		"EnrolledCert":      "",
+		"EnrolledKey":       "",
 	}
 
 } // End of function  deviceSettings.
@@ -119,6 +132,7 @@ func caCertificatesPattern() SettingsMap {
 	return map[string]any{
 		"Bootstrap": DEFAULT_BOOTSTRAP_CACERTS_PATTERN,
 		"Device":    DEFAULT_DEVICE_CACERTS_PATTERN,
+		"CRL":       DEFAULT_CRL_PATTERN,
 	}
 
 } // End of function  caCertificatesPattern.
@@ -141,12 +155,27 @@ func serviceSettings() SettingsMap {
 		"Kind":                 "station",
 		"BindAddress":          DEFAULT_BIND_ADDRESS,
 		"BindPort":             DEFAULT_BIND_PORT_NUMBER,
+		"CACert":               DEFAULT_CACERT,
 		"CACertPatterns":       makeDefaultCACertificatesPattern(),
+		"SigningCACert":        "",
+		"SigningCAKey":         "",
+		"DeviceCertLifetime":   DEFAULT_DEVICE_CERT_LIFETIME,
+		"PeerIdentity":         DEFAULT_PEER_IDENTITY,
+		"PeerIdentityOID":      DEFAULT_PEER_IDENTITY_OID,
+		"AuthTokenFile":        DEFAULT_AUTH_TOKEN_FILE,
+		"AuthHMACKeyFile":      DEFAULT_AUTH_HMAC_KEY_FILE,
+		"TokenSigningKey":      DEFAULT_TOKEN_SIGNING_KEY,
+		"TokenLifetime":        DEFAULT_TOKEN_LIFETIME,
+		"TokenTopics":          DEFAULT_TOKEN_TOPICS,
+		"TokenCategories":      DEFAULT_TOKEN_CATEGORIES,
+		"PolicyFile":           DEFAULT_POLICY_FILE,
+		"PolicyReload":         DEFAULT_POLICY_RELOAD_INTERVAL,
 		"DisableSubscriptions": false,
 		"BufferSize":           DEFAULT_READ_BUFFER_SIZE,
 		"MaxMessageSize":       DEFAULT_MAX_MESSAGE_SIZE,
 		"MaxConcurrentStreams": DEFAULT_MAX_CONCURRENT_STREAMS,
 		"NumStreamWorkers":     DEFAULT_NUM_STREAM_WORKERS,
+		"MaxHops":              DEFAULT_MAX_HOPS,
 	}
 
 } // End of function  serviceSettings.
@@ -180,6 +209,10 @@ func configTestCases() []configTestCase {
 			"ValidateTLS": false,
 			"Cert":        "",
 			"Key":         "",
+
+			"KeyPassphrase":     "",
+			"KeyPassphraseFile": "",
+			"CertExpiryWarning": DEFAULT_CERT_EXPIRY_WARNING,
 		},
 		"Timeouts": timeoutSettings(),
 		"Device": map[string]any{
@@ -188,6 +221,13 @@ func configTestCases() []configTestCase {
 			"ServicePort":    9876,
 			"ServiceCACert":  "",
 			"RetryQueueSize": uint32(280),
+
+			"OutboxDir":         "",
+			"OutboxMaxBytes":    DEFAULT_OUTBOX_MAX_BYTES,
+			"OutboxSegmentSize": DEFAULT_OUTBOX_SEGMENT_SIZE,
+			"MembershipFile":    "",
+			"EnrolledCert":      "",
+			"EnrolledKey":       "",
 		},
 		"Service": serviceSettings(),
 	}
@@ -200,6 +240,10 @@ func configTestCases() []configTestCase {
 			"ValidateTLS": true,
 			"Cert":        "test/tls/device/telegraph-cert.pem",
 			"Key":         "test/tls/device/telegraph-key.pem",
+
+			"KeyPassphrase":     "",
+			"KeyPassphraseFile": "",
+			"CertExpiryWarning": time.Duration(14*24) * time.Hour,
 		},
 		"Timeouts": timeoutSettings(),
 		"Device": map[string]any{
@@ -208,6 +252,13 @@ func configTestCases() []configTestCase {
 			"ServicePort":    9340,
 			"ServiceCACert":  "test/tls/service/cacert.pem",
 			"RetryQueueSize": uint32(2048),
+
+			"OutboxDir":         "/var/spool/telegraph/outbox",
+			"OutboxMaxBytes":    uint64(16777216),
+			"OutboxSegmentSize": uint32(262144),
+			"MembershipFile":    "/var/lib/telegraph/membership",
+			"EnrolledCert":      "/var/lib/telegraph/device-cert.pem",
+			"EnrolledKey":       "/var/lib/telegraph/device-key.pem",
 		},
 		"Service": serviceSettings(),
 	}
@@ -223,6 +274,10 @@ func configTestCases() []configTestCase {
 			"ValidateTLS": true,
 			"Cert":        "test/tls/service/bundle/service.pem",
 			"Key":         "test/tls/service/bundle/service.pem",
+
+			"KeyPassphrase":     "",
+			"KeyPassphraseFile": "",
+			"CertExpiryWarning": time.Duration(14*24) * time.Hour,
 		},
 		"Timeouts": timeoutSettings(),
 		"Device":   svcdev,
@@ -231,16 +286,37 @@ func configTestCases() []configTestCase {
 			"BindAddress": DEFAULT_BIND_ADDRESS,
 			"BindPort":    DEFAULT_BIND_PORT_NUMBER,
 
+			"CACert": "test/tls/service/cacert.pem",
 			"CACertPatterns": CACertificatesPattern{
 				Bootstrap: "test/tls/bootstrap/*-cacert.pem",
 				Device:    "test/tls/device/*-cacert.pem",
+				CRL:       "test/tls/crl/*.pem",
 			},
 
+			"SigningCACert":      "test/tls/device/telegraph-cacert.pem",
+			"SigningCAKey":       "test/tls/device/telegraph-cakey.pem",
+			"DeviceCertLifetime": time.Duration(90*24) * time.Hour,
+
+			"PeerIdentity":    DEFAULT_PEER_IDENTITY,
+			"PeerIdentityOID": DEFAULT_PEER_IDENTITY_OID,
+
+			"AuthTokenFile":   DEFAULT_AUTH_TOKEN_FILE,
+			"AuthHMACKeyFile": DEFAULT_AUTH_HMAC_KEY_FILE,
+
+			"TokenSigningKey": DEFAULT_TOKEN_SIGNING_KEY,
+			"TokenLifetime":   DEFAULT_TOKEN_LIFETIME,
+			"TokenTopics":     DEFAULT_TOKEN_TOPICS,
+			"TokenCategories": DEFAULT_TOKEN_CATEGORIES,
+
+			"PolicyFile":   DEFAULT_POLICY_FILE,
+			"PolicyReload": DEFAULT_POLICY_RELOAD_INTERVAL,
+
 			"DisableSubscriptions": false,
 			"BufferSize":           uint32(4194304),
 			"MaxMessageSize":       uint32(4194304),
 			"MaxConcurrentStreams": uint32(255),
 			"NumStreamWorkers":     uint32(100),
+			"MaxHops":              uint32(4),
 		},
 	}
 
@@ -71,13 +71,21 @@ func TestLoadSettings(t *testing.T) {
 		"GRPC_TELEGRAPH_SERVICE_ADDRESS":        "127.0.0.1",
 		"GRPC_TELEGRAPH_SERVICE_PORT":           "9340",
 		"GRPC_TELEGRAPH_RETRY_QUEUE_SIZE":       "2048",
+		"GRPC_TELEGRAPH_OUTBOX_DIR":             "/var/spool/telegraph/outbox",
+		"GRPC_TELEGRAPH_OUTBOX_MAX_BYTES":       "16777216",
+		"GRPC_TELEGRAPH_OUTBOX_SEGMENT_SIZE":    "262144",
+		"GRPC_TELEGRAPH_MEMBERSHIP_FILE":        "/var/lib/telegraph/membership",
+		"GRPC_TELEGRAPH_ENROLLED_CERT":          "/var/lib/telegraph/device-cert.pem",
+		"GRPC_TELEGRAPH_ENROLLED_KEY":           "/var/lib/telegraph/device-key.pem",
 		"GRPC_TELEGRAPH_CERT":                   "test/tls/device/telegraph-cert.pem",
 		"GRPC_TELEGRAPH_KEY":                    "test/tls/device/telegraph-key.pem",
+		"GRPC_TELEGRAPH_CERT_EXPIRY_WARNING":    "336h",
 		"GRPC_TELEGRAPH_SERVICE_CACERT":         "test/tls/service/cacert.pem",
 		"GRPC_TELEGRAPH_CONNECT_TIMEOUT":        "30",
 		"GRPC_TELEGRAPH_SEND_TIMEOUT":           "60",
 		"GRPC_TELEGRAPH_KEEP_ALIVE_TIMEOUT":     "300",
 		"GRPC_TELEGRAPH_MAX_SUBSCRIPTION_DELAY": "300",
+		"GRPC_TELEGRAPH_TLS_RELOAD_INTERVAL":    "60",
 
 		// namespaced extensions
 		"GRPC_TELEGRAPH_ID":         "extensions",
@@ -109,15 +117,23 @@ func TestLoadSettings(t *testing.T) {
 		"GRPC_TELEGRAPH_SERVICE_PORT":              "9340",
 		"GRPC_TELEGRAPH_CERT":                      "test/tls/service/bundle/service.pem",
 		"GRPC_TELEGRAPH_KEY":                       "test/tls/service/bundle/service.pem",
+		"GRPC_TELEGRAPH_CERT_EXPIRY_WARNING":       "336h",
+		"GRPC_TELEGRAPH_CACERT":                    "test/tls/service/cacert.pem",
 		"GRPC_TELEGRAPH_BOOTSTRAP_CACERTS_PATTERN": "test/tls/bootstrap/*-cacert.pem",
 		"GRPC_TELEGRAPH_DEVICE_CACERTS_PATTERN":    "test/tls/device/*-cacert.pem",
+		"GRPC_TELEGRAPH_CRL_PATTERN":               "test/tls/crl/*.pem",
+		"GRPC_TELEGRAPH_SIGNING_CACERT":            "test/tls/device/telegraph-cacert.pem",
+		"GRPC_TELEGRAPH_SIGNING_CAKEY":             "test/tls/device/telegraph-cakey.pem",
+		"GRPC_TELEGRAPH_DEVICE_CERT_LIFETIME":      "2160h",
 		"GRPC_TELEGRAPH_ENABLE_SUBSCRIPTIONS":      "true",
 		"GRPC_TELEGRAPH_BUFFER_SIZE":               "4194304",
 		"GRPC_TELEGRAPH_MAX_MESSAGE_SIZE":          "4194304",
 		"GRPC_TELEGRAPH_MAX_STREAMS":               "255",
 		"GRPC_TELEGRAPH_NUM_STREAM_WORKERS":        "100",
+		"GRPC_TELEGRAPH_MAX_HOPS":                  "4",
 		"GRPC_TELEGRAPH_SEND_TIMEOUT":              "60",
 		"GRPC_TELEGRAPH_KEEP_ALIVE_TIMEOUT":        "300",
+		"GRPC_TELEGRAPH_TLS_RELOAD_INTERVAL":       "60",
 
 		// namespaced extensions
 		"GRPC_TELEGRAPH_ID":         "extensions",
@@ -0,0 +1,659 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Error returned (wrapped) when a failed communique was queued for retry.
+var ErrQueued = errors.New("communique queued for retry")
+
+// Telegraph device client.
+type Client struct {
+	config     *config.Config
+	passphrase ptls.PassphraseFunc
+	options    []grpc.DialOption
+	extra      []grpc.DialOption
+	producer   *pb.Producer
+	queue      *RetryQueue
+	outbox     *Outbox
+
+	mutex  sync.RWMutex
+	conn   *grpc.ClientConn
+	client pb.TelegraphServiceClient
+	cancel context.CancelFunc
+
+	membership *pb.Membership
+	handlers   map[string]PublicationHandler
+
+	replaying  sync.Mutex
+	refreshing sync.Mutex
+}
+
+// Returns the transport credentials for the device.
+// No certificate, key or service CA certificate means we use an insecure
+// channel - only really useful for tests and local development.
+// An enrolled device certificate takes over from the (bootstrap)
+// certificate in the settings. The certificate, key and service CA files
+// are reloaded when they change. An encrypted key is decrypted with the
+// passphrase source.
+func clientCredentials(cfg *config.Config, passphrase ptls.PassphraseFunc) (credentials.TransportCredentials, error) {
+	certPath, keyPath := cfg.Settings.Cert, cfg.Settings.Key
+	if enrolled(cfg) {
+		certPath, keyPath = cfg.Device.EnrolledCert, cfg.Device.EnrolledKey
+	}
+
+	caCertPaths := []string{}
+
+	if len(cfg.Device.ServiceCACert) > 0 {
+		caCertPaths = append(caCertPaths, cfg.Device.ServiceCACert)
+	}
+
+	if len(certPath) == 0 && len(keyPath) == 0 && len(caCertPaths) == 0 {
+		slog.Warn("no device TLS config, using insecure credentials")
+		return insecure.NewCredentials(), nil
+	}
+
+	reloader, err := ptls.NewDeviceReloader(certPath, keyPath,
+		passphrase, caCertPaths, cfg.Timeouts.TLSReload)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := reloader.ClientConfig(cfg.Device.ServiceAddress)
+	return credentials.NewTLS(tlsConfig), nil
+
+} // End of function  clientCredentials.
+
+// Returns the gRPC dial options for the device settings.
+func dialOptions(cfg *config.Config, creds credentials.TransportCredentials) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.Timeouts.KeepAlive,
+			PermitWithoutStream: true,
+		}),
+	}
+
+} // End of function  dialOptions.
+
+// Returns a new device client built from the config.
+// Any additional dial options are appended to the options derived from
+// the device settings. An encrypted private key is decrypted with the
+// passphrase file or setting in the config.
+func NewClient(cfg *config.Config, opts ...grpc.DialOption) (*Client, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid device config")
+	}
+
+	return NewClientWithPassphrase(cfg, ptls.ConfigPassphrase(cfg), opts...)
+
+} // End of function  NewClient.
+
+// Returns a new device client built from the config, with an encrypted
+// private key decrypted with the passphrase source - ala
+// ptls.PassphraseFromEnv or a callback.
+func NewClientWithPassphrase(cfg *config.Config, passphrase ptls.PassphraseFunc,
+	opts ...grpc.DialOption) (*Client, error) {
+
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid device config")
+	}
+
+	if err := ptls.ValidateDeviceConfig(cfg); err != nil {
+		slog.Error("validating tls config", "error", err)
+		return nil, err
+	}
+
+	creds, err := clientCredentials(cfg, passphrase)
+	if err != nil {
+		slog.Error("loading device credentials", "error", err)
+		return nil, err
+	}
+
+	c := &Client{
+		config:     cfg,
+		passphrase: passphrase,
+		options:    append(dialOptions(cfg, creds), opts...),
+		extra:      opts,
+		producer: &pb.Producer{
+			Name: cfg.Settings.Name,
+			Pid:  strconv.Itoa(os.Getpid()),
+		},
+		queue:    NewRetryQueue(cfg.Device.RetryQueueSize),
+		handlers: make(map[string]PublicationHandler),
+	}
+
+	if path := cfg.Device.MembershipFile; len(path) > 0 {
+		membership, err := LoadMembership(path)
+		if err != nil {
+			slog.Error("loading membership", "file", path, "error", err)
+			return nil, err
+		}
+
+		c.membership = membership
+	}
+
+	if len(cfg.Device.OutboxDir) > 0 {
+		if err := c.openOutbox(); err != nil {
+			slog.Error("opening outbox", "dir", cfg.Device.OutboxDir,
+				"error", err)
+			return nil, err
+		}
+	}
+
+	return c, nil
+
+} // End of function  NewClientWithPassphrase.
+
+// Open the persistent outbox and queue up anything left undelivered from
+// a previous run.
+func (c *Client) openOutbox() error {
+	settings := c.config.Device
+
+	outbox, err := OpenOutbox(settings.OutboxDir, settings.OutboxMaxBytes,
+		settings.OutboxSegmentSize)
+	if err != nil {
+		return err
+	}
+
+	c.outbox = outbox
+
+	// Whatever doesn't fit in the retry queue stays in the outbox and is
+	// replayed in later batches.
+	queued, err := c.refill(nil)
+	if err != nil {
+		return err
+	}
+
+	if queued > 0 {
+		slog.Info("loaded undelivered communiques from outbox",
+			"count", queued, "pending", outbox.Len(),
+			"dir", settings.OutboxDir)
+	}
+
+	return nil
+
+} //  End of  Client.openOutbox
+
+// Returns the persistent outbox or nil if there is none.
+func (c *Client) Outbox() *Outbox {
+	return c.outbox
+
+} //  End of  Client.Outbox
+
+// Returns the device client config.
+func (c *Client) Config() *config.Config {
+	return c.config
+
+} //  End of  Client.Config
+
+// Returns the retry queue.
+func (c *Client) Queue() *RetryQueue {
+	return c.queue
+
+} //  End of  Client.Queue
+
+// Returns the number of communiques dropped because the retry queue was
+// full.
+func (c *Client) Dropped() uint64 {
+	return c.queue.Dropped()
+
+} //  End of  Client.Dropped
+
+// Returns the service target ala host:port.
+func (c *Client) Target() string {
+	port := strconv.Itoa(c.config.Device.ServicePort)
+	return net.JoinHostPort(c.config.Device.ServiceAddress, port)
+
+} //  End of  Client.Target
+
+// Checks if the client is connected to the service.
+func (c *Client) Connected() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.conn != nil && c.conn.GetState() == connectivity.Ready
+
+} //  End of  Client.Connected
+
+// Connect to the service - waits at most for the connect timeout.
+// With a membership file configured, a device that is not a member yet
+// registers on connect (and so does a device that is yet to enroll).
+func (c *Client) Connect(ctx context.Context) error {
+	connected, err := c.connect(ctx)
+	if err != nil || !connected {
+		return err
+	}
+
+	if len(c.config.Device.MembershipFile) == 0 && !c.Enrolling() {
+		return nil
+	}
+
+	if _, err := c.Join(ctx); err != nil {
+		slog.Warn("joining service", "target", c.Target(), "error", err)
+	}
+
+	return nil
+
+} //  End of  Client.Connect
+
+// Connect to the service unless already connected.
+// Returns true if a new connection was made.
+func (c *Client) connect(ctx context.Context) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		return false, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	conn, err := grpc.NewClient(c.Target(), c.options...)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeouts.Connect)
+	defer cancel()
+
+	conn.Connect()
+
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			slog.Error("connecting to service", "target", c.Target(),
+				"error", ctx.Err())
+			return false, fmt.Errorf("connecting to %v: %w",
+				c.Target(), ctx.Err())
+		}
+	}
+
+	slog.Debug("connected to service", "target", c.Target())
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+
+	c.conn = conn
+	c.client = pb.NewTelegraphServiceClient(conn)
+	c.cancel = cancel
+
+	go c.watch(watchCtx, conn)
+
+	return true, nil
+
+} //  End of  Client.connect
+
+// Watch the connection state and replay the retry queue every time we
+// (re)gain connectivity.
+func (c *Client) watch(ctx context.Context, conn *grpc.ClientConn) {
+	for state := conn.GetState(); ; state = conn.GetState() {
+		if state == connectivity.Ready && c.queue.Len() > 0 {
+			if _, err := c.Replay(ctx); err != nil {
+				slog.Warn("replaying retry queue", "error", err)
+			}
+		}
+
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+
+} //  End of  Client.watch
+
+// Close the connection to the service.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	c.cancel()
+
+	err := c.conn.Close()
+	c.conn = nil
+	c.client = nil
+	c.cancel = nil
+
+	return err
+
+} //  End of  Client.Close
+
+// Returns the service client, connecting if needed.
+func (c *Client) service(ctx context.Context) (pb.TelegraphServiceClient, error) {
+	c.mutex.RLock()
+	client := c.client
+	c.mutex.RUnlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.client, nil
+
+} //  End of  Client.service
+
+// Returns the credentials to send along with a communique - the
+// membership permit token for members and the device token otherwise.
+func (c *Client) credentials() *pb.Credentials {
+	if membership := c.Membership(); len(membership.GetToken()) > 0 {
+		return &pb.Credentials{Token: membership.GetToken()}
+	}
+
+	return &pb.Credentials{Token: c.config.Device.Token}
+
+} //  End of  Client.credentials
+
+// Returns a communique packaging up a note.
+func (c *Client) Communique(note *pb.Note) *pb.Communique {
+	envelope := &pb.Envelope{
+		Postmark: util.NewPostmark(),
+		Origin:   &pb.Origin{Producer: c.producer},
+	}
+
+	return &pb.Communique{
+		Envelope:    envelope,
+		Credentials: c.credentials(),
+		Note:        note,
+	}
+
+} //  End of  Client.Communique
+
+// Checks if a failed dispatch is worth retrying later.
+func retryable(err error) bool {
+	if _, ok := status.FromError(err); !ok {
+		// Not a gRPC status - failed connecting to the service.
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted,
+		codes.ResourceExhausted:
+		return true
+	}
+
+	return false
+
+} // End of function  retryable.
+
+// Checks if a response acknowledges a communique - either an explicit
+// ack or a response addressed to the communique postmark tag.
+func acknowledges(resp *pb.Response, communique *pb.Communique) bool {
+	tag := communique.GetEnvelope().GetPostmark().GetTag()
+	if tag == nil {
+		return false
+	}
+
+	if ack := resp.GetAnswer().GetAck(); ack != nil && util.SameTag(ack.GetOrigination(), tag) {
+		return true
+	}
+
+	return util.SameTag(resp.GetEnvelope().GetDestination().GetRecipient(), tag)
+
+} // End of function  acknowledges.
+
+// Dispatch a communique to the service - applies the send timeout.
+// Acknowledged communiques are removed from the outbox.
+func (c *Client) dispatch(ctx context.Context, communique *pb.Communique) (*pb.Response, error) {
+	client, err := c.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.refreshMembership(ctx)
+	communique = c.refreshCredentials(communique)
+
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeouts.Send)
+	defer cancel()
+
+	resp, err := client.Dispatch(ctx, communique)
+	if err == nil && c.outbox != nil && acknowledges(resp, communique) {
+		c.outbox.Ack(communique.GetEnvelope().GetPostmark().GetTag())
+	}
+
+	return resp, err
+
+} //  End of  Client.dispatch
+
+// Dispatch a communique to the service.
+// The communique is first appended to the outbox (if any). Communiques
+// that fail because the service is unreachable are queued for retry and
+// the returned error wraps ErrQueued.
+func (c *Client) Dispatch(ctx context.Context, communique *pb.Communique) (*pb.Response, error) {
+	if c.outbox != nil {
+		if err := c.outbox.Append(communique); err != nil {
+			slog.Warn("appending to outbox", "error", err,
+				"tag", util.TagString(communique.GetEnvelope().GetPostmark().GetTag()))
+		}
+	}
+
+	resp, err := c.dispatch(ctx, communique)
+	if err == nil {
+		return resp, nil
+	}
+
+	if !retryable(err) {
+		// No point in keeping it around if it will never get through.
+		if c.outbox != nil {
+			c.outbox.Ack(communique.GetEnvelope().GetPostmark().GetTag())
+		}
+
+		return nil, err
+	}
+
+	if c.queue.Push(communique) {
+		return nil, fmt.Errorf("%w: %w", ErrQueued, err)
+	}
+
+	return nil, err
+
+} //  End of  Client.Dispatch
+
+// Open a subscription stream for a communique.
+// No send timeout here, the stream lives as long as the context does.
+func (c *Client) SubscribeStream(ctx context.Context, communique *pb.Communique) (grpc.ServerStreamingClient[pb.Response], error) {
+	client, err := c.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.refreshMembership(ctx)
+	return client.Subscribe(ctx, c.refreshCredentials(communique))
+
+} //  End of  Client.SubscribeStream
+
+// Queue up the pending outbox communiques not replayed yet, as many as
+// fit in the retry queue. Returns the number of communiques queued.
+func (c *Client) refill(replayed map[string]bool) (int, error) {
+	if c.outbox == nil {
+		return 0, nil
+	}
+
+	pending, err := c.outbox.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	room := c.queue.Size() - c.queue.Len()
+
+	for _, communique := range pending {
+		if queued >= room {
+			break
+		}
+
+		tag := util.TagString(communique.GetEnvelope().GetPostmark().GetTag())
+		if replayed[tag] {
+			continue
+		}
+
+		if c.queue.Push(communique) {
+			queued++
+		}
+	}
+
+	return queued, nil
+
+} //  End of  Client.refill
+
+// Replay the queued communiques in postmark order.
+// The communiques are resent as is, so the postmark tags stay the same
+// and the service can de-duplicate them. Once the queue is replayed, the
+// outbox communiques that didn't fit in it are replayed in batches.
+// Stops at the first failure and re-queues whatever is left. Returns the
+// number of replayed communiques.
+func (c *Client) Replay(ctx context.Context) (int, error) {
+	c.replaying.Lock()
+	defer c.replaying.Unlock()
+
+	count := 0
+	replayed := make(map[string]bool)
+
+	for {
+		pending := c.queue.Drain()
+
+		for idx, communique := range pending {
+			tag := communique.GetEnvelope().GetPostmark().GetTag()
+			replayed[util.TagString(tag)] = true
+
+			_, err := c.dispatch(ctx, communique)
+			if err == nil {
+				continue
+			}
+
+			if !retryable(err) {
+				slog.Error("replaying communique", "error", err,
+					"tag", util.TagString(tag))
+
+				if c.outbox != nil {
+					c.outbox.Ack(tag)
+				}
+
+				continue
+			}
+
+			for _, remaining := range pending[idx:] {
+				c.queue.Push(remaining)
+			}
+
+			return count + idx, err
+		}
+
+		count += len(pending)
+
+		queued, err := c.refill(replayed)
+		if err != nil {
+			slog.Warn("reading outbox", "error", err)
+		}
+
+		if queued == 0 {
+			break
+		}
+	}
+
+	if count > 0 {
+		slog.Info("replayed retry queue", "count", count,
+			"dropped", c.queue.Dropped())
+	}
+
+	return count, nil
+
+} //  End of  Client.Replay
+
+// Send a note to the service.
+func (c *Client) Send(ctx context.Context, note *pb.Note) (*pb.Response, error) {
+	return c.Dispatch(ctx, c.Communique(note))
+
+} //  End of  Client.Send
+
+// Send a record to the service.
+func (c *Client) SendRecord(ctx context.Context, record *pb.Record) (*pb.Response, error) {
+	return c.Send(ctx, &pb.Note{Kind: &pb.Note_Record{Record: record}})
+
+} //  End of  Client.SendRecord
+
+// Send a task (or task step) status.
+// No state (aka STATE_NONE_UNSPECIFIED) means it is a progress update.
+func (c *Client) SendStatus(ctx context.Context, task, step string, state pb.State, info *pb.Generic) (*pb.Response, error) {
+	status := &pb.Status{Task: task, Step: step, State: state, Info: info}
+
+	return c.SendRecord(ctx, &pb.Record{
+		Kind: &pb.Record_Status{Status: status},
+	})
+
+} //  End of  Client.SendStatus
+
+// Send an incident event.
+func (c *Client) SendIncident(ctx context.Context, level pb.Level, info *pb.Generic) (*pb.Response, error) {
+	incident := &pb.Incident{Category: level, Info: info}
+
+	return c.SendRecord(ctx, &pb.Record{
+		Kind: &pb.Record_Incident{Incident: incident},
+	})
+
+} //  End of  Client.SendIncident
+
+// Send metrics measures.
+func (c *Client) SendMetrics(ctx context.Context, measures ...*pb.Generic) (*pb.Response, error) {
+	metrics := &pb.Metrics{Tag: util.NewTag(), Measures: measures}
+
+	return c.SendRecord(ctx, &pb.Record{
+		Kind: &pb.Record_Metrics{Metrics: metrics},
+	})
+
+} //  End of  Client.SendMetrics
+
+// Send a timing event.
+func (c *Client) SendTiming(ctx context.Context, start, end time.Time, info *pb.Generic) (*pb.Response, error) {
+	timing := &pb.Timing{
+		Start: timestamppb.New(start),
+		End:   timestamppb.New(end),
+		Info:  info,
+	}
+
+	return c.SendRecord(ctx, &pb.Record{
+		Kind: &pb.Record_Timing{Timing: timing},
+	})
+
+} //  End of  Client.SendTiming
+
+// Send a trace event.
+func (c *Client) SendTrace(ctx context.Context, location *pb.Fields, info *pb.Generic) (*pb.Response, error) {
+	trace := &pb.Trace{Location: location, Info: info}
+
+	return c.SendRecord(ctx, &pb.Record{
+		Kind: &pb.Record_Trace{Trace: trace},
+	})
+
+} //  End of  Client.SendTrace
@@ -0,0 +1,363 @@
+package device
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	TEST_BUFFER_SIZE = 1024 * 1024
+)
+
+// Fake telegraph service that records the communiques it receives.
+type fakeService struct {
+	pb.UnimplementedTelegraphServiceServer
+
+	mutex     sync.Mutex
+	received  []*pb.Communique
+	failure   error
+	permit    *pb.Membership
+	subscribe func(*pb.Communique, grpc.ServerStreamingServer[pb.Response]) error
+}
+
+// Returns the received communiques.
+func (f *fakeService) communiques() []*pb.Communique {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]*pb.Communique{}, f.received...)
+
+} //  End of  fakeService.communiques
+
+// Set the failure returned for dispatches.
+func (f *fakeService) fail(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failure = err
+
+} //  End of  fakeService.fail
+
+// Fake dispatch - records the communique and acks it.
+// Registrations get the membership permit (if any).
+func (f *fakeService) Dispatch(ctx context.Context, c *pb.Communique) (*pb.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failure != nil {
+		return nil, f.failure
+	}
+
+	f.received = append(f.received, proto.Clone(c).(*pb.Communique))
+
+	if f.permit != nil && c.GetNote().GetRecord().GetRegistration() != nil {
+		publication := &pb.Publication{
+			Kind: &pb.Publication_Permit{Permit: f.permit},
+		}
+
+		answer := &pb.Answer{
+			Kind: &pb.Answer_Publication{Publication: publication},
+		}
+
+		return &pb.Response{Answer: answer}, nil
+	}
+
+	answer := &pb.Answer{
+		Kind: &pb.Answer_Ack{
+			Ack: &pb.Ack{Origination: c.GetEnvelope().GetPostmark().GetTag()},
+		},
+	}
+
+	return &pb.Response{Answer: answer}, nil
+
+} //  End of  fakeService.Dispatch
+
+// Fake subscribe - hands the stream to the test subscribe function.
+func (f *fakeService) Subscribe(c *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+	f.mutex.Lock()
+	subscribe := f.subscribe
+	f.mutex.Unlock()
+
+	if subscribe == nil {
+		return status.Error(codes.Unimplemented, "no subscriptions")
+	}
+
+	return subscribe(c, stream)
+
+} //  End of  fakeService.Subscribe
+
+// Returns a test config with the default settings.
+func testConfig(t *testing.T) *config.Config {
+	cfg, err := config.NewConfig("TELEGRAPH_DEVICE_TEST", "")
+	if err != nil {
+		t.Fatalf("creating config: %v", err)
+	}
+
+	cfg.Settings.Name = "test-device"
+	cfg.Device.ServiceAddress = "127.0.0.1"
+	cfg.Device.Token = "open sesame"
+	cfg.Timeouts.Connect = 2 * time.Second
+	cfg.Timeouts.Send = 2 * time.Second
+
+	return cfg
+
+} //  End of  testConfig
+
+// Starts a fake service on an in-memory listener.
+func startFakeServiceListener(t *testing.T, fake *fakeService) *bufconn.Listener {
+	listener := bufconn.Listen(TEST_BUFFER_SIZE)
+	server := grpc.NewServer()
+	pb.RegisterTelegraphServiceServer(server, fake)
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(server.Stop)
+
+	return listener
+
+} //  End of  startFakeServiceListener
+
+// Starts a fake service on an in-memory listener.
+// Returns the dial option to connect to it.
+func startFakeService(t *testing.T, fake *fakeService) grpc.DialOption {
+	listener := startFakeServiceListener(t, fake)
+
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	})
+
+} //  End of  startFakeService
+
+// Returns a connected test client for a fake service.
+func testClient(t *testing.T, cfg *config.Config, fake *fakeService) *Client {
+	client, err := NewClient(cfg, startFakeService(t, fake))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+
+} //  End of  testClient
+
+// Test NewClient function.
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient(nil); err == nil {
+		t.Errorf("expected an error for a nil config")
+	}
+
+	cfg := testConfig(t)
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.Config() != cfg {
+		t.Errorf("expected client config to match")
+	}
+
+	if target := client.Target(); target != "127.0.0.1:9340" {
+		t.Errorf("expected target 127.0.0.1:9340, got %v", target)
+	}
+
+	if client.Connected() {
+		t.Errorf("expected client to not be connected")
+	}
+
+	cfg.Device.ServiceCACert = "/tmp/path/to/missing/cacert.pem"
+	if _, err := NewClient(cfg); err == nil {
+		t.Errorf("expected an error for a missing CA certificate")
+	}
+
+} //  End of  TestNewClient
+
+// Test Client.Connect and Client.Close functions.
+func TestConnect(t *testing.T) {
+	client := testClient(t, testConfig(t), &fakeService{})
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !client.Connected() {
+		t.Errorf("expected client to be connected")
+	}
+
+	// Connecting again is a no-op.
+	if err := client.Connect(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if client.Connected() {
+		t.Errorf("expected client to be disconnected")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("unexpected error closing twice: %v", err)
+	}
+
+} //  End of  TestConnect
+
+// Test Client.Connect timeout.
+func TestConnectTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Timeouts.Connect = 100 * time.Millisecond
+
+	unreachable := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return nil, status.Error(codes.Unavailable, "down")
+	})
+
+	client, err := NewClient(cfg, unreachable)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if err := client.Connect(context.Background()); err == nil {
+		t.Errorf("expected a connect error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connect took too long: %v", elapsed)
+	}
+
+} //  End of  TestConnectTimeout
+
+// Test typed send helpers.
+func TestSendHelpers(t *testing.T) {
+	fake := &fakeService{}
+	client := testClient(t, testConfig(t), fake)
+	ctx := context.Background()
+	info := &pb.Generic{Name: "info"}
+
+	sends := []struct {
+		name string
+		send func() (*pb.Response, error)
+	}{
+		{
+			name: "incident",
+			send: func() (*pb.Response, error) {
+				return client.SendIncident(ctx, pb.Level_LEVEL_ALERT, info)
+			},
+		},
+		{
+			name: "metrics",
+			send: func() (*pb.Response, error) {
+				return client.SendMetrics(ctx, info, info)
+			},
+		},
+		{
+			name: "timing",
+			send: func() (*pb.Response, error) {
+				return client.SendTiming(ctx, time.Now(), time.Now(), info)
+			},
+		},
+		{
+			name: "trace",
+			send: func() (*pb.Response, error) {
+				return client.SendTrace(ctx, &pb.Fields{}, info)
+			},
+		},
+		{
+			name: "registration",
+			send: func() (*pb.Response, error) {
+				return client.Register(ctx, []byte("data"), info)
+			},
+		},
+	}
+
+	for _, step := range sends {
+		resp, err := step.send()
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", step.name, err)
+			continue
+		}
+
+		if resp.GetAnswer().GetAck() == nil {
+			t.Errorf("test %v expected an ack", step.name)
+		}
+	}
+
+	received := fake.communiques()
+	if len(received) != len(sends) {
+		t.Fatalf("expected %v communiques, got %v", len(sends),
+			len(received))
+	}
+
+	for idx, c := range received {
+		if c.GetEnvelope().GetPostmark().GetTag() == nil {
+			t.Errorf("communique %v missing postmark tag", idx)
+		}
+
+		if c.GetEnvelope().GetOrigin().GetProducer().GetName() != "test-device" {
+			t.Errorf("communique %v missing producer name", idx)
+		}
+
+		if c.GetCredentials().GetToken() != "open sesame" {
+			t.Errorf("communique %v missing credentials token", idx)
+		}
+	}
+
+	record := received[0].GetNote().GetRecord()
+	if record.GetIncident().GetCategory() != pb.Level_LEVEL_ALERT {
+		t.Errorf("expected alert incident, got %v", record)
+	}
+
+	if n := len(received[1].GetNote().GetRecord().GetMetrics().GetMeasures()); n != 2 {
+		t.Errorf("expected 2 measures, got %v", n)
+	}
+
+	if received[2].GetNote().GetRecord().GetTiming().GetStart() == nil {
+		t.Errorf("expected timing start")
+	}
+
+	if received[3].GetNote().GetRecord().GetTrace().GetLocation() == nil {
+		t.Errorf("expected trace location")
+	}
+
+	registration := received[4].GetNote().GetRecord().GetRegistration()
+	if registration.GetDevice() != "test-device" || registration.GetToken() != "open sesame" {
+		t.Errorf("unexpected registration %v", registration)
+	}
+
+} //  End of  TestSendHelpers
+
+// Test Client.Dispatch send timeout.
+func TestDispatchTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Timeouts.Send = time.Nanosecond
+
+	client := testClient(t, cfg, &fakeService{})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	communique := client.Communique(&pb.Note{Kind: &pb.Note_Empty{}})
+	if _, err := client.Dispatch(context.Background(), communique); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if util.PostmarkTime(communique.GetEnvelope().GetPostmark()).IsZero() {
+		t.Errorf("expected postmark time")
+	}
+
+} //  End of  TestDispatchTimeout
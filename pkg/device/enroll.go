@@ -0,0 +1,116 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+)
+
+var (
+	// Registration went through but no device certificate was issued.
+	ErrNotEnrolled = errors.New("no device certificate issued")
+)
+
+// Returns true if a file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+
+} // End of function  exists.
+
+// Returns true if the config has an enrolled device certificate and key.
+func enrolled(cfg *config.Config) bool {
+	settings := cfg.Device
+	if len(settings.EnrolledCert) == 0 || len(settings.EnrolledKey) == 0 {
+		return false
+	}
+
+	return exists(settings.EnrolledCert) && exists(settings.EnrolledKey)
+
+} // End of function  enrolled.
+
+// Returns true if the device enrolls for a device certificate.
+func (c *Client) Enrolling() bool {
+	settings := c.config.Device
+	return len(settings.EnrolledCert) > 0 && len(settings.EnrolledKey) > 0
+
+} //  End of  Client.Enrolling
+
+// Returns true if the device holds an enrolled device certificate.
+func (c *Client) Enrolled() bool {
+	return enrolled(c.config)
+
+} //  End of  Client.Enrolled
+
+// Enroll for a device certificate - registers with a certificate signing
+// request for a new key. The issued certificate and the key are saved to
+// the enrolled certificate and key files and the device reconnects with
+// them (dropping the bootstrap certificate).
+func (c *Client) Enroll(ctx context.Context) error {
+	settings := c.config.Device
+
+	key, err := ptls.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	csr, err := ptls.CreateCertificateRequest(c.config.Settings.Name, key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Register(ctx, csr, nil)
+	if err != nil {
+		return err
+	}
+
+	cert := resp.GetAnswer().GetPublication().GetPermit().GetData()
+	if len(cert) == 0 {
+		return ErrNotEnrolled
+	}
+
+	data, err := ptls.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Key first - the device only counts as enrolled once the
+	// certificate is in place.
+	if err := writeCredential(settings.EnrolledKey, data); err != nil {
+		return err
+	}
+
+	if err := writeCredential(settings.EnrolledCert, cert); err != nil {
+		return err
+	}
+
+	slog.Info("enrolled device certificate", "cert", settings.EnrolledCert)
+
+	return c.Reconnect(ctx)
+
+} //  End of  Client.Enroll
+
+// Reconnect to the service with freshly loaded credentials.
+func (c *Client) Reconnect(ctx context.Context) error {
+	creds, err := clientCredentials(c.config, c.passphrase)
+	if err != nil {
+		slog.Error("loading device credentials", "error", err)
+		return err
+	}
+
+	if err := c.Close(); err != nil {
+		slog.Warn("closing connection", "target", c.Target(), "error", err)
+	}
+
+	c.mutex.Lock()
+	c.options = append(dialOptions(c.config, creds), c.extra...)
+	c.mutex.Unlock()
+
+	_, err = c.connect(ctx)
+	return err
+
+} //  End of  Client.Reconnect
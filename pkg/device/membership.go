@@ -0,0 +1,225 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// Registration was acknowledged but no membership permit was issued.
+	ErrNoMembership = errors.New("no membership permit issued")
+)
+
+// Load a persisted membership permit - returns nil if there's none.
+func LoadMembership(path string) (*pb.Membership, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	membership := &pb.Membership{}
+	if err := proto.Unmarshal(data, membership); err != nil {
+		return nil, fmt.Errorf("parsing membership %v: %w", path, err)
+	}
+
+	return membership, nil
+
+} // End of function  LoadMembership.
+
+// Write a credential file - only readable by the owner and written
+// atomically via a temporary file.
+func writeCredential(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+
+} // End of function  writeCredential.
+
+// Persist a membership permit. The permit is a credential, so it is only
+// readable by the owner.
+func SaveMembership(path string, membership *pb.Membership) error {
+	data, err := proto.Marshal(membership)
+	if err != nil {
+		return err
+	}
+
+	return writeCredential(path, data)
+
+} // End of function  SaveMembership.
+
+// Returns the membership permit or nil if the device is not a member.
+func (c *Client) Membership() *pb.Membership {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.membership
+
+} //  End of  Client.Membership
+
+// Set the membership permit presented in the credentials and persist it
+// to the membership file (if any). A nil permit drops the membership.
+func (c *Client) SetMembership(membership *pb.Membership) error {
+	c.mutex.Lock()
+	c.membership = membership
+	c.mutex.Unlock()
+
+	path := c.config.Device.MembershipFile
+	if len(path) == 0 {
+		return nil
+	}
+
+	if membership == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	return SaveMembership(path, membership)
+
+} //  End of  Client.SetMembership
+
+// Register the device with the service using the device token.
+// The service replies with a membership permit, which is kept and then
+// presented in the credentials of all the subsequent communiques. Signed
+// membership tokens are refreshed (registering again) before they expire.
+// Registrations are not queued for retry - there's no permit to be had
+// from a replayed registration.
+func (c *Client) Register(ctx context.Context, data []byte, info *pb.Generic) (*pb.Response, error) {
+	registration := &pb.Registration{
+		Device: c.config.Settings.Name,
+		Token:  c.config.Device.Token,
+		Data:   data,
+		Info:   info,
+	}
+
+	note := &pb.Note{
+		Kind: &pb.Note_Record{
+			Record: &pb.Record{
+				Kind: &pb.Record_Registration{Registration: registration},
+			},
+		},
+	}
+
+	client, err := c.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeouts.Send)
+	defer cancel()
+
+	resp, err := client.Dispatch(ctx, c.Communique(note))
+	if err != nil {
+		return nil, err
+	}
+
+	if permit := resp.GetAnswer().GetPublication().GetPermit(); permit != nil {
+		if err := c.SetMembership(permit); err != nil {
+			slog.Error("saving membership", "error", err,
+				"file", c.config.Device.MembershipFile)
+			return resp, err
+		}
+
+		slog.Info("registered with service", "device", permit.GetDevice())
+	}
+
+	return resp, nil
+
+} //  End of  Client.Register
+
+// Join the service - registers the device unless it already holds a
+// membership permit (and an enrolled certificate when enrolling).
+// Returns the membership permit.
+func (c *Client) Join(ctx context.Context) (*pb.Membership, error) {
+	enroll := c.Enrolling() && !c.Enrolled()
+
+	if membership := c.Membership(); membership != nil && !enroll {
+		return membership, nil
+	}
+
+	if enroll {
+		if err := c.Enroll(ctx); err != nil {
+			return nil, err
+		}
+	} else if _, err := c.Register(ctx, nil, nil); err != nil {
+		return nil, err
+	}
+
+	membership := c.Membership()
+	if membership == nil {
+		return nil, ErrNoMembership
+	}
+
+	return membership, nil
+
+} //  End of  Client.Join
+
+// Refresh a signed membership token that is close to expiring - by
+// registering again. Failures are only logged, the current token is good
+// until it expires (and the service tells us when it has).
+func (c *Client) refreshMembership(ctx context.Context) {
+	signed := c.Membership().GetToken()
+
+	claims, err := token.Parse(signed)
+	if err != nil || time.Now().Before(claims.RefreshTime()) {
+		return
+	}
+
+	c.refreshing.Lock()
+	defer c.refreshing.Unlock()
+
+	if c.Membership().GetToken() != signed {
+		// Someone else got there first.
+		return
+	}
+
+	if _, err := c.Register(ctx, nil, nil); err != nil {
+		slog.Warn("refreshing membership token", "error", err,
+			"expires", claims.ExpiryTime())
+	}
+
+} //  End of  Client.refreshMembership
+
+// Returns the communique with the current membership token if it carries
+// an older signed token of ours - queued and replayed communiques would
+// otherwise present expired tokens.
+func (c *Client) refreshCredentials(communique *pb.Communique) *pb.Communique {
+	current := c.credentials()
+	signed := communique.GetCredentials().GetToken()
+	if signed == current.GetToken() {
+		return communique
+	}
+
+	claims, err := token.Parse(signed)
+	if err != nil || claims.Device != c.config.Settings.Name {
+		return communique
+	}
+
+	refreshed := proto.Clone(communique).(*pb.Communique)
+	refreshed.Credentials = current
+
+	return refreshed
+
+} //  End of  Client.refreshCredentials
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Test LoadMembership and SaveMembership functions.
+func TestMembershipFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "var", "membership")
+
+	membership, err := LoadMembership(path)
+	if err != nil || membership != nil {
+		t.Errorf("expected no membership, got %v %v", membership, err)
+	}
+
+	permit := &pb.Membership{Device: "test-device", Token: "permit"}
+	if err := SaveMembership(path, permit); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected owner only membership file, got %v %v", fi, err)
+	}
+
+	membership, err = LoadMembership(path)
+	if err != nil || !proto.Equal(membership, permit) {
+		t.Errorf("expected saved membership, got %v %v", membership, err)
+	}
+
+	os.WriteFile(path, []byte("not a membership"), 0o600)
+	if _, err := LoadMembership(path); err == nil {
+		t.Errorf("expected an error for a corrupt membership file")
+	}
+
+} //  End of  TestMembershipFile
+
+// Test registering on connect and presenting the membership permit.
+func TestClientJoin(t *testing.T) {
+	permit := &pb.Membership{Device: "test-device", Token: "member"}
+	fake := &fakeService{permit: permit}
+
+	cfg := testConfig(t)
+	cfg.Device.MembershipFile = filepath.Join(t.TempDir(), "membership")
+
+	client := testClient(t, cfg, fake)
+	if client.Membership() != nil {
+		t.Fatalf("expected no membership before registering")
+	}
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !proto.Equal(client.Membership(), permit) {
+		t.Errorf("expected membership permit, got %v", client.Membership())
+	}
+
+	if _, err := client.SendIncident(context.Background(), pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received := fake.communiques()
+	if len(received) != 2 {
+		t.Fatalf("expected registration and incident, got %v", len(received))
+	}
+
+	registration := received[0].GetNote().GetRecord().GetRegistration()
+	if registration.GetDevice() != "test-device" || registration.GetToken() != "open sesame" {
+		t.Errorf("expected registration with device token, got %v", registration)
+	}
+
+	if token := received[1].GetCredentials().GetToken(); token != "member" {
+		t.Errorf("expected membership credentials, got %v", token)
+	}
+
+	// The permit is persisted, so a restarted device doesn't register.
+	restarted := testClient(t, cfg, fake)
+	if !proto.Equal(restarted.Membership(), permit) {
+		t.Errorf("expected persisted membership, got %v", restarted.Membership())
+	}
+
+	if err := restarted.Connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := len(fake.communiques()); n != 2 {
+		t.Errorf("expected no new registration, got %v communiques", n)
+	}
+
+	if err := restarted.SetMembership(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(cfg.Device.MembershipFile); !os.IsNotExist(err) {
+		t.Errorf("expected membership file to be removed, got %v", err)
+	}
+
+	// No permit issued.
+	fake.permit = nil
+	if _, err := restarted.Join(context.Background()); !errors.Is(err, ErrNoMembership) {
+		t.Errorf("expected no membership error, got %v", err)
+	}
+
+} //  End of  TestClientJoin
@@ -0,0 +1,567 @@
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Outbox segment file name suffix.
+	SEGMENT_SUFFIX = ".wal"
+
+	// Size of the length prefix and checksum (CRC-32C) for each outbox
+	// entry.
+	ENTRY_HEADER_SIZE = 8
+
+	// Length prefix flag for ack entries - the payload is the acked tag.
+	ACK_ENTRY_FLAG = uint32(1 << 31)
+)
+
+var (
+	// Error returned when the outbox has no room left for a communique.
+	ErrOutboxFull = errors.New("outbox is full")
+
+	// Outbox entry that fails its checksum.
+	ErrCorruptEntry = errors.New("corrupt outbox entry")
+)
+
+// Checksum table for the outbox entries.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Outbox segment file.
+type segment struct {
+	sequence uint64
+	path     string
+	size     int64
+	entries  int
+	pending  map[string]bool
+}
+
+// Write-ahead-log style persistent outbox of communiques.
+// Communiques are appended as length-prefixed (and checksummed) protobuf
+// entries to segment files and acks are appended as flagged entries
+// carrying the acked tag.
+// Segments are removed once every entry in them has been acked and a
+// compaction pass rewrites segments to drop acked entries.
+type Outbox struct {
+	mutex       sync.Mutex
+	dir         string
+	maxBytes    uint64
+	segmentSize int64
+	segments    []*segment
+	sequence    uint64
+}
+
+// Returns the segment file path for a sequence number.
+func segmentPath(dir string, sequence uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%v", sequence, SEGMENT_SUFFIX))
+
+} // End of function  segmentPath.
+
+// Contents of a segment file.
+type segmentContents struct {
+	communiques []*pb.Communique
+	acked       map[string]bool
+	offset      int64
+}
+
+// Returns the payload and flags of the entry at the start of a buffer and
+// the size of the entry. The size is zero if there's no complete entry
+// with a plausible length (no bigger than `maxEntry` or what's left of
+// the buffer) and valid is false if the entry fails its checksum.
+func decodeFrame(buf []byte, maxEntry uint64) ([]byte, uint32, int, bool) {
+	if len(buf) < ENTRY_HEADER_SIZE {
+		return nil, 0, 0, false
+	}
+
+	header := binary.BigEndian.Uint32(buf)
+	length := uint64(header &^ ACK_ENTRY_FLAG)
+
+	if length > uint64(len(buf)-ENTRY_HEADER_SIZE) || (maxEntry > 0 && length > maxEntry) {
+		return nil, 0, 0, false
+	}
+
+	size := ENTRY_HEADER_SIZE + int(length)
+	payload := buf[ENTRY_HEADER_SIZE:size]
+	valid := binary.BigEndian.Uint32(buf[4:]) == entryChecksum(buf[:4], payload)
+
+	return payload, header & ACK_ENTRY_FLAG, size, valid
+
+} // End of function  decodeFrame.
+
+// Returns the checksum of an entry - its length prefix and payload.
+func entryChecksum(prefix, payload []byte) uint32 {
+	checksum := crc32.Update(0, crcTable, prefix)
+	return crc32.Update(checksum, crcTable, payload)
+
+} // End of function  entryChecksum.
+
+// Reads all the good entries in a segment file - no entry is bigger than
+// `maxEntry` (zero for no limit).
+// The returned offset is just past the last good entry, so that a
+// partially written (torn) final entry or a corrupt header can be
+// truncated away. Entries that fail their checksum are skipped if a good
+// entry follows them and so are good entries that fail to decode.
+func readSegment(path string, maxEntry uint64) (*segmentContents, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := &segmentContents{
+		communiques: []*pb.Communique{},
+		acked:       make(map[string]bool),
+	}
+
+	for offset := 0; offset < len(data); {
+		payload, flags, size, valid := decodeFrame(data[offset:], maxEntry)
+		if size == 0 {
+			break
+		}
+
+		if !valid {
+			// Corrupt payload or a torn write - only a good entry after
+			// it tells which one.
+			_, _, next, ok := decodeFrame(data[offset+size:], maxEntry)
+			if next == 0 || !ok {
+				break
+			}
+
+			slog.Warn("skipping corrupt outbox entry", "path", path,
+				"offset", offset, "error", ErrCorruptEntry)
+			offset += size
+			continue
+		}
+
+		if flags&ACK_ENTRY_FLAG != 0 {
+			contents.acked[util.TagString(&pb.Tag{Value: payload})] = true
+		} else {
+			communique := &pb.Communique{}
+			if err := proto.Unmarshal(payload, communique); err == nil {
+				contents.communiques = append(contents.communiques,
+					communique)
+			} else {
+				slog.Warn("skipping corrupt outbox entry", "path", path,
+					"offset", offset, "error", err)
+			}
+		}
+
+		offset += size
+		contents.offset = int64(offset)
+	}
+
+	return contents, nil
+
+} // End of function  readSegment.
+
+// Returns an encoded outbox entry.
+func encodeFrame(data []byte, flags uint32) []byte {
+	entry := make([]byte, ENTRY_HEADER_SIZE, ENTRY_HEADER_SIZE+len(data))
+	binary.BigEndian.PutUint32(entry, uint32(len(data))|flags)
+	binary.BigEndian.PutUint32(entry[4:], entryChecksum(entry[:4], data))
+
+	return append(entry, data...)
+
+} // End of function  encodeFrame.
+
+// Returns the encoded outbox entry for a communique.
+func encodeEntry(communique *pb.Communique) ([]byte, error) {
+	data, err := proto.Marshal(communique)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeFrame(data, 0), nil
+
+} // End of function  encodeEntry.
+
+// Append an entry to a segment file.
+func appendEntry(path string, entry []byte, sync bool) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+
+	if sync {
+		return file.Sync()
+	}
+
+	return nil
+
+} // End of function  appendEntry.
+
+// Write a file and sync it to disk.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+
+} // End of function  writeSynced.
+
+// Sync a directory, so that renames in it survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return file.Sync()
+
+} // End of function  syncDir.
+
+// Opens (or creates) an outbox in a directory.
+// Existing segments are loaded and any torn entries at the end of a
+// segment (crash mid-write) are truncated.
+func OpenOutbox(dir string, maxBytes uint64, segmentSize uint32) (*Outbox, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("invalid outbox directory")
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: int64(segmentSize),
+		segments:    []*segment{},
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+SEGMENT_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zpath := range paths {
+		name := strings.TrimSuffix(filepath.Base(zpath), SEGMENT_SUFFIX)
+		sequence, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			slog.Warn("skipping unknown outbox file", "path", zpath)
+			continue
+		}
+
+		contents, err := readSegment(zpath, o.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		offset := contents.offset
+		if info, err := os.Stat(zpath); err == nil && info.Size() > offset {
+			slog.Warn("truncating torn outbox segment", "path", zpath,
+				"size", info.Size(), "offset", offset)
+			if err := os.Truncate(zpath, offset); err != nil {
+				return nil, err
+			}
+		}
+
+		seg := &segment{
+			sequence: sequence,
+			path:     zpath,
+			size:     offset,
+			entries:  len(contents.communiques),
+			pending:  make(map[string]bool),
+		}
+
+		for _, communique := range contents.communiques {
+			key := util.TagString(communique.GetEnvelope().GetPostmark().GetTag())
+			if !contents.acked[key] {
+				seg.pending[key] = true
+			}
+		}
+
+		o.segments = append(o.segments, seg)
+		o.sequence = max(o.sequence, sequence)
+	}
+
+	sort.Slice(o.segments, func(i, j int) bool {
+		return o.segments[i].sequence < o.segments[j].sequence
+	})
+
+	// Anything fully acked (or empty) can go.
+	o.prune()
+
+	return o, nil
+
+} // End of function  OpenOutbox.
+
+// Returns the outbox directory.
+func (o *Outbox) Dir() string {
+	return o.dir
+
+} //  End of  Outbox.Dir
+
+// Returns the number of pending (unacked) communiques.
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	count := 0
+	for _, seg := range o.segments {
+		count += len(seg.pending)
+	}
+
+	return count
+
+} //  End of  Outbox.Len
+
+// Returns the size of the outbox on disk (in bytes).
+func (o *Outbox) Size() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.size()
+
+} //  End of  Outbox.Size
+
+// Returns the size of all the segments - caller holds the lock.
+func (o *Outbox) size() uint64 {
+	total := uint64(0)
+	for _, seg := range o.segments {
+		total += uint64(seg.size)
+	}
+
+	return total
+
+} //  End of  Outbox.size
+
+// Remove fully acked segments - caller holds the lock.
+// The last segment stays around while it still has room for entries.
+func (o *Outbox) prune() {
+	kept := []*segment{}
+
+	for idx, seg := range o.segments {
+		last := idx == len(o.segments)-1
+		if len(seg.pending) > 0 || (last && seg.size < o.segmentSize && seg.size > 0) {
+			kept = append(kept, seg)
+			continue
+		}
+
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			slog.Error("removing outbox segment", "path", seg.path,
+				"error", err)
+			kept = append(kept, seg)
+		}
+	}
+
+	o.segments = kept
+
+} //  End of  Outbox.prune
+
+// Returns the segment to append an entry to - caller holds the lock.
+// Rolls over to a new segment if the entry doesn't fit in the last one.
+func (o *Outbox) active(entrySize int) *segment {
+	if n := len(o.segments); n > 0 {
+		last := o.segments[n-1]
+		if last.size == 0 || last.size+int64(entrySize) <= o.segmentSize {
+			return last
+		}
+	}
+
+	o.sequence++
+	seg := &segment{
+		sequence: o.sequence,
+		path:     segmentPath(o.dir, o.sequence),
+		pending:  make(map[string]bool),
+	}
+
+	o.segments = append(o.segments, seg)
+
+	return seg
+
+} //  End of  Outbox.active
+
+// Append a communique to the outbox.
+func (o *Outbox) Append(communique *pb.Communique) error {
+	entry, err := encodeEntry(communique)
+	if err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.size()+uint64(len(entry)) > o.maxBytes {
+		if err := o.compact(); err != nil {
+			return err
+		}
+
+		if o.size()+uint64(len(entry)) > o.maxBytes {
+			return ErrOutboxFull
+		}
+	}
+
+	seg := o.active(len(entry))
+	if err := appendEntry(seg.path, entry, true); err != nil {
+		return err
+	}
+
+	tag := communique.GetEnvelope().GetPostmark().GetTag()
+	seg.pending[util.TagString(tag)] = true
+	seg.size += int64(len(entry))
+	seg.entries++
+
+	return nil
+
+} //  End of  Outbox.Append
+
+// Ack a communique by its postmark tag - returns false if no pending
+// communique has that tag. Segments with nothing left pending are removed.
+func (o *Outbox) Ack(tag *pb.Tag) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	key := util.TagString(tag)
+
+	for _, seg := range o.segments {
+		if !seg.pending[key] {
+			continue
+		}
+
+		delete(seg.pending, key)
+
+		// Record the ack, no need to sync - worst case a lost ack just
+		// means the service sees a duplicate after a restart.
+		entry := encodeFrame(tag.GetValue(), ACK_ENTRY_FLAG)
+		if err := appendEntry(seg.path, entry, false); err != nil {
+			slog.Warn("recording outbox ack", "path", seg.path,
+				"error", err)
+		} else {
+			seg.size += int64(len(entry))
+		}
+
+		o.prune()
+		return true
+	}
+
+	return false
+
+} //  End of  Outbox.Ack
+
+// Returns the pending (unacked) communiques in the order they were added.
+func (o *Outbox) Pending() ([]*pb.Communique, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pending := []*pb.Communique{}
+
+	for _, seg := range o.segments {
+		contents, err := readSegment(seg.path, o.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, communique := range contents.communiques {
+			tag := communique.GetEnvelope().GetPostmark().GetTag()
+			if seg.pending[util.TagString(tag)] {
+				pending = append(pending, communique)
+			}
+		}
+	}
+
+	return pending, nil
+
+} //  End of  Outbox.Pending
+
+// Compaction pass - rewrites segments to drop the acked entries.
+func (o *Outbox) Compact() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.compact()
+
+} //  End of  Outbox.Compact
+
+// Compaction pass - caller holds the lock.
+func (o *Outbox) compact() error {
+	for _, seg := range o.segments {
+		if len(seg.pending) == seg.entries {
+			// Nothing acked, nothing to compact.
+			continue
+		}
+
+		contents, err := readSegment(seg.path, o.maxBytes)
+		if err != nil {
+			return err
+		}
+
+		data := []byte{}
+		entries := 0
+
+		for _, communique := range contents.communiques {
+			tag := communique.GetEnvelope().GetPostmark().GetTag()
+			if !seg.pending[util.TagString(tag)] {
+				continue
+			}
+
+			entry, err := encodeEntry(communique)
+			if err != nil {
+				return err
+			}
+
+			data = append(data, entry...)
+			entries++
+		}
+
+		// Write out the compacted segment and atomically swap it in -
+		// synced before and after the rename, so that a crash leaves
+		// either the old or the new segment in place.
+		tmpPath := seg.path + ".tmp"
+		if err := writeSynced(tmpPath, data); err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmpPath, seg.path); err != nil {
+			return err
+		}
+
+		if err := syncDir(o.dir); err != nil {
+			return err
+		}
+
+		slog.Debug("compacted outbox segment", "path", seg.path,
+			"before", seg.size, "after", len(data))
+
+		seg.size = int64(len(data))
+		seg.entries = entries
+	}
+
+	o.prune()
+
+	return nil
+
+} //  End of  Outbox.compact
@@ -0,0 +1,469 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a test communique with a payload of `size` bytes.
+func payloadCommunique(size int) *pb.Communique {
+	generic := &pb.Generic{Name: "payload", Data: make([]byte, size)}
+
+	return &pb.Communique{
+		Envelope: &pb.Envelope{Postmark: util.NewPostmark()},
+		Note:     &pb.Note{Kind: &pb.Note_Generic{Generic: generic}},
+	}
+
+} //  End of  payloadCommunique
+
+// Returns the segment files in an outbox directory.
+func segmentFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+SEGMENT_SUFFIX))
+	if err != nil {
+		t.Fatalf("listing segments: %v", err)
+	}
+
+	return paths
+
+} //  End of  segmentFiles
+
+// Test OpenOutbox function.
+func TestOpenOutbox(t *testing.T) {
+	if _, err := OpenOutbox("", 1024, 1024); err == nil {
+		t.Errorf("expected an error for an empty directory")
+	}
+
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := OpenOutbox(dir, 1024, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if outbox.Dir() != dir || outbox.Len() != 0 || outbox.Size() != 0 {
+		t.Errorf("expected an empty outbox in %v", dir)
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("expected outbox directory to be created: %v", err)
+	}
+
+} //  End of  TestOpenOutbox
+
+// Test Outbox append, ack and segment rollover.
+func TestOutboxAppendAck(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir, 64*1024, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	communiques := []*pb.Communique{}
+	for idx := 0; idx < 6; idx++ {
+		communique := payloadCommunique(400)
+		if err := outbox.Append(communique); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+
+		communiques = append(communiques, communique)
+	}
+
+	if outbox.Len() != 6 {
+		t.Errorf("expected 6 pending, got %v", outbox.Len())
+	}
+
+	if n := len(segmentFiles(t, dir)); n != 3 {
+		t.Errorf("expected 3 segments, got %v", n)
+	}
+
+	// Ack the first segment's worth - should remove the segment file.
+	for _, communique := range communiques[:2] {
+		if !outbox.Ack(communique.GetEnvelope().GetPostmark().GetTag()) {
+			t.Errorf("expected ack to match a pending communique")
+		}
+	}
+
+	if outbox.Ack(util.NewTag()) {
+		t.Errorf("expected unknown tag ack to not match")
+	}
+
+	if n := len(segmentFiles(t, dir)); n != 2 {
+		t.Errorf("expected 2 segments after ack, got %v", n)
+	}
+
+	pending, err := outbox.Pending()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(pending) != 4 {
+		t.Fatalf("expected 4 pending, got %v", len(pending))
+	}
+
+	for idx, communique := range pending {
+		tag := communiques[idx+2].GetEnvelope().GetPostmark().GetTag()
+		if !util.SameTag(communique.GetEnvelope().GetPostmark().GetTag(), tag) {
+			t.Errorf("pending communique %v out of order", idx)
+		}
+	}
+
+} //  End of  TestOutboxAppendAck
+
+// Test Outbox reopen after a restart and torn entries.
+func TestOutboxReopen(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir, 64*1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first := payloadCommunique(100)
+	second := payloadCommunique(100)
+
+	for _, communique := range []*pb.Communique{first, second} {
+		if err := outbox.Append(communique); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+	}
+
+	// Simulate a crash in the middle of writing an entry.
+	paths := segmentFiles(t, dir)
+	file, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _ = file.Write([]byte{0, 0, 1, 0, 42, 42})
+	file.Close()
+
+	reopened, err := OpenOutbox(dir, 64*1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected reopen error: %v", err)
+	}
+
+	if reopened.Len() != 2 {
+		t.Errorf("expected 2 pending after reopen, got %v", reopened.Len())
+	}
+
+	if reopened.Size() != outbox.Size() {
+		t.Errorf("expected torn entry to be truncated, size %v vs %v",
+			reopened.Size(), outbox.Size())
+	}
+
+	if err := reopened.Append(payloadCommunique(10)); err != nil {
+		t.Errorf("unexpected append error: %v", err)
+	}
+
+	if reopened.Len() != 3 {
+		t.Errorf("expected 3 pending, got %v", reopened.Len())
+	}
+
+} //  End of  TestOutboxReopen
+
+// Test Outbox reopen keeps the entries after a corrupt entry.
+func TestOutboxCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir, 64*1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := outbox.Append(payloadCommunique(100)); err != nil {
+		t.Fatalf("unexpected append error: %v", err)
+	}
+
+	// A complete entry that doesn't decode, followed by a good one.
+	paths := segmentFiles(t, dir)
+	if err := appendEntry(paths[0], encodeFrame([]byte{0x0a, 0xff}, 0), true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	last := payloadCommunique(100)
+	entry, _ := encodeEntry(last)
+	if err := appendEntry(paths[0], entry, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, _ := os.Stat(paths[0])
+
+	reopened, err := OpenOutbox(dir, 64*1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected reopen error: %v", err)
+	}
+
+	if reopened.Len() != 2 {
+		t.Errorf("expected 2 pending after reopen, got %v", reopened.Len())
+	}
+
+	if reopened.Size() != uint64(info.Size()) {
+		t.Errorf("expected no truncation, size %v vs %v", reopened.Size(),
+			info.Size())
+	}
+
+	pending, err := reopened.Pending()
+	if err != nil || len(pending) != 2 || !util.SameTag(pending[1].GetEnvelope().GetPostmark().GetTag(),
+		last.GetEnvelope().GetPostmark().GetTag()) {
+		t.Errorf("expected the entry after the corrupt one, got %v %v", pending, err)
+	}
+
+} //  End of  TestOutboxCorruptEntry
+
+// Test Outbox reopen with corrupt entry headers and payloads.
+func TestOutboxCorruptFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(path string)
+		pending int
+		trimmed bool
+	}{
+		{
+			// Length way past the end of the segment.
+			name: "huge length",
+			corrupt: func(path string) {
+				appendEntry(path, []byte{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 42}, true)
+			},
+			pending: 2,
+			trimmed: true,
+		},
+		{
+			// Length bigger than the outbox can hold.
+			name: "oversized entry",
+			corrupt: func(path string) {
+				appendEntry(path, encodeFrame(make([]byte, 80*1024), 0), true)
+			},
+			pending: 2,
+			trimmed: true,
+		},
+		{
+			// Torn final entry - all there but garbage at the end.
+			name: "torn payload",
+			corrupt: func(path string) {
+				entry, _ := encodeEntry(payloadCommunique(100))
+				entry[len(entry)-1] ^= 0xff
+				appendEntry(path, entry, true)
+			},
+			pending: 2,
+			trimmed: true,
+		},
+		{
+			// Flipped bit in the first entry, the second one is good.
+			name: "corrupt payload",
+			corrupt: func(path string) {
+				data, _ := os.ReadFile(path)
+				data[ENTRY_HEADER_SIZE+10] ^= 0x01
+				os.WriteFile(path, data, 0640)
+			},
+			pending: 1,
+		},
+	}
+
+	for idx, step := range tests {
+		dir := t.TempDir()
+		outbox, err := OpenOutbox(dir, 64*1024, 4096)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for range 2 {
+			if err := outbox.Append(payloadCommunique(100)); err != nil {
+				t.Fatalf("unexpected append error: %v", err)
+			}
+		}
+
+		paths := segmentFiles(t, dir)
+		size := int64(outbox.Size())
+		step.corrupt(paths[0])
+
+		reopened, err := OpenOutbox(dir, 64*1024, 4096)
+		if err != nil {
+			t.Errorf("test %v (%v) unexpected reopen error: %v", idx, step.name, err)
+			continue
+		}
+
+		if reopened.Len() != step.pending {
+			t.Errorf("test %v (%v) expected %v pending, got %v", idx, step.name,
+				step.pending, reopened.Len())
+		}
+
+		if info, _ := os.Stat(paths[0]); step.trimmed && info.Size() != size {
+			t.Errorf("test %v (%v) expected truncation to %v, got %v", idx,
+				step.name, size, info.Size())
+		}
+	}
+
+} //  End of  TestOutboxCorruptFrames
+
+// Test Outbox max bytes and compaction.
+func TestOutboxCompact(t *testing.T) {
+	dir := t.TempDir()
+	entry, _ := encodeEntry(payloadCommunique(200))
+	entrySize := uint64(len(entry))
+
+	outbox, err := OpenOutbox(dir, 4*entrySize, 1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	communiques := []*pb.Communique{}
+	for idx := 0; idx < 4; idx++ {
+		communique := payloadCommunique(200)
+		if err := outbox.Append(communique); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+
+		communiques = append(communiques, communique)
+	}
+
+	if err := outbox.Append(payloadCommunique(200)); !errors.Is(err, ErrOutboxFull) {
+		t.Errorf("expected outbox full error, got %v", err)
+	}
+
+	// Ack a couple, the next append compacts the segment to make room.
+	outbox.Ack(communiques[0].GetEnvelope().GetPostmark().GetTag())
+	outbox.Ack(communiques[2].GetEnvelope().GetPostmark().GetTag())
+
+	if err := outbox.Append(payloadCommunique(200)); err != nil {
+		t.Errorf("unexpected append error after acks: %v", err)
+	}
+
+	if outbox.Size() != 3*entrySize {
+		t.Errorf("expected compacted size %v, got %v", 3*entrySize,
+			outbox.Size())
+	}
+
+	outbox.Ack(communiques[1].GetEnvelope().GetPostmark().GetTag())
+	if err := outbox.Compact(); err != nil {
+		t.Errorf("unexpected compact error: %v", err)
+	}
+
+	if outbox.Size() != 2*entrySize || outbox.Len() != 2 {
+		t.Errorf("expected 2 entries after compaction, got %v (%v bytes)",
+			outbox.Len(), outbox.Size())
+	}
+
+	pending, err := outbox.Pending()
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("expected 2 pending, got %v %v", len(pending), err)
+	}
+
+	tag := communiques[3].GetEnvelope().GetPostmark().GetTag()
+	if !util.SameTag(pending[0].GetEnvelope().GetPostmark().GetTag(), tag) {
+		t.Errorf("expected compaction to keep the entry order")
+	}
+
+} //  End of  TestOutboxCompact
+
+// Test the device client send path with an outbox.
+func TestClientOutbox(t *testing.T) {
+	fake := &fakeService{}
+	cfg := testConfig(t)
+	cfg.Device.OutboxDir = t.TempDir()
+
+	client := testClient(t, cfg, fake)
+	if client.Outbox() == nil {
+		t.Fatalf("expected an outbox")
+	}
+
+	ctx := context.Background()
+
+	if _, err := client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.Outbox().Len() != 0 {
+		t.Errorf("expected acked communique to be removed from outbox")
+	}
+
+	fake.fail(status.Error(codes.Unavailable, "down"))
+
+	for idx := 0; idx < 3; idx++ {
+		if _, err := client.SendMetrics(ctx); !errors.Is(err, ErrQueued) {
+			t.Errorf("expected queued error, got %v", err)
+		}
+	}
+
+	fake.fail(status.Error(codes.InvalidArgument, "bad"))
+	if _, err := client.SendMetrics(ctx); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	if client.Outbox().Len() != 3 {
+		t.Errorf("expected 3 in outbox, got %v", client.Outbox().Len())
+	}
+
+	// Restart - a new client picks up the undelivered communiques.
+	fake.fail(nil)
+	client.Close()
+
+	restarted := testClient(t, cfg, fake)
+	if restarted.Queue().Len() != 3 {
+		t.Errorf("expected 3 queued after restart, got %v",
+			restarted.Queue().Len())
+	}
+
+	if n, err := restarted.Replay(ctx); err != nil || n != 3 {
+		t.Errorf("expected 3 replayed, got %v %v", n, err)
+	}
+
+	if restarted.Outbox().Len() != 0 {
+		t.Errorf("expected empty outbox after replay, got %v",
+			restarted.Outbox().Len())
+	}
+
+	if n := len(fake.communiques()); n != 4 {
+		t.Errorf("expected 4 communiques delivered, got %v", n)
+	}
+
+	cfg.Device.OutboxDir = filepath.Join(cfg.Device.OutboxDir, segmentPath("", 1))
+	if err := os.WriteFile(cfg.Device.OutboxDir, nil, 0640); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := NewClient(cfg); err == nil {
+		t.Errorf("expected an error for a bad outbox directory")
+	}
+
+} //  End of  TestClientOutbox
+
+// Test replaying an outbox bigger than the retry queue.
+func TestClientOutboxBatches(t *testing.T) {
+	fake := &fakeService{}
+	cfg := testConfig(t)
+	cfg.Device.OutboxDir = t.TempDir()
+	cfg.Device.RetryQueueSize = 2
+
+	outbox, err := OpenOutbox(cfg.Device.OutboxDir, cfg.Device.OutboxMaxBytes,
+		cfg.Device.OutboxSegmentSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for idx := 0; idx < 5; idx++ {
+		if err := outbox.Append(payloadCommunique(10)); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+	}
+
+	client := testClient(t, cfg, fake)
+	if client.Queue().Len() != 2 || client.Queue().Dropped() != 0 {
+		t.Errorf("expected 2 queued and none dropped, got %v %v",
+			client.Queue().Len(), client.Queue().Dropped())
+	}
+
+	if n, err := client.Replay(context.Background()); err != nil || n != 5 {
+		t.Errorf("expected 5 replayed, got %v %v", n, err)
+	}
+
+	if client.Outbox().Len() != 0 || len(fake.communiques()) != 5 {
+		t.Errorf("expected all 5 delivered, got %v pending %v delivered",
+			client.Outbox().Len(), len(fake.communiques()))
+	}
+
+} //  End of  TestClientOutboxBatches
@@ -0,0 +1,93 @@
+package device
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+// Bounded in-memory queue of communiques to retry once the service is
+// reachable again. Communiques are kept in postmark order and anything
+// beyond the queue size is dropped on the floor.
+type RetryQueue struct {
+	mutex   sync.Mutex
+	size    int
+	items   []*pb.Communique
+	dropped uint64
+}
+
+// Returns a new retry queue that holds at most `size` communiques.
+func NewRetryQueue(size uint32) *RetryQueue {
+	return &RetryQueue{size: int(size), items: []*pb.Communique{}}
+
+} // End of function  NewRetryQueue.
+
+// Returns the max number of communiques the queue holds.
+func (q *RetryQueue) Size() int {
+	return q.size
+
+} //  End of  RetryQueue.Size
+
+// Returns the number of queued communiques.
+func (q *RetryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items)
+
+} //  End of  RetryQueue.Len
+
+// Returns the number of communiques dropped because the queue was full.
+func (q *RetryQueue) Dropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.dropped
+
+} //  End of  RetryQueue.Dropped
+
+// Queue up a communique - returns false if it was dropped.
+func (q *RetryQueue) Push(communique *pb.Communique) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	postmark := communique.GetEnvelope().GetPostmark()
+
+	if len(q.items) >= q.size {
+		q.dropped++
+		slog.Warn("retry queue full, dropping communique",
+			"tag", util.TagString(postmark.GetTag()),
+			"size", q.size, "dropped", q.dropped)
+		return false
+	}
+
+	// Insert after any communiques with the same or an earlier postmark,
+	// that way communiques stamped at the same time keep their order.
+	when := util.PostmarkTime(postmark)
+	idx := sort.Search(len(q.items), func(i int) bool {
+		other := q.items[i].GetEnvelope().GetPostmark()
+		return util.PostmarkTime(other).After(when)
+	})
+
+	q.items = append(q.items, nil)
+	copy(q.items[idx+1:], q.items[idx:])
+	q.items[idx] = communique
+
+	return true
+
+} //  End of  RetryQueue.Push
+
+// Removes and returns all the queued communiques in postmark order.
+func (q *RetryQueue) Drain() []*pb.Communique {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := q.items
+	q.items = []*pb.Communique{}
+
+	return items
+
+} //  End of  RetryQueue.Drain
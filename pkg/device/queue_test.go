@@ -0,0 +1,205 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Returns a communique postmarked at a specific time.
+func postmarkedCommunique(when time.Time) *pb.Communique {
+	return &pb.Communique{
+		Envelope: &pb.Envelope{
+			Postmark: &pb.Postmark{
+				Tag:  util.NewTag(),
+				When: timestamppb.New(when),
+			},
+		},
+		Note: &pb.Note{Kind: &pb.Note_Empty{Empty: &pb.Empty{}}},
+	}
+
+} //  End of  postmarkedCommunique
+
+// Test RetryQueue ordering and overflow.
+func TestRetryQueue(t *testing.T) {
+	queue := NewRetryQueue(4)
+	if queue.Size() != 4 || queue.Len() != 0 {
+		t.Fatalf("unexpected queue size %v len %v", queue.Size(),
+			queue.Len())
+	}
+
+	now := time.Now()
+	later := postmarkedCommunique(now.Add(time.Minute))
+	earlier := postmarkedCommunique(now.Add(-time.Minute))
+	first := postmarkedCommunique(now)
+	second := postmarkedCommunique(now)
+	overflow := postmarkedCommunique(now.Add(-time.Hour))
+
+	for _, c := range []*pb.Communique{later, first, earlier, second} {
+		if !queue.Push(c) {
+			t.Errorf("unexpected drop")
+		}
+	}
+
+	if queue.Push(overflow) {
+		t.Errorf("expected overflow communique to be dropped")
+	}
+
+	if queue.Dropped() != 1 {
+		t.Errorf("expected 1 dropped, got %v", queue.Dropped())
+	}
+
+	expected := []*pb.Communique{earlier, first, second, later}
+	items := queue.Drain()
+	if len(items) != len(expected) {
+		t.Fatalf("expected %v items, got %v", len(expected), len(items))
+	}
+
+	for idx, c := range items {
+		if c != expected[idx] {
+			t.Errorf("item %v out of postmark order", idx)
+		}
+	}
+
+	if queue.Len() != 0 {
+		t.Errorf("expected empty queue after drain, got %v", queue.Len())
+	}
+
+	empty := NewRetryQueue(0)
+	if empty.Push(first) || empty.Dropped() != 1 {
+		t.Errorf("expected zero sized queue to drop everything")
+	}
+
+} //  End of  TestRetryQueue
+
+// Test Client.Dispatch queueing and Client.Replay.
+func TestClientReplay(t *testing.T) {
+	fake := &fakeService{}
+	cfg := testConfig(t)
+	cfg.Device.RetryQueueSize = 3
+
+	client := testClient(t, cfg, fake)
+	ctx := context.Background()
+
+	fake.fail(status.Error(codes.InvalidArgument, "bad"))
+	if _, err := client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); errors.Is(err, ErrQueued) {
+		t.Errorf("expected non-retryable error to not be queued")
+	}
+
+	fake.fail(status.Error(codes.Unavailable, "down"))
+
+	sent := []*pb.Communique{}
+	for idx := 0; idx < 5; idx++ {
+		communique := client.Communique(&pb.Note{Kind: &pb.Note_Empty{}})
+		_, err := client.Dispatch(ctx, communique)
+		if idx < 3 {
+			if !errors.Is(err, ErrQueued) {
+				t.Errorf("expected queued error, got %v", err)
+			}
+
+			if status.Code(err) != codes.Unavailable {
+				t.Errorf("expected unavailable code, got %v", err)
+			}
+
+			sent = append(sent, communique)
+			continue
+		}
+
+		if err == nil || errors.Is(err, ErrQueued) {
+			t.Errorf("expected overflow error, got %v", err)
+		}
+	}
+
+	if client.Dropped() != 2 || client.Queue().Len() != 3 {
+		t.Errorf("expected 2 dropped and 3 queued, got %v and %v",
+			client.Dropped(), client.Queue().Len())
+	}
+
+	// Still down, so everything goes back into the queue.
+	if n, err := client.Replay(ctx); err == nil || n != 0 {
+		t.Errorf("expected replay failure, got %v %v", n, err)
+	}
+
+	if client.Queue().Len() != 3 {
+		t.Errorf("expected 3 re-queued, got %v", client.Queue().Len())
+	}
+
+	fake.fail(nil)
+
+	if n, err := client.Replay(ctx); err != nil || n != 3 {
+		t.Errorf("expected 3 replayed, got %v %v", n, err)
+	}
+
+	received := fake.communiques()
+	if len(received) != len(sent) {
+		t.Fatalf("expected %v replayed, got %v", len(sent), len(received))
+	}
+
+	for idx, c := range received {
+		tag := sent[idx].GetEnvelope().GetPostmark().GetTag()
+		if !util.SameTag(c.GetEnvelope().GetPostmark().GetTag(), tag) {
+			t.Errorf("replayed communique %v has a different tag", idx)
+		}
+	}
+
+} //  End of  TestClientReplay
+
+// Test replaying the retry queue on (re)connect.
+func TestClientReplayOnConnect(t *testing.T) {
+	fake := &fakeService{}
+	cfg := testConfig(t)
+	cfg.Timeouts.Connect = 100 * time.Millisecond
+
+	var up atomic.Bool
+	listener := startFakeServiceListener(t, fake)
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		if !up.Load() {
+			return nil, errors.New("service is down")
+		}
+
+		return listener.DialContext(ctx)
+	})
+
+	client, err := NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	_, err = client.SendMetrics(context.Background(), &pb.Generic{Name: "cpu"})
+	if !errors.Is(err, ErrQueued) {
+		t.Fatalf("expected queued error, got %v", err)
+	}
+
+	up.Store(true)
+	cfg.Timeouts.Connect = 2 * time.Second
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fake.communiques()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := len(fake.communiques()); n != 1 {
+		t.Errorf("expected replay on connect, got %v communiques", n)
+	}
+
+	if client.Queue().Len() != 0 {
+		t.Errorf("expected empty retry queue, got %v", client.Queue().Len())
+	}
+
+} //  End of  TestClientReplayOnConnect
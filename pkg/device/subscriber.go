@@ -0,0 +1,262 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Publication kinds used to route publications to handlers.
+const (
+	KIND_NONE       = ""
+	KIND_EMPTY      = "empty"
+	KIND_MEMBERSHIP = "membership"
+	KIND_CONFIG     = "config"
+	KIND_TASK       = "task"
+	KIND_GENERIC    = "generic"
+)
+
+const (
+	// Initial delay before re-subscribing after a stream error. Doubles on
+	// every consecutive failure, capped at MAX_SUBSCRIPTION_DELAY.
+	SUBSCRIPTION_BASE_DELAY = time.Second
+)
+
+// Handler for publications received on a subscription stream.
+// The topic is the topic the publication was published on.
+type PublicationHandler func(ctx context.Context, topic string, publication *pb.Publication)
+
+// Returns the kind of a publication.
+func PublicationKind(publication *pb.Publication) string {
+	switch publication.GetKind().(type) {
+	case *pb.Publication_Empty:
+		return KIND_EMPTY
+
+	case *pb.Publication_Permit:
+		return KIND_MEMBERSHIP
+
+	case *pb.Publication_Config:
+		return KIND_CONFIG
+
+	case *pb.Publication_Task:
+		return KIND_TASK
+
+	case *pb.Publication_Generic:
+		return KIND_GENERIC
+	}
+
+	return KIND_NONE
+
+} // End of function  PublicationKind.
+
+// Returns the topic a publication response was published on - the service
+// adds it as the first routing label.
+func PublicationTopic(resp *pb.Response) string {
+	labels := resp.GetEnvelope().GetRouting().GetLabels()
+	if len(labels) == 0 {
+		return ""
+	}
+
+	return string(labels[0].GetValue())
+
+} // End of function  PublicationTopic.
+
+// Returns the delay before the next subscription attempt.
+// Exponential backoff with jitter - a random delay between half and all of
+// the backoff, so a fleet of devices doesn't all come back at once.
+func subscriptionDelay(attempt int, max time.Duration) time.Duration {
+	delay := SUBSCRIPTION_BASE_DELAY
+	for idx := 0; idx < attempt && delay < max; idx++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + rand.N(half+1)
+
+} // End of function  subscriptionDelay.
+
+// Register a handler for a publication kind. A nil handler removes it.
+func (c *Client) HandlePublication(kind string, handler PublicationHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if handler == nil {
+		delete(c.handlers, kind)
+		return
+	}
+
+	c.handlers[kind] = handler
+
+} //  End of  Client.HandlePublication
+
+// Deliver a publication to the handler for its kind.
+func (c *Client) deliver(ctx context.Context, topic string, publication *pb.Publication) {
+	kind := PublicationKind(publication)
+
+	c.mutex.RLock()
+	handler, ok := c.handlers[kind]
+	c.mutex.RUnlock()
+
+	if !ok {
+		slog.Debug("no publication handler", "kind", kind,
+			"topic", topic)
+		return
+	}
+
+	handler(ctx, topic, publication)
+
+} //  End of  Client.deliver
+
+// Subscribe once and deliver publications until the stream ends.
+// Returns the number of publications received.
+func (c *Client) subscribe(ctx context.Context, topic string) (int, error) {
+	note := &pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: topic},
+		},
+	}
+
+	stream, err := c.SubscribeStream(ctx, c.Communique(note))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		count++
+
+		published := PublicationTopic(resp)
+		if len(published) == 0 {
+			published = topic
+		}
+
+		publication := resp.GetAnswer().GetPublication()
+		if publication == nil {
+			slog.Warn("ignoring non-publication answer", "topic", topic)
+			continue
+		}
+
+		c.deliver(ctx, published, publication)
+	}
+
+} //  End of  Client.subscribe
+
+// Returns true if a subscription error is permanent - retrying is not
+// going to fix a bad topic, a denied subscription or a service with
+// subscriptions disabled. Rejected (aka expired) credentials are not
+// permanent, the membership can be renewed.
+func permanent(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unimplemented, codes.PermissionDenied:
+		return true
+	}
+
+	return false
+
+} // End of function  permanent.
+
+// Renew the membership after the service rejected the credentials -
+// registers again for a new membership permit.
+func (c *Client) renewMembership(ctx context.Context) error {
+	slog.Info("credentials rejected, renewing membership")
+
+	_, err := c.Register(ctx, nil, nil)
+	return err
+
+} //  End of  Client.renewMembership
+
+// Keep a subscription to a topic (filter) open until the context is done,
+// delivering publications to the registered handlers.
+// The subscription is re-established after stream errors (or the service
+// ending the stream) with exponential backoff and jitter capped at the
+// MAX_SUBSCRIPTION_DELAY timeout. Rejected credentials renew the
+// membership before re-subscribing. Returns the context error when done,
+// or the error for a subscription the service will never accept.
+func (c *Client) Subscribe(ctx context.Context, topic string) error {
+	max := c.config.Timeouts.MaxSubscriptionDelay
+	if max <= 0 {
+		max = config.DEFAULT_MAX_SUBSCRIPTION_DELAY
+	}
+
+	attempt := 0
+	renewed := false
+
+	for {
+		count, err := c.subscribe(ctx, topic)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Start backing off from scratch if the stream was working.
+		if count > 0 {
+			attempt = 0
+			renewed = false
+		}
+
+		if status.Code(err) == codes.Unauthenticated {
+			if renewed {
+				// Still rejected with brand new credentials.
+				slog.Error("subscription rejected", "topic", topic,
+					"error", err)
+				return err
+			}
+
+			if rerr := c.renewMembership(ctx); rerr == nil {
+				renewed = true
+			} else if permanent(rerr) {
+				slog.Error("renewing membership", "topic", topic,
+					"error", rerr)
+				return rerr
+			}
+		} else {
+			renewed = false
+		}
+
+		if permanent(err) {
+			slog.Error("subscription rejected", "topic", topic,
+				"error", err)
+			return err
+		}
+
+		delay := subscriptionDelay(attempt, max)
+		attempt++
+
+		slog.Warn("subscription ended, re-subscribing", "topic", topic,
+			"error", err, "delay", delay, "attempt", attempt)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+
+		case <-timer.C:
+		}
+	}
+
+} //  End of  Client.Subscribe
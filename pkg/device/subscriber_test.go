@@ -0,0 +1,264 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Test subscriptionDelay function.
+func TestSubscriptionDelay(t *testing.T) {
+	max := 10 * time.Second
+
+	tests := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{attempt: 0, backoff: time.Second},
+		{attempt: 1, backoff: 2 * time.Second},
+		{attempt: 3, backoff: 8 * time.Second},
+		{attempt: 4, backoff: max},
+		{attempt: 1000, backoff: max},
+	}
+
+	for _, step := range tests {
+		for idx := 0; idx < 20; idx++ {
+			delay := subscriptionDelay(step.attempt, max)
+			if delay < step.backoff/2 || delay > step.backoff {
+				t.Errorf("attempt %v expected delay in [%v, %v], got %v",
+					step.attempt, step.backoff/2, step.backoff, delay)
+			}
+		}
+	}
+
+	if delay := subscriptionDelay(5, 0); delay != 0 {
+		t.Errorf("expected no delay, got %v", delay)
+	}
+
+} //  End of  TestSubscriptionDelay
+
+// Test PublicationKind function.
+func TestPublicationKind(t *testing.T) {
+	publications := map[string]*pb.Publication{
+		KIND_NONE:       nil,
+		KIND_EMPTY:      {Kind: &pb.Publication_Empty{}},
+		KIND_MEMBERSHIP: {Kind: &pb.Publication_Permit{}},
+		KIND_CONFIG:     {Kind: &pb.Publication_Config{}},
+		KIND_TASK:       {Kind: &pb.Publication_Task{}},
+		KIND_GENERIC:    {Kind: &pb.Publication_Generic{}},
+	}
+
+	for expected, publication := range publications {
+		if kind := PublicationKind(publication); kind != expected {
+			t.Errorf("expected publication kind %q, got %q", expected,
+				kind)
+		}
+	}
+
+} //  End of  TestPublicationKind
+
+// Returns a publication response on a topic.
+func publicationResponse(topic string, publication *pb.Publication) *pb.Response {
+	return &pb.Response{
+		Envelope: &pb.Envelope{
+			Routing: &pb.Route{
+				Labels: []*pb.Tag{{Value: []byte(topic)}},
+			},
+		},
+		Answer: &pb.Answer{
+			Kind: &pb.Answer_Publication{Publication: publication},
+		},
+	}
+
+} //  End of  publicationResponse
+
+// Test Client.Subscribe re-subscribes and delivers publications by kind.
+func TestClientSubscribe(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+
+	fake := &fakeService{}
+	fake.subscribe = func(c *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+		mutex.Lock()
+		attempts++
+		attempt := attempts
+		mutex.Unlock()
+
+		if c.GetNote().GetSubscription().GetTopic() != "tasks/#" {
+			return status.Error(codes.InvalidArgument, "wrong topic")
+		}
+
+		switch attempt {
+		case 1:
+			return status.Error(codes.Unavailable, "not yet")
+
+		case 2:
+			publications := []*pb.Publication{
+				{Kind: &pb.Publication_Permit{Permit: &pb.Membership{}}},
+				{Kind: &pb.Publication_Config{Config: &pb.Config{}}},
+				{Kind: &pb.Publication_Task{Task: &pb.Task{Name: "reboot"}}},
+				{Kind: &pb.Publication_Generic{Generic: &pb.Generic{}}},
+				{Kind: &pb.Publication_Empty{}},
+			}
+
+			for _, p := range publications {
+				if err := stream.Send(publicationResponse("tasks/site-7", p)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		<-stream.Context().Done()
+		return nil
+	}
+
+	cfg := testConfig(t)
+	cfg.Timeouts.MaxSubscriptionDelay = 20 * time.Millisecond
+
+	client := testClient(t, cfg, fake)
+
+	received := make(chan string, 10)
+	record := func(ctx context.Context, topic string, publication *pb.Publication) {
+		received <- PublicationKind(publication) + "@" + topic
+	}
+
+	for _, kind := range []string{KIND_MEMBERSHIP, KIND_CONFIG, KIND_TASK, KIND_GENERIC} {
+		client.HandlePublication(kind, record)
+	}
+
+	client.HandlePublication(KIND_CONFIG, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- client.Subscribe(ctx, "tasks/#")
+	}()
+
+	expected := []string{"membership@tasks/site-7", "task@tasks/site-7",
+		"generic@tasks/site-7"}
+
+	for _, e := range expected {
+		select {
+		case got := <-received:
+			if got != e {
+				t.Errorf("expected %v, got %v", e, got)
+			}
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %v", e)
+		}
+	}
+
+	// Wait for the third (long-lived) subscription.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mutex.Lock()
+		n := attempts
+		mutex.Unlock()
+
+		if n >= 3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected client to re-subscribe, got %v attempts", n)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+
+	if len(received) != 0 {
+		t.Errorf("expected no more publications, got %v", len(received))
+	}
+
+	// A topic the service rejects is not retried.
+	err := client.Subscribe(context.Background(), "news")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+} //  End of  TestClientSubscribe
+
+// Test Client.Subscribe renews rejected credentials.
+func TestClientSubscribeRenew(t *testing.T) {
+	var mutex sync.Mutex
+	tokens := []string{}
+
+	fake := &fakeService{permit: &pb.Membership{Device: "test-device", Token: "renewed"}}
+	fake.subscribe = func(c *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+		mutex.Lock()
+		tokens = append(tokens, c.GetCredentials().GetToken())
+		mutex.Unlock()
+
+		if c.GetCredentials().GetToken() != "renewed" || c.GetNote().GetSubscription().GetTopic() == "gossip" {
+			return status.Error(codes.Unauthenticated, "expired")
+		}
+
+		publication := &pb.Publication{Kind: &pb.Publication_Generic{Generic: &pb.Generic{}}}
+		if err := stream.Send(publicationResponse("news", publication)); err != nil {
+			return err
+		}
+
+		<-stream.Context().Done()
+		return nil
+	}
+
+	cfg := testConfig(t)
+	cfg.Timeouts.MaxSubscriptionDelay = 20 * time.Millisecond
+
+	client := testClient(t, cfg, fake)
+	client.SetMembership(&pb.Membership{Device: "test-device", Token: "expired"})
+
+	received := make(chan string, 10)
+	client.HandlePublication(KIND_GENERIC, func(ctx context.Context, topic string, publication *pb.Publication) {
+		received <- topic
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- client.Subscribe(ctx, "news")
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for a publication")
+	}
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+
+	mutex.Lock()
+	if len(tokens) != 2 || tokens[0] != "expired" || tokens[1] != "renewed" {
+		t.Errorf("expected to re-subscribe with renewed credentials, got %v", tokens)
+	}
+	mutex.Unlock()
+
+	// Still rejected after renewing gives up.
+	err := client.Subscribe(context.Background(), "gossip")
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+} //  End of  TestClientSubscribeRenew
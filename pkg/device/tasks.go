@@ -0,0 +1,376 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/task"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+const (
+	// Default number of tasks that can be queued up waiting to run.
+	DEFAULT_TASK_QUEUE_SIZE = 16
+
+	// Default time a task gets to run before it is timed out.
+	DEFAULT_TASK_TIMEOUT = time.Duration(3600) * time.Second
+)
+
+var (
+	// No handler for a task or one of its steps.
+	ErrUnknownTask = errors.New("unknown task")
+
+	// A task with the same name is already queued or running.
+	ErrTaskActive = errors.New("task is already active")
+
+	// The task queue is full.
+	ErrTaskQueueFull = errors.New("task queue is full")
+)
+
+// Progress reports progress for a running task or task step.
+type Progress func(info *pb.Generic)
+
+// Handler for a whole task.
+type TaskHandler func(ctx context.Context, task *pb.Task, progress Progress) error
+
+// Handler for a task step.
+type StepHandler func(ctx context.Context, task *pb.Task, step *pb.Generic, progress Progress) error
+
+// Task runner executes tasks published to the device and reports their
+// status back to the service. Tasks are run one at a time in the order
+// they were received, by the handler registered for the task name or
+// else step by step by the handlers registered for the step names.
+//
+// Register it for task publications with:
+//
+//	client.HandlePublication(KIND_TASK, runner.Handle)
+type TaskRunner struct {
+	client  *Client
+	timeout time.Duration
+	queue   chan *pb.Task
+
+	mutex  sync.Mutex
+	tasks  map[string]TaskHandler
+	steps  map[string]StepHandler
+	states map[string]pb.State
+}
+
+// Returns a new task runner queueing up to `size` tasks and giving each
+// task `timeout` to run. Zero values use the defaults.
+func NewTaskRunner(client *Client, size int, timeout time.Duration) *TaskRunner {
+	if size <= 0 {
+		size = DEFAULT_TASK_QUEUE_SIZE
+	}
+
+	if timeout <= 0 {
+		timeout = DEFAULT_TASK_TIMEOUT
+	}
+
+	return &TaskRunner{
+		client:  client,
+		timeout: timeout,
+		queue:   make(chan *pb.Task, size),
+		tasks:   make(map[string]TaskHandler),
+		steps:   make(map[string]StepHandler),
+		states:  make(map[string]pb.State),
+	}
+
+} // End of function  NewTaskRunner.
+
+// Returns the key used to track the state of a task or task step.
+func stateKey(name, step string) string {
+	if len(step) == 0 {
+		return name
+	}
+
+	return name + "/" + step
+
+} // End of function  stateKey.
+
+// Returns the info sent with a failed status.
+func errorInfo(err error) *pb.Generic {
+	return &pb.Generic{Name: "error", Data: []byte(err.Error())}
+
+} // End of function  errorInfo.
+
+// Register a handler for a task name. A nil handler removes it.
+func (r *TaskRunner) HandleTask(name string, handler TaskHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if handler == nil {
+		delete(r.tasks, name)
+		return
+	}
+
+	r.tasks[name] = handler
+
+} //  End of  TaskRunner.HandleTask
+
+// Register a handler for a task step name. A nil handler removes it.
+func (r *TaskRunner) HandleStep(name string, handler StepHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if handler == nil {
+		delete(r.steps, name)
+		return
+	}
+
+	r.steps[name] = handler
+
+} //  End of  TaskRunner.HandleStep
+
+// Returns the current state of a task or task step - no state if it is
+// not active.
+func (r *TaskRunner) State(name, step string) pb.State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.states[stateKey(name, step)]
+
+} //  End of  TaskRunner.State
+
+// Returns an error if there's no way to run a task.
+func (r *TaskRunner) runnable(t *pb.Task) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.tasks[t.GetName()]; ok {
+		return nil
+	}
+
+	if len(t.GetSteps()) == 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownTask, t.GetName())
+	}
+
+	for _, step := range t.GetSteps() {
+		if _, ok := r.steps[step.GetName()]; !ok {
+			return fmt.Errorf("%w: %q step %q", ErrUnknownTask,
+				t.GetName(), step.GetName())
+		}
+	}
+
+	return nil
+
+} //  End of  TaskRunner.runnable
+
+// Move a task or task step to a new state and send its status.
+// The transition is checked first - invalid ones are logged and dropped.
+func (r *TaskRunner) emit(name, step string, state pb.State, info *pb.Generic) error {
+	key := stateKey(name, step)
+
+	r.mutex.Lock()
+	err := task.CheckTransition(r.states[key], state)
+	if err == nil {
+		switch {
+		case task.IsFinal(state):
+			delete(r.states, key)
+
+		case !task.IsProgress(state):
+			r.states[key] = state
+		}
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
+		slog.Error("dropping task status", "task", name, "step", step,
+			"state", state, "error", err)
+		return err
+	}
+
+	// Statuses are sent independently of the task context, so that
+	// timed out and aborted tasks still get reported. Failures get
+	// queued for retry by the client.
+	if _, err := r.client.SendStatus(context.Background(), name, step, state, info); err != nil {
+		slog.Warn("sending task status", "task", name, "step", step,
+			"state", state, "error", err)
+	}
+
+	return nil
+
+} //  End of  TaskRunner.emit
+
+// Submit a task to run. Unknown tasks and tasks that don't fit in the
+// queue are rejected.
+func (r *TaskRunner) Submit(t *pb.Task) error {
+	name := t.GetName()
+
+	if r.State(name, "") != pb.State_STATE_NONE_UNSPECIFIED {
+		return fmt.Errorf("%w: %q", ErrTaskActive, name)
+	}
+
+	if err := r.runnable(t); err != nil {
+		r.emit(name, "", pb.State_STATE_REJECTED, errorInfo(err))
+		return err
+	}
+
+	if err := r.emit(name, "", pb.State_STATE_QUEUED, nil); err != nil {
+		return fmt.Errorf("%w: %q", ErrTaskActive, name)
+	}
+
+	select {
+	case r.queue <- t:
+		return nil
+
+	default:
+		r.emit(name, "", pb.State_STATE_REJECTED,
+			errorInfo(ErrTaskQueueFull))
+		return ErrTaskQueueFull
+	}
+
+} //  End of  TaskRunner.Submit
+
+// Publication handler that submits published tasks.
+func (r *TaskRunner) Handle(ctx context.Context, topic string, publication *pb.Publication) {
+	t := publication.GetTask()
+	if t == nil {
+		return
+	}
+
+	if err := r.Submit(t); err != nil {
+		slog.Warn("task not submitted", "task", t.GetName(),
+			"topic", topic, "error", err)
+	}
+
+} //  End of  TaskRunner.Handle
+
+// Run the queued tasks until the context is done. Tasks still waiting in
+// the queue at that point are aborted.
+func (r *TaskRunner) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case t := <-r.queue:
+					r.emit(t.GetName(), "", pb.State_STATE_ABORTED, nil)
+
+				default:
+					return ctx.Err()
+				}
+			}
+
+		case t := <-r.queue:
+			if ctx.Err() != nil {
+				r.emit(t.GetName(), "", pb.State_STATE_ABORTED, nil)
+				continue
+			}
+
+			r.run(ctx, t)
+		}
+	}
+
+} //  End of  TaskRunner.Run
+
+// Returns the end state for a task or step that returned `err`.
+func endState(ctx context.Context, err error) pb.State {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return pb.State_STATE_TIMED_OUT
+
+	case ctx.Err() != nil:
+		return pb.State_STATE_ABORTED
+
+	case err != nil:
+		return pb.State_STATE_FAILED
+	}
+
+	return pb.State_STATE_COMPLETED
+
+} // End of function  endState.
+
+// Call `fn` and wait for it to return or for the context to be done.
+// A handler that ignores its context is left behind when it times out.
+func wait(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+} // End of function  wait.
+
+// Returns a progress reporter for a task or task step.
+func (r *TaskRunner) progress(name, step string) Progress {
+	return func(info *pb.Generic) {
+		r.emit(name, step, pb.State_STATE_NONE_UNSPECIFIED, info)
+	}
+
+} //  End of  TaskRunner.progress
+
+// Run a task step.
+func (r *TaskRunner) runStep(ctx context.Context, t *pb.Task, step *pb.Generic) error {
+	r.mutex.Lock()
+	handler := r.steps[step.GetName()]
+	r.mutex.Unlock()
+
+	name := t.GetName()
+	r.emit(name, step.GetName(), pb.State_STATE_RUNNING, nil)
+
+	if handler == nil {
+		err := fmt.Errorf("%w: %q step %q", ErrUnknownTask, name,
+			step.GetName())
+		r.emit(name, step.GetName(), pb.State_STATE_FAILED, errorInfo(err))
+		return err
+	}
+
+	err := wait(ctx, func() error {
+		return handler(ctx, t, step, r.progress(name, step.GetName()))
+	})
+
+	var info *pb.Generic
+	if err != nil {
+		info = errorInfo(err)
+	}
+
+	r.emit(name, step.GetName(), endState(ctx, err), info)
+	return err
+
+} //  End of  TaskRunner.runStep
+
+// Run a task.
+func (r *TaskRunner) run(ctx context.Context, t *pb.Task) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	name := t.GetName()
+	r.emit(name, "", pb.State_STATE_RUNNING, nil)
+
+	r.mutex.Lock()
+	handler, ok := r.tasks[name]
+	r.mutex.Unlock()
+
+	var err error
+	if ok {
+		err = wait(ctx, func() error {
+			return handler(ctx, t, r.progress(name, ""))
+		})
+	} else {
+		for _, step := range t.GetSteps() {
+			if err = r.runStep(ctx, t, step); err != nil {
+				break
+			}
+		}
+	}
+
+	var info *pb.Generic
+	if err != nil {
+		info = errorInfo(err)
+		slog.Warn("task did not complete", "task", name, "error", err)
+	}
+
+	r.emit(name, "", endState(ctx, err), info)
+
+} //  End of  TaskRunner.run
@@ -0,0 +1,200 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+// Returns the task statuses received by the fake service.
+func receivedStatuses(fake *fakeService) []string {
+	statuses := []string{}
+	for _, c := range fake.communiques() {
+		s := c.GetNote().GetRecord().GetStatus()
+		if s == nil {
+			continue
+		}
+
+		name := stateKey(s.GetTask(), s.GetStep())
+		state := strings.TrimPrefix(s.GetState().String(), "STATE_")
+		statuses = append(statuses, name+":"+state)
+	}
+
+	return statuses
+
+} //  End of  receivedStatuses
+
+// Wait for the fake service to receive the expected task statuses.
+func expectStatuses(t *testing.T, fake *fakeService, expected ...string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(receivedStatuses(fake)) < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := receivedStatuses(fake); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, got)
+	}
+
+} //  End of  expectStatuses
+
+// Returns a test task runner that is running until the test ends.
+func testTaskRunner(t *testing.T, size int, timeout time.Duration) (*TaskRunner, *fakeService) {
+	fake := &fakeService{}
+	runner := NewTaskRunner(testClient(t, testConfig(t), fake), size,
+		timeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		runner.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return runner, fake
+
+} //  End of  testTaskRunner
+
+// Test running tasks with task handlers.
+func TestTaskRunnerTask(t *testing.T) {
+	runner, fake := testTaskRunner(t, 0, 0)
+
+	runner.HandleTask("reboot", func(ctx context.Context, task *pb.Task, progress Progress) error {
+		progress(&pb.Generic{Name: "halfway"})
+		return nil
+	})
+
+	task := &pb.Task{Name: "reboot"}
+	publication := &pb.Publication{Kind: &pb.Publication_Task{Task: task}}
+	runner.Handle(context.Background(), "tasks/reboot", publication)
+
+	expectStatuses(t, fake, "reboot:QUEUED", "reboot:RUNNING",
+		"reboot:NONE_UNSPECIFIED", "reboot:COMPLETED")
+
+	if state := runner.State("reboot", ""); state != pb.State_STATE_NONE_UNSPECIFIED {
+		t.Errorf("expected completed task to be inactive, got %v", state)
+	}
+
+} //  End of  TestTaskRunnerTask
+
+// Test running tasks step by step.
+func TestTaskRunnerSteps(t *testing.T) {
+	runner, fake := testTaskRunner(t, 0, 0)
+
+	runner.HandleStep("download", func(ctx context.Context, task *pb.Task, step *pb.Generic, progress Progress) error {
+		progress(nil)
+		return nil
+	})
+
+	runner.HandleStep("install", func(ctx context.Context, task *pb.Task, step *pb.Generic, progress Progress) error {
+		return errors.New("disk full")
+	})
+
+	task := &pb.Task{
+		Name: "upgrade",
+		Steps: []*pb.Generic{
+			{Name: "download"}, {Name: "install"}, {Name: "download"},
+		},
+	}
+
+	if err := runner.Submit(task); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectStatuses(t, fake, "upgrade:QUEUED", "upgrade:RUNNING",
+		"upgrade/download:RUNNING", "upgrade/download:NONE_UNSPECIFIED",
+		"upgrade/download:COMPLETED", "upgrade/install:RUNNING",
+		"upgrade/install:FAILED", "upgrade:FAILED")
+
+	last := fake.communiques()[len(fake.communiques())-1]
+	info := last.GetNote().GetRecord().GetStatus().GetInfo()
+	if string(info.GetData()) != "disk full" {
+		t.Errorf("expected failure info, got %v", info)
+	}
+
+} //  End of  TestTaskRunnerSteps
+
+// Test tasks timing out.
+func TestTaskRunnerTimeout(t *testing.T) {
+	runner, fake := testTaskRunner(t, 0, 50*time.Millisecond)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	// Ignores its context, the runner moves on without it.
+	runner.HandleStep("hang", func(ctx context.Context, task *pb.Task, step *pb.Generic, progress Progress) error {
+		<-release
+		progress(nil)
+		return nil
+	})
+
+	task := &pb.Task{Name: "stuck", Steps: []*pb.Generic{{Name: "hang"}}}
+	if err := runner.Submit(task); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectStatuses(t, fake, "stuck:QUEUED", "stuck:RUNNING",
+		"stuck/hang:RUNNING", "stuck/hang:TIMED_OUT", "stuck:TIMED_OUT")
+
+} //  End of  TestTaskRunnerTimeout
+
+// Test rejected and aborted tasks.
+func TestTaskRunnerRejected(t *testing.T) {
+	fake := &fakeService{}
+	runner := NewTaskRunner(testClient(t, testConfig(t), fake), 1, 0)
+
+	runner.HandleTask("one", func(context.Context, *pb.Task, Progress) error {
+		return nil
+	})
+
+	runner.HandleTask("two", func(context.Context, *pb.Task, Progress) error {
+		return nil
+	})
+
+	tests := []struct {
+		task *pb.Task
+		err  error
+	}{
+		{task: &pb.Task{Name: "unknown"}, err: ErrUnknownTask},
+		{
+			task: &pb.Task{Name: "steps", Steps: []*pb.Generic{{Name: "x"}}},
+			err:  ErrUnknownTask,
+		},
+		{task: &pb.Task{Name: "one"}},
+		{task: &pb.Task{Name: "one"}, err: ErrTaskActive},
+		{task: &pb.Task{Name: "two"}, err: ErrTaskQueueFull},
+	}
+
+	for _, step := range tests {
+		err := runner.Submit(step.task)
+		if step.err == nil && err != nil {
+			t.Errorf("task %v unexpected error: %v", step.task.Name, err)
+		}
+
+		if step.err != nil && !errors.Is(err, step.err) {
+			t.Errorf("task %v expected %v, got %v", step.task.Name,
+				step.err, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := runner.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+
+	expectStatuses(t, fake, "unknown:REJECTED", "steps:REJECTED",
+		"one:QUEUED", "two:QUEUED", "two:REJECTED", "one:ABORTED")
+
+} //  End of  TestTaskRunnerRejected
@@ -0,0 +1,459 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Min size (in bytes) of the HMAC token keys - same as the signed
+	// token keys.
+	HMAC_MIN_KEY_SIZE = token.HMAC_MIN_KEY_SIZE
+)
+
+// The token errors are shared with the signed tokens, so errors.Is works
+// the same whichever authenticator rejected the credentials.
+var (
+	// Credentials token missing or not valid.
+	ErrInvalidToken = token.ErrInvalidToken
+
+	// Credentials token past its expiry.
+	ErrTokenExpired = token.ErrTokenExpired
+
+	// HMAC key too short to be any good.
+	ErrWeakKey = token.ErrWeakKey
+
+	// Device is not the principal the credentials were issued to.
+	ErrPrincipalMismatch = errors.New("device does not match principal")
+)
+
+// Authenticated principal - who the credentials token was issued to.
+type Principal struct {
+	Name    string
+	Scopes  token.Scopes
+	Expires time.Time
+}
+
+// Authenticator validates the credentials token of a communique and
+// returns the principal it was issued to.
+type Authenticator interface {
+	Authenticate(ctx context.Context, credentials *pb.Credentials) (*Principal, error)
+}
+
+// Callback authenticator.
+type AuthenticatorFunc func(ctx context.Context, credentials *pb.Credentials) (*Principal, error)
+
+// Authenticators try each authenticator in turn - the first one to
+// accept the credentials wins.
+type Authenticators []Authenticator
+
+// Context key for the principal.
+type principalKey struct{}
+
+// Authenticate the credentials with the callback.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+	return f(ctx, credentials)
+
+} //  End of  AuthenticatorFunc.Authenticate
+
+// Authenticate the credentials with the first authenticator that accepts
+// them. Returns the errors of all of them otherwise.
+func (a Authenticators) Authenticate(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+	errs := []error{}
+	for _, auth := range a {
+		principal, err := auth.Authenticate(ctx, credentials)
+		if err == nil {
+			return principal, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	return nil, errors.Join(errs...)
+
+} //  End of  Authenticators.Authenticate
+
+// Returns a context carrying the principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+
+} // End of function  WithPrincipal.
+
+// Returns the authenticated principal in a context.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+
+} // End of function  PrincipalFromContext.
+
+// Token file authenticator accepts the static tokens in a file - one
+// `<principal> <token>` per line, blank lines and # comments ignored.
+type TokenFileAuthenticator struct {
+	mutex  sync.RWMutex
+	path   string
+	tokens map[string][][]byte
+}
+
+// Returns a new authenticator for the tokens in a file.
+func NewTokenFileAuthenticator(path string) (*TokenFileAuthenticator, error) {
+	a := &TokenFileAuthenticator{path: path}
+	if err := a.Load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+
+} // End of function  NewTokenFileAuthenticator.
+
+// (Re)load the tokens from the file.
+func (a *TokenFileAuthenticator) Load() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	tokens := make(map[string][][]byte)
+	scanner := bufio.NewScanner(f)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%v:%v: expected <principal> <token>", a.path, n)
+		}
+
+		tokens[fields[0]] = append(tokens[fields[0]], []byte(fields[1]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.tokens = tokens
+	a.mutex.Unlock()
+
+	return nil
+
+} //  End of  TokenFileAuthenticator.Load
+
+// Authenticate the credentials token against the static tokens.
+func (a *TokenFileAuthenticator) Authenticate(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+	token := []byte(credentials.GetToken())
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	// Check every token, so the time taken doesn't give the match away.
+	name := ""
+	for principal, secrets := range a.tokens {
+		for _, secret := range secrets {
+			if sameToken(secret, token) {
+				name = principal
+			}
+		}
+	}
+
+	if len(name) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{Name: name}, nil
+
+} //  End of  TokenFileAuthenticator.Authenticate
+
+// HMAC authenticator accepts tokens signed (HMAC-SHA256) with a shared
+// key - `<principal>.<expiry>.<signature>` with the principal and the
+// signature base64 (url) encoded and the expiry in unix seconds.
+type HMACAuthenticator struct {
+	key []byte
+}
+
+// Returns a new HMAC authenticator for a key.
+func NewHMACAuthenticator(key []byte) (*HMACAuthenticator, error) {
+	if len(key) < HMAC_MIN_KEY_SIZE {
+		return nil, fmt.Errorf("%w: %v bytes, need %v", ErrWeakKey,
+			len(key), HMAC_MIN_KEY_SIZE)
+	}
+
+	return &HMACAuthenticator{key: append([]byte{}, key...)}, nil
+
+} // End of function  NewHMACAuthenticator.
+
+// Returns the signature for a token payload.
+func (a *HMACAuthenticator) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+
+} //  End of  HMACAuthenticator.sign
+
+// Returns a token for a principal valid for `ttl`.
+func (a *HMACAuthenticator) Token(principal string, ttl time.Duration) string {
+	encoding := base64.RawURLEncoding
+	expiry := time.Now().Add(ttl).Unix()
+
+	payload := fmt.Sprintf("%v.%v", encoding.EncodeToString([]byte(principal)), expiry)
+	return payload + "." + encoding.EncodeToString(a.sign(payload))
+
+} //  End of  HMACAuthenticator.Token
+
+// Authenticate the credentials token signature and expiry.
+func (a *HMACAuthenticator) Authenticate(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+	encoding := base64.RawURLEncoding
+
+	token := credentials.GetToken()
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 {
+		return nil, ErrInvalidToken
+	}
+
+	payload := token[:dot]
+	signature, err := encoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(signature, a.sign(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	name, expiry, _ := strings.Cut(payload, ".")
+	principal, err := encoding.DecodeString(name)
+	if err != nil || len(principal) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	expires := time.Unix(seconds, 0)
+	if time.Now().After(expires) {
+		return nil, fmt.Errorf("%w: %q at %v", ErrTokenExpired, principal, expires)
+	}
+
+	return &Principal{Name: string(principal), Expires: expires}, nil
+
+} //  End of  HMACAuthenticator.Authenticate
+
+// Returns the authenticator for the service config - the token file and
+// HMAC key file authenticators, nil if there's neither. With a token
+// issuer the membership tokens it signs are accepted as well.
+func configAuthenticator(cfg *config.Config, issuer *TokenIssuer) (Authenticator, error) {
+	auths := Authenticators{}
+
+	if zpath := cfg.Service.AuthTokenFile; len(zpath) > 0 {
+		auth, err := NewTokenFileAuthenticator(zpath)
+		if err != nil {
+			return nil, err
+		}
+
+		auths = append(auths, auth)
+	}
+
+	if zpath := cfg.Service.AuthHMACKeyFile; len(zpath) > 0 {
+		data, err := os.ReadFile(zpath)
+		if err != nil {
+			return nil, err
+		}
+
+		auth, err := NewHMACAuthenticator([]byte(strings.TrimSpace(string(data))))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", zpath, err)
+		}
+
+		auths = append(auths, auth)
+	}
+
+	// Registered devices present their signed membership tokens.
+	if len(auths) > 0 && issuer != nil {
+		auths = append(auths, NewSignedTokenAuthenticator(issuer.Key()))
+	}
+
+	switch len(auths) {
+	case 0:
+		return nil, nil
+
+	case 1:
+		return auths[0], nil
+	}
+
+	return auths, nil
+
+} // End of function  configAuthenticator.
+
+// Authenticate a request - returns the context with the principal.
+// Registrations are left to the registrar, devices don't have their
+// credentials before they register. Devices can only speak for the
+// principal their credentials were issued to.
+func authenticate(ctx context.Context, auth Authenticator, req any) (context.Context, error) {
+	communique, ok := req.(*pb.Communique)
+	if !ok {
+		return ctx, nil
+	}
+
+	if RecordKind(communique.GetNote().GetRecord()) == KIND_REGISTRATION {
+		return ctx, nil
+	}
+
+	device := communique.GetEnvelope().GetOrigin().GetProducer().GetName()
+
+	principal, err := auth.Authenticate(ctx, communique.GetCredentials())
+	if err != nil {
+		slog.Warn("authentication failed", "error", err, "device", device)
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if principal.Name != device {
+		err := fmt.Errorf("%w: %q is not %q", ErrPrincipalMismatch, device,
+			principal.Name)
+		slog.Warn("rejecting device", "device", device,
+			"principal", principal.Name, "error", err)
+		return ctx, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	return WithPrincipal(ctx, principal), nil
+
+} // End of function  authenticate.
+
+// Returns a unary server interceptor authenticating the communique
+// credentials token - the principal goes into the handler context.
+func UnaryAuthInterceptor(auth Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+
+		ctx, err := authenticate(ctx, auth, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+
+} // End of function  UnaryAuthInterceptor.
+
+// Server stream authenticating every communique received - the stream
+// context carries the principal of the last one.
+type authStream struct {
+	grpc.ServerStream
+
+	auth  Authenticator
+	mutex sync.RWMutex
+	ctx   context.Context
+}
+
+// Returns the stream context.
+func (s *authStream) Context() context.Context {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.ctx
+
+} //  End of  authStream.Context
+
+// Receive and authenticate a message.
+func (s *authStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	ctx, err := authenticate(s.ServerStream.Context(), s.auth, m)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.ctx = ctx
+	s.mutex.Unlock()
+
+	return nil
+
+} //  End of  authStream.RecvMsg
+
+// Returns a stream server interceptor authenticating the credentials
+// token of every communique received on the stream.
+func StreamAuthInterceptor(auth Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+
+		wrapped := &authStream{
+			ServerStream: stream,
+			auth:         auth,
+			ctx:          stream.Context(),
+		}
+
+		return handler(srv, wrapped)
+	}
+
+} // End of function  StreamAuthInterceptor.
+
+// Use an authenticator for the communique credentials. A nil
+// authenticator turns authentication off.
+func (s *Service) UseAuthenticator(auth Authenticator) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.auth = auth
+
+} //  End of  Service.UseAuthenticator
+
+// Returns the authenticator or nil if there's no authentication.
+func (s *Service) Authenticator() Authenticator {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.auth
+
+} //  End of  Service.Authenticator
+
+// Unary server interceptor for the service authenticator.
+func (s *Service) authUnaryInterceptor(ctx context.Context, req any,
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+
+	auth := s.Authenticator()
+	if auth == nil {
+		return handler(ctx, req)
+	}
+
+	return UnaryAuthInterceptor(auth)(ctx, req, info, handler)
+
+} //  End of  Service.authUnaryInterceptor
+
+// Stream server interceptor for the service authenticator.
+func (s *Service) authStreamInterceptor(srv any, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	auth := s.Authenticator()
+	if auth == nil {
+		return handler(srv, stream)
+	}
+
+	return StreamAuthInterceptor(auth)(srv, stream, info, handler)
+
+} //  End of  Service.authStreamInterceptor
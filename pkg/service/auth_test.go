@@ -0,0 +1,356 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// HMAC token key for the tests.
+	TEST_HMAC_KEY = "0123456789abcdef0123456789abcdef"
+
+	// Static token file for the tests.
+	TEST_TOKEN_FILE = `
+# Test tokens.
+news     n3ws-t0ken
+alchemy  alch3my-t0ken
+news     n3ws-t0ken-2
+`
+)
+
+// Returns a communique with credentials.
+func credentialsCommunique(token string, note *pb.Note) *pb.Communique {
+	communique := testCommunique(note)
+	communique.Credentials = &pb.Credentials{Token: token}
+
+	return communique
+
+} //  End of  credentialsCommunique
+
+// Test TokenFileAuthenticator functions.
+func TestTokenFileAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	zpath := filepath.Join(dir, "tokens")
+	os.WriteFile(zpath, []byte(TEST_TOKEN_FILE), 0o600)
+
+	if _, err := NewTokenFileAuthenticator(filepath.Join(dir, "404")); err == nil {
+		t.Errorf("expected an error for a missing token file")
+	}
+
+	auth, err := NewTokenFileAuthenticator(zpath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		token     string
+		principal string
+	}{
+		{token: "n3ws-t0ken", principal: "news"},
+		{token: "n3ws-t0ken-2", principal: "news"},
+		{token: "alch3my-t0ken", principal: "alchemy"},
+		{token: "n3ws"},
+		{token: "news"},
+		{token: ""},
+	}
+
+	ctx := context.Background()
+
+	for idx, step := range tests {
+		principal, err := auth.Authenticate(ctx, &pb.Credentials{Token: step.token})
+		if len(step.principal) == 0 {
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("test %v expected invalid token, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil || principal.Name != step.principal {
+			t.Errorf("test %v expected %v, got %v %v", idx, step.principal,
+				principal, err)
+		}
+	}
+
+	// Reloading picks up the changed tokens.
+	os.WriteFile(zpath, []byte("news r0tated\n"), 0o600)
+	if err := auth.Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := auth.Authenticate(ctx, &pb.Credentials{Token: "n3ws-t0ken"}); err == nil {
+		t.Errorf("expected the old token to be rejected")
+	}
+
+	if _, err := auth.Authenticate(ctx, &pb.Credentials{Token: "r0tated"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(zpath, []byte("news\n"), 0o600)
+	if err := auth.Load(); err == nil {
+		t.Errorf("expected an error for a malformed token file")
+	}
+
+} //  End of  TestTokenFileAuthenticator
+
+// Test HMACAuthenticator functions.
+func TestHMACAuthenticator(t *testing.T) {
+	if _, err := NewHMACAuthenticator([]byte("short")); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("expected weak key error, got %v", err)
+	}
+
+	auth, err := NewHMACAuthenticator([]byte(TEST_HMAC_KEY))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	other, _ := NewHMACAuthenticator(bytes.Repeat([]byte("x"), HMAC_MIN_KEY_SIZE))
+
+	valid := auth.Token("news.device", time.Hour)
+	tampered := []byte(valid)
+	tampered[0] ^= 0x01
+
+	tests := []struct {
+		token     string
+		principal string
+		err       error
+	}{
+		{token: valid, principal: "news.device"},
+		{token: auth.Token("news", -time.Minute), err: ErrTokenExpired},
+		{token: other.Token("news", time.Hour), err: ErrInvalidToken},
+		{token: string(tampered), err: ErrInvalidToken},
+		{token: "news.42", err: ErrInvalidToken},
+		{token: "junk", err: ErrInvalidToken},
+		{token: "", err: ErrInvalidToken},
+	}
+
+	ctx := context.Background()
+
+	for idx, step := range tests {
+		principal, err := auth.Authenticate(ctx, &pb.Credentials{Token: step.token})
+		if step.err != nil {
+			if !errors.Is(err, step.err) {
+				t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil || principal.Name != step.principal {
+			t.Errorf("test %v expected %v, got %v %v", idx, step.principal,
+				principal, err)
+			continue
+		}
+
+		if time.Until(principal.Expires) > time.Hour || time.Until(principal.Expires) < 59*time.Minute {
+			t.Errorf("test %v unexpected expiry %v", idx, principal.Expires)
+		}
+	}
+
+} //  End of  TestHMACAuthenticator
+
+// Test the service config authenticators.
+func TestConfigAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+
+	tokenPath := filepath.Join(dir, "tokens")
+	os.WriteFile(tokenPath, []byte(TEST_TOKEN_FILE), 0o600)
+
+	keyPath := filepath.Join(dir, "token.key")
+	os.WriteFile(keyPath, []byte(TEST_HMAC_KEY+"\n"), 0o600)
+
+	weakPath := filepath.Join(dir, "weak.key")
+	os.WriteFile(weakPath, []byte("short"), 0o600)
+
+	hmacAuth, _ := NewHMACAuthenticator([]byte(TEST_HMAC_KEY))
+
+	issuer := testTokenIssuer(t, time.Hour, token.Scopes{})
+	minted, _, _ := issuer.Issue("test-device")
+
+	tests := []struct {
+		tokens string
+		key    string
+		issuer *TokenIssuer
+		valid  []string
+		nilled bool
+		fails  bool
+	}{
+		{nilled: true},
+		{issuer: issuer, nilled: true},
+		{tokens: tokenPath, valid: []string{"alch3my-t0ken"}},
+		{key: keyPath, valid: []string{hmacAuth.Token("news", time.Hour)}},
+		{
+			tokens: tokenPath,
+			key:    keyPath,
+			valid:  []string{"alch3my-t0ken", hmacAuth.Token("news", time.Hour)},
+		},
+		{
+			tokens: tokenPath,
+			issuer: issuer,
+			valid:  []string{"alch3my-t0ken", minted},
+		},
+		{key: keyPath, issuer: issuer, valid: []string{minted}},
+		{tokens: filepath.Join(dir, "404"), fails: true},
+		{key: weakPath, fails: true},
+	}
+
+	for idx, step := range tests {
+		cfg := testConfig(t)
+		cfg.Service.AuthTokenFile = step.tokens
+		cfg.Service.AuthHMACKeyFile = step.key
+
+		auth, err := configAuthenticator(cfg, step.issuer)
+		if step.fails {
+			if err == nil {
+				t.Errorf("test %v expected an error", idx)
+			}
+
+			continue
+		}
+
+		if err != nil || (auth == nil) != step.nilled {
+			t.Errorf("test %v unexpected %v %v", idx, auth, err)
+			continue
+		}
+
+		for _, token := range step.valid {
+			if _, err := auth.Authenticate(context.Background(), &pb.Credentials{Token: token}); err != nil {
+				t.Errorf("test %v unexpected error: %v", idx, err)
+			}
+		}
+	}
+
+} //  End of  TestConfigAuthenticator
+
+// Test the authentication interceptors.
+func TestAuthInterceptors(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.UseAuthenticator(AuthenticatorFunc(func(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+		switch credentials.GetToken() {
+		case "open sesame":
+			return &Principal{Name: "test-device"}, nil
+
+		case "ali-baba":
+			return &Principal{Name: "ali-baba"}, nil
+		}
+
+		return nil, ErrInvalidToken
+	}))
+
+	principals := make(chan string, 16)
+	svc.HandleRecord(KIND_METRICS, func(ctx context.Context, c *pb.Communique) (*pb.Answer, error) {
+		if principal, ok := PrincipalFromContext(ctx); ok {
+			principals <- principal.Name
+		}
+
+		return nil, nil
+	})
+
+	client := startService(t, svc)
+	ctx := context.Background()
+
+	metrics := recordNote(&pb.Record{Kind: &pb.Record_Metrics{}})
+
+	// Unary.
+	if _, err := client.DispatchUnary(ctx, credentialsCommunique("open sesame", metrics)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if name := <-principals; name != "test-device" {
+		t.Errorf("expected principal test-device, got %v", name)
+	}
+
+	_, err = client.DispatchUnary(ctx, credentialsCommunique("open barley", metrics))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+	// Devices can't speak for other principals.
+	_, err = client.DispatchUnary(ctx, credentialsCommunique("ali-baba", metrics))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied for another principal, got %v", err)
+	}
+
+	stream, err := client.DispatchStream(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream.Send(credentialsCommunique("ali-baba", metrics))
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied stream for another principal, got %v", err)
+	}
+
+	// Registrations are left to the registrar.
+	registration := recordNote(&pb.Record{
+		Kind: &pb.Record_Registration{
+			Registration: &pb.Registration{Device: "test-device"},
+		},
+	})
+
+	if _, err := client.DispatchUnary(ctx, testCommunique(registration)); err != nil {
+		t.Errorf("unexpected registration error: %v", err)
+	}
+
+	// Streams authenticate every communique.
+	stream, err = client.DispatchStream(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream.Send(credentialsCommunique("open sesame", metrics))
+	stream.Send(credentialsCommunique("open sesame", metrics))
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Errorf("unexpected stream error: %v", err)
+	}
+
+	for idx := 0; idx < 2; idx++ {
+		if name := <-principals; name != "test-device" {
+			t.Errorf("expected principal test-device, got %v", name)
+		}
+	}
+
+	stream, _ = client.DispatchStream(ctx)
+	stream.Send(credentialsCommunique("open sesame", metrics))
+	stream.Send(credentialsCommunique("open rye", metrics))
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated stream, got %v", err)
+	}
+
+	// Subscriptions.
+	subscription := &pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: "news"},
+		},
+	}
+
+	subscriber, err := client.Subscribe(ctx, credentialsCommunique("open wheat", subscription))
+	if err == nil {
+		_, err = subscriber.Recv()
+	}
+
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated subscription, got %v", err)
+	}
+
+	// No authenticator, no authentication.
+	svc.UseAuthenticator(nil)
+	if _, err := client.DispatchUnary(ctx, testCommunique(metrics)); err != nil {
+		t.Errorf("unexpected error without an authenticator: %v", err)
+	}
+
+} //  End of  TestAuthInterceptors
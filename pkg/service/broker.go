@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Number of publications buffered per subscriber stream. Publications
+	// to a subscriber that can't keep up are dropped (ala the retry queue).
+	SUBSCRIBER_BUFFER_SIZE = 64
+)
+
+var (
+	// Publishing with subscriptions disabled.
+	ErrSubscriptionsDisabled = errors.New("subscriptions are disabled")
+)
+
+// A publication waiting to be delivered to a subscriber.
+type delivery struct {
+	topic       string
+	publication *pb.Publication
+}
+
+// A subscriber stream.
+type subscriber struct {
+	topic      string
+	device     string
+	deliveries chan delivery
+}
+
+// Broker tracks subscriber streams by topic and device and fans out
+// publications to them.
+type Broker struct {
+	mutex       sync.RWMutex
+	size        int
+	closed      bool
+	done        chan struct{}
+	subscribers map[*subscriber]struct{}
+}
+
+// Returns a new broker buffering up to `size` publications per subscriber.
+func NewBroker(size int) *Broker {
+	return &Broker{
+		size:        size,
+		done:        make(chan struct{}),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+
+} // End of function  NewBroker.
+
+// Returns the number of subscriber streams.
+func (b *Broker) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return len(b.subscribers)
+
+} //  End of  Broker.Len
+
+// Returns the subscribed topic filters for a device.
+func (b *Broker) Topics(device string) []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	topics := []string{}
+	for sub := range b.subscribers {
+		if sub.device == device {
+			topics = append(topics, sub.topic)
+		}
+	}
+
+	return topics
+
+} //  End of  Broker.Topics
+
+// Add a subscriber.
+func (b *Broker) add(topic, device string) (*subscriber, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, status.Error(codes.Unavailable, "broker is closed")
+	}
+
+	sub := &subscriber{
+		topic:      topic,
+		device:     device,
+		deliveries: make(chan delivery, b.size),
+	}
+
+	b.subscribers[sub] = struct{}{}
+	return sub, nil
+
+} //  End of  Broker.add
+
+// Remove a subscriber.
+func (b *Broker) remove(sub *subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, sub)
+
+} //  End of  Broker.remove
+
+// Deliver a publication to the subscribers that `match` returns a topic for.
+// Returns the number of subscribers the publication was delivered to.
+func (b *Broker) deliver(publication *pb.Publication, match func(*subscriber) (string, bool)) int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	count := 0
+	for sub := range b.subscribers {
+		topic, ok := match(sub)
+		if !ok {
+			continue
+		}
+
+		select {
+		case sub.deliveries <- delivery{topic: topic, publication: publication}:
+			count++
+
+		default:
+			slog.Warn("subscriber is full, dropping publication",
+				"device", sub.device, "topic", topic)
+		}
+	}
+
+	return count
+
+} //  End of  Broker.deliver
+
+// Publish to all the subscribers with a topic filter matching the topic.
+// Returns the number of subscribers the publication was delivered to.
+func (b *Broker) Publish(topic string, publication *pb.Publication) int {
+	return b.deliver(publication, func(sub *subscriber) (string, bool) {
+		return topic, MatchTopic(sub.topic, topic)
+	})
+
+} //  End of  Broker.Publish
+
+// Publish to all the subscriber streams of a device, whatever the topic.
+// Returns the number of subscribers the publication was delivered to.
+func (b *Broker) PublishTo(device string, publication *pb.Publication) int {
+	return b.deliver(publication, func(sub *subscriber) (string, bool) {
+		return sub.topic, sub.device == device
+	})
+
+} //  End of  Broker.PublishTo
+
+// Serve a subscriber - calls `send` for every publication delivered to the
+// subscriber until the context is done or the broker is closed.
+func (b *Broker) Serve(ctx context.Context, topic, device string, send func(topic string, publication *pb.Publication) error) error {
+	sub, err := b.add(topic, device)
+	if err != nil {
+		return err
+	}
+
+	defer b.remove(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-b.done:
+			return nil
+
+		case d := <-sub.deliveries:
+			if err := send(d.topic, d.publication); err != nil {
+				return err
+			}
+		}
+	}
+
+} //  End of  Broker.Serve
+
+// Close the broker, ending all the subscriber streams.
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+
+} //  End of  Broker.Close
+
+// Returns a response carrying a publication on a topic.
+// The topic is added as a routing label, so that devices with multiple
+// subscriptions can tell the publications apart.
+func (s *Service) publication(communique *pb.Communique, topic string, publication *pb.Publication) *pb.Response {
+	answer := &pb.Answer{
+		Kind: &pb.Answer_Publication{Publication: publication},
+	}
+
+	resp := s.respond(communique, answer)
+	resp.Envelope.Routing = &pb.Route{
+		Labels: []*pb.Tag{{Value: []byte(topic)}},
+	}
+
+	return resp
+
+} //  End of  Service.publication
+
+// Subscription handler that serves subscriber streams from the broker.
+func (s *Service) brokerHandler(communique *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+	topic := communique.GetNote().GetSubscription().GetTopic()
+	if err := ValidateTopicFilter(topic); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	device := communique.GetEnvelope().GetOrigin().GetProducer().GetName()
+
+	slog.Info("subscribed", "device", device, "topic", topic)
+	defer slog.Info("unsubscribed", "device", device, "topic", topic)
+
+	send := func(topic string, publication *pb.Publication) error {
+		return stream.Send(s.publication(communique, topic, publication))
+	}
+
+	return s.broker.Serve(stream.Context(), topic, device, send)
+
+} //  End of  Service.brokerHandler
+
+// Returns the service broker.
+func (s *Service) Broker() *Broker {
+	return s.broker
+
+} //  End of  Service.Broker
+
+// Publish to all the subscribers of a topic.
+// Returns the number of subscribers the publication was delivered to.
+func (s *Service) Publish(topic string, publication *pb.Publication) (int, error) {
+	if s.config.Service.DisableSubscriptions {
+		return 0, ErrSubscriptionsDisabled
+	}
+
+	if err := ValidateTopic(topic); err != nil {
+		return 0, err
+	}
+
+	return s.broker.Publish(topic, publication), nil
+
+} //  End of  Service.Publish
+
+// Publish to all the subscriber streams of a device.
+// Returns the number of subscribers the publication was delivered to.
+func (s *Service) PublishTo(device string, publication *pb.Publication) (int, error) {
+	if s.config.Service.DisableSubscriptions {
+		return 0, ErrSubscriptionsDisabled
+	}
+
+	return s.broker.PublishTo(device, publication), nil
+
+} //  End of  Service.PublishTo
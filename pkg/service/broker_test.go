@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a generic publication named `name`.
+func namedPublication(name string) *pb.Publication {
+	generic := &pb.Generic{Name: name}
+	return &pb.Publication{Kind: &pb.Publication_Generic{Generic: generic}}
+
+} //  End of  namedPublication
+
+// Subscribe to a topic as a device.
+func subscribeAs(t *testing.T, client pb.TelegraphServiceClient, device, topic string) grpc.ServerStreamingClient[pb.Response] {
+	communique := testCommunique(&pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: topic},
+		},
+	})
+
+	communique.Envelope.Origin.Producer.Name = device
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stream, err := client.Subscribe(ctx, communique)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return stream
+
+} //  End of  subscribeAs
+
+// Wait for the broker to have `count` subscribers.
+func waitForSubscribers(t *testing.T, broker *Broker, count int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for broker.Len() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v subscribers, got %v", count,
+				broker.Len())
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+} //  End of  waitForSubscribers
+
+// Receive a publication and return its name and topic label.
+func receivePublication(t *testing.T, stream grpc.ServerStreamingClient[pb.Response]) (string, string) {
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	topic := ""
+	if labels := resp.GetEnvelope().GetRouting().GetLabels(); len(labels) > 0 {
+		topic = string(labels[0].GetValue())
+	}
+
+	return resp.GetAnswer().GetPublication().GetGeneric().GetName(), topic
+
+} //  End of  receivePublication
+
+// Test publishing to topics and devices.
+func TestBrokerPublish(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := startService(t, svc)
+
+	news := subscribeAs(t, client, "device-1", "news")
+	weather := subscribeAs(t, client, "device-1", "weather")
+	other := subscribeAs(t, client, "device-2", "news")
+	waitForSubscribers(t, svc.Broker(), 3)
+
+	if topics := svc.Broker().Topics("device-2"); len(topics) != 1 || topics[0] != "news" {
+		t.Errorf("expected device-2 topics [news], got %v", topics)
+	}
+
+	if n, err := svc.Publish("news", namedPublication("headline")); err != nil || n != 2 {
+		t.Errorf("expected 2 deliveries, got %v %v", n, err)
+	}
+
+	if n, _ := svc.Publish("sports", namedPublication("score")); n != 0 {
+		t.Errorf("expected no deliveries, got %v", n)
+	}
+
+	for _, stream := range []grpc.ServerStreamingClient[pb.Response]{news, other} {
+		if name, topic := receivePublication(t, stream); name != "headline" || topic != "news" {
+			t.Errorf("expected news headline, got %v %v", topic, name)
+		}
+	}
+
+	if n, err := svc.PublishTo("device-1", namedPublication("direct")); err != nil || n != 2 {
+		t.Errorf("expected 2 deliveries, got %v %v", n, err)
+	}
+
+	if name, topic := receivePublication(t, news); name != "direct" || topic != "news" {
+		t.Errorf("expected direct on news, got %v %v", topic, name)
+	}
+
+	if name, topic := receivePublication(t, weather); name != "direct" || topic != "weather" {
+		t.Errorf("expected direct on weather, got %v %v", topic, name)
+	}
+
+	// Stopping the service ends the subscriber streams.
+	svc.Stop()
+
+	if _, err := news.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+
+	if n := svc.Broker().Publish("news", namedPublication("late")); n != 0 {
+		t.Errorf("expected no deliveries after stop, got %v", n)
+	}
+
+} //  End of  TestBrokerPublish
+
+// Test subscribers going away and slow subscribers.
+func TestBrokerSubscribers(t *testing.T) {
+	broker := NewBroker(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- broker.Serve(ctx, "news", "device-1", func(string, *pb.Publication) error {
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	waitForSubscribers(t, broker, 1)
+
+	// First one is being sent, second one is buffered, third is dropped.
+	broker.Publish("news", namedPublication("one"))
+	time.Sleep(10 * time.Millisecond)
+
+	broker.Publish("news", namedPublication("two"))
+	if n := broker.Publish("news", namedPublication("three")); n != 0 {
+		t.Errorf("expected full subscriber to drop publication, got %v", n)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if broker.Len() != 0 {
+		t.Errorf("expected subscriber to be removed")
+	}
+
+	broker.Close()
+	broker.Close()
+
+	err := broker.Serve(context.Background(), "news", "device-1", nil)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable from a closed broker, got %v", err)
+	}
+
+} //  End of  TestBrokerSubscribers
+
+// Test publishing with subscriptions disabled and missing topics.
+func TestBrokerDisabled(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Service.DisableSubscriptions = true
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := svc.Publish("news", namedPublication("x")); !errors.Is(err, ErrSubscriptionsDisabled) {
+		t.Errorf("expected subscriptions disabled, got %v", err)
+	}
+
+	if _, err := svc.PublishTo("device-1", namedPublication("x")); !errors.Is(err, ErrSubscriptionsDisabled) {
+		t.Errorf("expected subscriptions disabled, got %v", err)
+	}
+
+	svc, err = NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream := subscribeAs(t, startService(t, svc), "device-1", "")
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a missing topic, got %v", err)
+	}
+
+} //  End of  TestBrokerDisabled
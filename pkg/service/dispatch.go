@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Note and record kinds used to route communiques to handlers.
+const (
+	KIND_NONE         = ""
+	KIND_EMPTY        = "empty"
+	KIND_RECORD       = "record"
+	KIND_SUBSCRIPTION = "subscription"
+	KIND_GENERIC      = "generic"
+
+	KIND_ACK          = "ack"
+	KIND_REGISTRATION = "registration"
+	KIND_STATUS       = "status"
+	KIND_INCIDENT     = "incident"
+	KIND_METRICS      = "metrics"
+	KIND_TIMING       = "timing"
+	KIND_TRACE        = "trace"
+)
+
+// Handler processes a communique and returns the answer to send back.
+type Handler func(ctx context.Context, communique *pb.Communique) (*pb.Answer, error)
+
+// Handler for subscriptions - streams publications back to the device.
+type SubscribeHandler func(communique *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error
+
+// Returns the kind of a note.
+func NoteKind(note *pb.Note) string {
+	switch note.GetKind().(type) {
+	case *pb.Note_Empty:
+		return KIND_EMPTY
+
+	case *pb.Note_Record:
+		return KIND_RECORD
+
+	case *pb.Note_Subscription:
+		return KIND_SUBSCRIPTION
+
+	case *pb.Note_Generic:
+		return KIND_GENERIC
+	}
+
+	return KIND_NONE
+
+} // End of function  NoteKind.
+
+// Returns the kind of a record.
+func RecordKind(record *pb.Record) string {
+	switch record.GetKind().(type) {
+	case *pb.Record_Empty:
+		return KIND_EMPTY
+
+	case *pb.Record_Ack:
+		return KIND_ACK
+
+	case *pb.Record_Registration:
+		return KIND_REGISTRATION
+
+	case *pb.Record_Status:
+		return KIND_STATUS
+
+	case *pb.Record_Incident:
+		return KIND_INCIDENT
+
+	case *pb.Record_Metrics:
+		return KIND_METRICS
+
+	case *pb.Record_Timing:
+		return KIND_TIMING
+
+	case *pb.Record_Trace:
+		return KIND_TRACE
+
+	case *pb.Record_Generic:
+		return KIND_GENERIC
+	}
+
+	return KIND_NONE
+
+} // End of function  RecordKind.
+
+// Returns an ack answer for a communique.
+func Acknowledge(communique *pb.Communique, msg []byte) *pb.Answer {
+	ack := &pb.Ack{
+		Origination: communique.GetEnvelope().GetPostmark().GetTag(),
+		Msg:         msg,
+	}
+
+	return &pb.Answer{Kind: &pb.Answer_Ack{Ack: ack}}
+
+} // End of function  Acknowledge.
+
+// Default handler - just acknowledges the communique.
+func AckHandler(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	return Acknowledge(communique, nil), nil
+
+} // End of function  AckHandler.
+
+// Register a handler for a note kind.
+func (s *Service) HandleNote(kind string, handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if handler == nil {
+		delete(s.notes, kind)
+		return
+	}
+
+	s.notes[kind] = handler
+
+} //  End of  Service.HandleNote
+
+// Register a handler for a record kind.
+// Record handlers take precedence over the `record` note handler.
+func (s *Service) HandleRecord(kind string, handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if handler == nil {
+		delete(s.records, kind)
+		return
+	}
+
+	s.records[kind] = handler
+
+} //  End of  Service.HandleRecord
+
+// Register the fallback handler for notes that have no specific handler.
+func (s *Service) HandleDefault(handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if handler == nil {
+		handler = AckHandler
+		if s.relay != nil {
+			handler = s.relay.Handler
+		}
+	}
+
+	s.fallback = handler
+
+} //  End of  Service.HandleDefault
+
+// Register the subscription handler.
+// The default handler serves subscriptions from the broker (or relays
+// them upstream for a tower) - a nil handler disables subscriptions.
+func (s *Service) HandleSubscribe(handler SubscribeHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscribe = handler
+
+} //  End of  Service.HandleSubscribe
+
+// Returns the handler for a note.
+func (s *Service) handler(note *pb.Note) Handler {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	kind := NoteKind(note)
+	if kind == KIND_RECORD {
+		if h, ok := s.records[RecordKind(note.GetRecord())]; ok {
+			return h
+		}
+	}
+
+	if h, ok := s.notes[kind]; ok {
+		return h
+	}
+
+	return s.fallback
+
+} //  End of  Service.handler
+
+// Returns a response envelope for a communique.
+func (s *Service) envelope(communique *pb.Communique) *pb.Envelope {
+	origin := communique.GetEnvelope().GetOrigin()
+	postmark := communique.GetEnvelope().GetPostmark()
+
+	return &pb.Envelope{
+		Postmark: util.NewPostmark(),
+		Origin:   &pb.Origin{Address: s.address, Producer: s.producer},
+		Destination: &pb.Destination{
+			Address:   origin.GetAddress(),
+			Recipient: postmark.GetTag(),
+		},
+	}
+
+} //  End of  Service.envelope
+
+// Returns a response to a communique for an answer.
+func (s *Service) respond(communique *pb.Communique, answer *pb.Answer) *pb.Response {
+	return &pb.Response{Envelope: s.envelope(communique), Answer: answer}
+
+} //  End of  Service.respond
+
+// Process a communique and return its answer.
+func (s *Service) process(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	if communique.GetNote() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing note")
+	}
+
+	if err := s.checkRoute(communique); err != nil {
+		return nil, err
+	}
+
+	ctx, err := s.verify(ctx, communique)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.authorize(ctx, communique); err != nil {
+		return nil, err
+	}
+
+	answer, err := s.handler(communique.GetNote())(ctx, communique)
+	if err != nil {
+		slog.Error("processing communique", "error", err,
+			"tag", util.TagString(communique.GetEnvelope().GetPostmark().GetTag()))
+		return nil, err
+	}
+
+	if answer == nil {
+		answer = Acknowledge(communique, nil)
+	}
+
+	return answer, nil
+
+} //  End of  Service.process
+
+// Dispatch a communique.
+func (s *Service) Dispatch(ctx context.Context, communique *pb.Communique) (*pb.Response, error) {
+	answer, err := s.process(ctx, communique)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.respond(communique, answer), nil
+
+} //  End of  Service.Dispatch
+
+// Dispatch a single communique.
+func (s *Service) DispatchUnary(ctx context.Context, communique *pb.Communique) (*pb.Response, error) {
+	return s.Dispatch(ctx, communique)
+
+} //  End of  Service.DispatchUnary
+
+// Dispatch a stream of communiques.
+// The response acknowledges the last communique in the stream.
+func (s *Service) DispatchStream(stream grpc.ClientStreamingServer[pb.Communique, pb.Response]) error {
+	var last *pb.Communique
+	count := 0
+
+	for {
+		communique, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.process(stream.Context(), communique); err != nil {
+			return err
+		}
+
+		last = communique
+		count++
+	}
+
+	if last == nil {
+		return status.Error(codes.InvalidArgument, "empty stream")
+	}
+
+	msg := []byte(fmt.Sprintf("%v communiques", count))
+
+	return stream.SendAndClose(s.respond(last, Acknowledge(last, msg)))
+
+} //  End of  Service.DispatchStream
+
+// Subscribe to publications.
+func (s *Service) Subscribe(communique *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+	if s.config.Service.DisableSubscriptions {
+		return status.Error(codes.Unimplemented,
+			"subscriptions are disabled")
+	}
+
+	if communique.GetNote().GetSubscription() == nil {
+		return status.Error(codes.InvalidArgument,
+			"missing subscription")
+	}
+
+	if err := s.checkRoute(communique); err != nil {
+		return err
+	}
+
+	ctx, err := s.verify(stream.Context(), communique)
+	if err != nil {
+		return err
+	}
+
+	if err := s.authorize(ctx, communique); err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	handler := s.subscribe
+	s.mutex.RUnlock()
+
+	if handler == nil {
+		return status.Error(codes.Unimplemented,
+			"no subscription handler")
+	}
+
+	return handler(communique, stream)
+
+} //  End of  Service.Subscribe
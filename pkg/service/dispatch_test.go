@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a test communique for a note.
+func testCommunique(note *pb.Note) *pb.Communique {
+	return &pb.Communique{
+		Envelope: &pb.Envelope{
+			Postmark: util.NewPostmark(),
+			Origin: &pb.Origin{
+				Producer: &pb.Producer{Name: "test-device"},
+			},
+		},
+		Note: note,
+	}
+
+} //  End of  testCommunique
+
+// Returns a record note.
+func recordNote(record *pb.Record) *pb.Note {
+	return &pb.Note{Kind: &pb.Note_Record{Record: record}}
+
+} //  End of  recordNote
+
+// Test NoteKind and RecordKind functions.
+func TestKinds(t *testing.T) {
+	notes := map[string]*pb.Note{
+		KIND_NONE:         nil,
+		KIND_EMPTY:        {Kind: &pb.Note_Empty{Empty: &pb.Empty{}}},
+		KIND_RECORD:       recordNote(&pb.Record{}),
+		KIND_SUBSCRIPTION: {Kind: &pb.Note_Subscription{Subscription: &pb.Subscription{}}},
+		KIND_GENERIC:      {Kind: &pb.Note_Generic{Generic: &pb.Generic{}}},
+	}
+
+	for expected, note := range notes {
+		if kind := NoteKind(note); kind != expected {
+			t.Errorf("expected note kind %q, got %q", expected, kind)
+		}
+	}
+
+	records := map[string]*pb.Record{
+		KIND_NONE:         nil,
+		KIND_EMPTY:        {Kind: &pb.Record_Empty{}},
+		KIND_ACK:          {Kind: &pb.Record_Ack{}},
+		KIND_REGISTRATION: {Kind: &pb.Record_Registration{}},
+		KIND_STATUS:       {Kind: &pb.Record_Status{}},
+		KIND_INCIDENT:     {Kind: &pb.Record_Incident{}},
+		KIND_METRICS:      {Kind: &pb.Record_Metrics{}},
+		KIND_TIMING:       {Kind: &pb.Record_Timing{}},
+		KIND_TRACE:        {Kind: &pb.Record_Trace{}},
+		KIND_GENERIC:      {Kind: &pb.Record_Generic{}},
+	}
+
+	for expected, record := range records {
+		if kind := RecordKind(record); kind != expected {
+			t.Errorf("expected record kind %q, got %q", expected,
+				kind)
+		}
+	}
+
+} //  End of  TestKinds
+
+// Returns a handler that answers with a generic named `name`.
+func namedHandler(name string) Handler {
+	return func(ctx context.Context, c *pb.Communique) (*pb.Answer, error) {
+		generic := &pb.Generic{Name: name}
+		return &pb.Answer{Kind: &pb.Answer_Generic{Generic: generic}}, nil
+	}
+
+} //  End of  namedHandler
+
+// Test Service.Dispatch and Service.DispatchUnary with handlers.
+func TestDispatch(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.HandleNote(KIND_GENERIC, namedHandler("generic-note"))
+	svc.HandleNote(KIND_RECORD, namedHandler("record-note"))
+	svc.HandleRecord(KIND_INCIDENT, namedHandler("incident"))
+	svc.HandleRecord(KIND_TRACE, namedHandler("trace"))
+	svc.HandleRecord(KIND_TRACE, nil)
+
+	failure := func(ctx context.Context, c *pb.Communique) (*pb.Answer, error) {
+		return nil, status.Error(codes.Aborted, "nope")
+	}
+
+	svc.HandleRecord(KIND_TIMING, failure)
+
+	client := startService(t, svc)
+
+	tests := []struct {
+		name     string
+		note     *pb.Note
+		expected string
+		code     codes.Code
+	}{
+		{
+			name: "empty note is acked",
+			note: &pb.Note{Kind: &pb.Note_Empty{Empty: &pb.Empty{}}},
+		},
+		{
+			name:     "generic note",
+			note:     &pb.Note{Kind: &pb.Note_Generic{Generic: &pb.Generic{}}},
+			expected: "generic-note",
+		},
+		{
+			name:     "incident record",
+			note:     recordNote(&pb.Record{Kind: &pb.Record_Incident{}}),
+			expected: "incident",
+		},
+		{
+			name:     "trace record removed handler",
+			note:     recordNote(&pb.Record{Kind: &pb.Record_Trace{}}),
+			expected: "record-note",
+		},
+		{
+			name: "timing record fails",
+			note: recordNote(&pb.Record{Kind: &pb.Record_Timing{}}),
+			code: codes.Aborted,
+		},
+		{
+			name: "missing note",
+			code: codes.InvalidArgument,
+		},
+	}
+
+	calls := map[string]func(context.Context, *pb.Communique, ...grpc.CallOption) (*pb.Response, error){
+		"Dispatch":      client.Dispatch,
+		"DispatchUnary": client.DispatchUnary,
+	}
+
+	for call, fn := range calls {
+		for _, step := range tests {
+			communique := testCommunique(step.note)
+			resp, err := fn(context.Background(), communique)
+			if step.code != codes.OK {
+				if status.Code(err) != step.code {
+					t.Errorf("%v test %v expected code %v, got %v",
+						call, step.name, step.code, err)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%v test %v unexpected error: %v", call,
+					step.name, err)
+				continue
+			}
+
+			tag := communique.GetEnvelope().GetPostmark().GetTag()
+			if !util.SameTag(resp.GetEnvelope().GetDestination().GetRecipient(), tag) {
+				t.Errorf("%v test %v expected recipient tag", call,
+					step.name)
+			}
+
+			if resp.GetEnvelope().GetOrigin().GetProducer().GetName() != "test-station" {
+				t.Errorf("%v test %v expected producer name", call,
+					step.name)
+			}
+
+			if len(step.expected) == 0 {
+				ack := resp.GetAnswer().GetAck()
+				if ack == nil || !util.SameTag(ack.GetOrigination(), tag) {
+					t.Errorf("%v test %v expected ack, got %v",
+						call, step.name, resp.GetAnswer())
+				}
+
+				continue
+			}
+
+			if name := resp.GetAnswer().GetGeneric().GetName(); name != step.expected {
+				t.Errorf("%v test %v expected %v, got %v", call,
+					step.name, step.expected, name)
+			}
+		}
+	}
+
+} //  End of  TestDispatch
+
+// Test Service.HandleDefault function.
+func TestHandleDefault(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.HandleDefault(namedHandler("fallback"))
+
+	communique := testCommunique(&pb.Note{Kind: &pb.Note_Empty{}})
+	resp, err := svc.Dispatch(context.Background(), communique)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if name := resp.GetAnswer().GetGeneric().GetName(); name != "fallback" {
+		t.Errorf("expected fallback handler, got %v", name)
+	}
+
+	svc.HandleDefault(nil)
+
+	resp, err = svc.Dispatch(context.Background(), communique)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.GetAnswer().GetAck() == nil {
+		t.Errorf("expected ack after resetting default handler")
+	}
+
+} //  End of  TestHandleDefault
+
+// Test Service.DispatchStream function.
+func TestDispatchStream(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	counter := 0
+	svc.HandleRecord(KIND_METRICS, func(ctx context.Context, c *pb.Communique) (*pb.Answer, error) {
+		counter++
+		return nil, nil
+	})
+
+	client := startService(t, svc)
+
+	stream, err := client.DispatchStream(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var last *pb.Communique
+	for idx := 0; idx < 5; idx++ {
+		last = testCommunique(recordNote(&pb.Record{Kind: &pb.Record_Metrics{}}))
+		if err := stream.Send(last); err != nil {
+			t.Fatalf("unexpected send error: %v", err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if counter != 5 {
+		t.Errorf("expected 5 metrics handled, got %v", counter)
+	}
+
+	ack := resp.GetAnswer().GetAck()
+	if !util.SameTag(ack.GetOrigination(), last.GetEnvelope().GetPostmark().GetTag()) {
+		t.Errorf("expected ack for the last communique")
+	}
+
+	if string(ack.GetMsg()) != "5 communiques" {
+		t.Errorf("expected ack message, got %q", ack.GetMsg())
+	}
+
+	empty, err := client.DispatchStream(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := empty.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument for empty stream, got %v",
+			err)
+	}
+
+} //  End of  TestDispatchStream
+
+// Test Service.Subscribe function.
+func TestSubscribe(t *testing.T) {
+	subscription := &pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: "news"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		disabled bool
+		handler  bool
+		note     *pb.Note
+		code     codes.Code
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			handler:  true,
+			note:     subscription,
+			code:     codes.Unimplemented,
+		},
+		{
+			name: "no handler",
+			note: subscription,
+			code: codes.Unimplemented,
+		},
+		{
+			name:    "not a subscription",
+			handler: true,
+			note:    &pb.Note{Kind: &pb.Note_Empty{}},
+			code:    codes.InvalidArgument,
+		},
+		{
+			name:    "subscribed",
+			handler: true,
+			note:    subscription,
+			code:    codes.OK,
+		},
+	}
+
+	for _, step := range tests {
+		cfg := testConfig(t)
+		cfg.Service.DisableSubscriptions = step.disabled
+
+		svc, err := NewService(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if step.handler {
+			svc.HandleSubscribe(func(c *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+				topic := c.GetNote().GetSubscription().GetTopic()
+				generic := &pb.Generic{Name: topic}
+				publication := &pb.Publication{
+					Kind: &pb.Publication_Generic{Generic: generic},
+				}
+
+				answer := &pb.Answer{
+					Kind: &pb.Answer_Publication{Publication: publication},
+				}
+
+				return stream.Send(svc.respond(c, answer))
+			})
+		} else {
+			svc.HandleSubscribe(nil)
+		}
+
+		client := startService(t, svc)
+
+		stream, err := client.Subscribe(context.Background(),
+			testCommunique(step.note))
+		if err != nil {
+			t.Fatalf("test %v unexpected error: %v", step.name, err)
+		}
+
+		resp, err := stream.Recv()
+		if step.code != codes.OK {
+			if status.Code(err) != step.code {
+				t.Errorf("test %v expected code %v, got %v",
+					step.name, step.code, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", step.name, err)
+			continue
+		}
+
+		generic := resp.GetAnswer().GetPublication().GetGeneric()
+		if generic.GetName() != "news" {
+			t.Errorf("test %v expected news publication, got %v",
+				step.name, resp.GetAnswer())
+		}
+	}
+
+} //  End of  TestSubscribe
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Enrolling a device neither admitted by a registrar nor bound to the peer.
+var ErrUnregisteredEnrollment = errors.New("enrollment without registration")
+
+// Enroller issues device certificates - signs the certificate signing
+// requests devices send along with their registrations.
+type Enroller struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	lifetime time.Duration
+}
+
+// Returns a new enroller signing device certificates valid for `lifetime`
+// with a CA certificate and key (decrypted with the passphrase source).
+// Zero uses the default lifetime.
+func NewEnroller(certPath, keyPath string, passphrase ptls.PassphraseFunc, lifetime time.Duration) (*Enroller, error) {
+	pair, err := ptls.LoadCertKeyPair(certPath, keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key %T", pair.PrivateKey)
+	}
+
+	if lifetime <= 0 {
+		lifetime = config.DEFAULT_DEVICE_CERT_LIFETIME
+	}
+
+	return &Enroller{cert: cert, key: key, lifetime: lifetime}, nil
+
+} // End of function  NewEnroller.
+
+// Sign a device certificate signing request (PEM or DER encoded).
+// The request needs to be for the registering device. Returns the PEM
+// encoded device certificate followed by the signing CA certificate.
+func (e *Enroller) Sign(device string, request []byte) ([]byte, error) {
+	csr, err := ptls.ParseCertificateRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if csr.Subject.CommonName != device {
+		return nil, fmt.Errorf("%w: %q does not match device %q",
+			ptls.ErrInvalidCertificateRequest, csr.Subject.CommonName,
+			device)
+	}
+
+	cert, err := ptls.SignCertificateRequest(csr, e.cert, e.key, e.lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("issued device certificate", "device", device,
+		"serial", cert.SerialNumber, "expires", cert.NotAfter)
+
+	return ptls.EncodeCertificates(cert, e.cert), nil
+
+} //  End of  Enroller.Sign
+
+// Returns the enroller for the service config - nil if there's no signing
+// CA certificate. An encrypted CA key is decrypted with the passphrase
+// source.
+func configEnroller(cfg *config.Config, passphrase ptls.PassphraseFunc) (*Enroller, error) {
+	settings := cfg.Service
+	if len(settings.SigningCACert) == 0 && len(settings.SigningCAKey) == 0 {
+		return nil, nil
+	}
+
+	return NewEnroller(settings.SigningCACert, settings.SigningCAKey,
+		passphrase, settings.DeviceCertLifetime)
+
+} // End of function  configEnroller.
+
+// Use an enroller for device certificates. Registrations carrying a
+// certificate signing request get the device certificate back in the
+// membership permit. A nil enroller turns enrollment off.
+func (s *Service) UseEnroller(enroller *Enroller) {
+	s.mutex.Lock()
+	s.enroller = enroller
+	s.mutex.Unlock()
+
+	s.handleRegistrations()
+
+} //  End of  Service.UseEnroller
+
+// Returns the enroller or nil if there's no enrollment.
+func (s *Service) Enroller() *Enroller {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.enroller
+
+} //  End of  Service.Enroller
+
+// Enroll a registering device - signs the certificate signing request
+// carried in the registration data (if any) into the membership permit.
+// Certificates are only signed for devices the registrar admitted or the
+// peer certificate is bound to - a bootstrap (or any other) certificate
+// says nothing about the device otherwise.
+func (s *Service) enroll(ctx context.Context, registration *pb.Registration, membership *pb.Membership, registered bool) error {
+	enroller := s.Enroller()
+	if enroller == nil || len(registration.GetData()) == 0 {
+		return nil
+	}
+
+	if !registered && !s.boundPeer(ctx, registration.GetDevice()) {
+		slog.Warn("enrollment denied", "device", registration.GetDevice(),
+			"error", ErrUnregisteredEnrollment)
+		return status.Error(codes.PermissionDenied,
+			ErrUnregisteredEnrollment.Error())
+	}
+
+	cert, err := enroller.Sign(registration.GetDevice(), registration.GetData())
+	if err != nil {
+		slog.Warn("enrollment denied", "device", registration.GetDevice(),
+			"error", err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	membership.Data = cert
+	return nil
+
+} //  End of  Service.enroll
+
+// Returns true if the peer authenticated with a certificate that chained
+// to a bootstrap CA.
+func (s *Service) bootstrapPeer(ctx context.Context) bool {
+	if s.reloader == nil {
+		return false
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return false
+	}
+
+	pools := s.reloader.Pools()
+	return pools.ConnectionPool(info.State) == ptls.POOL_BOOTSTRAP
+
+} //  End of  Service.bootstrapPeer
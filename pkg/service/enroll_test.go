@@ -0,0 +1,315 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/tls/pki"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Test certificate authority.
+type testAuthority struct {
+	*pki.Authority
+	certPath string
+	keyPath  string
+}
+
+// Write a PEM certificate and key to files in a directory.
+// Returns the certificate and key paths.
+func writeTestPair(t *testing.T, dir, name string, cert *x509.Certificate, key crypto.Signer) (string, string) {
+	data, err := ptls.EncodePrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, name+"-cert.pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+
+	if err := os.WriteFile(certPath, ptls.EncodeCertificates(cert), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+
+	if err := os.WriteFile(keyPath, data, 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+
+	return certPath, keyPath
+
+} //  End of  writeTestPair
+
+// Returns a new test certificate authority with its files in a directory.
+func newTestAuthority(t *testing.T, dir, name string) *testAuthority {
+	key, err := ptls.GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	ca, err := pki.NewAuthority(pkix.Name{CommonName: name}, key, time.Hour)
+	if err != nil {
+		t.Fatalf("creating authority: %v", err)
+	}
+
+	certPath, keyPath := writeTestPair(t, dir, name+"-ca", ca.Cert, ca.Key)
+
+	return &testAuthority{Authority: ca, certPath: certPath, keyPath: keyPath}
+
+} //  End of  newTestAuthority
+
+// Issue a test certificate for a subject with a profile.
+// Returns the certificate and its key.
+func (ca *testAuthority) certify(t *testing.T, subject pkix.Name, profile pki.Profile) (*x509.Certificate, crypto.Signer) {
+	key, err := ptls.GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	der, err := pki.CreateRequest(subject, key)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+
+	cert, err := ca.Issue(csr, profile)
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+
+	return cert, key
+
+} //  End of  testAuthority.certify
+
+// Issue a leaf certificate for a name - server certificates are for
+// localhost. Returns the certificate and key paths.
+func (ca *testAuthority) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	profile := pki.DeviceProfile()
+	if usage == x509.ExtKeyUsageServerAuth {
+		profile = pki.ServerProfile("localhost", "127.0.0.1")
+	}
+
+	cert, key := ca.certify(t, pkix.Name{CommonName: name}, profile)
+	return writeTestPair(t, dir, name, cert, key)
+
+} //  End of  testAuthority.issue
+
+// Test Enroller functions.
+func TestEnroller(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestAuthority(t, dir, "device")
+
+	if _, err := NewEnroller(filepath.Join(dir, "404"), ca.keyPath, nil, 0); err == nil {
+		t.Errorf("expected an error for a missing CA certificate")
+	}
+
+	enroller, err := NewEnroller(ca.certPath, ca.keyPath, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key, _ := ptls.GenerateKey()
+	csr, _ := ptls.CreateCertificateRequest("d1", key)
+
+	tests := []struct {
+		device  string
+		request []byte
+		valid   bool
+	}{
+		{device: "d1", request: csr, valid: true},
+		{device: "d2", request: csr},
+		{device: "d1", request: []byte("not a request")},
+		{device: "d1"},
+	}
+
+	for idx, step := range tests {
+		data, err := enroller.Sign(step.device, step.request)
+		if !step.valid {
+			if !errors.Is(err, ptls.ErrInvalidCertificateRequest) {
+				t.Errorf("test %v expected invalid request, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("test %v unexpected error: %v", idx, err)
+		}
+
+		path := filepath.Join(dir, "issued.pem")
+		os.WriteFile(path, data, 0o600)
+
+		certs, err := ptls.LoadCertificates(path)
+		if err != nil || len(certs) != 2 {
+			t.Fatalf("test %v expected certificate chain, got %v %v", idx, certs, err)
+		}
+
+		if certs[0].Subject.CommonName != step.device || !certs[1].Equal(ca.Cert) {
+			t.Errorf("test %v unexpected certificates %v", idx, certs)
+		}
+
+		lifetime := certs[0].NotAfter.Sub(time.Now())
+		if lifetime < config.DEFAULT_DEVICE_CERT_LIFETIME-time.Hour {
+			t.Errorf("test %v expected default lifetime, got %v", idx, lifetime)
+		}
+	}
+
+} //  End of  TestEnroller
+
+// Test the bootstrap to device certificate enrollment.
+func TestEnrollment(t *testing.T) {
+	dir := t.TempDir()
+
+	serviceCA := newTestAuthority(t, dir, "service")
+	bootstrapCA := newTestAuthority(t, dir, "bootstrap")
+	deviceCA := newTestAuthority(t, dir, "device")
+
+	cfg := testConfig(t)
+	cfg.Settings.Cert, cfg.Settings.Key = serviceCA.issue(t, dir, "test-station",
+		x509.ExtKeyUsageServerAuth)
+	cfg.Service.CACertPatterns.Bootstrap = filepath.Join(dir, "bootstrap-ca-cert.pem")
+	cfg.Service.CACertPatterns.Device = filepath.Join(dir, "device-ca-cert.pem")
+	cfg.Service.SigningCACert = deviceCA.certPath
+	cfg.Service.SigningCAKey = deviceCA.keyPath
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if svc.Enroller() == nil {
+		t.Fatalf("expected an enroller for the signing CA")
+	}
+
+	dialer := startServiceListener(t, svc)
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Name = "test-device"
+	devcfg.Settings.Cert, devcfg.Settings.Key = bootstrapCA.issue(t, dir, "bootstrap",
+		x509.ExtKeyUsageClientAuth)
+	devcfg.Device.ServiceAddress = "127.0.0.1"
+	devcfg.Device.ServiceCACert = serviceCA.certPath
+	devcfg.Device.Token = "let me inside"
+
+	ctx := context.Background()
+
+	// Bootstrap certificates can only register.
+	bootstrap, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer bootstrap.Close()
+
+	_, err = bootstrap.SendIncident(ctx, pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	enrolled := *devcfg
+	enrolled.Device.EnrolledCert = filepath.Join(dir, "enrolled", "cert.pem")
+	enrolled.Device.EnrolledKey = filepath.Join(dir, "enrolled", "key.pem")
+
+	// Bootstrap peers only enroll devices the registrar admitted.
+	unregistered, err := device.NewClient(&enrolled, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer unregistered.Close()
+
+	if _, err := unregistered.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	if unregistered.Enrolled() {
+		t.Errorf("expected an unregistered device not to be enrolled")
+	}
+
+	// And so do the peers with any other certificate.
+	other := enrolled
+	other.Settings.Cert, other.Settings.Key = deviceCA.issue(t, dir, "other-device",
+		x509.ExtKeyUsageClientAuth)
+	other.Device.EnrolledCert = filepath.Join(dir, "other", "cert.pem")
+	other.Device.EnrolledKey = filepath.Join(dir, "other", "key.pem")
+
+	impostor, err := device.NewClient(&other, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer impostor.Close()
+
+	if _, err := impostor.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	if impostor.Enrolled() {
+		t.Errorf("expected an unregistered device not to be enrolled")
+	}
+
+	svc.UseRegistrar(NewTokenRegistrar("let me inside"))
+
+	client, err := device.NewClient(&enrolled, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	if !client.Enrolling() || client.Enrolled() {
+		t.Fatalf("expected an enrolling device")
+	}
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !client.Enrolled() {
+		t.Fatalf("expected an enrolled device")
+	}
+
+	certs, err := ptls.LoadCertificates(enrolled.Device.EnrolledCert)
+	if err != nil || certs[0].Subject.CommonName != "test-device" {
+		t.Fatalf("expected an enrolled device certificate, got %v %v", certs, err)
+	}
+
+	if err := certs[0].CheckSignatureFrom(deviceCA.Cert); err != nil {
+		t.Errorf("expected certificate signed by device CA, got %v", err)
+	}
+
+	if _, err := client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Errorf("expected enrolled device to be accepted, got %v", err)
+	}
+
+	// A restarted device comes up with the enrolled certificate.
+	restarted, err := device.NewClient(&enrolled, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer restarted.Close()
+
+	if err := restarted.Connect(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := restarted.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Errorf("expected restarted device to be accepted, got %v", err)
+	}
+
+} //  End of  TestEnrollment
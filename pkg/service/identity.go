@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Peer identity sources - where in the client certificate the device
+// identity comes from.
+const (
+	IDENTITY_NONE = ""
+	IDENTITY_CN   = "cn"
+	IDENTITY_URI  = "uri"
+	IDENTITY_DNS  = "dns"
+	IDENTITY_OID  = "oid"
+)
+
+var (
+	// Peer has no (usable) identity.
+	ErrNoPeerIdentity = errors.New("no peer identity")
+
+	// Device is not the one the peer identity is for.
+	ErrIdentityMismatch = errors.New("device does not match peer identity")
+
+	// Unknown peer identity source or OID.
+	ErrInvalidIdentitySource = errors.New("invalid peer identity source")
+)
+
+// Identity of a peer from its client certificate.
+type PeerIdentity struct {
+	Source  string
+	Subject string
+
+	// Device names the peer can claim.
+	Names []string
+
+	// Peer authenticated with a bootstrap certificate.
+	Bootstrap bool
+}
+
+// Extracts the peer identity from a client certificate.
+type IdentityExtractor func(cert *x509.Certificate) (*PeerIdentity, error)
+
+// Context key for the peer identity.
+type peerIdentityKey struct{}
+
+// Returns true if the peer can claim to be a device.
+func (p *PeerIdentity) Matches(device string) bool {
+	return len(device) > 0 && slices.Contains(p.Names, device)
+
+} //  End of  PeerIdentity.Matches
+
+// Returns the names in a SAN URI - the URI and the last segment of its
+// path ala spiffe://telegraph.biota.local/device/news -> news
+func uriNames(uri string) []string {
+	names := []string{uri}
+	if _, rest, ok := strings.Cut(uri, "://"); ok {
+		if _, p, ok := strings.Cut(rest, "/"); ok && len(p) > 0 {
+			names = append(names, path.Base(p))
+		}
+	}
+
+	return names
+
+} // End of function  uriNames.
+
+// Returns the names in SAN DNS names - the names (but no wildcards) and
+// their first labels ala news.device.telegraph.biota.local -> news
+func dnsNames(names []string) []string {
+	found := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "*") {
+			continue
+		}
+
+		found = append(found, name)
+		if label, _, ok := strings.Cut(name, "."); ok && len(label) > 0 {
+			found = append(found, label)
+		}
+	}
+
+	return found
+
+} // End of function  dnsNames.
+
+// Returns the values of a subject attribute or a string extension with
+// an OID.
+func oidNames(cert *x509.Certificate, oid asn1.ObjectIdentifier) []string {
+	names := []string{}
+	for _, attr := range cert.Subject.Names {
+		if value, ok := attr.Value.(string); ok && attr.Type.Equal(oid) {
+			names = append(names, value)
+		}
+	}
+
+	for _, ext := range cert.Extensions {
+		var value string
+		if ext.Id.Equal(oid) {
+			if _, err := asn1.Unmarshal(ext.Value, &value); err == nil {
+				names = append(names, value)
+			}
+		}
+	}
+
+	return names
+
+} // End of function  oidNames.
+
+// Parse a dotted OID ala 1.3.6.1.4.1.99999.1
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	oid := asn1.ObjectIdentifier{}
+	for _, part := range strings.Split(value, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: oid %q", ErrInvalidIdentitySource, value)
+		}
+
+		oid = append(oid, n)
+	}
+
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("%w: oid %q", ErrInvalidIdentitySource, value)
+	}
+
+	return oid, nil
+
+} // End of function  parseOID.
+
+// Returns the identity extractor for a source (see IDENTITY_*) - the oid
+// is only used by the oid source. No source means no extractor (nil).
+func NewIdentityExtractor(source, oid string) (IdentityExtractor, error) {
+	var names func(cert *x509.Certificate) []string
+
+	switch strings.ToLower(source) {
+	case IDENTITY_NONE:
+		return nil, nil
+
+	case IDENTITY_CN:
+		names = func(cert *x509.Certificate) []string {
+			if cn := cert.Subject.CommonName; len(cn) > 0 {
+				return []string{cn}
+			}
+
+			return nil
+		}
+
+	case IDENTITY_URI:
+		names = func(cert *x509.Certificate) []string {
+			found := []string{}
+			for _, uri := range cert.URIs {
+				found = append(found, uriNames(uri.String())...)
+			}
+
+			return found
+		}
+
+	case IDENTITY_DNS:
+		names = func(cert *x509.Certificate) []string {
+			return dnsNames(cert.DNSNames)
+		}
+
+	case IDENTITY_OID:
+		id, err := parseOID(oid)
+		if err != nil {
+			return nil, err
+		}
+
+		names = func(cert *x509.Certificate) []string {
+			return oidNames(cert, id)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidIdentitySource, source)
+	}
+
+	source = strings.ToLower(source)
+
+	return func(cert *x509.Certificate) (*PeerIdentity, error) {
+		found := names(cert)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("%w: no %v in %v", ErrNoPeerIdentity,
+				source, cert.Subject)
+		}
+
+		return &PeerIdentity{
+			Source:  source,
+			Subject: cert.Subject.String(),
+			Names:   found,
+		}, nil
+	}, nil
+
+} // End of function  NewIdentityExtractor.
+
+// Returns the identity extractor for the service config - nil if devices
+// are not bound to their certificates.
+func configIdentityExtractor(cfg *config.Config) (IdentityExtractor, error) {
+	return NewIdentityExtractor(cfg.Service.PeerIdentity,
+		cfg.Service.PeerIdentityOID)
+
+} // End of function  configIdentityExtractor.
+
+// Returns a context carrying the peer identity.
+func WithPeerIdentity(ctx context.Context, identity *PeerIdentity) context.Context {
+	return context.WithValue(ctx, peerIdentityKey{}, identity)
+
+} // End of function  WithPeerIdentity.
+
+// Returns the peer identity in a context - handlers get it from their
+// context when the service binds devices to their certificates.
+func PeerIdentityFromContext(ctx context.Context) (*PeerIdentity, bool) {
+	identity, ok := ctx.Value(peerIdentityKey{}).(*PeerIdentity)
+	return identity, ok && identity != nil
+
+} // End of function  PeerIdentityFromContext.
+
+// Use an identity extractor to bind devices to their client certificates.
+// The device names in communiques, registrations and membership permits
+// need to match the peer identity. A nil extractor turns it off.
+func (s *Service) UseIdentityExtractor(extractor IdentityExtractor) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.identify = extractor
+
+} //  End of  Service.UseIdentityExtractor
+
+// Returns the identity extractor or nil if devices are not bound to their
+// certificates.
+func (s *Service) IdentityExtractor() IdentityExtractor {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.identify
+
+} //  End of  Service.IdentityExtractor
+
+// Returns the identity of the peer in a context.
+func (s *Service) peerIdentity(ctx context.Context, extractor IdentityExtractor) (*PeerIdentity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%w: no peer", ErrNoPeerIdentity)
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("%w: no client certificate from %v",
+			ErrNoPeerIdentity, p.Addr)
+	}
+
+	identity, err := extractor(info.State.PeerCertificates[0])
+	if err != nil {
+		return nil, err
+	}
+
+	identity.Bootstrap = s.bootstrapPeer(ctx)
+	return identity, nil
+
+} //  End of  Service.peerIdentity
+
+// Returns the context with the peer identity attached (if there's one).
+func (s *Service) identityContext(ctx context.Context) context.Context {
+	extractor := s.IdentityExtractor()
+	if extractor == nil {
+		return ctx
+	}
+
+	identity, err := s.peerIdentity(ctx, extractor)
+	if err != nil {
+		slog.Warn("extracting peer identity", "error", err)
+		return ctx
+	}
+
+	return WithPeerIdentity(ctx, identity)
+
+} //  End of  Service.identityContext
+
+// Server stream with the peer identity in its context.
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Returns the stream context.
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+
+} //  End of  identityStream.Context
+
+// Unary server interceptor attaching the peer identity to the context.
+func (s *Service) identityUnaryInterceptor(ctx context.Context, req any,
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+
+	return handler(s.identityContext(ctx), req)
+
+} //  End of  Service.identityUnaryInterceptor
+
+// Stream server interceptor attaching the peer identity to the stream
+// context.
+func (s *Service) identityStreamInterceptor(srv any, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	ctx := s.identityContext(stream.Context())
+	return handler(srv, &identityStream{ServerStream: stream, ctx: ctx})
+
+} //  End of  Service.identityStreamInterceptor
+
+// Check the peer identity is for the devices - always passes if devices
+// are not bound to their certificates. Bootstrap certificates are shared
+// by all the devices and pass too, they can only register anyway.
+func (s *Service) checkIdentity(ctx context.Context, devices ...string) error {
+	if s.IdentityExtractor() == nil {
+		return nil
+	}
+
+	identity, ok := PeerIdentityFromContext(ctx)
+	if !ok {
+		slog.Warn("rejecting communique without peer identity",
+			"devices", devices)
+		return status.Error(codes.PermissionDenied, ErrNoPeerIdentity.Error())
+	}
+
+	if identity.Bootstrap {
+		return nil
+	}
+
+	for _, device := range devices {
+		if !identity.Matches(device) {
+			err := fmt.Errorf("%w: %q is not %v", ErrIdentityMismatch,
+				device, identity.Subject)
+			slog.Warn("rejecting device", "device", device,
+				"identity", identity.Names, "error", err)
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+
+	return nil
+
+} //  End of  Service.checkIdentity
+
+// Returns true if the peer is bound to a device by its (device, not
+// bootstrap) client certificate.
+func (s *Service) boundPeer(ctx context.Context, device string) bool {
+	if s.IdentityExtractor() == nil {
+		return false
+	}
+
+	identity, ok := PeerIdentityFromContext(ctx)
+	return ok && !identity.Bootstrap && identity.Matches(device)
+
+} //  End of  Service.boundPeer
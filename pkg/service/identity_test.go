@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	"github.com/biota/go-grpc-telegraph/pkg/tls/pki"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Test NewIdentityExtractor function.
+func TestNewIdentityExtractor(t *testing.T) {
+	attrOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	extOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	extValue, _ := asn1.Marshal("news-ext")
+	uri, _ := url.Parse("spiffe://telegraph.biota.local/device/news")
+
+	ca := newTestAuthority(t, t.TempDir(), "identity")
+	cert, _ := ca.certify(t, pkix.Name{
+		CommonName: "news",
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: attrOID, Value: "news-attr"},
+		},
+	}, pki.Profile{
+		Hosts: []string{
+			"*.telegraph.biota.local",
+			"news.device.telegraph.biota.local",
+			uri.String(),
+		},
+		Extensions: []pkix.Extension{
+			{Id: extOID, Value: extValue},
+		},
+	})
+
+	anonymous, _ := ca.certify(t, pkix.Name{}, pki.Profile{})
+
+	tests := []struct {
+		source  string
+		oid     string
+		cert    *x509.Certificate
+		matches []string
+		rejects []string
+		err     error
+	}{
+		{source: IDENTITY_NONE},
+		{source: "CN", cert: cert, matches: []string{"news"}, rejects: []string{"alchemy", ""}},
+		{
+			source:  IDENTITY_URI,
+			cert:    cert,
+			matches: []string{"news", uri.String()},
+			rejects: []string{"device"},
+		},
+		{
+			source:  IDENTITY_DNS,
+			cert:    cert,
+			matches: []string{"news", "news.device.telegraph.biota.local"},
+			rejects: []string{"*", "*.telegraph.biota.local"},
+		},
+		{source: IDENTITY_OID, oid: "1.3.6.1.4.1.99999.1", cert: cert, matches: []string{"news-attr"}},
+		{source: IDENTITY_OID, oid: "1.3.6.1.4.1.99999.2", cert: cert, matches: []string{"news-ext"}},
+		{source: IDENTITY_OID, oid: "1.3.6.1.4.1.99999.3", cert: cert, err: ErrNoPeerIdentity},
+		{source: IDENTITY_CN, cert: anonymous, err: ErrNoPeerIdentity},
+		{source: IDENTITY_URI, cert: anonymous, err: ErrNoPeerIdentity},
+		{source: IDENTITY_OID, oid: "1.x", err: ErrInvalidIdentitySource},
+		{source: IDENTITY_OID, err: ErrInvalidIdentitySource},
+		{source: "serial", err: ErrInvalidIdentitySource},
+	}
+
+	for idx, step := range tests {
+		extractor, err := NewIdentityExtractor(step.source, step.oid)
+		if step.cert == nil {
+			if !errors.Is(err, step.err) || (step.err == nil && extractor != nil) {
+				t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+			continue
+		}
+
+		identity, err := extractor(step.cert)
+		if step.err != nil {
+			if !errors.Is(err, step.err) {
+				t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+			continue
+		}
+
+		for _, name := range step.matches {
+			if !identity.Matches(name) {
+				t.Errorf("test %v expected %q in %v", idx, name, identity.Names)
+			}
+		}
+
+		for _, name := range step.rejects {
+			if identity.Matches(name) {
+				t.Errorf("test %v unexpected %q in %v", idx, name, identity.Names)
+			}
+		}
+	}
+
+} //  End of  TestNewIdentityExtractor
+
+// Test binding devices to their client certificates.
+func TestIdentityBinding(t *testing.T) {
+	dir := t.TempDir()
+
+	serviceCA := newTestAuthority(t, dir, "service")
+	deviceCA := newTestAuthority(t, dir, "device")
+
+	cfg := testConfig(t)
+	cfg.Settings.Cert, cfg.Settings.Key = serviceCA.issue(t, dir, "test-station",
+		x509.ExtKeyUsageServerAuth)
+	cfg.Service.CACertPatterns.Device = filepath.Join(dir, "device-ca-cert.pem")
+
+	cfg.Service.PeerIdentity = "serial"
+	if _, err := NewService(cfg); !errors.Is(err, ErrInvalidIdentitySource) {
+		t.Errorf("expected invalid identity source error, got %v", err)
+	}
+
+	cfg.Service.PeerIdentity = IDENTITY_CN
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.UseRegistrar(NewTokenRegistrar("let me inside"))
+
+	// Handlers see the peer identity.
+	identities := make(chan []string, 4)
+	svc.HandleRecord(KIND_INCIDENT, func(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+		if identity, ok := PeerIdentityFromContext(ctx); ok {
+			identities <- identity.Names
+		}
+
+		return nil, nil
+	})
+
+	dialer := startServiceListener(t, svc)
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Name = "test-device"
+	devcfg.Settings.Cert, devcfg.Settings.Key = deviceCA.issue(t, dir, "test-device",
+		x509.ExtKeyUsageClientAuth)
+	devcfg.Device.ServiceAddress = "127.0.0.1"
+	devcfg.Device.ServiceCACert = serviceCA.certPath
+	devcfg.Device.Token = "let me inside"
+	devcfg.Device.MembershipFile = filepath.Join(dir, "membership")
+
+	ctx := context.Background()
+
+	client, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if names := <-identities; !slices.Contains(names, "test-device") {
+		t.Errorf("expected the peer identity in the context, got %v", names)
+	}
+
+	// Another device with the same certificate can't register or send.
+	impostorcfg := *devcfg
+	impostorcfg.Settings.Name = "other-device"
+	impostorcfg.Device.MembershipFile = ""
+
+	impostor, err := device.NewClient(&impostorcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer impostor.Close()
+
+	if _, err := impostor.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied registration, got %v", err)
+	}
+
+	_, err = impostor.SendIncident(ctx, pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	err = impostor.Subscribe(ctx, "news")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied subscription, got %v", err)
+	}
+
+	// Without the binding it's down to the membership credentials.
+	svc.UseIdentityExtractor(nil)
+
+	_, err = impostor.SendIncident(ctx, pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+} //  End of  TestIdentityBinding
+
+// Test devices without client certificates have no peer identity.
+func TestIdentityInsecure(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	extractor, _ := NewIdentityExtractor(IDENTITY_CN, "")
+	svc.UseIdentityExtractor(extractor)
+
+	dialer := startServiceListener(t, svc)
+
+	cfg := testConfig(t)
+	cfg.Settings.Name = "test-device"
+	cfg.Device.ServiceAddress = "127.0.0.1"
+
+	client, err := device.NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	_, err = client.SendIncident(context.Background(), pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+} //  End of  TestIdentityInsecure
@@ -0,0 +1,530 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy rule effects, actions and directives.
+const (
+	POLICY_ALLOW   = "allow"
+	POLICY_DENY    = "deny"
+	POLICY_DEFAULT = "default"
+
+	ACTION_SUBSCRIBE = "subscribe"
+	ACTION_SEND      = "send"
+	ACTION_ANY       = "*"
+)
+
+var (
+	// Malformed policy file.
+	ErrInvalidPolicy = errors.New("invalid policy")
+
+	// Denied by the access policy.
+	ErrPolicyDenied = errors.New("denied by policy")
+
+	// Neither credentials nor a client certificate vouch for the sender.
+	ErrNoIdentity = errors.New("no authenticated identity")
+)
+
+// Access policy rule - allows or denies an action on the targets (topics
+// or record kinds) matching a glob to the identities matching a glob.
+// Subscriptions are for topic filters - allowed if the glob matches all
+// the topics a filter matches, denied if it matches any of them.
+type PolicyRule struct {
+	Allow    bool
+	Action   string
+	Identity string
+	Target   string
+	Line     int
+}
+
+// Access policy - the rules (from a policy file) deciding which devices
+// can subscribe to which topics and send which kinds of records. The
+// first matching rule decides, anything no rule matches gets the default
+// (deny unless the policy says otherwise).
+// The policy file is reloaded when it changes - checked at most every
+// reload interval. A failed reload keeps the current rules.
+type Policy struct {
+	mutex    sync.RWMutex
+	path     string
+	interval time.Duration
+	rules    []PolicyRule
+	allow    bool
+	checked  time.Time
+	stamp    ptls.FileStamp
+}
+
+// Topic filter wildcard tokens - single level `+` and multi level `#`.
+const (
+	filterLevel = -1
+	filterRest  = -2
+)
+
+// Returns true if a name matches a glob - `*` matches anything (including
+// `/`) and `?` any one character.
+func globMatch(pattern, name string) bool {
+	px, nx := 0, 0
+	starPx, starNx := -1, -1
+
+	for nx < len(name) {
+		switch {
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starNx = px, nx
+			px++
+
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == name[nx]):
+			px++
+			nx++
+
+		case starPx >= 0:
+			// Backtrack - let the last star eat one more character.
+			starNx++
+			px, nx = starPx+1, starNx
+
+		default:
+			return false
+		}
+	}
+
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+
+	return px == len(pattern)
+
+} // End of function  globMatch.
+
+// Returns the tokens of a (MQTT-style) topic filter - its characters with
+// the `+` and `#` levels as wildcard tokens.
+func filterTokens(filter string) []int {
+	tokens := []int{}
+	for idx, level := range strings.Split(filter, "/") {
+		if idx > 0 {
+			tokens = append(tokens, '/')
+		}
+
+		switch level {
+		case "+":
+			tokens = append(tokens, filterLevel)
+
+		case "#":
+			tokens = append(tokens, filterRest)
+
+		default:
+			for _, c := range []byte(level) {
+				tokens = append(tokens, int(c))
+			}
+		}
+	}
+
+	return tokens
+
+} // End of function  filterTokens.
+
+// Returns true if a glob matches every topic a topic filter matches. The
+// wildcards need to be swallowed whole by a `*`, so this can say no to
+// some filters it covers but never yes to one it doesn't.
+func globCovers(pattern, filter string) bool {
+	// `a/#` matches `a` as well.
+	if parent, ok := strings.CutSuffix(filter, "/#"); ok && !globCovers(pattern, parent) {
+		return false
+	}
+
+	tokens := filterTokens(filter)
+
+	// covers[px][nx] - pattern[px:] matches all of tokens[nx:].
+	covers := make([][]bool, len(pattern)+1)
+	for px := range covers {
+		covers[px] = make([]bool, len(tokens)+1)
+	}
+
+	covers[len(pattern)][len(tokens)] = true
+
+	for px := len(pattern) - 1; px >= 0; px-- {
+		for nx := len(tokens); nx >= 0; nx-- {
+			switch {
+			case pattern[px] == '*':
+				covers[px][nx] = covers[px+1][nx] ||
+					(nx < len(tokens) && covers[px][nx+1])
+
+			case nx == len(tokens) || tokens[nx] < 0:
+				covers[px][nx] = false
+
+			default:
+				covers[px][nx] = (pattern[px] == '?' || int(pattern[px]) == tokens[nx]) &&
+					covers[px+1][nx+1]
+			}
+		}
+	}
+
+	return covers[0][0]
+
+} // End of function  globCovers.
+
+// Returns true if a glob matches any of the topics a topic filter
+// matches.
+func globOverlaps(pattern, filter string) bool {
+	// `a/#` matches `a` as well.
+	if parent, ok := strings.CutSuffix(filter, "/#"); ok && globOverlaps(pattern, parent) {
+		return true
+	}
+
+	tokens := filterTokens(filter)
+
+	// overlaps[px][nx] - some topic matches both pattern[px:] and
+	// tokens[nx:].
+	overlaps := make([][]bool, len(pattern)+1)
+	for px := range overlaps {
+		overlaps[px] = make([]bool, len(tokens)+1)
+	}
+
+	for px := len(pattern); px >= 0; px-- {
+		for nx := len(tokens); nx >= 0; nx-- {
+			switch {
+			case nx == len(tokens):
+				overlaps[px][nx] = px == len(pattern) ||
+					(pattern[px] == '*' && overlaps[px+1][nx])
+
+			case tokens[nx] == filterRest:
+				overlaps[px][nx] = true
+
+			case px == len(pattern):
+				overlaps[px][nx] = tokens[nx] == filterLevel && overlaps[px][nx+1]
+
+			case pattern[px] == '*':
+				// Either one ends first.
+				overlaps[px][nx] = overlaps[px+1][nx] || overlaps[px][nx+1]
+
+			case tokens[nx] == filterLevel:
+				// `+` ends here or takes the character - anything but
+				// the level separator.
+				overlaps[px][nx] = overlaps[px][nx+1] ||
+					(pattern[px] != '/' && overlaps[px+1][nx])
+
+			default:
+				overlaps[px][nx] = (pattern[px] == '?' || int(pattern[px]) == tokens[nx]) &&
+					overlaps[px+1][nx+1]
+			}
+		}
+	}
+
+	return overlaps[0][0]
+
+} // End of function  globOverlaps.
+
+// Parse policy rules - one `<allow|deny> <action> <identity> <target>`
+// rule or `default <allow|deny>` directive per line, blank lines and #
+// comments ignored. Returns the rules and the default effect.
+func ParsePolicy(reader io.Reader, name string) ([]PolicyRule, bool, error) {
+	rules := []PolicyRule{}
+	allow := false
+
+	scanner := bufio.NewScanner(reader)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		effect := strings.ToLower(fields[0])
+
+		if effect == POLICY_DEFAULT {
+			if len(fields) != 2 || !isEffect(fields[1]) {
+				return nil, false, fmt.Errorf("%w: %v:%v: expected default <allow|deny>",
+					ErrInvalidPolicy, name, n)
+			}
+
+			allow = strings.ToLower(fields[1]) == POLICY_ALLOW
+			continue
+		}
+
+		if len(fields) != 4 || !isEffect(effect) {
+			return nil, false, fmt.Errorf("%w: %v:%v: expected <allow|deny> <action> <identity> <target>",
+				ErrInvalidPolicy, name, n)
+		}
+
+		action := strings.ToLower(fields[1])
+		if action != ACTION_SUBSCRIBE && action != ACTION_SEND && action != ACTION_ANY {
+			return nil, false, fmt.Errorf("%w: %v:%v: unknown action %q",
+				ErrInvalidPolicy, name, n, fields[1])
+		}
+
+		rules = append(rules, PolicyRule{
+			Allow:    effect == POLICY_ALLOW,
+			Action:   action,
+			Identity: fields[2],
+			Target:   fields[3],
+			Line:     n,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return rules, allow, nil
+
+} // End of function  ParsePolicy.
+
+// Returns true for a rule effect.
+func isEffect(effect string) bool {
+	effect = strings.ToLower(effect)
+	return effect == POLICY_ALLOW || effect == POLICY_DENY
+
+} // End of function  isEffect.
+
+// Returns true if the rule matches an action on a target by an identity.
+// Subscription filters with wildcards stand for all the topics they
+// match - deny rules match if any of them is a target, allow rules only
+// if all of them are.
+func (r PolicyRule) Matches(identity, action, target string) bool {
+	if (r.Action != ACTION_ANY && r.Action != action) || !globMatch(r.Identity, identity) {
+		return false
+	}
+
+	switch {
+	case action != ACTION_SUBSCRIBE:
+		return globMatch(r.Target, target)
+
+	case r.Allow:
+		return globCovers(r.Target, target)
+	}
+
+	return globOverlaps(r.Target, target)
+
+} //  End of  PolicyRule.Matches
+
+// Returns a new policy for the rules in a policy file, checked for
+// changes at most every `interval` - zero turns reloading off.
+func NewPolicy(path string, interval time.Duration) (*Policy, error) {
+	p := &Policy{path: path, interval: interval}
+	if err := p.Load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+
+} // End of function  NewPolicy.
+
+// Returns the policy for the service config - nil if there's no policy
+// file.
+func configPolicy(cfg *config.Config) (*Policy, error) {
+	settings := cfg.Service
+	if len(settings.PolicyFile) == 0 {
+		return nil, nil
+	}
+
+	return NewPolicy(settings.PolicyFile, settings.PolicyReload)
+
+} // End of function  configPolicy.
+
+// Returns the state of the policy file - the zero stamp if it's missing.
+func (p *Policy) stat() ptls.FileStamp {
+	stamp, _ := ptls.StatFile(p.path)
+	return stamp
+
+} //  End of  Policy.stat
+
+// (Re)load the rules from the policy file.
+func (p *Policy) Load() error {
+	stamp := p.stat()
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	rules, allow, err := ParsePolicy(f, p.path)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.rules = rules
+	p.allow = allow
+	p.stamp = stamp
+	p.checked = time.Now()
+	p.mutex.Unlock()
+
+	slog.Info("loaded access policy", "file", p.path, "rules", len(rules),
+		"default", effectName(allow))
+
+	return nil
+
+} //  End of  Policy.Load
+
+// Check the policy file and reload it if it changed. Returns true if the
+// rules were reloaded.
+func (p *Policy) Check() (bool, error) {
+	p.mutex.Lock()
+	p.checked = time.Now()
+	unchanged := p.stat() == p.stamp
+	p.mutex.Unlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	if err := p.Load(); err != nil {
+		// Keep the current rules - and retry on the next check, the
+		// file could be half way through being written.
+		slog.Error("reloading access policy", "file", p.path, "error", err)
+		return false, err
+	}
+
+	return true, nil
+
+} //  End of  Policy.Check
+
+// Check the policy file if the reload interval has passed.
+func (p *Policy) refresh() {
+	if p.interval <= 0 {
+		return
+	}
+
+	p.mutex.RLock()
+	due := time.Since(p.checked) >= p.interval
+	p.mutex.RUnlock()
+
+	if due {
+		p.Check()
+	}
+
+} //  End of  Policy.refresh
+
+// Returns true if the policy allows an action on a target by an identity
+// and the rule that decided (nil for the default).
+func (p *Policy) Allowed(identity, action, target string) (bool, *PolicyRule) {
+	p.refresh()
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for idx := range p.rules {
+		if rule := p.rules[idx]; rule.Matches(identity, action, target) {
+			return rule.Allow, &rule
+		}
+	}
+
+	return p.allow, nil
+
+} //  End of  Policy.Allowed
+
+// Returns the name of a rule effect.
+func effectName(allow bool) string {
+	if allow {
+		return POLICY_ALLOW
+	}
+
+	return POLICY_DENY
+
+} // End of function  effectName.
+
+// Use an access policy for subscriptions and records. A nil policy turns
+// access control off.
+func (s *Service) UsePolicy(policy *Policy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.policy = policy
+
+} //  End of  Service.UsePolicy
+
+// Returns the access policy or nil if there's no access control.
+func (s *Service) Policy() *Policy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.policy
+
+} //  End of  Service.Policy
+
+// Returns the authenticated identity of a communique - the principal the
+// credentials were issued to (or the verified member device) or the
+// device the peer certificate is bound to. Empty if neither vouches for
+// the sender, anyone can claim to be any device in the envelope.
+func (s *Service) authenticatedIdentity(ctx context.Context, communique *pb.Communique) string {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		return principal.Name
+	}
+
+	device := communique.GetEnvelope().GetOrigin().GetProducer().GetName()
+	if s.boundPeer(ctx, device) {
+		return device
+	}
+
+	return ""
+
+} //  End of  Service.authenticatedIdentity
+
+// Returns the policy action and target of a communique - the topic for
+// subscriptions and the (record) kind otherwise.
+func policyTarget(note *pb.Note) (string, string) {
+	switch kind := NoteKind(note); kind {
+	case KIND_SUBSCRIPTION:
+		return ACTION_SUBSCRIBE, note.GetSubscription().GetTopic()
+
+	case KIND_RECORD:
+		return ACTION_SEND, RecordKind(note.GetRecord())
+
+	default:
+		return ACTION_SEND, kind
+	}
+
+} // End of function  policyTarget.
+
+// Authorize a (verified) communique against the access policy - anyone
+// unauthenticated is denied. Registrations are left to the registrar.
+func (s *Service) authorize(ctx context.Context, communique *pb.Communique) error {
+	policy := s.Policy()
+	if policy == nil || RecordKind(communique.GetNote().GetRecord()) == KIND_REGISTRATION {
+		return nil
+	}
+
+	identity := s.authenticatedIdentity(ctx, communique)
+	action, target := policyTarget(communique.GetNote())
+
+	if len(identity) == 0 {
+		slog.Warn("access denied", "device",
+			communique.GetEnvelope().GetOrigin().GetProducer().GetName(),
+			"action", action, "target", target, "error", ErrNoIdentity)
+		return status.Errorf(codes.PermissionDenied, "%v: %v", ErrPolicyDenied,
+			ErrNoIdentity)
+	}
+
+	allowed, rule := policy.Allowed(identity, action, target)
+	if allowed {
+		return nil
+	}
+
+	line := 0
+	if rule != nil {
+		line = rule.Line
+	}
+
+	slog.Warn("access denied", "identity", identity, "action", action,
+		"target", target, "rule", line)
+
+	return status.Errorf(codes.PermissionDenied, "%v: %v %q", ErrPolicyDenied,
+		action, target)
+
+} //  End of  Service.authorize
@@ -0,0 +1,520 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Access policy for the tests.
+const TEST_POLICY = `
+# Test access policy.
+default deny
+
+deny   send       test-device  incident
+allow  subscribe  test-*       news/*
+allow  send       test-*       metrics
+ALLOW  *          ali-baba     *
+allow  send       *            ack
+`
+
+// Test globMatch function.
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matches bool
+	}{
+		{pattern: "*", name: "", matches: true},
+		{pattern: "*", name: "news/sports/#", matches: true},
+		{pattern: "news/*", name: "news/sports", matches: true},
+		{pattern: "news/*", name: "news/sports/today", matches: true},
+		{pattern: "news/*", name: "news"},
+		{pattern: "news/*/today", name: "news/sports/today", matches: true},
+		{pattern: "news/*/today", name: "news/sports/tomorrow"},
+		{pattern: "test-?", name: "test-1", matches: true},
+		{pattern: "test-?", name: "test-10"},
+		{pattern: "*-device", name: "test-device", matches: true},
+		{pattern: "*e*e*", name: "test-device", matches: true},
+		{pattern: "metrics", name: "metrics", matches: true},
+		{pattern: "metrics", name: "metric"},
+		{pattern: "", name: "", matches: true},
+		{pattern: "", name: "news"},
+	}
+
+	for idx, step := range tests {
+		if matches := globMatch(step.pattern, step.name); matches != step.matches {
+			t.Errorf("test %v expected %v for %q %q, got %v", idx, step.matches,
+				step.pattern, step.name, matches)
+		}
+	}
+
+} //  End of  TestGlobMatch
+
+// Test globCovers and globOverlaps functions.
+func TestGlobFilters(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		filter   string
+		covers   bool
+		overlaps bool
+	}{
+		{pattern: "*", filter: "#", covers: true, overlaps: true},
+		{pattern: "*", filter: "tasks/+/x", covers: true, overlaps: true},
+		{pattern: "news/*", filter: "news/sports", covers: true, overlaps: true},
+		{pattern: "news/*", filter: "news/+", covers: true, overlaps: true},
+		{pattern: "news/*", filter: "news/+/today", covers: true, overlaps: true},
+		{pattern: "news/*", filter: "news/sports/#", covers: true, overlaps: true},
+		{pattern: "news/*", filter: "news/#", overlaps: true},
+		{pattern: "news/*", filter: "#", overlaps: true},
+		{pattern: "news/*", filter: "+/sports", overlaps: true},
+		{pattern: "news/*", filter: "gossip/#"},
+		{pattern: "news/*", filter: "+"},
+		{pattern: "news/s?orts", filter: "news/+", overlaps: true},
+		{pattern: "news/*/today", filter: "news/+/today", covers: true, overlaps: true},
+		{pattern: "news/*/today", filter: "news/+/tomorrow"},
+		{pattern: "tasks/secret/*", filter: "tasks/+/x", overlaps: true},
+		{pattern: "tasks/secret/*", filter: "tasks/+"},
+		{pattern: "tasks/secret/*", filter: "tasks/#", overlaps: true},
+		{pattern: "tasks", filter: "tasks/#", overlaps: true},
+		{pattern: "tasks/*", filter: "tasks/#", overlaps: true},
+	}
+
+	for idx, step := range tests {
+		if covers := globCovers(step.pattern, step.filter); covers != step.covers {
+			t.Errorf("test %v expected covers %v for %q %q, got %v", idx, step.covers,
+				step.pattern, step.filter, covers)
+		}
+
+		if overlaps := globOverlaps(step.pattern, step.filter); overlaps != step.overlaps {
+			t.Errorf("test %v expected overlaps %v for %q %q, got %v", idx, step.overlaps,
+				step.pattern, step.filter, overlaps)
+		}
+
+		// Plain topics are globbed as is.
+		if !strings.ContainsAny(step.filter, "+#") {
+			matches := globMatch(step.pattern, step.filter)
+			if matches != step.covers || matches != step.overlaps {
+				t.Errorf("test %v expected %v for topic %q %q", idx, matches,
+					step.pattern, step.filter)
+			}
+		}
+	}
+
+} //  End of  TestGlobFilters
+
+// Test ParsePolicy function.
+func TestParsePolicy(t *testing.T) {
+	rules, allow, err := ParsePolicy(strings.NewReader(TEST_POLICY), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if allow || len(rules) != 5 {
+		t.Errorf("unexpected policy %v %v", allow, rules)
+	}
+
+	if rules[0].Allow || rules[0].Line != 5 || !rules[3].Allow || rules[3].Action != ACTION_ANY {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	tests := []struct {
+		policy string
+		allow  bool
+		fails  bool
+	}{
+		{policy: ""},
+		{policy: "default allow", allow: true},
+		{policy: "default maybe", fails: true},
+		{policy: "default", fails: true},
+		{policy: "allow send test-device", fails: true},
+		{policy: "permit send test-device metrics", fails: true},
+		{policy: "allow publish test-device metrics", fails: true},
+	}
+
+	for idx, step := range tests {
+		_, allow, err := ParsePolicy(strings.NewReader(step.policy), "test")
+		if step.fails {
+			if !errors.Is(err, ErrInvalidPolicy) {
+				t.Errorf("test %v expected invalid policy, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil || allow != step.allow {
+			t.Errorf("test %v expected %v, got %v %v", idx, step.allow, allow, err)
+		}
+	}
+
+} //  End of  TestParsePolicy
+
+// Test Policy functions.
+func TestPolicy(t *testing.T) {
+	zpath := filepath.Join(t.TempDir(), "policy")
+	os.WriteFile(zpath, []byte(TEST_POLICY), 0o600)
+
+	if _, err := NewPolicy(zpath+".404", 0); err == nil {
+		t.Errorf("expected an error for a missing policy file")
+	}
+
+	policy, err := NewPolicy(zpath, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		identity string
+		action   string
+		target   string
+		allowed  bool
+		line     int
+	}{
+		{identity: "test-device", action: ACTION_SEND, target: KIND_METRICS, allowed: true, line: 7},
+		{identity: "test-device", action: ACTION_SEND, target: KIND_INCIDENT, line: 5},
+		{identity: "test-other", action: ACTION_SEND, target: KIND_INCIDENT},
+		{identity: "test-device", action: ACTION_SUBSCRIBE, target: "news/sports", allowed: true, line: 6},
+		{identity: "test-device", action: ACTION_SUBSCRIBE, target: "gossip"},
+		{identity: "test-device", action: ACTION_SUBSCRIBE, target: KIND_METRICS},
+		{identity: "ali-baba", action: ACTION_SUBSCRIBE, target: "gossip", allowed: true, line: 8},
+		{identity: "other", action: ACTION_SEND, target: KIND_ACK, allowed: true, line: 9},
+	}
+
+	for idx, step := range tests {
+		allowed, rule := policy.Allowed(step.identity, step.action, step.target)
+		line := 0
+		if rule != nil {
+			line = rule.Line
+		}
+
+		if allowed != step.allowed || line != step.line {
+			t.Errorf("test %v expected %v at %v, got %v at %v", idx, step.allowed,
+				step.line, allowed, line)
+		}
+	}
+
+	// Subscription wildcards can't get around the deny rules.
+	os.WriteFile(zpath, []byte("deny subscribe * tasks/secret/*\nallow subscribe * *\n"), 0o600)
+	if _, err := policy.Check(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	filters := []struct {
+		filter  string
+		allowed bool
+	}{
+		{filter: "tasks/secret/x"},
+		{filter: "tasks/+/x"},
+		{filter: "tasks/#"},
+		{filter: "#"},
+		{filter: "+/secret/+"},
+		{filter: "tasks/public/x", allowed: true},
+		{filter: "tasks/+", allowed: true},
+		{filter: "news/#", allowed: true},
+	}
+
+	for idx, step := range filters {
+		if allowed, _ := policy.Allowed("test-device", ACTION_SUBSCRIBE, step.filter); allowed != step.allowed {
+			t.Errorf("filter %v expected %v for %q, got %v", idx, step.allowed,
+				step.filter, allowed)
+		}
+	}
+
+	// Allow rules need to cover the whole filter.
+	os.WriteFile(zpath, []byte("allow subscribe * news/*\n"), 0o600)
+	if _, err := policy.Check(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if allowed, _ := policy.Allowed("test-device", ACTION_SUBSCRIBE, "news/+"); !allowed {
+		t.Errorf("expected news/+ to be allowed")
+	}
+
+	if allowed, _ := policy.Allowed("test-device", ACTION_SUBSCRIBE, "#"); allowed {
+		t.Errorf("expected # to be denied")
+	}
+
+	// Changes are picked up.
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(zpath, []byte("default allow\ndeny send * metrics\n"), 0o600)
+	time.Sleep(10 * time.Millisecond)
+
+	if allowed, _ := policy.Allowed("test-device", ACTION_SEND, KIND_METRICS); allowed {
+		t.Errorf("expected the reloaded policy to deny metrics")
+	}
+
+	if allowed, _ := policy.Allowed("test-device", ACTION_SEND, KIND_INCIDENT); !allowed {
+		t.Errorf("expected the reloaded policy to allow incidents")
+	}
+
+	// Broken policies keep the current rules.
+	os.WriteFile(zpath, []byte("allow everything\n"), 0o600)
+	if _, err := policy.Check(); !errors.Is(err, ErrInvalidPolicy) {
+		t.Errorf("expected invalid policy, got %v", err)
+	}
+
+	if allowed, _ := policy.Allowed("test-device", ACTION_SEND, KIND_INCIDENT); !allowed {
+		t.Errorf("expected the current rules to be kept")
+	}
+
+} //  End of  TestPolicy
+
+// Test the service access control.
+func TestPolicyEnforcement(t *testing.T) {
+	dir := t.TempDir()
+	zpath := filepath.Join(dir, "policy")
+	os.WriteFile(zpath, []byte(TEST_POLICY), 0o600)
+
+	cfg := testConfig(t)
+	cfg.Service.PolicyFile = filepath.Join(dir, "404")
+	if _, err := NewService(cfg); err == nil {
+		t.Errorf("expected an error for a missing policy file")
+	}
+
+	cfg.Service.PolicyFile = zpath
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if svc.Policy() == nil {
+		t.Fatalf("expected an access policy")
+	}
+
+	client := startService(t, svc)
+	ctx := context.Background()
+
+	metrics := recordNote(&pb.Record{Kind: &pb.Record_Metrics{}})
+	incident := recordNote(&pb.Record{Kind: &pb.Record_Incident{}})
+	registration := recordNote(&pb.Record{
+		Kind: &pb.Record_Registration{
+			Registration: &pb.Registration{Device: "test-device"},
+		},
+	})
+
+	// Claiming to be a device in the envelope is not an identity.
+	_, err = client.DispatchUnary(ctx, testCommunique(metrics))
+	if code := status.Code(err); code != codes.PermissionDenied || !strings.Contains(err.Error(), ErrNoIdentity.Error()) {
+		t.Errorf("expected PermissionDenied without an identity, got %v", err)
+	}
+
+	// The authenticated principal is the identity.
+	svc.UseAuthenticator(AuthenticatorFunc(func(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+		return &Principal{Name: credentials.GetToken()}, nil
+	}))
+
+	tests := []struct {
+		note *pb.Note
+		code codes.Code
+	}{
+		{note: metrics, code: codes.OK},
+		{note: incident, code: codes.PermissionDenied},
+		{note: registration, code: codes.OK},
+		{note: &pb.Note{Kind: &pb.Note_Empty{Empty: &pb.Empty{}}}, code: codes.PermissionDenied},
+	}
+
+	for idx, step := range tests {
+		_, err := client.DispatchUnary(ctx, credentialsCommunique("test-device", step.note))
+		if code := status.Code(err); code != step.code {
+			t.Errorf("test %v expected %v, got %v", idx, step.code, err)
+		}
+	}
+
+	// Subscriptions.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	subscribe := func(topic string) grpc.ServerStreamingClient[pb.Response] {
+		communique := credentialsCommunique("test-device", &pb.Note{
+			Kind: &pb.Note_Subscription{
+				Subscription: &pb.Subscription{Topic: topic},
+			},
+		})
+
+		stream, err := client.Subscribe(ctx, communique)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return stream
+	}
+
+	subscribe("news/sports")
+	waitForSubscribers(t, svc.broker, 1)
+
+	stream := subscribe("gossip")
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied subscription, got %v", err)
+	}
+
+	communique := credentialsCommunique("ali-baba", incident)
+	communique.Envelope.Origin.Producer.Name = "ali-baba"
+
+	if _, err := client.DispatchUnary(ctx, communique); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.DispatchUnary(ctx, credentialsCommunique("test-device", incident))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	// No policy, no access control.
+	svc.UsePolicy(nil)
+	if _, err := client.DispatchUnary(ctx, credentialsCommunique("test-device", incident)); err != nil {
+		t.Errorf("unexpected error without a policy: %v", err)
+	}
+
+} //  End of  TestPolicyEnforcement
+
+// Test the peer certificate identity for the access policy.
+func TestPolicyPeerIdentity(t *testing.T) {
+	dir := t.TempDir()
+	zpath := filepath.Join(dir, "policy")
+	os.WriteFile(zpath, []byte(TEST_POLICY), 0o600)
+
+	serviceCA := newTestAuthority(t, dir, "service")
+	deviceCA := newTestAuthority(t, dir, "device")
+
+	cfg := testConfig(t)
+	cfg.Settings.Cert, cfg.Settings.Key = serviceCA.issue(t, dir, "test-station",
+		x509.ExtKeyUsageServerAuth)
+	cfg.Service.CACertPatterns.Device = filepath.Join(dir, "device-ca-cert.pem")
+	cfg.Service.PolicyFile = zpath
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dialer := startServiceListener(t, svc)
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Name = "test-device"
+	devcfg.Settings.Cert, devcfg.Settings.Key = deviceCA.issue(t, dir, "test-device",
+		x509.ExtKeyUsageClientAuth)
+	devcfg.Device.ServiceAddress = "127.0.0.1"
+	devcfg.Device.ServiceCACert = serviceCA.certPath
+
+	client, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Not bound to the certificate - no identity.
+	if _, err := client.SendMetrics(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied without an identity, got %v", err)
+	}
+
+	// Bound to the certificate - the device is the identity.
+	extractor, _ := NewIdentityExtractor(IDENTITY_CN, "")
+	svc.UseIdentityExtractor(extractor)
+
+	if _, err := client.SendMetrics(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.SendIncident(ctx, pb.Level_LEVEL_ERROR, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied incident, got %v", err)
+	}
+
+} //  End of  TestPolicyPeerIdentity
+
+// Test the verified member device is the identity for the access policy.
+func TestPolicyMemberIdentity(t *testing.T) {
+	zpath := filepath.Join(t.TempDir(), "policy")
+	os.WriteFile(zpath, []byte(TEST_POLICY), 0o600)
+
+	cfg := testConfig(t)
+	cfg.Service.PolicyFile = zpath
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.UseRegistrar(NewTokenRegistrar("let me inside"))
+	dialer := startServiceListener(t, svc)
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Name = "test-device"
+	devcfg.Device.ServiceAddress = "127.0.0.1"
+	devcfg.Device.Token = "let me inside"
+
+	client, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	ctx := context.Background()
+	if _, err := client.Join(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Registrar members.
+	if _, err := client.SendMetrics(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.SendIncident(ctx, pb.Level_LEVEL_ERROR, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied incident, got %v", err)
+	}
+
+	// Signed membership tokens.
+	svc.UseTokenIssuer(testTokenIssuer(t, time.Hour, token.Scopes{}))
+
+	client, err = device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	if _, err := client.Join(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := client.SendMetrics(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- client.Subscribe(subCtx, "news/sports") }()
+
+	waitForSubscribers(t, svc.broker, 1)
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled subscription, got %v", err)
+	}
+
+	if err := client.Subscribe(ctx, "gossip"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied subscription, got %v", err)
+	}
+
+} //  End of  TestPolicyMemberIdentity
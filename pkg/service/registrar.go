@@ -0,0 +1,260 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Size (in bytes) of the random membership tokens.
+	MEMBERSHIP_TOKEN_SIZE = 32
+)
+
+var (
+	// Registration was denied.
+	ErrRegistrationDenied = errors.New("registration denied")
+
+	// Credentials are not those of a member device.
+	ErrNotMember = errors.New("not a member")
+)
+
+// Registrar validates device registrations, issues the membership
+// permits and verifies the credentials member devices present.
+type Registrar interface {
+	// Validate a registration and return the membership permit.
+	Register(ctx context.Context, registration *pb.Registration) (*pb.Membership, error)
+
+	// Verify the credentials presented by a device.
+	Verify(ctx context.Context, device string, credentials *pb.Credentials) error
+}
+
+// Token registrar accepts registrations with one of a set of (shared)
+// registration tokens and issues random membership tokens, remembered in
+// memory.
+type TokenRegistrar struct {
+	mutex   sync.RWMutex
+	tokens  [][]byte
+	members map[string][]byte
+}
+
+// Returns a new token registrar accepting the registration tokens.
+func NewTokenRegistrar(tokens ...string) *TokenRegistrar {
+	r := &TokenRegistrar{members: make(map[string][]byte)}
+	for _, token := range tokens {
+		if len(token) > 0 {
+			r.tokens = append(r.tokens, []byte(token))
+		}
+	}
+
+	return r
+
+} // End of function  NewTokenRegistrar.
+
+// Returns true if two tokens match - in constant time.
+func sameToken(a, b []byte) bool {
+	return len(a) > 0 && subtle.ConstantTimeCompare(a, b) == 1
+
+} // End of function  sameToken.
+
+// Validate a registration token and issue a new membership permit.
+// Registering again replaces the previous permit.
+func (r *TokenRegistrar) Register(ctx context.Context, registration *pb.Registration) (*pb.Membership, error) {
+	device := registration.GetDevice()
+	if len(device) == 0 {
+		return nil, fmt.Errorf("%w: missing device", ErrRegistrationDenied)
+	}
+
+	token := []byte(registration.GetToken())
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	valid := false
+	for _, t := range r.tokens {
+		if sameToken(t, token) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return nil, fmt.Errorf("%w: invalid token for %q",
+			ErrRegistrationDenied, device)
+	}
+
+	secret := make([]byte, MEMBERSHIP_TOKEN_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	permit := hex.EncodeToString(secret)
+	r.members[device] = []byte(permit)
+
+	return &pb.Membership{Device: device, Token: permit}, nil
+
+} //  End of  TokenRegistrar.Register
+
+// Verify the membership token presented by a device.
+func (r *TokenRegistrar) Verify(ctx context.Context, device string, credentials *pb.Credentials) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	permit, ok := r.members[device]
+	if !ok || !sameToken(permit, []byte(credentials.GetToken())) {
+		return fmt.Errorf("%w: %q", ErrNotMember, device)
+	}
+
+	return nil
+
+} //  End of  TokenRegistrar.Verify
+
+// Revoke the membership of a device.
+func (r *TokenRegistrar) Revoke(device string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.members, device)
+
+} //  End of  TokenRegistrar.Revoke
+
+// Use a registrar for device registrations.
+// Registrations are answered with a membership permit and all the other
+// communiques need to carry the credentials of a member device. A nil
+// registrar turns the handshake off.
+func (s *Service) UseRegistrar(registrar Registrar) {
+	s.mutex.Lock()
+	s.registrar = registrar
+	s.mutex.Unlock()
+
+	s.handleRegistrations()
+
+} //  End of  Service.UseRegistrar
+
+// Register the registration handler if there's a registrar, an enroller
+// or a token issuer and remove it otherwise.
+func (s *Service) handleRegistrations() {
+	if s.Registrar() == nil && s.Enroller() == nil && s.TokenIssuer() == nil {
+		s.HandleRecord(KIND_REGISTRATION, nil)
+		return
+	}
+
+	s.HandleRecord(KIND_REGISTRATION, s.register)
+
+} //  End of  Service.handleRegistrations
+
+// Returns the registrar or nil if there's no registration handshake.
+func (s *Service) Registrar() Registrar {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.registrar
+
+} //  End of  Service.Registrar
+
+// Registration handler - answers with the membership permit, carrying
+// the signed token (with a token issuer) and the device certificate for
+// enrolling devices.
+func (s *Service) register(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	registration := communique.GetNote().GetRecord().GetRegistration()
+	membership := &pb.Membership{Device: registration.GetDevice()}
+	registered := false
+
+	if registrar := s.Registrar(); registrar != nil {
+		permit, err := registrar.Register(ctx, registration)
+		if err != nil {
+			slog.Warn("registration denied", "device", registration.GetDevice(),
+				"error", err)
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		membership = permit
+		registered = true
+		slog.Info("registered device", "device", membership.GetDevice())
+	}
+
+	if err := s.checkIdentity(ctx, membership.GetDevice()); err != nil {
+		return nil, err
+	}
+
+	if err := s.signMembership(ctx, membership, registered); err != nil {
+		return nil, err
+	}
+
+	if err := s.enroll(ctx, registration, membership, registered); err != nil {
+		return nil, err
+	}
+
+	publication := &pb.Publication{
+		Kind: &pb.Publication_Permit{Permit: membership},
+	}
+
+	return &pb.Answer{
+		Kind: &pb.Answer_Publication{Publication: publication},
+	}, nil
+
+} //  End of  Service.register
+
+// Verify the credentials of a communique - everything but registrations
+// needs to come from a member device once there's a registrar (or a
+// signed token within its scopes with a token issuer). Devices with a
+// bootstrap certificate can only register. Devices bound to their
+// certificates can only speak (and register) for themselves.
+// Returns the context with the verified device as the principal (unless
+// an authenticator already put one there).
+func (s *Service) verify(ctx context.Context, communique *pb.Communique) (context.Context, error) {
+	device := communique.GetEnvelope().GetOrigin().GetProducer().GetName()
+
+	record := communique.GetNote().GetRecord()
+	if RecordKind(record) == KIND_REGISTRATION {
+		return ctx, s.checkIdentity(ctx, device, record.GetRegistration().GetDevice())
+	}
+
+	if s.bootstrapPeer(ctx) {
+		slog.Warn("rejecting bootstrap communique", "device", device,
+			"kind", NoteKind(communique.GetNote()))
+		return ctx, status.Error(codes.PermissionDenied,
+			"bootstrap certificates can only register")
+	}
+
+	if err := s.checkIdentity(ctx, device); err != nil {
+		return ctx, err
+	}
+
+	var principal *Principal
+
+	if issuer := s.TokenIssuer(); issuer != nil {
+		claims, err := s.verifyToken(issuer, device, communique)
+		if err != nil {
+			return ctx, err
+		}
+
+		principal = &Principal{
+			Name:    claims.Device,
+			Scopes:  claims.Scopes,
+			Expires: claims.ExpiryTime(),
+		}
+	} else if registrar := s.Registrar(); registrar != nil {
+		if err := registrar.Verify(ctx, device, communique.GetCredentials()); err != nil {
+			slog.Warn("rejecting communique", "device", device, "error", err)
+			return ctx, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		principal = &Principal{Name: device}
+	}
+
+	if _, ok := PrincipalFromContext(ctx); ok || principal == nil {
+		return ctx, nil
+	}
+
+	return WithPrincipal(ctx, principal), nil
+
+} //  End of  Service.verify
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Test TokenRegistrar functions.
+func TestTokenRegistrar(t *testing.T) {
+	ctx := context.Background()
+	registrar := NewTokenRegistrar("let me inside", "")
+
+	tests := []struct {
+		registration *pb.Registration
+		valid        bool
+	}{
+		{registration: &pb.Registration{Device: "d1", Token: "let me inside"}, valid: true},
+		{registration: &pb.Registration{Device: "d1", Token: "let me in"}},
+		{registration: &pb.Registration{Device: "d1"}},
+		{registration: &pb.Registration{Token: "let me inside"}},
+	}
+
+	for idx, step := range tests {
+		membership, err := registrar.Register(ctx, step.registration)
+		if !step.valid {
+			if !errors.Is(err, ErrRegistrationDenied) {
+				t.Errorf("registration %v expected denial, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil || membership.GetDevice() != "d1" || len(membership.GetToken()) != 2*MEMBERSHIP_TOKEN_SIZE {
+			t.Errorf("registration %v unexpected %v %v", idx, membership, err)
+		}
+	}
+
+	first, _ := registrar.Register(ctx, tests[0].registration)
+	second, _ := registrar.Register(ctx, tests[0].registration)
+
+	if first.GetToken() == second.GetToken() {
+		t.Errorf("expected a new membership token on every registration")
+	}
+
+	verify := func(device, token string) error {
+		return registrar.Verify(ctx, device, &pb.Credentials{Token: token})
+	}
+
+	if err := verify("d1", second.GetToken()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := verify("d1", first.GetToken()); !errors.Is(err, ErrNotMember) {
+		t.Errorf("expected replaced permit to be rejected, got %v", err)
+	}
+
+	if err := verify("d2", second.GetToken()); !errors.Is(err, ErrNotMember) {
+		t.Errorf("expected other device to be rejected, got %v", err)
+	}
+
+	registrar.Revoke("d1")
+	if err := verify("d1", second.GetToken()); !errors.Is(err, ErrNotMember) {
+		t.Errorf("expected revoked permit to be rejected, got %v", err)
+	}
+
+} //  End of  TestTokenRegistrar
+
+// Test the registration handshake between a device and the service.
+func TestRegistrationHandshake(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.UseRegistrar(NewTokenRegistrar("let me inside"))
+	dialer := startServiceListener(t, svc)
+
+	cfg := testConfig(t)
+	cfg.Settings.Name = "test-device"
+	cfg.Device.ServiceAddress = "127.0.0.1"
+	cfg.Device.Token = "let me inside"
+	cfg.Device.MembershipFile = filepath.Join(t.TempDir(), "membership")
+
+	client, err := device.NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.Membership().GetDevice() != "test-device" {
+		t.Fatalf("expected a membership permit, got %v", client.Membership())
+	}
+
+	if _, err := client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Non-members are turned away.
+	cfg.Settings.Name = "other-device"
+	cfg.Device.MembershipFile = ""
+
+	other, err := device.NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer other.Close()
+
+	_, err = other.SendIncident(ctx, pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+	// Rejected subscriptions renew the membership and get in.
+	subCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- other.Subscribe(subCtx, "news") }()
+
+	waitForSubscribers(t, svc.broker, 1)
+	if other.Membership().GetDevice() != "other-device" {
+		t.Errorf("expected a renewed membership permit, got %v", other.Membership())
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled subscription, got %v", err)
+	}
+
+	cfg.Device.Token = "let me in"
+	denied, err := device.NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer denied.Close()
+
+	if _, err := denied.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	if err := denied.Subscribe(ctx, "news"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied subscription, got %v", err)
+	}
+
+	svc.UseRegistrar(nil)
+	if _, err := other.SendIncident(ctx, pb.Level_LEVEL_INFO, nil); err != nil {
+		t.Errorf("expected no handshake without a registrar, got %v", err)
+	}
+
+} //  End of  TestRegistrationHandshake
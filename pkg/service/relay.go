@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Relay forwards communiques to an upstream service (tower mode).
+// The upstream connection is a device-style client using the device
+// settings ala SERVICE_ADDRESS, SERVICE_PORT and SERVICE_CACERT.
+type Relay struct {
+	client  *device.Client
+	address *pb.Address
+}
+
+// Returns a new relay that stamps communiques with the local address.
+func NewRelay(cfg *config.Config, address *pb.Address, opts ...grpc.DialOption) (*Relay, error) {
+	return NewRelayWithPassphrase(cfg, address, ptls.ConfigPassphrase(cfg), opts...)
+
+} // End of function  NewRelay.
+
+// Returns a new relay that stamps communiques with the local address, with
+// an encrypted private key decrypted with the passphrase source.
+func NewRelayWithPassphrase(cfg *config.Config, address *pb.Address,
+	passphrase ptls.PassphraseFunc, opts ...grpc.DialOption) (*Relay, error) {
+
+	client, err := device.NewClientWithPassphrase(cfg, passphrase, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Relay{client: client, address: address}, nil
+
+} // End of function  NewRelayWithPassphrase.
+
+// Returns the upstream client.
+func (r *Relay) Client() *device.Client {
+	return r.client
+
+} //  End of  Relay.Client
+
+// Returns a copy of the communique with the local address added to the
+// routing hops.
+func (r *Relay) stamp(communique *pb.Communique) *pb.Communique {
+	relayed := proto.Clone(communique).(*pb.Communique)
+
+	if relayed.Envelope == nil {
+		relayed.Envelope = &pb.Envelope{}
+	}
+
+	if relayed.Envelope.Routing == nil {
+		relayed.Envelope.Routing = &pb.Route{}
+	}
+
+	routing := relayed.Envelope.Routing
+	routing.Hops = append(routing.Hops, r.address)
+
+	return relayed
+
+} //  End of  Relay.stamp
+
+// Forward a communique upstream and return the upstream answer.
+// If upstream is unreachable the communique is queued for retry by the
+// upstream client and we ack it locally - the tower takes it from here.
+func (r *Relay) Forward(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	resp, err := r.client.Dispatch(ctx, r.stamp(communique))
+	if errors.Is(err, device.ErrQueued) {
+		slog.Warn("upstream unavailable, queued for relay",
+			"upstream", r.client.Target(),
+			"tag", util.TagString(communique.GetEnvelope().GetPostmark().GetTag()))
+		return Acknowledge(communique, []byte("queued for relay")), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.GetAnswer(), nil
+
+} //  End of  Relay.Forward
+
+// Handler that forwards communiques upstream.
+func (r *Relay) Handler(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	return r.Forward(ctx, communique)
+
+} //  End of  Relay.Handler
+
+// Subscribe upstream and relay every answer back down via `send` until
+// either stream ends.
+func (r *Relay) Subscribe(ctx context.Context, communique *pb.Communique, send func(*pb.Answer) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := r.client.SubscribeStream(ctx, r.stamp(communique))
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := send(resp.GetAnswer()); err != nil {
+			return err
+		}
+	}
+
+} //  End of  Relay.Subscribe
+
+// Close the upstream connection.
+func (r *Relay) Close() error {
+	return r.client.Close()
+
+} //  End of  Relay.Close
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Returns a tower service relaying to an upstream station service.
+// The handler records the communiques the station receives.
+func startTower(t *testing.T) (pb.TelegraphServiceClient, *Service, func() []*pb.Communique) {
+	var mutex sync.Mutex
+	received := []*pb.Communique{}
+
+	station, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	station.HandleRecord(KIND_INCIDENT, func(ctx context.Context, c *pb.Communique) (*pb.Answer, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		received = append(received, proto.Clone(c).(*pb.Communique))
+		generic := &pb.Generic{Name: "station"}
+		return &pb.Answer{Kind: &pb.Answer_Generic{Generic: generic}}, nil
+	})
+
+	station.HandleSubscribe(func(c *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+		hops := len(c.GetEnvelope().GetRouting().GetHops())
+		for _, name := range []string{"one", "two"} {
+			generic := &pb.Generic{Name: name, Data: []byte{byte(hops)}}
+			publication := &pb.Publication{
+				Kind: &pb.Publication_Generic{Generic: generic},
+			}
+
+			answer := &pb.Answer{
+				Kind: &pb.Answer_Publication{Publication: publication},
+			}
+
+			if err := stream.Send(station.respond(c, answer)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	dialer := startServiceListener(t, station)
+
+	cfg := testConfig(t)
+	cfg.Settings.Name = "test-tower"
+	cfg.Service.Kind = "tower"
+	cfg.Service.BindAddress = "tower.local"
+	cfg.Device.ServiceAddress = "127.0.0.1"
+	cfg.Timeouts.Connect = 2 * time.Second
+
+	tower, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tower.Relay() == nil {
+		t.Fatalf("expected tower to have a relay")
+	}
+
+	relay, err := NewRelay(cfg, tower.Address(), dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tower.UseRelay(relay)
+
+	communiques := func() []*pb.Communique {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return append([]*pb.Communique{}, received...)
+	}
+
+	return startService(t, tower), tower, communiques
+
+} //  End of  startTower
+
+// Test relaying communiques upstream.
+func TestRelayDispatch(t *testing.T) {
+	client, tower, received := startTower(t)
+
+	incident := recordNote(&pb.Record{
+		Kind: &pb.Record_Incident{Incident: &pb.Incident{}},
+	})
+
+	communique := testCommunique(incident)
+	resp, err := client.Dispatch(context.Background(), communique)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if name := resp.GetAnswer().GetGeneric().GetName(); name != "station" {
+		t.Errorf("expected the station answer, got %v", resp.GetAnswer())
+	}
+
+	if name := resp.GetEnvelope().GetOrigin().GetProducer().GetName(); name != "test-tower" {
+		t.Errorf("expected response from the tower, got %v", name)
+	}
+
+	relayed := received()
+	if len(relayed) != 1 {
+		t.Fatalf("expected 1 relayed communique, got %v", len(relayed))
+	}
+
+	hops := relayed[0].GetEnvelope().GetRouting().GetHops()
+	if len(hops) != 1 || !proto.Equal(hops[0], tower.Address()) {
+		t.Errorf("expected tower hop, got %v", hops)
+	}
+
+	tag := communique.GetEnvelope().GetPostmark().GetTag()
+	if !util.SameTag(relayed[0].GetEnvelope().GetPostmark().GetTag(), tag) {
+		t.Errorf("expected relayed communique to keep the postmark tag")
+	}
+
+	if len(communique.GetEnvelope().GetRouting().GetHops()) != 0 {
+		t.Errorf("expected original communique to be left untouched")
+	}
+
+	// Local handlers take precedence over relaying.
+	tower.HandleRecord(KIND_INCIDENT, AckHandler)
+
+	resp, err = client.Dispatch(context.Background(), testCommunique(incident))
+	if err != nil || resp.GetAnswer().GetAck() == nil {
+		t.Errorf("expected local ack, got %v %v", resp, err)
+	}
+
+	tower.HandleDefault(nil)
+	if len(received()) != 1 {
+		t.Errorf("expected local handler to not relay")
+	}
+
+} //  End of  TestRelayDispatch
+
+// Test relaying subscriptions upstream.
+func TestRelaySubscribe(t *testing.T) {
+	client, _, _ := startTower(t)
+
+	subscription := &pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: "news"},
+		},
+	}
+
+	stream, err := client.Subscribe(context.Background(),
+		testCommunique(subscription))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := []string{}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		generic := resp.GetAnswer().GetPublication().GetGeneric()
+		if len(generic.GetData()) != 1 || generic.GetData()[0] != 1 {
+			t.Errorf("expected upstream to see 1 hop, got %v",
+				generic.GetData())
+		}
+
+		names = append(names, generic.GetName())
+	}
+
+	if len(names) != 2 || names[0] != "one" || names[1] != "two" {
+		t.Errorf("expected relayed publications, got %v", names)
+	}
+
+} //  End of  TestRelaySubscribe
+
+// Test relaying when upstream is down.
+func TestRelayUpstreamDown(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Device.ServiceAddress = "127.0.0.1"
+	cfg.Timeouts.Connect = 50 * time.Millisecond
+
+	down := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return nil, errors.New("upstream is down")
+	})
+
+	relay, err := NewRelay(cfg, localAddress(cfg), down)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer relay.Close()
+
+	communique := testCommunique(&pb.Note{Kind: &pb.Note_Empty{}})
+	answer, err := relay.Forward(context.Background(), communique)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(answer.GetAck().GetMsg()) != "queued for relay" {
+		t.Errorf("expected local queued ack, got %v", answer)
+	}
+
+	if relay.Client().Queue().Len() != 1 {
+		t.Errorf("expected communique queued upstream, got %v",
+			relay.Client().Queue().Len())
+	}
+
+	cfg.Device.RetryQueueSize = 0
+
+	full, err := NewRelay(cfg, localAddress(cfg), down)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := full.Forward(context.Background(), communique); err == nil {
+		t.Errorf("expected an error when nothing can be queued")
+	}
+
+} //  End of  TestRelayUpstreamDown
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/biota/go-grpc-telegraph/pkg/util"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Returns a printable form of an address for error messages and logs.
+func addressString(address *pb.Address) string {
+	switch address.GetKind().(type) {
+	case *pb.Address_Routeid:
+		return strconv.FormatUint(address.GetRouteid(), 10)
+
+	case *pb.Address_Hostport:
+		return address.GetHostport()
+	}
+
+	return address.String()
+
+} // End of function  addressString.
+
+// Check the routing hops of a communique against the routing policy.
+// A communique that has already been relayed via this service is looping
+// and one that has taken more than MAX_HOPS hops has likely been bounced
+// around by a misconfigured tower chain. Either way we reject it with a
+// FailedPrecondition status - the sender retrying won't fix it.
+func (s *Service) checkRoute(communique *pb.Communique) error {
+	hops := communique.GetEnvelope().GetRouting().GetHops()
+	tag := util.TagString(communique.GetEnvelope().GetPostmark().GetTag())
+
+	for idx, hop := range hops {
+		if proto.Equal(hop, s.address) {
+			slog.Warn("rejecting looping communique", "tag", tag,
+				"address", addressString(s.address), "hop", idx)
+
+			return status.Errorf(codes.FailedPrecondition,
+				"routing loop: communique already relayed via %v (hop %v of %v)",
+				addressString(s.address), idx+1, len(hops))
+		}
+	}
+
+	max := s.config.Service.MaxHops
+	if max > 0 && uint32(len(hops)) > max {
+		slog.Warn("rejecting communique exceeding max hops", "tag", tag,
+			"hops", len(hops), "max", max)
+
+		return status.Errorf(codes.FailedPrecondition,
+			"routing limit: communique took %v hops, max allowed is %v",
+			len(hops), max)
+	}
+
+	return nil
+
+} //  End of  Service.checkRoute
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a communique that has been relayed via the addresses.
+func relayedCommunique(addresses ...string) *pb.Communique {
+	communique := testCommunique(&pb.Note{Kind: &pb.Note_Empty{}})
+
+	hops := []*pb.Address{}
+	for _, hp := range addresses {
+		hops = append(hops, &pb.Address{
+			Kind: &pb.Address_Hostport{Hostport: hp},
+		})
+	}
+
+	communique.Envelope.Routing = &pb.Route{Hops: hops}
+	return communique
+
+} //  End of  relayedCommunique
+
+// Test the routing policy.
+func TestCheckRoute(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Service.MaxHops = 2
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	local := svc.Address().GetHostport()
+
+	tests := []struct {
+		name    string
+		hops    []string
+		message string
+	}{
+		{name: "no hops"},
+		{name: "one hop", hops: []string{"tower-1:9340"}},
+		{name: "max hops", hops: []string{"tower-1:9340", "tower-2:9340"}},
+		{
+			name:    "loop",
+			hops:    []string{"tower-1:9340", local},
+			message: "routing loop",
+		},
+		{
+			name:    "too many hops",
+			hops:    []string{"t1:1", "t2:2", "t3:3"},
+			message: "max allowed is 2",
+		},
+	}
+
+	client := startService(t, svc)
+
+	for _, step := range tests {
+		communique := relayedCommunique(step.hops...)
+		_, err := client.Dispatch(context.Background(), communique)
+
+		if len(step.message) == 0 {
+			if err != nil {
+				t.Errorf("test %v unexpected error: %v", step.name, err)
+			}
+
+			continue
+		}
+
+		st, _ := status.FromError(err)
+		if st.Code() != codes.FailedPrecondition {
+			t.Errorf("test %v expected FailedPrecondition, got %v",
+				step.name, err)
+		}
+
+		if !strings.Contains(st.Message(), step.message) {
+			t.Errorf("test %v expected %q in %q", step.name,
+				step.message, st.Message())
+		}
+	}
+
+	// Zero max hops means no hop limit, loops are still rejected.
+	cfg.Service.MaxHops = 0
+
+	if err := svc.checkRoute(relayedCommunique("t1:1", "t2:2", "t3:3")); err != nil {
+		t.Errorf("expected no hop limit, got %v", err)
+	}
+
+	if err := svc.checkRoute(relayedCommunique(local)); err == nil {
+		t.Errorf("expected a routing loop error")
+	}
+
+} //  End of  TestCheckRoute
+
+// Test loops are rejected on subscriptions.
+func TestCheckRouteSubscribe(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.HandleSubscribe(nil)
+	client := startService(t, svc)
+
+	communique := relayedCommunique(svc.Address().GetHostport())
+	communique.Note = &pb.Note{
+		Kind: &pb.Note_Subscription{
+			Subscription: &pb.Subscription{Topic: "news"},
+		},
+	}
+
+	stream, err := client.Subscribe(context.Background(), communique)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+
+} //  End of  TestCheckRouteSubscribe
@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// Service type for the topmost level service - anything else means
+	// we have another upstream to relay to.
+	SERVICE_TYPE_STATION = "station"
+
+	// How often the running service warns about expiring certificates.
+	EXPIRY_CHECK_INTERVAL = time.Duration(12) * time.Hour
+)
+
+// Telegraph service.
+type Service struct {
+	pb.UnimplementedTelegraphServiceServer
+
+	config   *config.Config
+	server   *grpc.Server
+	address  *pb.Address
+	producer *pb.Producer
+
+	mutex     sync.RWMutex
+	notes     map[string]Handler
+	records   map[string]Handler
+	fallback  Handler
+	subscribe SubscribeHandler
+	relay     *Relay
+	broker    *Broker
+	tasks     *TaskTracker
+	registrar Registrar
+	enroller  *Enroller
+	identify  IdentityExtractor
+	auth      Authenticator
+	issuer    *TokenIssuer
+	policy    *Policy
+	reloader  *ptls.Reloader
+	cancel    context.CancelFunc
+}
+
+// Returns the transport credentials for the service and the TLS reloader
+// (nil without TLS) the credentials get the certificate and client CAs
+// from. An encrypted key is decrypted with the passphrase source.
+// No certificate and key means we run an insecure service - only really
+// useful for tests and local development.
+func serverCredentials(cfg *config.Config, passphrase ptls.PassphraseFunc) (credentials.TransportCredentials, *ptls.Reloader, error) {
+	if len(cfg.Settings.Cert) == 0 && len(cfg.Settings.Key) == 0 {
+		slog.Warn("no service certificate, using insecure credentials")
+		return insecure.NewCredentials(), nil, nil
+	}
+
+	reloader, err := ptls.NewServiceReloader(cfg.Settings.Cert,
+		cfg.Settings.Key, passphrase,
+		cfg.Service.CACertPatterns, cfg.Timeouts.TLSReload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return credentials.NewTLS(reloader.ServerConfig()), reloader, nil
+
+} // End of function  serverCredentials.
+
+// Returns the gRPC server options for the service settings.
+func serverOptions(cfg *config.Config) []grpc.ServerOption {
+	settings := cfg.Service
+
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(settings.MaxMessageSize)),
+		grpc.MaxSendMsgSize(int(settings.MaxMessageSize)),
+		grpc.ReadBufferSize(int(settings.BufferSize)),
+		grpc.MaxConcurrentStreams(settings.MaxConcurrentStreams),
+		grpc.NumStreamWorkers(settings.NumStreamWorkers),
+		grpc.ConnectionTimeout(cfg.Timeouts.Connect),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time: cfg.Timeouts.KeepAlive,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             config.MIN_KEEP_ALIVE_TIMEOUT,
+			PermitWithoutStream: true,
+		}),
+	}
+
+} // End of function  serverOptions.
+
+// Returns the local address for the service.
+// Unspecified (aka listen on all interfaces) and loopback bind addresses
+// use the host name, so that relayed messages carry something meaningful
+// and towers with the default bind address don't all look the same.
+func localAddress(cfg *config.Config) *pb.Address {
+	host := cfg.Service.BindAddress
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && (ip.IsUnspecified() || ip.IsLoopback())) {
+		if name, err := os.Hostname(); err == nil {
+			host = name
+		}
+	}
+
+	port := strconv.Itoa(cfg.Service.BindPort)
+
+	return &pb.Address{
+		Kind: &pb.Address_Hostport{Hostport: net.JoinHostPort(host, port)},
+	}
+
+} // End of function  localAddress.
+
+// Returns a new service built from the config.
+// Any additional server options (interceptors etc) are appended to the
+// options derived from the service settings. Encrypted private keys are
+// decrypted with the passphrase file or setting in the config.
+func NewService(cfg *config.Config, opts ...grpc.ServerOption) (*Service, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid service config")
+	}
+
+	return NewServiceWithPassphrase(cfg, ptls.ConfigPassphrase(cfg), opts...)
+
+} // End of function  NewService.
+
+// Returns a new service built from the config, with encrypted private
+// keys (service, signing CA and token signing keys) decrypted with the
+// passphrase source - ala ptls.PassphraseFromEnv or a callback.
+func NewServiceWithPassphrase(cfg *config.Config, passphrase ptls.PassphraseFunc,
+	opts ...grpc.ServerOption) (*Service, error) {
+
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid service config")
+	}
+
+	if err := ptls.ValidateServiceConfig(cfg); err != nil {
+		slog.Error("validating tls config", "error", err)
+		return nil, err
+	}
+
+	creds, reloader, err := serverCredentials(cfg, passphrase)
+	if err != nil {
+		slog.Error("loading service credentials", "error", err)
+		return nil, err
+	}
+
+	enroller, err := configEnroller(cfg, passphrase)
+	if err != nil {
+		slog.Error("loading signing CA", "error", err)
+		return nil, err
+	}
+
+	identify, err := configIdentityExtractor(cfg)
+	if err != nil {
+		slog.Error("configuring peer identity", "error", err)
+		return nil, err
+	}
+
+	issuer, err := configTokenIssuer(cfg, passphrase)
+	if err != nil {
+		slog.Error("loading token signing key", "error", err)
+		return nil, err
+	}
+
+	auth, err := configAuthenticator(cfg, issuer)
+	if err != nil {
+		slog.Error("loading authenticator", "error", err)
+		return nil, err
+	}
+
+	policy, err := configPolicy(cfg)
+	if err != nil {
+		slog.Error("loading access policy", "error", err)
+		return nil, err
+	}
+
+	s := &Service{
+		config:  cfg,
+		address: localAddress(cfg),
+		producer: &pb.Producer{
+			Name: cfg.Settings.Name,
+			Pid:  strconv.Itoa(os.Getpid()),
+		},
+
+		notes:    make(map[string]Handler),
+		records:  make(map[string]Handler),
+		fallback: AckHandler,
+		broker:   NewBroker(SUBSCRIBER_BUFFER_SIZE),
+		tasks:    NewTaskTracker(DEFAULT_TASK_DEADLINE, DEFAULT_TASK_RETENTION),
+		identify: identify,
+		auth:     auth,
+		policy:   policy,
+		reloader: reloader,
+	}
+
+	// The peer identity and principal go into the context before any of
+	// the other interceptors get to see it.
+	options := append(serverOptions(cfg), grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(s.identityUnaryInterceptor,
+			s.authUnaryInterceptor),
+		grpc.ChainStreamInterceptor(s.identityStreamInterceptor,
+			s.authStreamInterceptor))
+	options = append(options, opts...)
+
+	s.server = grpc.NewServer(options...)
+
+	s.subscribe = s.brokerHandler
+
+	pb.RegisterTelegraphServiceServer(s.server, s)
+
+	if enroller != nil {
+		s.UseEnroller(enroller)
+	}
+
+	if issuer != nil {
+		s.UseTokenIssuer(issuer)
+	}
+
+	// Stations track task statuses, towers relay them upstream.
+	if cfg.Service.Kind == SERVICE_TYPE_STATION {
+		s.HandleRecord(KIND_STATUS, s.tasks.Handler)
+	} else {
+		relay, err := NewRelayWithPassphrase(cfg, s.address, passphrase)
+		if err != nil {
+			slog.Error("creating upstream relay", "error", err)
+			return nil, err
+		}
+
+		s.UseRelay(relay)
+	}
+
+	// Watch the certificate, key and CA files for rotations.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	if reloader != nil {
+		go reloader.Watch(ctx)
+	}
+
+	go s.watchExpiry(ctx, EXPIRY_CHECK_INTERVAL)
+
+	return s, nil
+
+} // End of function  NewServiceWithPassphrase.
+
+// Warn about expiring certificates now and then every interval until the
+// context is done.
+func (s *Service) watchExpiry(ctx context.Context, interval time.Duration) {
+	ptls.WarnExpiring(s.config)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			ptls.WarnExpiring(s.config)
+		}
+	}
+
+} //  End of  Service.watchExpiry
+
+// Returns the service config.
+func (s *Service) Config() *config.Config {
+	return s.config
+
+} //  End of  Service.Config
+
+// Returns the underlying gRPC server.
+func (s *Service) Server() *grpc.Server {
+	return s.server
+
+} //  End of  Service.Server
+
+// Returns the local service address.
+func (s *Service) Address() *pb.Address {
+	return s.address
+
+} //  End of  Service.Address
+
+// Returns the upstream relay or nil for a station.
+func (s *Service) Relay() *Relay {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.relay
+
+} //  End of  Service.Relay
+
+// Use a relay to forward communiques and subscriptions upstream.
+// Handlers registered for specific note or record kinds still take
+// precedence over relaying.
+func (s *Service) UseRelay(relay *Relay) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.relay = relay
+	s.fallback = relay.Handler
+	s.subscribe = func(communique *pb.Communique, stream grpc.ServerStreamingServer[pb.Response]) error {
+		send := func(answer *pb.Answer) error {
+			return stream.Send(s.respond(communique, answer))
+		}
+
+		return relay.Subscribe(stream.Context(), communique, send)
+	}
+
+} //  End of  Service.UseRelay
+
+// Returns the bind address ala host:port the service listens on.
+func (s *Service) BindAddress() string {
+	port := strconv.Itoa(s.config.Service.BindPort)
+	return net.JoinHostPort(s.config.Service.BindAddress, port)
+
+} //  End of  Service.BindAddress
+
+// Serve requests on the configured bind address and port.
+func (s *Service) Serve() error {
+	listener, err := net.Listen("tcp", s.BindAddress())
+	if err != nil {
+		slog.Error("listening", "address", s.BindAddress(),
+			"error", err)
+		return err
+	}
+
+	return s.ServeListener(listener)
+
+} //  End of  Service.Serve
+
+// Serve requests on a listener.
+func (s *Service) ServeListener(listener net.Listener) error {
+	slog.Info("serving telegraph", "name", s.config.Settings.Name,
+		"address", listener.Addr().String(),
+		"type", s.config.Service.Kind)
+
+	return s.server.Serve(listener)
+
+} //  End of  Service.ServeListener
+
+// Gracefully stop the service.
+// The broker is closed first, as subscriber streams would otherwise keep
+// the graceful stop waiting.
+func (s *Service) Stop() {
+	s.cancel()
+	s.broker.Close()
+	s.server.GracefulStop()
+
+	if relay := s.Relay(); relay != nil {
+		relay.Close()
+	}
+
+} //  End of  Service.Stop
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	TEST_BUFFER_SIZE = 1024 * 1024
+)
+
+// Get path to a tls config pem file.
+func getPath(where, name string) string {
+	repodir := "../.."
+
+	if zdir, err := os.Getwd(); err == nil {
+		zpath, err := filepath.Abs(filepath.Join(zdir, "..", ".."))
+		if err == nil {
+			repodir = zpath
+		}
+	}
+
+	return filepath.Join(repodir, "config/test/tls", where, name)
+
+} //  End of  getPath
+
+// Returns a test config with the default settings.
+func testConfig(t *testing.T) *config.Config {
+	cfg, err := config.NewConfig("TELEGRAPH_SERVICE_TEST", "")
+	if err != nil {
+		t.Fatalf("creating config: %v", err)
+	}
+
+	cfg.Settings.Name = "test-station"
+	return cfg
+
+} //  End of  testConfig
+
+// Starts a service on an in-memory listener.
+// Returns the dial option to connect to it.
+func startServiceListener(t *testing.T, svc *Service) grpc.DialOption {
+	listener := bufconn.Listen(TEST_BUFFER_SIZE)
+
+	go func() {
+		_ = svc.ServeListener(listener)
+	}()
+
+	t.Cleanup(svc.Stop)
+
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	})
+
+} //  End of  startServiceListener
+
+// Starts a service on an in-memory listener and returns a client for it.
+func startService(t *testing.T, svc *Service) pb.TelegraphServiceClient {
+	dialer := startServiceListener(t, svc)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dialing test service: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewTelegraphServiceClient(conn)
+
+} //  End of  startService
+
+// Test NewService function.
+func TestNewService(t *testing.T) {
+	if _, err := NewService(nil); err == nil {
+		t.Errorf("expected an error for a nil config")
+	}
+
+	cfg := testConfig(t)
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if svc.Config() != cfg {
+		t.Errorf("expected service config to match")
+	}
+
+	if svc.Server() == nil {
+		t.Errorf("expected a gRPC server")
+	}
+
+	if _, ok := svc.Server().GetServiceInfo()["local.grpc.telegraph.TelegraphService"]; !ok {
+		t.Errorf("expected telegraph service to be registered")
+	}
+
+	if addr := svc.BindAddress(); addr != "127.0.0.1:9340" {
+		t.Errorf("expected bind address 127.0.0.1:9340, got %v", addr)
+	}
+
+	hostname, _ := os.Hostname()
+	expected := net.JoinHostPort(hostname, "9340")
+	if hp := svc.Address().GetHostport(); hp != expected {
+		t.Errorf("expected local address %v, got %v", expected, hp)
+	}
+
+} //  End of  TestNewService
+
+// Test NewService function with TLS settings.
+func TestNewServiceTLS(t *testing.T) {
+	bundle := getPath("service/bundle", "service.pem")
+	if _, err := os.Stat(bundle); err != nil {
+		t.Skipf("missing test TLS config: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		bind     string
+		caCert   string
+		patterns config.CACertificatesPattern
+		fails    bool
+	}{
+		{
+			name: "service bundle",
+			cert: bundle,
+			key:  bundle,
+		},
+		{
+			name: "service bundle with client CAs",
+			cert: bundle,
+			key:  bundle,
+			patterns: config.CACertificatesPattern{
+				Bootstrap: getPath("bootstrap", "*-cacert.pem"),
+				Device:    getPath("device", "*-cacert.pem"),
+			},
+		},
+		{
+			name:   "service bundle issued by the service CA",
+			cert:   bundle,
+			key:    bundle,
+			caCert: getPath("service", "cacert.pem"),
+		},
+		{
+			name:   "service bundle not issued by the CA",
+			cert:   bundle,
+			key:    bundle,
+			caCert: getPath("bootstrap", "bootstrap-cacert.pem"),
+			fails:  true,
+		},
+		{
+			name:  "missing key",
+			cert:  getPath("service", "cert.pem"),
+			key:   getPath("service", "missing-key.pem"),
+			fails: true,
+		},
+		{
+			name:  "bind address not covered",
+			cert:  bundle,
+			key:   bundle,
+			bind:  "192.0.2.1",
+			fails: true,
+		},
+		{
+			name: "bad pattern",
+			cert: bundle,
+			key:  bundle,
+			patterns: config.CACertificatesPattern{
+				Device: "[",
+			},
+			fails: true,
+		},
+	}
+
+	for _, step := range tests {
+		cfg := testConfig(t)
+		cfg.Settings.Cert = step.cert
+		cfg.Settings.Key = step.key
+		cfg.Service.CACert = step.caCert
+		cfg.Service.CACertPatterns = step.patterns
+
+		// The test service certificate covers *.telegraph.biota.local and
+		// 0.0.0.0 (plus localhost and 127.0.0.1 once regenerated with
+		// generate-tls-config) - but never the 192.0.2.1 test address.
+		cfg.Service.BindAddress = "0.0.0.0"
+		if len(step.bind) > 0 {
+			cfg.Service.BindAddress = step.bind
+		}
+
+		_, err := NewService(cfg)
+		if step.fails && err == nil {
+			t.Errorf("test %v expected an error", step.name)
+		}
+
+		if !step.fails && err != nil {
+			t.Errorf("test %v unexpected error: %v", step.name, err)
+		}
+	}
+
+} //  End of  TestNewServiceTLS
+
+// Encrypt the private key in a file with a passphrase.
+func encryptTestKey(t *testing.T, keyPath, passphrase string) {
+	keys, err := ptls.LoadPrivateKeys(keyPath, nil)
+	if err != nil {
+		t.Fatalf("loading key: %v", err)
+	}
+
+	data, err := ptls.EncryptPrivateKey(keys[0].(crypto.Signer), []byte(passphrase))
+	if err != nil {
+		t.Fatalf("encrypting key: %v", err)
+	}
+
+	os.WriteFile(keyPath, data, 0o600)
+
+} //  End of  encryptTestKey
+
+// Test NewServiceWithPassphrase and NewClientWithPassphrase functions.
+func TestNewServiceWithPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestAuthority(t, dir, "service")
+
+	cfg := testConfig(t)
+	cfg.Settings.Cert, cfg.Settings.Key = ca.issue(t, dir, "test-station",
+		x509.ExtKeyUsageServerAuth)
+	encryptTestKey(t, cfg.Settings.Key, "secret")
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Cert, devcfg.Settings.Key = ca.issue(t, dir, "test-device",
+		x509.ExtKeyUsageClientAuth)
+	devcfg.Device.ServiceCACert = ca.certPath
+	encryptTestKey(t, devcfg.Settings.Key, "secret")
+
+	// Nothing in the configs to decrypt the keys with.
+	if _, err := NewService(cfg); !errors.Is(err, ptls.ErrNoPassphrase) {
+		t.Errorf("expected no passphrase error, got %v", err)
+	}
+
+	if _, err := device.NewClient(devcfg); !errors.Is(err, ptls.ErrNoPassphrase) {
+		t.Errorf("expected no passphrase error, got %v", err)
+	}
+
+	t.Setenv("SERVICE_TEST_KEY_PASSPHRASE", "secret")
+
+	callback := func(keyPath string) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+
+	tests := []struct {
+		passphrase ptls.PassphraseFunc
+		err        error
+	}{
+		{passphrase: ptls.PassphraseFromEnv("SERVICE_TEST_KEY_PASSPHRASE")},
+		{passphrase: callback},
+		{passphrase: ptls.StaticPassphrase("wrong"), err: ptls.ErrIncorrectPassphrase},
+	}
+
+	for idx, step := range tests {
+		svc, err := NewServiceWithPassphrase(cfg, step.passphrase)
+		if !errors.Is(err, step.err) {
+			t.Errorf("test %v expected service error %v, got %v", idx, step.err, err)
+		}
+
+		if svc != nil {
+			svc.Stop()
+		}
+
+		client, err := device.NewClientWithPassphrase(devcfg, step.passphrase)
+		if !errors.Is(err, step.err) {
+			t.Errorf("test %v expected client error %v, got %v", idx, step.err, err)
+		}
+
+		if client != nil {
+			client.Close()
+		}
+	}
+
+} //  End of  TestNewServiceWithPassphrase
+
+// Test localAddress function.
+func TestLocalAddress(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		address  string
+		port     int
+		expected string
+	}{
+		{address: "127.0.0.1", port: 9340, expected: net.JoinHostPort(hostname, "9340")},
+		{address: "::1", port: 42, expected: net.JoinHostPort(hostname, "42")},
+		{address: "192.0.2.1", port: 9340, expected: "192.0.2.1:9340"},
+		{address: "0.0.0.0", port: 7, expected: net.JoinHostPort(hostname, "7")},
+		{address: "", port: 8, expected: net.JoinHostPort(hostname, "8")},
+		{address: "tower.local", port: 9, expected: "tower.local:9"},
+	}
+
+	for _, step := range tests {
+		cfg := testConfig(t)
+		cfg.Service.BindAddress = step.address
+		cfg.Service.BindPort = step.port
+
+		if hp := localAddress(cfg).GetHostport(); hp != step.expected {
+			t.Errorf("expected %v, got %v", step.expected, hp)
+		}
+	}
+
+} //  End of  TestLocalAddress
+
+// Test serverOptions function.
+func TestServerOptions(t *testing.T) {
+	cfg := testConfig(t)
+	if n := len(serverOptions(cfg)); n != 8 {
+		t.Errorf("expected 8 server options, got %v", n)
+	}
+
+} //  End of  TestServerOptions
@@ -0,0 +1,456 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/task"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Default time a task has to reach an end state before it is flagged
+	// as timed out.
+	DEFAULT_TASK_DEADLINE = time.Duration(3600) * time.Second
+
+	// Default time finished tasks are kept around for.
+	DEFAULT_TASK_RETENTION = time.Duration(24) * time.Hour
+
+	// How often finished tasks past their retention are dropped.
+	TASK_PRUNE_INTERVAL = time.Minute
+)
+
+var (
+	// No such task.
+	ErrUnknownTask = errors.New("unknown task")
+)
+
+// Snapshot of a tracked task.
+type TaskInfo struct {
+	Device   string
+	Name     string
+	State    pb.State
+	Steps    map[string]pb.State
+	Info     *pb.Generic
+	Started  time.Time
+	Updated  time.Time
+	Deadline time.Time
+}
+
+// Tracked task keys.
+type taskKey struct {
+	device string
+	name   string
+}
+
+// A tracked task.
+type trackedTask struct {
+	info    TaskInfo
+	changed chan struct{}
+
+	// Finished task this one replaced - until the device picks it up.
+	previous *trackedTask
+}
+
+// Task tracker follows tasks to completion from the Status records the
+// devices send. Tasks are keyed by device and task name. Finished tasks
+// are dropped once they are past their retention.
+type TaskTracker struct {
+	mutex     sync.Mutex
+	deadline  time.Duration
+	retention time.Duration
+	pruned    time.Time
+	tasks     map[taskKey]*trackedTask
+}
+
+// Returns a new task tracker flagging tasks that have not reached an end
+// state within `deadline` as timed out and keeping finished tasks for
+// `retention`. Zero uses the defaults.
+func NewTaskTracker(deadline, retention time.Duration) *TaskTracker {
+	if deadline <= 0 {
+		deadline = DEFAULT_TASK_DEADLINE
+	}
+
+	if retention <= 0 {
+		retention = DEFAULT_TASK_RETENTION
+	}
+
+	return &TaskTracker{
+		deadline:  deadline,
+		retention: retention,
+		pruned:    time.Now(),
+		tasks:     make(map[taskKey]*trackedTask),
+	}
+
+} // End of function  NewTaskTracker.
+
+// Returns a copy of the task info.
+func (t *trackedTask) snapshot() TaskInfo {
+	info := t.info
+	info.Steps = maps.Clone(t.info.Steps)
+
+	if t.info.Info != nil {
+		info.Info = proto.Clone(t.info.Info).(*pb.Generic)
+	}
+
+	return info
+
+} //  End of  trackedTask.snapshot
+
+// Wake up anyone waiting on the task.
+func (t *trackedTask) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+
+} //  End of  trackedTask.notify
+
+// Flag the task as timed out if it is past its deadline.
+func (t *trackedTask) expire(now time.Time) {
+	if task.IsFinal(t.info.State) || now.Before(t.info.Deadline) {
+		return
+	}
+
+	slog.Warn("task timed out", "device", t.info.Device,
+		"task", t.info.Name, "state", t.info.State)
+
+	t.info.State = pb.State_STATE_TIMED_OUT
+	t.info.Updated = now
+	t.notify()
+
+} //  End of  trackedTask.expire
+
+// Returns a new tracked task.
+func (tt *TaskTracker) create(device, name string, state pb.State, now time.Time) *trackedTask {
+	t := &trackedTask{
+		info: TaskInfo{
+			Device:   device,
+			Name:     name,
+			State:    state,
+			Steps:    make(map[string]pb.State),
+			Started:  now,
+			Updated:  now,
+			Deadline: now.Add(tt.deadline),
+		},
+		changed: make(chan struct{}),
+	}
+
+	tt.tasks[taskKey{device: device, name: name}] = t
+	return t
+
+} //  End of  TaskTracker.create
+
+// Drop the finished tasks past their retention - at most every prune
+// interval.
+func (tt *TaskTracker) prune(now time.Time) {
+	if now.Sub(tt.pruned) < TASK_PRUNE_INTERVAL {
+		return
+	}
+
+	tt.pruned = now
+
+	for key, tracked := range tt.tasks {
+		tracked.expire(now)
+		if task.IsFinal(tracked.info.State) && now.Sub(tracked.info.Updated) >= tt.retention {
+			delete(tt.tasks, key)
+		}
+	}
+
+} //  End of  TaskTracker.prune
+
+// Drop the finished tasks past their retention now.
+func (tt *TaskTracker) Prune() {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	tt.pruned = time.Time{}
+	tt.prune(time.Now())
+
+} //  End of  TaskTracker.Prune
+
+// Start tracking a task published to a device. Tracking a task that is
+// still active is an error. A finished task is replaced, but kept until
+// the device picks up the new one - see Untrack.
+func (tt *TaskTracker) Track(device string, t *pb.Task) error {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	now := time.Now()
+	key := taskKey{device: device, name: t.GetName()}
+
+	tracked, ok := tt.tasks[key]
+	if ok {
+		tracked.expire(now)
+		if !task.IsFinal(tracked.info.State) {
+			return fmt.Errorf("%w: %q for device %q",
+				task.ErrInvalidTransition, t.GetName(), device)
+		}
+
+		tracked.notify()
+	}
+
+	created := tt.create(device, t.GetName(), pb.State_STATE_INITIAL, now)
+	if ok {
+		tracked.previous = nil
+		created.previous = tracked
+	}
+
+	tt.prune(now)
+	return nil
+
+} //  End of  TaskTracker.Track
+
+// Returns the state to check a transition from - an end state is treated
+// as no state, so that a task (or step) can be run again.
+func fromState(state pb.State, to pb.State) pb.State {
+	if task.IsFinal(state) && !task.IsProgress(to) {
+		return pb.State_STATE_NONE_UNSPECIFIED
+	}
+
+	return state
+
+} // End of function  fromState.
+
+// Ingest a status from a device. Statuses for tasks that are not being
+// tracked start tracking them.
+func (tt *TaskTracker) Ingest(device string, s *pb.Status) error {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	now := time.Now()
+	key := taskKey{device: device, name: s.GetTask()}
+
+	tracked, ok := tt.tasks[key]
+	if ok {
+		tracked.expire(now)
+		tracked.previous = nil
+	}
+
+	tt.prune(now)
+
+	state := pb.State_STATE_NONE_UNSPECIFIED
+	if ok {
+		state = tracked.info.State
+	}
+
+	if len(s.GetStep()) > 0 {
+		if !ok {
+			return fmt.Errorf("%w: step %q of %w %q", task.ErrInvalidTransition,
+				s.GetStep(), ErrUnknownTask, s.GetTask())
+		}
+
+		if state != pb.State_STATE_RUNNING {
+			return fmt.Errorf("%w: step %q while task is %v",
+				task.ErrInvalidTransition, s.GetStep(), state)
+		}
+
+		from := fromState(tracked.info.Steps[s.GetStep()], s.GetState())
+		if err := task.CheckTransition(from, s.GetState()); err != nil {
+			return fmt.Errorf("task %q step %q: %w", s.GetTask(),
+				s.GetStep(), err)
+		}
+
+		if !task.IsProgress(s.GetState()) {
+			tracked.info.Steps[s.GetStep()] = s.GetState()
+		}
+	} else {
+		from := fromState(state, s.GetState())
+		if err := task.CheckTransition(from, s.GetState()); err != nil {
+			return fmt.Errorf("task %q: %w", s.GetTask(), err)
+		}
+
+		if !ok || from != state {
+			if ok {
+				tracked.notify()
+			}
+
+			tracked = tt.create(device, s.GetTask(), from, now)
+		}
+
+		if !task.IsProgress(s.GetState()) {
+			tracked.info.State = s.GetState()
+		}
+	}
+
+	if s.GetInfo() != nil {
+		tracked.info.Info = s.GetInfo()
+	}
+
+	tracked.info.Updated = now
+	tracked.notify()
+
+	return nil
+
+} //  End of  TaskTracker.Ingest
+
+// Returns a tracked task.
+func (tt *TaskTracker) Get(device, name string) (TaskInfo, bool) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	tracked, ok := tt.tasks[taskKey{device: device, name: name}]
+	if !ok {
+		return TaskInfo{}, false
+	}
+
+	tracked.expire(time.Now())
+	return tracked.snapshot(), true
+
+} //  End of  TaskTracker.Get
+
+// Returns the tracked tasks for a device (or for all devices if empty),
+// ordered by device, start time and name.
+func (tt *TaskTracker) List(device string) []TaskInfo {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	now := time.Now()
+	tasks := []TaskInfo{}
+
+	for key, tracked := range tt.tasks {
+		if len(device) > 0 && key.device != device {
+			continue
+		}
+
+		tracked.expire(now)
+		tasks = append(tasks, tracked.snapshot())
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Device != tasks[j].Device {
+			return tasks[i].Device < tasks[j].Device
+		}
+
+		if !tasks[i].Started.Equal(tasks[j].Started) {
+			return tasks[i].Started.Before(tasks[j].Started)
+		}
+
+		return tasks[i].Name < tasks[j].Name
+	})
+
+	return tasks
+
+} //  End of  TaskTracker.List
+
+// Stop tracking a task.
+func (tt *TaskTracker) Forget(device, name string) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	delete(tt.tasks, taskKey{device: device, name: name})
+
+} //  End of  TaskTracker.Forget
+
+// Stop tracking a task that never made it to the device - the finished
+// task it replaced (if any) is tracked again.
+func (tt *TaskTracker) Untrack(device, name string) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	key := taskKey{device: device, name: name}
+
+	tracked, ok := tt.tasks[key]
+	if !ok {
+		return
+	}
+
+	if tracked.previous != nil {
+		tt.tasks[key] = tracked.previous
+	} else {
+		delete(tt.tasks, key)
+	}
+
+	tracked.notify()
+
+} //  End of  TaskTracker.Untrack
+
+// Wait for a task to reach an end state (timed out included) or for the
+// context to be done.
+func (tt *TaskTracker) Wait(ctx context.Context, device, name string) (TaskInfo, error) {
+	for {
+		tt.mutex.Lock()
+		tracked, ok := tt.tasks[taskKey{device: device, name: name}]
+		if !ok {
+			tt.mutex.Unlock()
+			return TaskInfo{}, fmt.Errorf("%w: %q for device %q",
+				ErrUnknownTask, name, device)
+		}
+
+		tracked.expire(time.Now())
+		info := tracked.snapshot()
+		changed := tracked.changed
+		tt.mutex.Unlock()
+
+		if task.IsFinal(info.State) {
+			return info, nil
+		}
+
+		timer := time.NewTimer(time.Until(info.Deadline))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return info, ctx.Err()
+
+		case <-changed:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+
+} //  End of  TaskTracker.Wait
+
+// Record handler that ingests task statuses.
+func (tt *TaskTracker) Handler(ctx context.Context, communique *pb.Communique) (*pb.Answer, error) {
+	device := communique.GetEnvelope().GetOrigin().GetProducer().GetName()
+	s := communique.GetNote().GetRecord().GetStatus()
+
+	if err := tt.Ingest(device, s); err != nil {
+		slog.Warn("rejecting task status", "device", device,
+			"task", s.GetTask(), "step", s.GetStep(),
+			"state", s.GetState(), "error", err)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return Acknowledge(communique, nil), nil
+
+} //  End of  TaskTracker.Handler
+
+// Returns the service task tracker.
+func (s *Service) Tasks() *TaskTracker {
+	return s.tasks
+
+} //  End of  Service.Tasks
+
+// Publish a task to a device and track it.
+// Returns the number of subscriber streams the task was delivered to - the
+// task is only tracked if it was delivered, an earlier run of the task
+// stays tracked otherwise.
+func (s *Service) PublishTask(device string, t *pb.Task) (int, error) {
+	publication := &pb.Publication{Kind: &pb.Publication_Task{Task: t}}
+
+	if s.config.Service.DisableSubscriptions {
+		return 0, ErrSubscriptionsDisabled
+	}
+
+	if err := s.tasks.Track(device, t); err != nil {
+		return 0, err
+	}
+
+	n, err := s.PublishTo(device, publication)
+	if err != nil || n == 0 {
+		s.tasks.Untrack(device, t.GetName())
+	}
+
+	return n, err
+
+} //  End of  Service.PublishTask
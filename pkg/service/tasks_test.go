@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/task"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a task status.
+func taskStatus(name, step string, state pb.State) *pb.Status {
+	return &pb.Status{Task: name, Step: step, State: state}
+
+} //  End of  taskStatus
+
+// Test TaskTracker.Ingest function.
+func TestTaskTrackerIngest(t *testing.T) {
+	tracker := NewTaskTracker(0, 0)
+
+	if err := tracker.Track("device-1", &pb.Task{Name: "upgrade"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := tracker.Track("device-1", &pb.Task{Name: "upgrade"}); !errors.Is(err, task.ErrInvalidTransition) {
+		t.Errorf("expected tracking an active task to fail, got %v", err)
+	}
+
+	tests := []struct {
+		status *pb.Status
+		valid  bool
+	}{
+		{status: taskStatus("upgrade", "download", pb.State_STATE_RUNNING)},
+		{status: taskStatus("upgrade", "", pb.State_STATE_QUEUED), valid: true},
+		{status: taskStatus("upgrade", "", pb.State_STATE_COMPLETED)},
+		{status: taskStatus("upgrade", "", pb.State_STATE_RUNNING), valid: true},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_RUNNING), valid: true},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_NONE_UNSPECIFIED), valid: true},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_COMPLETED), valid: true},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_NONE_UNSPECIFIED)},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_RUNNING), valid: true},
+		{status: taskStatus("upgrade", "download", pb.State_STATE_FAILED), valid: true},
+		{status: taskStatus("upgrade", "", pb.State_STATE_FAILED), valid: true},
+		{status: taskStatus("upgrade", "", pb.State_STATE_NONE_UNSPECIFIED)},
+		{status: taskStatus("upgrade", "install", pb.State_STATE_RUNNING)},
+		{status: taskStatus("unknown", "step", pb.State_STATE_RUNNING)},
+		{status: taskStatus("unknown", "", pb.State_STATE_RUNNING), valid: true},
+	}
+
+	for idx, step := range tests {
+		err := tracker.Ingest("device-1", step.status)
+		if step.valid && err != nil {
+			t.Errorf("status %v unexpected error: %v", idx, err)
+		}
+
+		if !step.valid && err == nil {
+			t.Errorf("status %v expected an error", idx)
+		}
+	}
+
+	info, ok := tracker.Get("device-1", "upgrade")
+	if !ok || info.State != pb.State_STATE_FAILED {
+		t.Fatalf("expected failed upgrade, got %v %v", info, ok)
+	}
+
+	if info.Steps["download"] != pb.State_STATE_FAILED {
+		t.Errorf("expected failed download step, got %v", info.Steps)
+	}
+
+	// Finished tasks can be run again.
+	if err := tracker.Ingest("device-1", taskStatus("upgrade", "", pb.State_STATE_QUEUED)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	info, _ = tracker.Get("device-1", "upgrade")
+	if info.State != pb.State_STATE_QUEUED || len(info.Steps) != 0 {
+		t.Errorf("expected requeued upgrade, got %v", info)
+	}
+
+	if _, ok := tracker.Get("device-2", "upgrade"); ok {
+		t.Errorf("expected tasks to be tracked per device")
+	}
+
+} //  End of  TestTaskTrackerIngest
+
+// Test tasks timing out.
+func TestTaskTrackerTimeout(t *testing.T) {
+	tracker := NewTaskTracker(30*time.Millisecond, 0)
+	tracker.Track("device-1", &pb.Task{Name: "stuck"})
+
+	info, err := tracker.Wait(context.Background(), "device-1", "stuck")
+	if err != nil || info.State != pb.State_STATE_TIMED_OUT {
+		t.Errorf("expected timed out task, got %v %v", info.State, err)
+	}
+
+	late := taskStatus("stuck", "", pb.State_STATE_COMPLETED)
+	if err := tracker.Ingest("device-1", late); err == nil {
+		t.Errorf("expected late completion to be rejected")
+	}
+
+	// Tracking again after the time out is fine.
+	if err := tracker.Track("device-1", &pb.Task{Name: "stuck"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+} //  End of  TestTaskTrackerTimeout
+
+// Test TaskTracker.Wait, List and Forget functions.
+func TestTaskTrackerQueries(t *testing.T) {
+	tracker := NewTaskTracker(0, 0)
+	tracker.Track("device-2", &pb.Task{Name: "b"})
+	tracker.Track("device-1", &pb.Task{Name: "a"})
+	tracker.Track("device-1", &pb.Task{Name: "c"})
+
+	done := make(chan TaskInfo)
+	go func() {
+		info, _ := tracker.Wait(context.Background(), "device-1", "a")
+		done <- info
+	}()
+
+	for _, state := range []pb.State{pb.State_STATE_QUEUED, pb.State_STATE_RUNNING, pb.State_STATE_COMPLETED} {
+		time.Sleep(5 * time.Millisecond)
+		if err := tracker.Ingest("device-1", taskStatus("a", "", state)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	select {
+	case info := <-done:
+		if info.State != pb.State_STATE_COMPLETED {
+			t.Errorf("expected completed task, got %v", info.State)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for task")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := tracker.Wait(ctx, "device-1", "c"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if _, err := tracker.Wait(ctx, "device-1", "x"); !errors.Is(err, ErrUnknownTask) {
+		t.Errorf("expected unknown task, got %v", err)
+	}
+
+	names := []string{}
+	for _, info := range tracker.List("") {
+		names = append(names, info.Device+":"+info.Name)
+	}
+
+	if len(names) != 3 || names[0] != "device-1:a" || names[1] != "device-1:c" || names[2] != "device-2:b" {
+		t.Errorf("expected ordered tasks, got %v", names)
+	}
+
+	if tasks := tracker.List("device-2"); len(tasks) != 1 {
+		t.Errorf("expected 1 device-2 task, got %v", len(tasks))
+	}
+
+	tracker.Forget("device-2", "b")
+	if tasks := tracker.List("device-2"); len(tasks) != 0 {
+		t.Errorf("expected forgotten task, got %v", tasks)
+	}
+
+} //  End of  TestTaskTrackerQueries
+
+// Test TaskTracker.Untrack and Prune functions.
+func TestTaskTrackerRetention(t *testing.T) {
+	tracker := NewTaskTracker(0, 20*time.Millisecond)
+	tracker.Track("device-1", &pb.Task{Name: "upgrade"})
+
+	for _, state := range []pb.State{pb.State_STATE_QUEUED, pb.State_STATE_RUNNING, pb.State_STATE_COMPLETED} {
+		if err := tracker.Ingest("device-1", taskStatus("upgrade", "", state)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// An undelivered rerun leaves the earlier run as it was.
+	if err := tracker.Track("device-1", &pb.Task{Name: "upgrade"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tracker.Untrack("device-1", "upgrade")
+
+	info, err := tracker.Wait(context.Background(), "device-1", "upgrade")
+	if err != nil || info.State != pb.State_STATE_COMPLETED {
+		t.Errorf("expected the completed task back, got %v %v", info.State, err)
+	}
+
+	// Never tracked before, nothing to go back to.
+	tracker.Track("device-1", &pb.Task{Name: "reboot"})
+	tracker.Untrack("device-1", "reboot")
+
+	if _, ok := tracker.Get("device-1", "reboot"); ok {
+		t.Errorf("expected an untracked task to be gone")
+	}
+
+	// Finished tasks go once they are past their retention.
+	tracker.Track("device-1", &pb.Task{Name: "active"})
+	time.Sleep(30 * time.Millisecond)
+	tracker.Prune()
+
+	if _, ok := tracker.Get("device-1", "upgrade"); ok {
+		t.Errorf("expected the finished task to be dropped")
+	}
+
+	if _, ok := tracker.Get("device-1", "active"); !ok {
+		t.Errorf("expected the active task to be kept")
+	}
+
+} //  End of  TestTaskTrackerRetention
+
+// Test publishing and tracking tasks via the service.
+func TestServiceTasks(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := startService(t, svc)
+
+	if n, err := svc.PublishTask("test-device", &pb.Task{Name: "reboot"}); err != nil || n != 0 {
+		t.Errorf("expected no deliveries, got %v %v", n, err)
+	}
+
+	if _, ok := svc.Tasks().Get("test-device", "reboot"); ok {
+		t.Errorf("expected undelivered task to not be tracked")
+	}
+
+	stream := subscribeAs(t, client, "test-device", "tasks/#")
+	waitForSubscribers(t, svc.Broker(), 1)
+
+	if n, err := svc.PublishTask("test-device", &pb.Task{Name: "reboot"}); err != nil || n != 1 {
+		t.Errorf("expected 1 delivery, got %v %v", n, err)
+	}
+
+	resp, err := stream.Recv()
+	if err != nil || resp.GetAnswer().GetPublication().GetTask().GetName() != "reboot" {
+		t.Fatalf("expected reboot task, got %v %v", resp, err)
+	}
+
+	dispatch := func(state pb.State) error {
+		record := &pb.Record{
+			Kind: &pb.Record_Status{Status: taskStatus("reboot", "", state)},
+		}
+
+		_, err := client.Dispatch(context.Background(),
+			testCommunique(recordNote(record)))
+		return err
+	}
+
+	if err := dispatch(pb.State_STATE_COMPLETED); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+
+	for _, state := range []pb.State{pb.State_STATE_QUEUED, pb.State_STATE_RUNNING, pb.State_STATE_COMPLETED} {
+		if err := dispatch(state); err != nil {
+			t.Errorf("state %v unexpected error: %v", state, err)
+		}
+	}
+
+	info, err := svc.Tasks().Wait(context.Background(), "test-device", "reboot")
+	if err != nil || info.State != pb.State_STATE_COMPLETED {
+		t.Errorf("expected completed task, got %v %v", info.State, err)
+	}
+
+} //  End of  TestServiceTasks
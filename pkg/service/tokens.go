@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Categories of the record kinds - for the token category scopes.
+// Empty records and acks are not in any category.
+var recordCategories = map[string]pb.Category{
+	KIND_STATUS:   pb.Category_CATEGORY_TASKS,
+	KIND_INCIDENT: pb.Category_CATEGORY_INCIDENTS,
+	KIND_METRICS:  pb.Category_CATEGORY_METRICS,
+	KIND_TIMING:   pb.Category_CATEGORY_TIMINGS,
+	KIND_TRACE:    pb.Category_CATEGORY_TRACES,
+	KIND_GENERIC:  pb.Category_CATEGORY_OTHER,
+}
+
+// Registration neither admitted by a registrar nor bound to the peer.
+var ErrUnauthenticatedRegistration = errors.New("unauthenticated registration")
+
+// Token issuer mints the signed membership tokens.
+type TokenIssuer struct {
+	key      *token.Key
+	lifetime time.Duration
+	scopes   token.Scopes
+}
+
+// Returns the category of a record kind.
+func RecordCategory(record *pb.Record) pb.Category {
+	return recordCategories[RecordKind(record)]
+
+} // End of function  RecordCategory.
+
+// Returns the category of a note - generic notes are other things.
+func NoteCategory(note *pb.Note) pb.Category {
+	switch NoteKind(note) {
+	case KIND_RECORD:
+		return RecordCategory(note.GetRecord())
+
+	case KIND_GENERIC:
+		return pb.Category_CATEGORY_OTHER
+	}
+
+	return pb.Category_CATEGORY_NONE_UNSPECIFIED
+
+} // End of function  NoteCategory.
+
+// Returns the token scopes for comma separated topic filters and
+// category names.
+func ParseScopes(topics, categories string) (token.Scopes, error) {
+	scopes := token.Scopes{}
+
+	for _, filter := range strings.Split(topics, ",") {
+		if filter = strings.TrimSpace(filter); len(filter) == 0 {
+			continue
+		}
+
+		if err := ValidateTopicFilter(filter); err != nil {
+			return scopes, err
+		}
+
+		scopes.Topics = append(scopes.Topics, filter)
+	}
+
+	for _, category := range strings.Split(categories, ",") {
+		if category = strings.TrimSpace(category); len(category) == 0 {
+			continue
+		}
+
+		name, err := token.CategoryName(category)
+		if err != nil {
+			return scopes, err
+		}
+
+		scopes.Categories = append(scopes.Categories, name)
+	}
+
+	return scopes, nil
+
+} // End of function  ParseScopes.
+
+// Returns a new token issuer minting tokens valid for `lifetime` with
+// the scopes. Zero uses the default lifetime.
+func NewTokenIssuer(key *token.Key, lifetime time.Duration, scopes token.Scopes) *TokenIssuer {
+	if lifetime <= 0 {
+		lifetime = config.DEFAULT_TOKEN_LIFETIME
+	}
+
+	return &TokenIssuer{key: key, lifetime: lifetime, scopes: scopes}
+
+} // End of function  NewTokenIssuer.
+
+// Returns the token issuer for the service config - nil if there's no
+// token signing key. An encrypted key is decrypted with the passphrase
+// source.
+func configTokenIssuer(cfg *config.Config, passphrase ptls.PassphraseFunc) (*TokenIssuer, error) {
+	settings := cfg.Service
+	if len(settings.TokenSigningKey) == 0 {
+		return nil, nil
+	}
+
+	key, err := token.LoadKey(settings.TokenSigningKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := ParseScopes(settings.TokenTopics, settings.TokenCategories)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenIssuer(key, settings.TokenLifetime, scopes), nil
+
+} // End of function  configTokenIssuer.
+
+// Returns the token signing key.
+func (i *TokenIssuer) Key() *token.Key {
+	return i.key
+
+} //  End of  TokenIssuer.Key
+
+// Issue a signed token for a device.
+func (i *TokenIssuer) Issue(device string) (string, *token.Claims, error) {
+	return i.key.Issue(device, i.lifetime, i.scopes)
+
+} //  End of  TokenIssuer.Issue
+
+// Verify a signed token - returns the claims.
+func (i *TokenIssuer) Verify(signed string) (*token.Claims, error) {
+	return i.key.Verify(signed, time.Now())
+
+} //  End of  TokenIssuer.Verify
+
+// Returns an authenticator for the signed tokens - for the auth
+// interceptors, the principal carries the token scopes.
+func NewSignedTokenAuthenticator(key *token.Key) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, credentials *pb.Credentials) (*Principal, error) {
+		claims, err := key.Verify(credentials.GetToken(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		return &Principal{
+			Name:    claims.Device,
+			Scopes:  claims.Scopes,
+			Expires: claims.ExpiryTime(),
+		}, nil
+	})
+
+} // End of function  NewSignedTokenAuthenticator.
+
+// Use a token issuer for the membership permits. Registrations (admitted
+// by the registrar or bound to the peer certificate) get a signed token
+// instead of the registrar token and all the other communiques need to
+// carry a valid one, within its scopes. A nil issuer turns the signed
+// tokens off.
+// Signed tokens are good until they expire - revoking a membership does
+// not revoke them, so keep their lifetime short.
+func (s *Service) UseTokenIssuer(issuer *TokenIssuer) {
+	s.mutex.Lock()
+	s.issuer = issuer
+	s.mutex.Unlock()
+
+	s.handleRegistrations()
+
+} //  End of  Service.UseTokenIssuer
+
+// Returns the token issuer or nil if there are no signed tokens.
+func (s *Service) TokenIssuer() *TokenIssuer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.issuer
+
+} //  End of  Service.TokenIssuer
+
+// Sign the membership token of a registering device. Tokens are only
+// minted for devices the registrar admitted or the peer certificate is
+// bound to - anyone can claim to be any device otherwise.
+func (s *Service) signMembership(ctx context.Context, membership *pb.Membership, registered bool) error {
+	issuer := s.TokenIssuer()
+	if issuer == nil {
+		return nil
+	}
+
+	if !registered && !s.boundPeer(ctx, membership.GetDevice()) {
+		slog.Warn("refusing membership token", "device", membership.GetDevice(),
+			"error", ErrUnauthenticatedRegistration)
+		return status.Error(codes.PermissionDenied,
+			ErrUnauthenticatedRegistration.Error())
+	}
+
+	signed, claims, err := issuer.Issue(membership.GetDevice())
+	if err != nil {
+		slog.Error("signing membership token", "device",
+			membership.GetDevice(), "error", err)
+		return status.Error(codes.Internal, "signing membership token")
+	}
+
+	membership.Token = signed
+	slog.Info("issued membership token", "device", membership.GetDevice(),
+		"expires", claims.ExpiryTime())
+
+	return nil
+
+} //  End of  Service.signMembership
+
+// Verify the signed token of a communique - it needs to be issued to the
+// device and the communique within the token scopes. Returns the token
+// claims.
+func (s *Service) verifyToken(issuer *TokenIssuer, device string, communique *pb.Communique) (*token.Claims, error) {
+	claims, err := issuer.Verify(communique.GetCredentials().GetToken())
+	if err == nil && claims.Device != device {
+		err = fmt.Errorf("%w: issued to %q", ErrInvalidToken, claims.Device)
+	}
+
+	if err != nil {
+		slog.Warn("rejecting communique", "device", device, "error", err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	note := communique.GetNote()
+	topic := note.GetSubscription().GetTopic()
+	if NoteKind(note) == KIND_SUBSCRIPTION && !claims.AllowsTopic(topic) {
+		slog.Warn("rejecting subscription", "device", device, "topic", topic)
+		return nil, status.Errorf(codes.PermissionDenied,
+			"topic %q not in the token scopes", topic)
+	}
+
+	category := NoteCategory(note)
+	if category != pb.Category_CATEGORY_NONE_UNSPECIFIED && !claims.AllowsCategory(category) {
+		slog.Warn("rejecting communique", "device", device,
+			"category", category)
+		return nil, status.Errorf(codes.PermissionDenied,
+			"category %v not in the token scopes", category)
+	}
+
+	return claims, nil
+
+} //  End of  Service.verifyToken
@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/device"
+	"github.com/biota/go-grpc-telegraph/pkg/token"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a token issuer with an HMAC key for the tests.
+func testTokenIssuer(t *testing.T, lifetime time.Duration, scopes token.Scopes) *TokenIssuer {
+	key, err := token.NewHMACKey([]byte(TEST_HMAC_KEY))
+	if err != nil {
+		t.Fatalf("creating token key: %v", err)
+	}
+
+	return NewTokenIssuer(key, lifetime, scopes)
+
+} //  End of  testTokenIssuer
+
+// Test RecordCategory and NoteCategory functions.
+func TestCategories(t *testing.T) {
+	tests := []struct {
+		note     *pb.Note
+		category pb.Category
+	}{
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Metrics{}}), category: pb.Category_CATEGORY_METRICS},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Incident{}}), category: pb.Category_CATEGORY_INCIDENTS},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Status{}}), category: pb.Category_CATEGORY_TASKS},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Timing{}}), category: pb.Category_CATEGORY_TIMINGS},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Trace{}}), category: pb.Category_CATEGORY_TRACES},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Generic{}}), category: pb.Category_CATEGORY_OTHER},
+		{note: &pb.Note{Kind: &pb.Note_Generic{}}, category: pb.Category_CATEGORY_OTHER},
+		{note: recordNote(&pb.Record{Kind: &pb.Record_Ack{}})},
+		{note: &pb.Note{Kind: &pb.Note_Subscription{}}},
+		{note: nil},
+	}
+
+	for idx, step := range tests {
+		if category := NoteCategory(step.note); category != step.category {
+			t.Errorf("test %v expected %v, got %v", idx, step.category, category)
+		}
+	}
+
+} //  End of  TestCategories
+
+// Test ParseScopes function.
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		topics     string
+		categories string
+		scopes     token.Scopes
+		fails      bool
+	}{
+		{},
+		{
+			topics:     "news/#, weather/+/today",
+			categories: "metrics,CATEGORY_LOGS, ",
+			scopes: token.Scopes{
+				Topics:     []string{"news/#", "weather/+/today"},
+				Categories: []string{"CATEGORY_METRICS", "CATEGORY_LOGS"},
+			},
+		},
+		{topics: "news/#/sports", fails: true},
+		{categories: "gossip", fails: true},
+	}
+
+	for idx, step := range tests {
+		scopes, err := ParseScopes(step.topics, step.categories)
+		if step.fails {
+			if err == nil {
+				t.Errorf("test %v expected an error", idx)
+			}
+
+			continue
+		}
+
+		if err != nil || !slices.Equal(scopes.Topics, step.scopes.Topics) ||
+			!slices.Equal(scopes.Categories, step.scopes.Categories) {
+			t.Errorf("test %v expected %v, got %v %v", idx, step.scopes, scopes, err)
+		}
+	}
+
+} //  End of  TestParseScopes
+
+// Test the service config token issuer.
+func TestConfigTokenIssuer(t *testing.T) {
+	dir := t.TempDir()
+
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+
+	edPath := filepath.Join(dir, "token-ed25519.pem")
+	os.WriteFile(edPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+
+	hmacPath := filepath.Join(dir, "token.key")
+	os.WriteFile(hmacPath, []byte(TEST_HMAC_KEY+"\n"), 0o600)
+
+	tests := []struct {
+		key        string
+		topics     string
+		categories string
+		algorithm  string
+		fails      bool
+	}{
+		{},
+		{key: edPath, topics: "news/#", algorithm: token.ALG_EDDSA},
+		{key: hmacPath, categories: "metrics", algorithm: token.ALG_HS256},
+		{key: filepath.Join(dir, "404"), fails: true},
+		{key: hmacPath, topics: "news/#/sports", fails: true},
+		{key: hmacPath, categories: "gossip", fails: true},
+	}
+
+	for idx, step := range tests {
+		cfg := testConfig(t)
+		cfg.Service.TokenSigningKey = step.key
+		cfg.Service.TokenTopics = step.topics
+		cfg.Service.TokenCategories = step.categories
+
+		issuer, err := configTokenIssuer(cfg, nil)
+		if step.fails {
+			if err == nil {
+				t.Errorf("test %v expected an error", idx)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+			continue
+		}
+
+		if len(step.key) == 0 {
+			if issuer != nil {
+				t.Errorf("test %v expected no issuer, got %v", idx, issuer)
+			}
+
+			continue
+		}
+
+		if issuer.Key().Algorithm() != step.algorithm {
+			t.Errorf("test %v expected %v, got %v", idx, step.algorithm,
+				issuer.Key().Algorithm())
+		}
+
+		signed, _, err := issuer.Issue("news")
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+			continue
+		}
+
+		claims, err := issuer.Verify(signed)
+		if err != nil || claims.Device != "news" ||
+			time.Until(claims.ExpiryTime()) > cfg.Service.TokenLifetime {
+			t.Errorf("test %v unexpected claims %+v %v", idx, claims, err)
+		}
+	}
+
+} //  End of  TestConfigTokenIssuer
+
+// Test the signed token authenticator.
+func TestSignedTokenAuthenticator(t *testing.T) {
+	scopes := token.Scopes{Topics: []string{"news/#"}}
+	issuer := testTokenIssuer(t, time.Hour, scopes)
+	auth := NewSignedTokenAuthenticator(issuer.Key())
+
+	valid, _, _ := issuer.Issue("news")
+	expired, _, _ := issuer.Key().Issue("news", -time.Minute, scopes)
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{token: valid},
+		{token: expired, err: ErrTokenExpired},
+		{token: "junk", err: ErrInvalidToken},
+		{token: "", err: ErrInvalidToken},
+	}
+
+	for idx, step := range tests {
+		principal, err := auth.Authenticate(context.Background(), &pb.Credentials{Token: step.token})
+		if step.err != nil {
+			if !errors.Is(err, step.err) {
+				t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil || principal.Name != "news" || !slices.Equal(principal.Scopes.Topics, scopes.Topics) {
+			t.Errorf("test %v unexpected principal %+v %v", idx, principal, err)
+		}
+	}
+
+} //  End of  TestSignedTokenAuthenticator
+
+// Test verifying communiques with signed tokens.
+func TestVerifySignedToken(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	issuer := testTokenIssuer(t, time.Hour, token.Scopes{
+		Topics:     []string{"news/#"},
+		Categories: []string{"CATEGORY_METRICS"},
+	})
+
+	svc.UseTokenIssuer(issuer)
+
+	valid, _, _ := issuer.Issue("test-device")
+	other, _, _ := issuer.Issue("other-device")
+	expired, _, _ := issuer.Key().Issue("test-device", -time.Minute, token.Scopes{})
+
+	subscription := func(topic string) *pb.Note {
+		return &pb.Note{
+			Kind: &pb.Note_Subscription{
+				Subscription: &pb.Subscription{Topic: topic},
+			},
+		}
+	}
+
+	metrics := recordNote(&pb.Record{Kind: &pb.Record_Metrics{}})
+	incident := recordNote(&pb.Record{Kind: &pb.Record_Incident{}})
+	ack := recordNote(&pb.Record{Kind: &pb.Record_Ack{}})
+
+	tests := []struct {
+		token string
+		note  *pb.Note
+		code  codes.Code
+	}{
+		{token: valid, note: metrics, code: codes.OK},
+		{token: valid, note: ack, code: codes.OK},
+		{token: valid, note: subscription("news/sports"), code: codes.OK},
+		{token: valid, note: incident, code: codes.PermissionDenied},
+		{token: valid, note: subscription("gossip"), code: codes.PermissionDenied},
+		{token: valid, note: subscription("#"), code: codes.PermissionDenied},
+		{token: other, note: metrics, code: codes.Unauthenticated},
+		{token: expired, note: metrics, code: codes.Unauthenticated},
+		{token: "junk", note: metrics, code: codes.Unauthenticated},
+	}
+
+	ctx := context.Background()
+
+	for idx, step := range tests {
+		_, err := svc.verify(ctx, credentialsCommunique(step.token, step.note))
+		if code := status.Code(err); code != step.code {
+			t.Errorf("test %v expected %v, got %v", idx, step.code, err)
+		}
+	}
+
+	// No issuer, no signed tokens.
+	svc.UseTokenIssuer(nil)
+	if _, err := svc.verify(ctx, credentialsCommunique("junk", incident)); err != nil {
+		t.Errorf("unexpected error without an issuer: %v", err)
+	}
+
+} //  End of  TestVerifySignedToken
+
+// Test devices get signed membership tokens and refresh them.
+func TestSignedMembership(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	issuer := testTokenIssuer(t, time.Hour, token.Scopes{
+		Categories: []string{"CATEGORY_METRICS"},
+	})
+
+	svc.UseRegistrar(NewTokenRegistrar("let me inside"))
+	svc.UseTokenIssuer(issuer)
+
+	dialer := startServiceListener(t, svc)
+
+	cfg := testConfig(t)
+	cfg.Settings.Name = "test-device"
+	cfg.Device.ServiceAddress = "127.0.0.1"
+	cfg.Device.Token = "let me inside"
+
+	client, err := device.NewClient(cfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer client.Close()
+
+	ctx := context.Background()
+
+	membership, err := client.Join(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims, err := issuer.Verify(membership.GetToken())
+	if err != nil || claims.Device != "test-device" {
+		t.Fatalf("expected a signed membership token, got %+v %v", claims, err)
+	}
+
+	if _, err := client.SendMetrics(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.SendIncident(ctx, pb.Level_LEVEL_INFO, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	// Expired tokens are refreshed, even for communiques made with them.
+	stale := &token.Claims{
+		Device:   "test-device",
+		IssuedAt: time.Now().Add(-2 * time.Hour).Unix(),
+		Expires:  time.Now().Add(-time.Hour).Unix(),
+		Scopes:   claims.Scopes,
+	}
+
+	signed, _ := issuer.Key().Sign(stale)
+	client.SetMembership(&pb.Membership{Device: "test-device", Token: signed})
+
+	communique := client.Communique(recordNote(&pb.Record{Kind: &pb.Record_Metrics{}}))
+	if _, err := client.Dispatch(ctx, communique); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	refreshed := client.Membership().GetToken()
+	if refreshed == signed {
+		t.Errorf("expected the membership token to be refreshed")
+	}
+
+	if _, err := issuer.Verify(refreshed); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+} //  End of  TestSignedMembership
+
+// Test membership tokens are only minted for admitted or bound devices.
+func TestUnauthenticatedMembership(t *testing.T) {
+	dir := t.TempDir()
+
+	serviceCA := newTestAuthority(t, dir, "service")
+	deviceCA := newTestAuthority(t, dir, "device")
+
+	cfg := testConfig(t)
+	cfg.Settings.Cert, cfg.Settings.Key = serviceCA.issue(t, dir, "test-station",
+		x509.ExtKeyUsageServerAuth)
+	cfg.Service.CACertPatterns.Device = filepath.Join(dir, "device-ca-cert.pem")
+
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	issuer := testTokenIssuer(t, time.Hour, token.Scopes{})
+	svc.UseTokenIssuer(issuer)
+
+	dialer := startServiceListener(t, svc)
+
+	devcfg := testConfig(t)
+	devcfg.Settings.Name = "victim"
+	devcfg.Settings.Cert, devcfg.Settings.Key = deviceCA.issue(t, dir, "test-device",
+		x509.ExtKeyUsageClientAuth)
+	devcfg.Device.ServiceAddress = "127.0.0.1"
+	devcfg.Device.ServiceCACert = serviceCA.certPath
+
+	ctx := context.Background()
+
+	// No registrar and no binding - claiming to be a device gets nothing.
+	impostor, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer impostor.Close()
+
+	if _, err := impostor.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied registration, got %v", err)
+	}
+
+	if token := impostor.Membership().GetToken(); len(token) > 0 {
+		t.Errorf("expected no membership token, got %v", token)
+	}
+
+	_, err = impostor.SendMetrics(ctx)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+
+	// Devices bound to their certificates get their tokens.
+	extractor, _ := NewIdentityExtractor(IDENTITY_CN, "")
+	svc.UseIdentityExtractor(extractor)
+
+	if _, err := impostor.Join(ctx); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied for another device, got %v", err)
+	}
+
+	devcfg.Settings.Name = "test-device"
+
+	bound, err := device.NewClient(devcfg, dialer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer bound.Close()
+
+	membership, err := bound.Join(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if claims, err := issuer.Verify(membership.GetToken()); err != nil || claims.Device != "test-device" {
+		t.Errorf("expected a signed membership token, got %+v %v", claims, err)
+	}
+
+} //  End of  TestUnauthenticatedMembership
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"github.com/biota/go-grpc-telegraph/pkg/topic"
+)
+
+// MQTT-style hierarchical topics - see the topic package for the rules
+// the broker and the token scopes share.
+const (
+	TOPIC_SEPARATOR       = topic.SEPARATOR
+	TOPIC_WILDCARD_SINGLE = topic.WILDCARD_SINGLE
+	TOPIC_WILDCARD_MULTI  = topic.WILDCARD_MULTI
+)
+
+var (
+	// Invalid topic or topic filter.
+	ErrInvalidTopic = topic.ErrInvalidTopic
+)
+
+// Validate a topic filter used in a subscription.
+func ValidateTopicFilter(filter string) error {
+	return topic.ValidateFilter(filter)
+
+} // End of function  ValidateTopicFilter.
+
+// Validate a topic used to publish - no wildcards allowed.
+func ValidateTopic(name string) error {
+	return topic.Validate(name)
+
+} // End of function  ValidateTopic.
+
+// Returns true if a topic matches a (valid) topic filter.
+// As with MQTT, topics starting with "$" are reserved and are not
+// matched by a leading wildcard.
+func MatchTopic(filter, name string) bool {
+	return topic.Match(filter, name)
+
+} // End of function  MatchTopic.
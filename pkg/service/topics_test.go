@@ -0,0 +1,67 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Test wildcard subscriptions via the broker.
+func TestWildcardSubscriptions(t *testing.T) {
+	svc, err := NewService(testConfig(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := startService(t, svc)
+
+	tasks := subscribeAs(t, client, "device-1", "tasks/site-7/#")
+	sensors := subscribeAs(t, client, "device-2", "config/+/sensors")
+	waitForSubscribers(t, svc.Broker(), 2)
+
+	published := map[string]int{
+		"tasks/site-7/reboot":    1,
+		"tasks/site-7/upgrade/2": 1,
+		"tasks/site-8/reboot":    0,
+		"config/site-7/sensors":  1,
+		"config/site-7/lights":   0,
+	}
+
+	for topic, expected := range published {
+		n, err := svc.Publish(topic, namedPublication(topic))
+		if err != nil || n != expected {
+			t.Errorf("topic %v expected %v deliveries, got %v %v", topic,
+				expected, n, err)
+		}
+	}
+
+	received := map[string]bool{}
+	for idx := 0; idx < 2; idx++ {
+		name, topic := receivePublication(t, tasks)
+		if name != topic {
+			t.Errorf("expected topic label %v, got %v", name, topic)
+		}
+
+		received[topic] = true
+	}
+
+	if !received["tasks/site-7/reboot"] || !received["tasks/site-7/upgrade/2"] {
+		t.Errorf("expected both site-7 tasks, got %v", received)
+	}
+
+	if _, topic := receivePublication(t, sensors); topic != "config/site-7/sensors" {
+		t.Errorf("expected sensors config, got %v", topic)
+	}
+
+	if _, err := svc.Publish("tasks/+", namedPublication("x")); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("expected invalid topic error, got %v", err)
+	}
+
+	stream := subscribeAs(t, client, "device-3", "tasks/#/reboot")
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a bad filter, got %v", err)
+	}
+
+} //  End of  TestWildcardSubscriptions
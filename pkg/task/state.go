@@ -0,0 +1,94 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+var (
+	// Invalid task state transition.
+	ErrInvalidTransition = errors.New("invalid task state transition")
+)
+
+// Allowed task (and task step) state transitions. A status with no state
+// is a progress update and is only allowed while running.
+//
+//	NONE    -> INITIAL | QUEUED | RUNNING | REJECTED
+//	INITIAL -> QUEUED | RUNNING | ABORTED | REJECTED
+//	QUEUED  -> RUNNING | ABORTED | REJECTED | TIMED_OUT
+//	RUNNING -> COMPLETED | FAILED | ABORTED | TIMED_OUT
+//
+// The end states (COMPLETED, TIMED_OUT, ABORTED, FAILED and REJECTED)
+// don't transition anywhere.
+var transitions = map[pb.State][]pb.State{
+	pb.State_STATE_NONE_UNSPECIFIED: {
+		pb.State_STATE_INITIAL,
+		pb.State_STATE_QUEUED,
+		pb.State_STATE_RUNNING,
+		pb.State_STATE_REJECTED,
+	},
+
+	pb.State_STATE_INITIAL: {
+		pb.State_STATE_QUEUED,
+		pb.State_STATE_RUNNING,
+		pb.State_STATE_ABORTED,
+		pb.State_STATE_REJECTED,
+	},
+
+	pb.State_STATE_QUEUED: {
+		pb.State_STATE_RUNNING,
+		pb.State_STATE_ABORTED,
+		pb.State_STATE_REJECTED,
+		pb.State_STATE_TIMED_OUT,
+	},
+
+	pb.State_STATE_RUNNING: {
+		pb.State_STATE_COMPLETED,
+		pb.State_STATE_FAILED,
+		pb.State_STATE_ABORTED,
+		pb.State_STATE_TIMED_OUT,
+	},
+}
+
+// Returns true if the state is an end state.
+func IsFinal(state pb.State) bool {
+	switch state {
+	case pb.State_STATE_COMPLETED, pb.State_STATE_TIMED_OUT,
+		pb.State_STATE_ABORTED, pb.State_STATE_FAILED,
+		pb.State_STATE_REJECTED:
+		return true
+	}
+
+	return false
+
+} // End of function  IsFinal.
+
+// Returns true if a status with the state is a progress update.
+func IsProgress(state pb.State) bool {
+	return state == pb.State_STATE_NONE_UNSPECIFIED
+
+} // End of function  IsProgress.
+
+// Returns an error if moving from one state to another is not allowed.
+// Progress updates (no state) are only allowed while running.
+func CheckTransition(from, to pb.State) error {
+	if IsProgress(to) {
+		if from == pb.State_STATE_RUNNING {
+			return nil
+		}
+
+		return fmt.Errorf("%w: progress while %v", ErrInvalidTransition,
+			from)
+	}
+
+	for _, state := range transitions[from] {
+		if state == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %v to %v", ErrInvalidTransition, from, to)
+
+} // End of function  CheckTransition.
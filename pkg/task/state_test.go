@@ -0,0 +1,75 @@
+package task
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+// Test IsFinal and IsProgress functions.
+func TestStates(t *testing.T) {
+	final := map[pb.State]bool{
+		pb.State_STATE_NONE_UNSPECIFIED: false,
+		pb.State_STATE_INITIAL:          false,
+		pb.State_STATE_QUEUED:           false,
+		pb.State_STATE_RUNNING:          false,
+		pb.State_STATE_COMPLETED:        true,
+		pb.State_STATE_TIMED_OUT:        true,
+		pb.State_STATE_ABORTED:          true,
+		pb.State_STATE_FAILED:           true,
+		pb.State_STATE_REJECTED:         true,
+	}
+
+	for state, expected := range final {
+		if IsFinal(state) != expected {
+			t.Errorf("state %v expected final %v", state, expected)
+		}
+
+		if IsProgress(state) != (state == pb.State_STATE_NONE_UNSPECIFIED) {
+			t.Errorf("state %v unexpected progress", state)
+		}
+	}
+
+} //  End of  TestStates
+
+// Test CheckTransition function.
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from  pb.State
+		to    pb.State
+		valid bool
+	}{
+		{pb.State_STATE_NONE_UNSPECIFIED, pb.State_STATE_QUEUED, true},
+		{pb.State_STATE_NONE_UNSPECIFIED, pb.State_STATE_REJECTED, true},
+		{pb.State_STATE_NONE_UNSPECIFIED, pb.State_STATE_COMPLETED, false},
+		{pb.State_STATE_INITIAL, pb.State_STATE_QUEUED, true},
+		{pb.State_STATE_QUEUED, pb.State_STATE_RUNNING, true},
+		{pb.State_STATE_QUEUED, pb.State_STATE_TIMED_OUT, true},
+		{pb.State_STATE_QUEUED, pb.State_STATE_COMPLETED, false},
+		{pb.State_STATE_QUEUED, pb.State_STATE_NONE_UNSPECIFIED, false},
+		{pb.State_STATE_RUNNING, pb.State_STATE_NONE_UNSPECIFIED, true},
+		{pb.State_STATE_RUNNING, pb.State_STATE_COMPLETED, true},
+		{pb.State_STATE_RUNNING, pb.State_STATE_FAILED, true},
+		{pb.State_STATE_RUNNING, pb.State_STATE_TIMED_OUT, true},
+		{pb.State_STATE_RUNNING, pb.State_STATE_QUEUED, false},
+		{pb.State_STATE_RUNNING, pb.State_STATE_REJECTED, false},
+		{pb.State_STATE_COMPLETED, pb.State_STATE_RUNNING, false},
+		{pb.State_STATE_FAILED, pb.State_STATE_NONE_UNSPECIFIED, false},
+		{pb.State_STATE_REJECTED, pb.State_STATE_QUEUED, false},
+	}
+
+	for _, step := range tests {
+		err := CheckTransition(step.from, step.to)
+		if step.valid && err != nil {
+			t.Errorf("%v to %v unexpected error: %v", step.from, step.to,
+				err)
+		}
+
+		if !step.valid && !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("%v to %v expected an invalid transition, got %v",
+				step.from, step.to, err)
+		}
+	}
+
+} //  End of  TestCheckTransition
@@ -0,0 +1,153 @@
+package tls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var (
+	// Certificate revoked by its issuing CA.
+	ErrCertificateRevoked = errors.New("certificate revoked")
+)
+
+// Loads all certificate revocation lists from a file - either PEM format
+// (X509 CRL blocks) or a single DER encoded list.
+func LoadCRLs(path string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &LoadAssetErrors{Errors: []error{err}}
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, &LoadAssetErrors{Errors: []error{err}}
+		}
+
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	blocks, err := findBlocks(path, X509_CRL)
+	if err != nil {
+		return nil, &LoadAssetErrors{Errors: []error{err}}
+	}
+
+	crls := []*x509.RevocationList{}
+	errs := []error{}
+
+	for _, block := range blocks {
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err == nil {
+			crls = append(crls, crl)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return crls, &LoadAssetErrors{Errors: errs}
+	}
+
+	return crls, nil
+
+} //  End of function  LoadCRLs.
+
+// Certificate revocation lists by issuing CA (subject).
+type RevocationLists struct {
+	count  int
+	issuer map[string][]*x509.RevocationList
+}
+
+// Creates the revocation lists from the files matching the patterns.
+// Error indicates one or more assets failed to be loaded but the lists
+// still contain all the valid CRLs.
+func NewRevocationLists(patterns ...string) (*RevocationLists, error) {
+	paths, err := ExpandPatterns(patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RevocationLists{issuer: make(map[string][]*x509.RevocationList)}
+	errs := []error{}
+
+	for _, zpath := range paths {
+		crls, err := LoadCRLs(zpath)
+		if err != nil {
+			slog.Error("loading crl", "file", zpath, "error", err)
+			errs = append(errs, err)
+		}
+
+		for _, crl := range crls {
+			if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+				// Still better than nothing - use it.
+				slog.Warn("stale crl", "file", zpath,
+					"issuer", crl.Issuer, "next-update", crl.NextUpdate)
+			}
+
+			key := string(crl.RawIssuer)
+			r.issuer[key] = append(r.issuer[key], crl)
+			r.count++
+		}
+	}
+
+	if len(errs) > 0 {
+		return r, &LoadAssetErrors{Errors: errs}
+	}
+
+	return r, nil
+
+} //  End of function  NewRevocationLists.
+
+// Returns the number of revocation lists.
+func (r *RevocationLists) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	return r.count
+
+} //  End of  RevocationLists.Len
+
+// Returns true if a certificate was revoked by its issuer. Only the lists
+// signed by the issuer count.
+func (r *RevocationLists) Revoked(cert, issuer *x509.Certificate) bool {
+	if r.Len() == 0 {
+		return false
+	}
+
+	for _, crl := range r.issuer[string(issuer.RawSubject)] {
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			continue
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+
+} //  End of  RevocationLists.Revoked
+
+// Check a verified certificate chain (leaf first, root last) - returns an
+// error if any of the certificates was revoked by its issuer.
+func (r *RevocationLists) Check(chain []*x509.Certificate) error {
+	for idx := 0; idx+1 < len(chain); idx++ {
+		cert, issuer := chain[idx], chain[idx+1]
+		if r.Revoked(cert, issuer) {
+			return fmt.Errorf("%w: %v serial %v issued by %v",
+				ErrCertificateRevoked, cert.Subject, cert.SerialNumber,
+				issuer.Subject)
+		}
+	}
+
+	return nil
+
+} //  End of  RevocationLists.Check
@@ -0,0 +1,206 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Returns a DER encoded CRL revoking the certificates signed by a test CA.
+func testCRL(t *testing.T, caCert *x509.Certificate, caKey crypto.Signer,
+	revoked ...*x509.Certificate) []byte {
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+
+	for _, cert := range revoked {
+		entry := x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		}
+
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, entry)
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		t.Fatalf("creating crl: %v", err)
+	}
+
+	return der
+
+} //  End of  testCRL
+
+// Test LoadCRLs function.
+func TestLoadCRLs(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testCA(t, "test-ca")
+
+	der := testCRL(t, caCert, caKey)
+	block := &pem.Block{Type: X509_CRL, Bytes: der}
+
+	write := func(name string, data []byte) string {
+		zpath := filepath.Join(dir, name)
+		os.WriteFile(zpath, data, 0o600)
+		return zpath
+	}
+
+	tests := []struct {
+		path  string
+		count int
+		err   bool
+	}{
+		{path: write("crl.der", der), count: 1},
+		{path: write("crl.pem", pem.EncodeToMemory(block)), count: 1},
+		{path: write("crls.pem", append(pem.EncodeToMemory(block), pem.EncodeToMemory(block)...)), count: 2},
+		{path: write("junk.der", []byte("junk")), err: true},
+		{path: write("cert.pem", EncodeCertificates(caCert)), err: true},
+		{path: write("bad.pem", pem.EncodeToMemory(&pem.Block{Type: X509_CRL, Bytes: []byte("bad")})), err: true},
+		{path: filepath.Join(dir, "404.pem"), err: true},
+	}
+
+	for idx, step := range tests {
+		crls, err := LoadCRLs(step.path)
+		if step.err {
+			if _, ok := err.(*LoadAssetErrors); !ok {
+				t.Errorf("test %v expected load asset errors, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil || len(crls) != step.count {
+			t.Errorf("test %v expected %v crls, got %v %v", idx, step.count,
+				len(crls), err)
+		}
+	}
+
+} //  End of  TestLoadCRLs
+
+// Test RevocationLists functions.
+func TestRevocationLists(t *testing.T) {
+	dir := t.TempDir()
+
+	caCert, caKey := testCA(t, "test-ca")
+	imposterCA, imposterKey := testCA(t, "test-ca")
+
+	revoked := testClientCert(t, "revoked", caCert, caKey)
+	valid := testClientCert(t, "valid", caCert, caKey)
+	forged := testClientCert(t, "forged", caCert, caKey)
+
+	os.WriteFile(filepath.Join(dir, "ca.crl"), testCRL(t, caCert, caKey, revoked), 0o600)
+
+	// Same issuer name, but not signed by the CA - ignored.
+	os.WriteFile(filepath.Join(dir, "imposter.crl"),
+		testCRL(t, imposterCA, imposterKey, forged), 0o600)
+
+	lists, err := NewRevocationLists(filepath.Join(dir, "*.crl"))
+	if err != nil || lists.Len() != 2 {
+		t.Fatalf("expected 2 crls, got %v %v", lists.Len(), err)
+	}
+
+	tests := []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{
+		{cert: revoked, revoked: true},
+		{cert: valid, revoked: false},
+		{cert: forged, revoked: false},
+	}
+
+	for idx, step := range tests {
+		if r := lists.Revoked(step.cert, caCert); r != step.revoked {
+			t.Errorf("test %v expected revoked %v, got %v", idx, step.revoked, r)
+		}
+
+		err := lists.Check([]*x509.Certificate{step.cert, caCert})
+		if step.revoked != errors.Is(err, ErrCertificateRevoked) {
+			t.Errorf("test %v unexpected check error: %v", idx, err)
+		}
+	}
+
+	var none *RevocationLists
+	if none.Len() != 0 || none.Check([]*x509.Certificate{revoked, caCert}) != nil {
+		t.Errorf("expected no revocation checks for no crls")
+	}
+
+	// Bad files are reported, but the good ones still make it in.
+	os.WriteFile(filepath.Join(dir, "bad.crl"), []byte("bad"), 0o600)
+
+	lists, err = NewRevocationLists(filepath.Join(dir, "*.crl"))
+	if _, ok := err.(*LoadAssetErrors); !ok || lists == nil || lists.Len() != 2 {
+		t.Errorf("expected load asset errors and crls, got %v %v", lists, err)
+	}
+
+	if _, err := NewRevocationLists("[-]"); err == nil {
+		t.Errorf("expected an error for a bad pattern")
+	}
+
+} //  End of  TestRevocationLists
+
+// Test revoked client certificates are rejected - also once the CRLs
+// change under a reloader.
+func TestClientCAPoolsRevocation(t *testing.T) {
+	dir := t.TempDir()
+	deviceCA, deviceKey := testCA(t, "device-ca")
+
+	os.WriteFile(filepath.Join(dir, "device-cacert.pem"),
+		EncodeCertificates(deviceCA), 0o600)
+
+	leaked := testClientCert(t, "leaked", deviceCA, deviceKey)
+	device := testClientCert(t, "device", deviceCA, deviceKey)
+
+	crlPath := filepath.Join(dir, "device.crl")
+	os.WriteFile(crlPath, testCRL(t, deviceCA, deviceKey), 0o600)
+
+	patterns := config.CACertificatesPattern{
+		Device: filepath.Join(dir, "*-cacert.pem"),
+		CRL:    filepath.Join(dir, "*.crl"),
+	}
+
+	certPath := getPath(SERVICE, "cert.pem")
+	keyPath := getPath(SERVICE, "key.pem")
+
+	reloader, err := NewServiceReloader(certPath, keyPath, nil, patterns, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pool := reloader.Pools().Pool(leaked); pool != POOL_DEVICE {
+		t.Errorf("expected device pool before revocation, got %q", pool)
+	}
+
+	os.WriteFile(crlPath, testCRL(t, deviceCA, deviceKey, leaked), 0o600)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(crlPath, later, later)
+
+	if changed, err := reloader.Check(); !changed || err != nil {
+		t.Fatalf("expected a reload, got %v %v", changed, err)
+	}
+
+	pools := reloader.Pools()
+	if err := pools.VerifyPeerCertificate([][]byte{leaked.Raw}, nil); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("expected revoked certificate error, got %v", err)
+	}
+
+	if pool := pools.Pool(leaked); pool != POOL_NONE {
+		t.Errorf("expected no pool for a revoked certificate, got %q", pool)
+	}
+
+	if pool := pools.Pool(device); pool != POOL_DEVICE {
+		t.Errorf("expected device pool, got %q", pool)
+	}
+
+} //  End of  TestClientCAPoolsRevocation
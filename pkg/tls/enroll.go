@@ -0,0 +1,138 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// Size (in bits) of the random certificate serial numbers.
+	SERIAL_NUMBER_BITS = 128
+
+	// Backdate issued certificates to allow for clock skew.
+	CLOCK_SKEW_ALLOWANCE = time.Duration(5) * time.Minute
+)
+
+var (
+	// Not a usable certificate signing request.
+	ErrInvalidCertificateRequest = errors.New("invalid certificate request")
+)
+
+// Generate a new (ECDSA P-256) private key.
+func GenerateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+} //  End of function  GenerateKey.
+
+// Returns the PEM encoded (PKCS #8) private key.
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: PRIVATE_KEY, Bytes: der}), nil
+
+} //  End of function  EncodePrivateKey.
+
+// Returns the PEM encoded certificates.
+func EncodeCertificates(certs ...*x509.Certificate) []byte {
+	data := []byte{}
+	for _, cert := range certs {
+		block := &pem.Block{Type: CERTIFICATE, Bytes: cert.Raw}
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+
+	return data
+
+} //  End of function  EncodeCertificates.
+
+// Create a PEM encoded certificate signing request for a common name.
+func CreateCertificateRequest(name string, key crypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: CERTIFICATE_REQUEST, Bytes: der}
+	return pem.EncodeToMemory(block), nil
+
+} //  End of function  CreateCertificateRequest.
+
+// Parse a PEM or DER encoded certificate signing request and check its
+// signature.
+func ParseCertificateRequest(data []byte) (*x509.CertificateRequest, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != CERTIFICATE_REQUEST {
+			return nil, fmt.Errorf("%w: unexpected PEM type %v",
+				ErrInvalidCertificateRequest, block.Type)
+		}
+
+		der = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificateRequest, err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificateRequest, err)
+	}
+
+	return csr, nil
+
+} //  End of function  ParseCertificateRequest.
+
+// Sign a certificate signing request with a CA certificate and key.
+// The issued certificate is a client (device) certificate for the common
+// name of the request - any other names in the request are ignored.
+// Returns the issued certificate.
+func SignCertificateRequest(csr *x509.CertificateRequest, caCert *x509.Certificate,
+	caKey crypto.Signer, lifetime time.Duration) (*x509.Certificate, error) {
+
+	if len(csr.Subject.CommonName) == 0 {
+		return nil, fmt.Errorf("%w: missing common name",
+			ErrInvalidCertificateRequest)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), SERIAL_NUMBER_BITS))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:             now.Add(-CLOCK_SKEW_ALLOWANCE),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert,
+		csr.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+
+} //  End of function  SignCertificateRequest.
@@ -0,0 +1,146 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Issue a test certificate from a template - self-signed if there's no
+// CA, with a fresh serial number and validity unless the template sets
+// them. This is the one certificate builder for the package tests (the
+// pki package imports this one so its helpers can't be used here).
+// Returns the certificate and its key.
+func issueTestCert(t *testing.T, template, caCert *x509.Certificate,
+	caKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	parent, signer := template, key
+	if caCert != nil {
+		parent, signer = caCert, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		key.Public(), signer)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+
+	return cert, key
+
+} //  End of  issueTestCert
+
+// Returns a new self-signed test CA certificate and key.
+func testCA(t *testing.T, name string) (*x509.Certificate, crypto.Signer) {
+	return issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+
+} //  End of  testCA
+
+// Test certificate request creation and signing.
+func TestSignCertificateRequest(t *testing.T) {
+	caCert, caKey := testCA(t, "test-ca")
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if data, err := EncodePrivateKey(key); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if block, _ := pem.Decode(data); block == nil || block.Type != PRIVATE_KEY {
+		t.Errorf("expected a PEM private key, got %v", string(data))
+	}
+
+	data, err := CreateCertificateRequest("test-device", key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != CERTIFICATE_REQUEST {
+		t.Fatalf("expected a PEM certificate request, got %v", string(data))
+	}
+
+	for _, encoded := range [][]byte{data, block.Bytes} {
+		csr, err := ParseCertificateRequest(encoded)
+		if err != nil || csr.Subject.CommonName != "test-device" {
+			t.Errorf("unexpected certificate request %v %v", csr, err)
+		}
+	}
+
+	invalid := [][]byte{
+		nil,
+		[]byte("not a certificate request"),
+		EncodeCertificates(caCert),
+	}
+
+	for idx, encoded := range invalid {
+		if _, err := ParseCertificateRequest(encoded); !errors.Is(err, ErrInvalidCertificateRequest) {
+			t.Errorf("test %v expected invalid request, got %v", idx, err)
+		}
+	}
+
+	csr, _ := ParseCertificateRequest(data)
+	cert, err := SignCertificateRequest(csr, caCert, caKey, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cert.Subject.CommonName != "test-device" {
+		t.Errorf("expected device common name, got %v", cert.Subject)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	opts := x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if _, err := cert.Verify(opts); err != nil {
+		t.Errorf("expected issued certificate to verify, got %v", err)
+	}
+
+	if certs := EncodeCertificates(cert, caCert); len(certs) == 0 {
+		t.Errorf("expected encoded certificates")
+	}
+
+	csr.Subject.CommonName = ""
+	if _, err := SignCertificateRequest(csr, caCert, caKey, time.Hour); !errors.Is(err, ErrInvalidCertificateRequest) {
+		t.Errorf("expected missing common name error, got %v", err)
+	}
+
+} //  End of  TestSignCertificateRequest
@@ -0,0 +1,246 @@
+package tls
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+var (
+	// Certificate past its NotAfter time.
+	ErrCertificateExpired = errors.New("certificate expired")
+
+	// Certificate before its NotBefore time.
+	ErrCertificateNotYetValid = errors.New("certificate not yet valid")
+)
+
+// Certificate details - what's worth knowing about a certificate before
+// it fails a handshake.
+type CertificateInfo struct {
+	File          string
+	Subject       string
+	Issuer        string
+	SANs          []string
+	KeyType       string
+	SerialNumber  string
+	IsCA          bool
+	NotBefore     time.Time
+	NotAfter      time.Time
+	DaysRemaining int
+}
+
+// Returns the subject alternative names of a certificate.
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return append(names, cert.EmailAddresses...)
+
+} //  End of function  subjectAltNames.
+
+// Returns the details of a certificate as of `now`.
+func InspectCertificate(cert *x509.Certificate, now time.Time) CertificateInfo {
+	remaining := cert.NotAfter.Sub(now).Hours() / 24
+
+	return CertificateInfo{
+		Subject:       cert.Subject.String(),
+		Issuer:        cert.Issuer.String(),
+		SANs:          subjectAltNames(cert),
+		KeyType:       KeyType(cert.PublicKey),
+		SerialNumber:  cert.SerialNumber.String(),
+		IsCA:          cert.IsCA,
+		NotBefore:     cert.NotBefore,
+		NotAfter:      cert.NotAfter,
+		DaysRemaining: int(math.Floor(remaining)),
+	}
+
+} //  End of function  InspectCertificate.
+
+// Returns the details of all PEM format certificates in a file.
+func InspectCertificates(path string) ([]CertificateInfo, error) {
+	certs, err := LoadCertificates(path)
+
+	now := time.Now()
+	infos := []CertificateInfo{}
+
+	for _, cert := range certs {
+		info := InspectCertificate(cert, now)
+		info.File = path
+		infos = append(infos, info)
+	}
+
+	return infos, err
+
+} //  End of function  InspectCertificates.
+
+// Returns all the certificate and CA certificate files in the config.
+// Enrolled device certificates only count once they exist.
+func ConfigCertificateFiles(cfg *config.Config) ([]string, error) {
+	paths := []string{}
+	for _, zpath := range []string{cfg.Settings.Cert, cfg.Device.ServiceCACert} {
+		if len(zpath) > 0 {
+			paths = append(paths, zpath)
+		}
+	}
+
+	if zpath := cfg.Device.EnrolledCert; len(zpath) > 0 {
+		if _, err := os.Stat(zpath); err == nil {
+			paths = append(paths, zpath)
+		}
+	}
+
+	patterns := cfg.Service.CACertPatterns
+	matches, err := ExpandPatterns(patterns.Bootstrap, patterns.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	paths = append(paths, matches...)
+
+	if zpath := cfg.Service.SigningCACert; len(zpath) > 0 {
+		paths = append(paths, zpath)
+	}
+
+	return paths, nil
+
+} //  End of function  ConfigCertificateFiles.
+
+// Returns the details of every certificate in the config files.
+// Error indicates one or more files failed to be loaded, but the details
+// still cover all the valid certificates.
+func InspectConfig(cfg *config.Config) ([]CertificateInfo, error) {
+	paths, err := ConfigCertificateFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []CertificateInfo{}
+	errs := []error{}
+
+	for _, zpath := range paths {
+		found, err := InspectCertificates(zpath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", zpath, err))
+		}
+
+		infos = append(infos, found...)
+	}
+
+	if len(errs) > 0 {
+		return infos, &LoadAssetErrors{Errors: errs}
+	}
+
+	return infos, nil
+
+} //  End of function  InspectConfig.
+
+// Returns true if the certificate expired as of `now`.
+func (i CertificateInfo) Expired(now time.Time) bool {
+	return now.After(i.NotAfter)
+
+} //  End of  CertificateInfo.Expired
+
+// Returns true if the certificate is not valid yet as of `now`.
+func (i CertificateInfo) NotYetValid(now time.Time) bool {
+	return now.Before(i.NotBefore)
+
+} //  End of  CertificateInfo.NotYetValid
+
+// Returns true if the (still valid) certificate expires within `window`
+// of `now`.
+func (i CertificateInfo) ExpiresWithin(window time.Duration, now time.Time) bool {
+	return !i.Expired(now) && now.Add(window).After(i.NotAfter)
+
+} //  End of  CertificateInfo.ExpiresWithin
+
+// Check the certificates are valid as of `now` - returns the expired and
+// not yet valid certificates as load asset errors.
+func CheckValidity(infos []CertificateInfo, now time.Time) error {
+	errs := []error{}
+
+	for _, info := range infos {
+		if info.Expired(now) {
+			errs = append(errs, fmt.Errorf("%v: %w: %v on %v", info.File,
+				ErrCertificateExpired, info.Subject, info.NotAfter))
+		}
+
+		if info.NotYetValid(now) {
+			errs = append(errs, fmt.Errorf("%v: %w: %v until %v", info.File,
+				ErrCertificateNotYetValid, info.Subject, info.NotBefore))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &LoadAssetErrors{Errors: errs}
+	}
+
+	return nil
+
+} //  End of function  CheckValidity.
+
+// Validate the TLS config artifacts if the config asks for it (see
+// VALIDATE_TLS_CONFIG) - fails on certificates that don't load, are
+// expired or are not valid yet.
+func ValidateConfig(cfg *config.Config) error {
+	if !cfg.Settings.ValidateTLS {
+		return nil
+	}
+
+	infos, err := InspectConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	return CheckValidity(infos, time.Now())
+
+} //  End of function  ValidateConfig.
+
+// Log warnings for the certificates in the config that expire within the
+// expiry warning window and errors for the ones already expired.
+// Returns the number of certificates warned about.
+func WarnExpiring(cfg *config.Config) int {
+	window := cfg.Settings.CertExpiryWarning
+	if window <= 0 {
+		return 0
+	}
+
+	infos, _ := InspectConfig(cfg)
+
+	now := time.Now()
+	count := 0
+
+	for _, info := range infos {
+		switch {
+		case info.Expired(now):
+			slog.Error("certificate expired", "file", info.File,
+				"subject", info.Subject, "issuer", info.Issuer,
+				"expired", info.NotAfter)
+
+		case info.ExpiresWithin(window, now):
+			slog.Warn("certificate expiring", "file", info.File,
+				"subject", info.Subject, "issuer", info.Issuer,
+				"days", info.DaysRemaining, "expires", info.NotAfter)
+
+		default:
+			continue
+		}
+
+		count++
+	}
+
+	return count
+
+} //  End of function  WarnExpiring.
@@ -0,0 +1,172 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Write a certificate valid between two times issued by a test CA.
+func writeDatedCert(t *testing.T, path string, notBefore, notAfter time.Time,
+	caCert *x509.Certificate, caKey crypto.Signer) *x509.Certificate {
+
+	cert, _ := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: filepath.Base(path)},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}, caCert, caKey)
+
+	if err := os.WriteFile(path, EncodeCertificates(cert), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+
+	return cert
+
+} //  End of  writeDatedCert
+
+// Test InspectCertificate function.
+func TestInspectCertificate(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testCA(t, "test-ca")
+
+	now := time.Now()
+	cert := writeDatedCert(t, filepath.Join(dir, "cert.pem"), now.Add(-time.Hour),
+		now.Add(10*24*time.Hour+time.Hour), caCert, caKey)
+
+	info := InspectCertificate(cert, now)
+	if info.Subject != "CN=cert.pem" || info.Issuer != "CN=test-ca" {
+		t.Errorf("unexpected subject/issuer %v", info)
+	}
+
+	if len(info.SANs) != 2 || info.SANs[0] != "localhost" || info.SANs[1] != "127.0.0.1" {
+		t.Errorf("unexpected subject alternative names %v", info.SANs)
+	}
+
+	if info.KeyType != "ECDSA P-256" || info.IsCA || info.DaysRemaining != 10 {
+		t.Errorf("unexpected certificate details %v", info)
+	}
+
+	if InspectCertificate(caCert, now).IsCA != true {
+		t.Errorf("expected a CA certificate")
+	}
+
+	tests := []struct {
+		now         time.Time
+		expired     bool
+		notYetValid bool
+		expiring    bool
+	}{
+		{now: now},
+		{now: now.Add(9 * 24 * time.Hour), expiring: true},
+		{now: now.Add(20 * 24 * time.Hour), expired: true},
+		{now: now.Add(-2 * time.Hour), notYetValid: true},
+	}
+
+	for idx, step := range tests {
+		if info.Expired(step.now) != step.expired {
+			t.Errorf("test %v expected expired %v", idx, step.expired)
+		}
+
+		if info.NotYetValid(step.now) != step.notYetValid {
+			t.Errorf("test %v expected not yet valid %v", idx, step.notYetValid)
+		}
+
+		if info.ExpiresWithin(7*24*time.Hour, step.now) != step.expiring {
+			t.Errorf("test %v expected expiring %v", idx, step.expiring)
+		}
+
+		err := CheckValidity([]CertificateInfo{info}, step.now)
+		if errors.Is(err, ErrCertificateExpired) != step.expired {
+			t.Errorf("test %v unexpected validity error: %v", idx, err)
+		}
+
+		if errors.Is(err, ErrCertificateNotYetValid) != step.notYetValid {
+			t.Errorf("test %v unexpected validity error: %v", idx, err)
+		}
+	}
+
+} //  End of  TestInspectCertificate
+
+// Test InspectConfig, ValidateConfig and WarnExpiring functions.
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testCA(t, "test-ca")
+
+	// The test CA expires in an hour - don't have it warned about.
+	now := time.Now()
+	writeDatedCert(t, filepath.Join(dir, "device-cacert.pem"), now.Add(-time.Hour),
+		now.Add(365*24*time.Hour), caCert, caKey)
+
+	valid := filepath.Join(dir, "valid.pem")
+	writeDatedCert(t, valid, now.Add(-time.Hour), now.Add(365*24*time.Hour), caCert, caKey)
+
+	expiring := filepath.Join(dir, "expiring.pem")
+	writeDatedCert(t, expiring, now.Add(-time.Hour), now.Add(24*time.Hour), caCert, caKey)
+
+	expired := filepath.Join(dir, "expired.pem")
+	writeDatedCert(t, expired, now.Add(-2*time.Hour), now.Add(-time.Hour), caCert, caKey)
+
+	future := filepath.Join(dir, "future.pem")
+	writeDatedCert(t, future, now.Add(time.Hour), now.Add(2*time.Hour), caCert, caKey)
+
+	tests := []struct {
+		cert     string
+		validate bool
+		count    int
+		warned   int
+		err      error
+	}{
+		{cert: valid, validate: true, count: 2},
+		{cert: expiring, validate: true, count: 2, warned: 1},
+		{cert: expired, validate: true, count: 2, warned: 1, err: ErrCertificateExpired},
+		{cert: expired, validate: false, count: 2, warned: 1},
+		{cert: future, validate: true, count: 2, warned: 1, err: ErrCertificateNotYetValid},
+	}
+
+	for idx, step := range tests {
+		cfg, _ := config.NewConfig("TLS_TEST", "")
+		cfg.Settings.ValidateTLS = step.validate
+		cfg.Settings.Cert = step.cert
+		cfg.Service.CACertPatterns.Device = filepath.Join(dir, "*-cacert.pem")
+		cfg.Device.EnrolledCert = filepath.Join(dir, "404.pem")
+
+		infos, err := InspectConfig(cfg)
+		if err != nil || len(infos) != step.count {
+			t.Errorf("test %v expected %v certificates, got %v %v", idx,
+				step.count, len(infos), err)
+		}
+
+		err = ValidateConfig(cfg)
+		if step.err == nil && err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+		}
+
+		if step.err != nil && !errors.Is(err, step.err) {
+			t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+		}
+
+		if warned := WarnExpiring(cfg); warned != step.warned {
+			t.Errorf("test %v expected %v warnings, got %v", idx, step.warned, warned)
+		}
+	}
+
+	// Files that don't load fail validation.
+	cfg, _ := config.NewConfig("TLS_TEST", "")
+	cfg.Settings.ValidateTLS = true
+	cfg.Settings.Cert = filepath.Join(dir, "404.pem")
+
+	if _, ok := ValidateConfig(cfg).(*LoadAssetErrors); !ok {
+		t.Errorf("expected load asset errors for a missing certificate")
+	}
+
+} //  End of  TestValidateConfig
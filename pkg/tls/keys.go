@@ -0,0 +1,100 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Key algorithms.
+const (
+	KEY_ALGORITHM_RSA     = "RSA"
+	KEY_ALGORITHM_ECDSA   = "ECDSA"
+	KEY_ALGORITHM_ED25519 = "Ed25519"
+)
+
+var (
+	// PEM block types holding private keys.
+	privateKeyTypes = []string{
+		EC_PRIVATE_KEY,
+		RSA_PRIVATE_KEY,
+		PRIVATE_KEY,
+		ENCRYPTED_PRIVATE_KEY,
+	}
+
+	// Key of a type we don't do.
+	ErrUnsupportedKey = errors.New("unsupported key type")
+
+	// Private key doesn't match the certificate public key.
+	ErrKeyMismatch = errors.New("private key does not match certificate")
+)
+
+// Returns the public key of a public or private key.
+func publicKey(key any) any {
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Public()
+	}
+
+	return key
+
+} //  End of function  publicKey.
+
+// Returns the algorithm and size (in bits) of a public or private key.
+func KeyAlgorithm(key any) (string, int, error) {
+	switch k := publicKey(key).(type) {
+	case *rsa.PublicKey:
+		return KEY_ALGORITHM_RSA, k.N.BitLen(), nil
+
+	case *ecdsa.PublicKey:
+		return KEY_ALGORITHM_ECDSA, k.Curve.Params().BitSize, nil
+
+	case ed25519.PublicKey:
+		return KEY_ALGORITHM_ED25519, 8 * ed25519.PublicKeySize, nil
+	}
+
+	return "", 0, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+
+} //  End of function  KeyAlgorithm.
+
+// Returns the algorithm and size of a public or private key, ala
+// "ECDSA P-256" or "RSA 2048".
+func KeyType(key any) string {
+	algorithm, size, err := KeyAlgorithm(key)
+	if err != nil {
+		return fmt.Sprintf("unknown %T", key)
+	}
+
+	switch k := publicKey(key).(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("%v %v", algorithm, k.Curve.Params().Name)
+
+	case ed25519.PublicKey:
+		return algorithm
+	}
+
+	return fmt.Sprintf("%v %v", algorithm, size)
+
+} //  End of function  KeyType.
+
+// Check a private key matches the public key of a certificate.
+func KeyMatchesCertificate(key any, cert *x509.Certificate) error {
+	public, ok := publicKey(key).(interface {
+		Equal(crypto.PublicKey) bool
+	})
+
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+
+	if !public.Equal(cert.PublicKey) {
+		return fmt.Errorf("%w: %v %v", ErrKeyMismatch, KeyType(key),
+			cert.Subject)
+	}
+
+	return nil
+
+} //  End of function  KeyMatchesCertificate.
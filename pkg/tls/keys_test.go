@@ -0,0 +1,148 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test KeyAlgorithm and KeyType functions.
+func TestKeyAlgorithm(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		key       any
+		algorithm string
+		size      int
+		kind      string
+	}{
+		{key: ecKey, algorithm: KEY_ALGORITHM_ECDSA, size: 384, kind: "ECDSA P-384"},
+		{key: &ecKey.PublicKey, algorithm: KEY_ALGORITHM_ECDSA, size: 384, kind: "ECDSA P-384"},
+		{key: rsaKey, algorithm: KEY_ALGORITHM_RSA, size: 2048, kind: "RSA 2048"},
+		{key: &rsaKey.PublicKey, algorithm: KEY_ALGORITHM_RSA, size: 2048, kind: "RSA 2048"},
+		{key: edKey, algorithm: KEY_ALGORITHM_ED25519, size: 256, kind: "Ed25519"},
+		{key: edKey.Public(), algorithm: KEY_ALGORITHM_ED25519, size: 256, kind: "Ed25519"},
+		{key: "junk", kind: "unknown string"},
+	}
+
+	for idx, step := range tests {
+		algorithm, size, err := KeyAlgorithm(step.key)
+		if len(step.algorithm) == 0 {
+			if !errors.Is(err, ErrUnsupportedKey) {
+				t.Errorf("test %v expected unsupported key, got %v", idx, err)
+			}
+		} else if err != nil || algorithm != step.algorithm || size != step.size {
+			t.Errorf("test %v expected %v %v, got %v %v %v", idx,
+				step.algorithm, step.size, algorithm, size, err)
+		}
+
+		if kind := KeyType(step.key); kind != step.kind {
+			t.Errorf("test %v expected %q, got %q", idx, step.kind, kind)
+		}
+	}
+
+} //  End of  TestKeyAlgorithm
+
+// Test loading all the private key block types.
+func TestLoadPrivateKeyTypes(t *testing.T) {
+	dir := t.TempDir()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaDER := x509.MarshalPKCS1PrivateKey(rsaKey)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	encrypted, _ := EncryptPrivateKey(edKey, []byte("secret"))
+
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: EC_PRIVATE_KEY, Bytes: ecDER})
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: RSA_PRIVATE_KEY, Bytes: rsaDER})
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: PRIVATE_KEY, Bytes: edDER})
+
+	write := func(name string, blocks ...[]byte) string {
+		data := []byte{}
+		for _, block := range blocks {
+			data = append(data, block...)
+		}
+
+		zpath := filepath.Join(dir, name)
+		os.WriteFile(zpath, data, 0o600)
+		return zpath
+	}
+
+	tests := []struct {
+		path       string
+		algorithms []string
+	}{
+		{path: write("ec.pem", ecPEM), algorithms: []string{KEY_ALGORITHM_ECDSA}},
+		{path: write("rsa.pem", rsaPEM), algorithms: []string{KEY_ALGORITHM_RSA}},
+		{path: write("ed25519.pem", edPEM), algorithms: []string{KEY_ALGORITHM_ED25519}},
+		{path: write("encrypted.pem", encrypted), algorithms: []string{KEY_ALGORITHM_ED25519}},
+		{
+			path:       write("all.pem", ecPEM, rsaPEM, edPEM, encrypted),
+			algorithms: []string{KEY_ALGORITHM_ECDSA, KEY_ALGORITHM_RSA, KEY_ALGORITHM_ED25519, KEY_ALGORITHM_ED25519},
+		},
+	}
+
+	for idx, step := range tests {
+		keys, err := LoadPrivateKeys(step.path, StaticPassphrase("secret"))
+		if err != nil || len(keys) != len(step.algorithms) {
+			t.Errorf("test %v expected %v keys, got %v %v", idx,
+				len(step.algorithms), len(keys), err)
+			continue
+		}
+
+		for n, key := range keys {
+			if algorithm, _, _ := KeyAlgorithm(key); algorithm != step.algorithms[n] {
+				t.Errorf("test %v key %v expected %v, got %v", idx, n,
+					step.algorithms[n], algorithm)
+			}
+		}
+	}
+
+} //  End of  TestLoadPrivateKeyTypes
+
+// Test KeyMatchesCertificate function.
+func TestKeyMatchesCertificate(t *testing.T) {
+	caCert, caKey := testCA(t, "test-ca")
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := GenerateKey()
+
+	tests := []struct {
+		key  crypto.Signer
+		cert *x509.Certificate
+		err  error
+	}{
+		{key: caKey, cert: caCert},
+		{key: otherKey, cert: caCert, err: ErrKeyMismatch},
+		{key: edKey, cert: caCert, err: ErrKeyMismatch},
+	}
+
+	for idx, step := range tests {
+		err := KeyMatchesCertificate(step.key, step.cert)
+		if step.err == nil && err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+		}
+
+		if step.err != nil && !errors.Is(err, step.err) {
+			t.Errorf("test %v expected error %v, got %v", idx, step.err, err)
+		}
+	}
+
+	if err := KeyMatchesCertificate("junk", caCert); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("expected unsupported key error, got %v", err)
+	}
+
+} //  End of  TestKeyMatchesCertificate
@@ -0,0 +1,86 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Returns the passphrase for the encrypted private key in a file.
+type PassphraseFunc func(keyPath string) ([]byte, error)
+
+// Returns a passphrase source for a fixed passphrase.
+func StaticPassphrase(passphrase string) PassphraseFunc {
+	return func(string) ([]byte, error) {
+		return []byte(passphrase), nil
+	}
+
+} //  End of function  StaticPassphrase.
+
+// Returns a passphrase source reading the passphrase from an environment
+// variable.
+func PassphraseFromEnv(name string) PassphraseFunc {
+	return func(string) ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v not set", ErrNoPassphrase, name)
+		}
+
+		return []byte(value), nil
+	}
+
+} //  End of function  PassphraseFromEnv.
+
+// Returns a passphrase source reading the passphrase from (the first line
+// of) a file - re-read every time, so it can be rotated with the key.
+func PassphraseFromFile(path string) PassphraseFunc {
+	return func(string) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNoPassphrase, err)
+		}
+
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), nil
+	}
+
+} //  End of function  PassphraseFromFile.
+
+// Returns the passphrase source for the config - the passphrase file or
+// the passphrase setting. Nil if the config has neither.
+func ConfigPassphrase(cfg *config.Config) PassphraseFunc {
+	if zpath := cfg.Settings.KeyPassphraseFile; len(zpath) > 0 {
+		return PassphraseFromFile(zpath)
+	}
+
+	if len(cfg.Settings.KeyPassphrase) > 0 {
+		return StaticPassphrase(cfg.Settings.KeyPassphrase)
+	}
+
+	return nil
+
+} //  End of function  ConfigPassphrase.
+
+// Decrypt an encrypted private key PEM block from a file with the
+// passphrase source - returns the unencrypted PKCS#8 PEM block.
+func decryptBlock(keyPath string, block *pem.Block, passphrase PassphraseFunc) (*pem.Block, error) {
+	if passphrase == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPassphrase, keyPath)
+	}
+
+	secret, err := passphrase(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := DecryptPKCS8PrivateKey(block.Bytes, secret)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", keyPath, err)
+	}
+
+	return &pem.Block{Type: PRIVATE_KEY, Bytes: der}, nil
+
+} //  End of function  decryptBlock.
@@ -0,0 +1,285 @@
+package tls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+const (
+	// PBKDF2 iterations and salt size for the keys we encrypt.
+	PBKDF2_ITERATIONS = 200000
+	PBKDF2_SALT_SIZE  = 16
+)
+
+var (
+	// Encrypted private key, but no passphrase to decrypt it with.
+	ErrNoPassphrase = errors.New("no passphrase for encrypted private key")
+
+	// Encrypted private key didn't decrypt - most likely the wrong
+	// passphrase.
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase for encrypted private key")
+
+	// Encrypted private key uses an algorithm we don't do.
+	ErrUnsupportedEncryption = errors.New("unsupported private key encryption")
+)
+
+// PKCS#5 v2 (RFC 8018) object identifiers.
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// PKCS#8 EncryptedPrivateKeyInfo.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// PBES2 parameters.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// PBKDF2 parameters - the PRF defaults to HMAC-SHA1.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Returns the hash for a PBKDF2 pseudorandom function.
+func prfHash(prf pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+
+	return nil, fmt.Errorf("%w: prf %v", ErrUnsupportedEncryption, prf.Algorithm)
+
+} //  End of function  prfHash.
+
+// Returns the AES key size for an encryption scheme.
+func aesKeySize(scheme asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		return 16, nil
+
+	case scheme.Equal(oidAES192CBC):
+		return 24, nil
+
+	case scheme.Equal(oidAES256CBC):
+		return 32, nil
+	}
+
+	return 0, fmt.Errorf("%w: cipher %v", ErrUnsupportedEncryption, scheme)
+
+} //  End of function  aesKeySize.
+
+// PBKDF2 key derivation (RFC 8018 section 5.2).
+func pbkdf2Key(fn func() hash.Hash, passphrase, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(fn, passphrase)
+	derived := make([]byte, 0, size)
+
+	u := make([]byte, prf.Size())
+	t := make([]byte, prf.Size())
+	counter := make([]byte, 4)
+
+	for block := uint32(1); len(derived) < size; block++ {
+		binary.BigEndian.PutUint32(counter, block)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for idx := range t {
+				t[idx] ^= u[idx]
+			}
+		}
+
+		derived = append(derived, t...)
+	}
+
+	return derived[:size]
+
+} //  End of function  pbkdf2Key.
+
+// Decrypt a DER encoded PKCS#8 EncryptedPrivateKeyInfo (PBES2 with PBKDF2
+// and AES-CBC) - returns the DER encoded PKCS#8 private key.
+func DecryptPKCS8PrivateKey(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedEncryption,
+			info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("%w: kdf %v", ErrUnsupportedEncryption,
+			params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+
+	fn, err := prfHash(kdf.PRF)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := aesKeySize(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: bad iv or data size", ErrUnsupportedEncryption)
+	}
+
+	if kdf.IterationCount < 1 {
+		return nil, fmt.Errorf("%w: bad iteration count", ErrUnsupportedEncryption)
+	}
+
+	key := pbkdf2Key(fn, passphrase, kdf.Salt, kdf.IterationCount, size)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// PKCS#7 padding - bad padding is what a wrong passphrase looks like.
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		!bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return plain[:len(plain)-pad], nil
+
+} //  End of function  DecryptPKCS8PrivateKey.
+
+// Encrypt a private key with a passphrase - returns the PEM encoded PKCS#8
+// EncryptedPrivateKeyInfo (PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC).
+func EncryptPrivateKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, PBKDF2_SALT_SIZE)
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2Key(sha256.New, passphrase, salt,
+		PBKDF2_ITERATIONS, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: PBKDF2_ITERATIONS,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: ENCRYPTED_PRIVATE_KEY, Bytes: encrypted}), nil
+
+} //  End of function  EncryptPrivateKey.
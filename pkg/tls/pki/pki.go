@@ -0,0 +1,397 @@
+// Package pki is a small private CA toolkit - it creates the service,
+// bootstrap and device CAs and issues their certificates with the
+// extensions the telegraph service and devices expect.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+)
+
+const (
+	// Default organization and domain for the generated names.
+	DEFAULT_ORGANIZATION = "biota"
+	DEFAULT_DOMAIN       = "telegraph.biota.local"
+
+	// Default subject location.
+	DEFAULT_COUNTRY  = "US"
+	DEFAULT_PROVINCE = "CA"
+	DEFAULT_LOCALITY = "baylands"
+
+	// Default validity of the CAs and issued certificates (42 days).
+	DEFAULT_VALIDITY = time.Duration(42*24) * time.Hour
+
+	// Default RSA key size (in bits).
+	DEFAULT_RSA_BITS = 2048
+
+	// Organizational units for the service and device names.
+	SERVICE_UNIT = "Service"
+	DEVICE_UNIT  = "Device"
+)
+
+var (
+	// Subject emailAddress attribute (PKCS #9).
+	oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+	// Not a CA certificate.
+	ErrNotAuthority = errors.New("not a CA certificate")
+)
+
+// Options for the generated keys and certificate names.
+type Options struct {
+	Organization string
+	Domain       string
+	Country      string
+	Province     string
+	Locality     string
+
+	// Validity of the CAs and issued certificates.
+	Validity time.Duration
+
+	// Key algorithm (see tls.KEY_ALGORITHM_*) - defaults to RSA.
+	KeyAlgorithm string
+	RSABits      int
+
+	// Encrypts the generated private keys when set.
+	Passphrase []byte
+}
+
+// Certificate profile - what an issued certificate can be used for.
+type Profile struct {
+	ExtKeyUsage []x509.ExtKeyUsage
+	KeyUsage    x509.KeyUsage
+
+	// DNS names, IP addresses and URIs (e.g. SPIFFE IDs).
+	Hosts []string
+
+	// Extra certificate extensions.
+	Extensions []pkix.Extension
+}
+
+// Certificate authority - a CA certificate and its private key.
+type Authority struct {
+	Cert     *x509.Certificate
+	Key      crypto.Signer
+	Validity time.Duration
+}
+
+// Returns the options with the defaults filled in.
+func (o Options) withDefaults() Options {
+	defaults := []struct {
+		value    *string
+		fallback string
+	}{
+		{&o.Organization, DEFAULT_ORGANIZATION},
+		{&o.Domain, DEFAULT_DOMAIN},
+		{&o.Country, DEFAULT_COUNTRY},
+		{&o.Province, DEFAULT_PROVINCE},
+		{&o.Locality, DEFAULT_LOCALITY},
+		{&o.KeyAlgorithm, ptls.KEY_ALGORITHM_RSA},
+	}
+
+	for _, d := range defaults {
+		if len(*d.value) == 0 {
+			*d.value = d.fallback
+		}
+	}
+
+	if o.Validity <= 0 {
+		o.Validity = DEFAULT_VALIDITY
+	}
+
+	if o.RSABits <= 0 {
+		o.RSABits = DEFAULT_RSA_BITS
+	}
+
+	return o
+
+} //  End of  Options.withDefaults
+
+// Returns a subject name for an organizational unit, common name and
+// email address.
+func (o Options) subject(unit, name, email string) pkix.Name {
+	o = o.withDefaults()
+
+	return pkix.Name{
+		Country:            []string{o.Country},
+		Province:           []string{o.Province},
+		Locality:           []string{o.Locality},
+		Organization:       []string{o.Organization},
+		OrganizationalUnit: []string{unit},
+		CommonName:         name,
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: oidEmailAddress, Value: email},
+		},
+	}
+
+} //  End of  Options.subject
+
+// Returns the service subject name, ala service.telegraph.biota.local
+func (o Options) ServiceSubject() pkix.Name {
+	o = o.withDefaults()
+
+	return o.subject(SERVICE_UNIT, "service."+o.Domain,
+		fmt.Sprintf("%v-service@%v", o.Organization, o.Domain))
+
+} //  End of  Options.ServiceSubject
+
+// Returns the subject name of a device, ala news.device.telegraph.biota.local
+func (o Options) DeviceSubject(name string) pkix.Name {
+	o = o.withDefaults()
+
+	return o.subject(DEVICE_UNIT, fmt.Sprintf("%v.device.%v", name, o.Domain),
+		fmt.Sprintf("%v-device-%v@%v", o.Organization, name, o.Domain))
+
+} //  End of  Options.DeviceSubject
+
+// Returns the hosts the service certificate is good for.
+func (o Options) ServiceHosts() []string {
+	o = o.withDefaults()
+	return []string{"*." + o.Domain, "localhost", "0.0.0.0", "127.0.0.1"}
+
+} //  End of  Options.ServiceHosts
+
+// Returns the hosts the device certificates are good for.
+func (o Options) DeviceHosts() []string {
+	o = o.withDefaults()
+	return []string{"*." + o.Domain, "0.0.0.0"}
+
+} //  End of  Options.DeviceHosts
+
+// Generate a new private key for the options key algorithm.
+func (o Options) GenerateKey() (crypto.Signer, error) {
+	o = o.withDefaults()
+
+	switch o.KeyAlgorithm {
+	case ptls.KEY_ALGORITHM_RSA:
+		return rsa.GenerateKey(rand.Reader, o.RSABits)
+
+	case ptls.KEY_ALGORITHM_ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	case ptls.KEY_ALGORITHM_ED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, fmt.Errorf("%w: %v", ptls.ErrUnsupportedKey, o.KeyAlgorithm)
+
+} //  End of  Options.GenerateKey
+
+// Returns the PEM encoded private key - encrypted if the options have a
+// passphrase.
+func (o Options) EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	if len(o.Passphrase) > 0 {
+		return ptls.EncryptPrivateKey(key, o.Passphrase)
+	}
+
+	return ptls.EncodePrivateKey(key)
+
+} //  End of  Options.EncodePrivateKey
+
+// Returns the profile for service (server) certificates.
+func ServerProfile(hosts ...string) Profile {
+	return Profile{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		Hosts:       hosts,
+	}
+
+} //  End of function  ServerProfile.
+
+// Returns the profile for device (client) certificates.
+func DeviceProfile(hosts ...string) Profile {
+	return Profile{
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageEmailProtection,
+		},
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		Hosts:    hosts,
+	}
+
+} //  End of function  DeviceProfile.
+
+// Returns a random certificate serial number.
+func serialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), ptls.SERIAL_NUMBER_BITS)
+	return rand.Int(rand.Reader, limit)
+
+} //  End of function  serialNumber.
+
+// Create a new self-signed CA with a key and validity.
+func NewAuthority(subject pkix.Name, key crypto.Signer,
+	validity time.Duration) (*Authority, error) {
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-ptls.CLOCK_SKEW_ALLOWANCE),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Cert: cert, Key: key, Validity: validity}, nil
+
+} //  End of function  NewAuthority.
+
+// Load a CA from its (PEM encoded) certificate and key files - encrypted
+// keys are decrypted with the passphrase source.
+func LoadAuthority(certPath, keyPath string, passphrase ptls.PassphraseFunc,
+	validity time.Duration) (*Authority, error) {
+
+	pair, err := ptls.LoadCertKeyPair(certPath, keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := pair.Leaf
+	if cert == nil {
+		if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%w: %v", ErrNotAuthority, certPath)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ptls.ErrUnsupportedKey, pair.PrivateKey)
+	}
+
+	if validity <= 0 {
+		validity = DEFAULT_VALIDITY
+	}
+
+	return &Authority{Cert: cert, Key: key, Validity: validity}, nil
+
+} //  End of function  LoadAuthority.
+
+// Issue a certificate for a certificate signing request - the subject
+// comes (as is) from the request, the extensions from the profile.
+func (a *Authority) Issue(csr *x509.CertificateRequest,
+	profile Profile) (*x509.Certificate, error) {
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ptls.ErrInvalidCertificateRequest, err)
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	// Key encipherment only makes sense for RSA keys.
+	usage := profile.KeyUsage
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+
+	now := time.Now()
+	notAfter := now.Add(a.Validity)
+	if notAfter.After(a.Cert.NotAfter) {
+		notAfter = a.Cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            csr.RawSubject,
+		NotBefore:             now.Add(-ptls.CLOCK_SKEW_ALLOWANCE),
+		NotAfter:              notAfter,
+		KeyUsage:              usage,
+		ExtKeyUsage:           profile.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       profile.Extensions,
+	}
+
+	for _, host := range profile.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if uri, err := url.Parse(host); err == nil && strings.Contains(host, "://") {
+			template.URIs = append(template.URIs, uri)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.Cert,
+		csr.PublicKey, a.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+
+} //  End of  Authority.Issue
+
+// Returns a certificate revocation list (DER encoded) for the revoked
+// certificates, valid for `validity`.
+func (a *Authority) RevocationList(revoked []*x509.Certificate,
+	validity time.Duration) ([]byte, error) {
+
+	now := time.Now()
+
+	entries := []x509.RevocationListEntry{}
+	for _, cert := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: now,
+		})
+	}
+
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now.Add(-ptls.CLOCK_SKEW_ALLOWANCE),
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: entries,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, a.Cert, a.Key)
+
+} //  End of  Authority.RevocationList
+
+// Create a certificate signing request for a subject.
+// Returns the DER encoded request.
+func CreateRequest(subject pkix.Name, key crypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{Subject: subject}
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+
+} //  End of function  CreateRequest.
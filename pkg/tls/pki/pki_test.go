@@ -0,0 +1,284 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+)
+
+// Test options for quick (ECDSA) keys.
+func testOptions() Options {
+	return Options{KeyAlgorithm: ptls.KEY_ALGORITHM_ECDSA}
+
+} //  End of  testOptions
+
+// Test Generate function - the tree layout and certificates.
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := Generate(dir, testOptions(), "news", "alchemy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(tree.Devices) != 2 {
+		t.Errorf("expected 2 devices, got %v", len(tree.Devices))
+	}
+
+	files := []string{
+		"service/cacert.pem", "service/cakey.pem", "service/key.pem",
+		"service/csr.pem", "service/cert.pem", "service/bundle/ca.pem",
+		"service/bundle/service.pem",
+		"bootstrap/bootstrap-cacert.pem", "bootstrap/bootstrap-cert.pem",
+		"bootstrap/bundle/ca-bootstrap.pem",
+		"bootstrap/bundle/device-bootstrap.pem",
+		"device/news-cacert.pem", "device/news-cakey.pem",
+		"device/news-key.pem", "device/news-csr.pem", "device/news-cert.pem",
+		"device/bundle/ca-news.pem", "device/bundle/device-news.pem",
+		"device/alchemy-cert.pem", "device/bundle/device-alchemy.pem",
+	}
+
+	for idx, name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("test %v expected %v, got %v", idx, name, err)
+		}
+	}
+
+	tests := []struct {
+		set   *CertificateSet
+		usage x509.ExtKeyUsage
+		hosts []string
+		name  string
+	}{
+		{
+			set:   tree.Service,
+			usage: x509.ExtKeyUsageServerAuth,
+			hosts: []string{"service.telegraph.biota.local", "localhost", "127.0.0.1"},
+			name:  "service.telegraph.biota.local",
+		},
+		{
+			set:   tree.Bootstrap,
+			usage: x509.ExtKeyUsageClientAuth,
+			hosts: []string{"bootstrap.telegraph.biota.local"},
+			name:  "bootstrap.device.telegraph.biota.local",
+		},
+		{
+			set:   tree.Devices["news"],
+			usage: x509.ExtKeyUsageClientAuth,
+			hosts: []string{"news.telegraph.biota.local"},
+			name:  "news.device.telegraph.biota.local",
+		},
+	}
+
+	for idx, step := range tests {
+		if cn := step.set.Cert.Subject.CommonName; cn != step.name {
+			t.Errorf("test %v expected %v, got %v", idx, step.name, cn)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(step.set.Authority.Cert)
+
+		if errs := ptls.VerifyLeaf(step.set.CertPath, roots, step.usage, step.hosts...); len(errs) > 0 {
+			t.Errorf("test %v unexpected errors: %v", idx, errs)
+		}
+
+		if _, err := ptls.LoadCertKeyPair(step.set.BundlePath, step.set.BundlePath, nil); err != nil {
+			t.Errorf("test %v unexpected bundle error: %v", idx, err)
+		}
+
+		cas, err := ptls.LoadCACerts(step.set.CABundlePath)
+		if err != nil || len(cas) != 1 || !cas[0].Equal(step.set.Authority.Cert) {
+			t.Errorf("test %v expected the CA in the bundle, got %v", idx, err)
+		}
+
+		if step.set.Cert.Issuer.String() == step.set.Cert.Subject.String() {
+			t.Errorf("test %v expected a distinct CA subject", idx)
+		}
+	}
+
+	// Service certificates are no good for clients and vice versa.
+	roots := x509.NewCertPool()
+	roots.AddCert(tree.Service.Authority.Cert)
+
+	if errs := ptls.VerifyLeaf(tree.Service.CertPath, roots, x509.ExtKeyUsageClientAuth); len(errs) == 0 {
+		t.Errorf("expected service certificate to fail client auth")
+	}
+
+	if errs := ptls.VerifyLeaf(tree.Service.CertPath, roots, x509.ExtKeyUsageServerAuth, "192.0.2.1"); len(errs) == 0 {
+		t.Errorf("expected service certificate to not cover 192.0.2.1")
+	}
+
+} //  End of  TestGenerate
+
+// Test generated keys for the key algorithms and passphrases.
+func TestGenerateKeys(t *testing.T) {
+	tests := []struct {
+		opts      Options
+		algorithm string
+		size      int
+		encrypted bool
+		fails     bool
+	}{
+		{opts: Options{}, algorithm: ptls.KEY_ALGORITHM_RSA, size: DEFAULT_RSA_BITS},
+		{opts: testOptions(), algorithm: ptls.KEY_ALGORITHM_ECDSA, size: 256},
+		{
+			opts:      Options{KeyAlgorithm: ptls.KEY_ALGORITHM_ED25519},
+			algorithm: ptls.KEY_ALGORITHM_ED25519,
+			size:      256,
+		},
+		{
+			opts: Options{
+				KeyAlgorithm: ptls.KEY_ALGORITHM_ECDSA,
+				Passphrase:   []byte("secret"),
+			},
+			algorithm: ptls.KEY_ALGORITHM_ECDSA,
+			size:      256,
+			encrypted: true,
+		},
+		{opts: Options{KeyAlgorithm: "DSA"}, fails: true},
+	}
+
+	for idx, step := range tests {
+		set, err := GenerateDevice(t.TempDir(), "news", step.opts)
+		if step.fails {
+			if !errors.Is(err, ptls.ErrUnsupportedKey) {
+				t.Errorf("test %v expected unsupported key, got %v", idx, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+			continue
+		}
+
+		algorithm, size, _ := ptls.KeyAlgorithm(set.Cert.PublicKey)
+		if algorithm != step.algorithm || size != step.size {
+			t.Errorf("test %v expected %v %v, got %v %v", idx,
+				step.algorithm, step.size, algorithm, size)
+		}
+
+		// Key encipherment is only for RSA keys.
+		encipherment := set.Cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0
+		if encipherment != (algorithm == ptls.KEY_ALGORITHM_RSA) {
+			t.Errorf("test %v unexpected key usage %v", idx, set.Cert.KeyUsage)
+		}
+
+		data, _ := os.ReadFile(set.KeyPath)
+		block, _ := pem.Decode(data)
+		if block == nil || (block.Type == ptls.ENCRYPTED_PRIVATE_KEY) != step.encrypted {
+			t.Errorf("test %v unexpected key block", idx)
+		}
+
+		passphrase := ptls.StaticPassphrase("secret")
+		if _, err := LoadAuthority(set.CACertPath, set.CAKeyPath, passphrase, 0); err != nil {
+			t.Errorf("test %v unexpected load error: %v", idx, err)
+		}
+	}
+
+} //  End of  TestGenerateKeys
+
+// Test Authority functions.
+func TestAuthority(t *testing.T) {
+	opts := testOptions()
+	set, err := GenerateService(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := LoadAuthority(set.CertPath, set.KeyPath, nil, 0); !errors.Is(err, ErrNotAuthority) {
+		t.Errorf("expected not a CA error, got %v", err)
+	}
+
+	ca, err := LoadAuthority(set.CACertPath, set.CAKeyPath, nil, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key, _ := opts.GenerateKey()
+	der, _ := CreateRequest(opts.DeviceSubject("alchemy"), key)
+	csr, _ := x509.ParseCertificateRequest(der)
+
+	cert, err := ca.Issue(csr, DeviceProfile("alchemy.telegraph.biota.local", "10.0.0.7"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cert.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected the authority validity, got %v", cert.NotAfter)
+	}
+
+	if !slices.Equal(cert.DNSNames, []string{"alchemy.telegraph.biota.local"}) ||
+		len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "10.0.0.7" {
+		t.Errorf("unexpected SANs %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+
+	if cert.Subject.String() != csr.Subject.String() {
+		t.Errorf("expected subject %v, got %v", csr.Subject, cert.Subject)
+	}
+
+	// URIs and extra extensions.
+	profile := DeviceProfile("spiffe://telegraph.biota.local/device/alchemy")
+	profile.Extensions = []pkix.Extension{
+		{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: []byte{0x05, 0x00}},
+	}
+
+	cert, err = ca.Issue(csr, profile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != profile.Hosts[0] || len(cert.DNSNames) > 0 {
+		t.Errorf("unexpected SANs %v %v", cert.URIs, cert.DNSNames)
+	}
+
+	if !slices.ContainsFunc(cert.Extensions, func(ext pkix.Extension) bool {
+		return ext.Id.Equal(profile.Extensions[0].Id)
+	}) {
+		t.Errorf("expected the extra extension, got %v", cert.Extensions)
+	}
+
+	// Issued certificates don't outlive their CA.
+	ca.Validity = 1000 * DEFAULT_VALIDITY
+	if cert, _ := ca.Issue(csr, DeviceProfile()); cert.NotAfter.After(ca.Cert.NotAfter) {
+		t.Errorf("expected certificate to expire with the CA")
+	}
+
+	// Tampered requests are rejected.
+	tampered := *csr
+	tampered.Signature = append([]byte{}, csr.Signature...)
+	tampered.Signature[len(tampered.Signature)-1] ^= 0xff
+
+	if _, err := ca.Issue(&tampered, DeviceProfile()); !errors.Is(err, ptls.ErrInvalidCertificateRequest) {
+		t.Errorf("expected invalid request error, got %v", err)
+	}
+
+	// Revocation lists.
+	crl, err := ca.RevocationList([]*x509.Certificate{cert}, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	crlPath := filepath.Join(t.TempDir(), "crl.pem")
+	os.WriteFile(crlPath, pem.EncodeToMemory(&pem.Block{Type: ptls.X509_CRL, Bytes: crl}), 0o644)
+
+	lists, err := ptls.NewRevocationLists(crlPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !lists.Revoked(cert, ca.Cert) || lists.Revoked(set.Cert, ca.Cert) {
+		t.Errorf("expected only the issued certificate to be revoked")
+	}
+
+} //  End of  TestAuthority
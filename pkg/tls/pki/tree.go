@@ -0,0 +1,248 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+)
+
+const (
+	// Sub-directories of the TLS config tree.
+	SERVICE_DIR   = "service"
+	BOOTSTRAP_DIR = "bootstrap"
+	DEVICE_DIR    = "device"
+	BUNDLE_DIR    = "bundle"
+
+	// Name of the bootstrap device.
+	BOOTSTRAP_NAME = "bootstrap"
+
+	// File modes for the generated certificates and keys.
+	CERT_FILE_MODE = os.FileMode(0o644)
+	KEY_FILE_MODE  = os.FileMode(0o600)
+	DIR_MODE       = os.FileMode(0o755)
+)
+
+var (
+	// Devices in the test TLS config tree.
+	DEVICE_NAMES = []string{
+		"news", "communique", "telegraph", "alchemy", "industrial-disease",
+	}
+)
+
+// Files (and contents) of a CA and the certificate it issued.
+type CertificateSet struct {
+	Authority *Authority
+	Cert      *x509.Certificate
+	Key       crypto.Signer
+
+	CACertPath string
+	CAKeyPath  string
+	KeyPath    string
+	CSRPath    string
+	CertPath   string
+
+	// CA certificate and key+certificate bundles.
+	CABundlePath string
+	BundlePath   string
+}
+
+// The whole TLS config tree - service, bootstrap and devices.
+type Tree struct {
+	Service   *CertificateSet
+	Bootstrap *CertificateSet
+	Devices   map[string]*CertificateSet
+}
+
+// Returns the set with all its file names in a directory - prefixed with
+// the name for devices.
+func newCertificateSet(dir, name, bundle string) *CertificateSet {
+	prefix := ""
+	caBundle := "ca.pem"
+	if len(name) > 0 {
+		prefix = name + "-"
+		caBundle = fmt.Sprintf("ca-%v.pem", name)
+	}
+
+	return &CertificateSet{
+		CACertPath:   filepath.Join(dir, prefix+"cacert.pem"),
+		CAKeyPath:    filepath.Join(dir, prefix+"cakey.pem"),
+		KeyPath:      filepath.Join(dir, prefix+"key.pem"),
+		CSRPath:      filepath.Join(dir, prefix+"csr.pem"),
+		CertPath:     filepath.Join(dir, prefix+"cert.pem"),
+		CABundlePath: filepath.Join(dir, BUNDLE_DIR, caBundle),
+		BundlePath:   filepath.Join(dir, BUNDLE_DIR, bundle),
+	}
+
+} //  End of function  newCertificateSet.
+
+// Returns the CA subject for a certificate subject.
+func authoritySubject(subject pkix.Name) pkix.Name {
+	ca := subject
+	ca.OrganizationalUnit = []string{}
+	for _, unit := range subject.OrganizationalUnit {
+		ca.OrganizationalUnit = append(ca.OrganizationalUnit, unit+" CA")
+	}
+
+	return ca
+
+} //  End of function  authoritySubject.
+
+// Create a CA and issue a certificate for the subject, then write all
+// the files of the set.
+func (s *CertificateSet) generate(subject pkix.Name, profile Profile,
+	opts Options) error {
+
+	opts = opts.withDefaults()
+
+	caKey, err := opts.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	s.Authority, err = NewAuthority(authoritySubject(subject), caKey,
+		opts.Validity)
+	if err != nil {
+		return err
+	}
+
+	if s.Key, err = opts.GenerateKey(); err != nil {
+		return err
+	}
+
+	der, err := CreateRequest(subject, s.Key)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+
+	if s.Cert, err = s.Authority.Issue(csr, profile); err != nil {
+		return err
+	}
+
+	return s.write(der, opts)
+
+} //  End of  CertificateSet.generate
+
+// Write the set files.
+func (s *CertificateSet) write(csr []byte, opts Options) error {
+	caKey, err := opts.EncodePrivateKey(s.Authority.Key)
+	if err != nil {
+		return err
+	}
+
+	key, err := opts.EncodePrivateKey(s.Key)
+	if err != nil {
+		return err
+	}
+
+	caCert := ptls.EncodeCertificates(s.Authority.Cert)
+	cert := ptls.EncodeCertificates(s.Cert)
+	request := pem.EncodeToMemory(&pem.Block{
+		Type: ptls.CERTIFICATE_REQUEST, Bytes: csr,
+	})
+
+	files := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{s.CACertPath, caCert, CERT_FILE_MODE},
+		{s.CAKeyPath, caKey, KEY_FILE_MODE},
+		{s.CABundlePath, caCert, CERT_FILE_MODE},
+		{s.KeyPath, key, KEY_FILE_MODE},
+		{s.CSRPath, request, CERT_FILE_MODE},
+		{s.CertPath, cert, CERT_FILE_MODE},
+		{s.BundlePath, append(append([]byte{}, key...), cert...), KEY_FILE_MODE},
+	}
+
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), DIR_MODE); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(f.path, f.data, f.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+} //  End of  CertificateSet.write
+
+// Generate the service CA and certificate in a directory - cacert.pem,
+// cakey.pem, key.pem, csr.pem, cert.pem and the bundle/ca.pem and
+// bundle/service.pem bundles.
+func GenerateService(dir string, opts Options) (*CertificateSet, error) {
+	set := newCertificateSet(dir, "", "service.pem")
+
+	profile := ServerProfile(opts.ServiceHosts()...)
+	if err := set.generate(opts.ServiceSubject(), profile, opts); err != nil {
+		return nil, fmt.Errorf("service: %w", err)
+	}
+
+	return set, nil
+
+} //  End of function  GenerateService.
+
+// Generate a device CA and certificate in a directory - {name}-cacert.pem,
+// {name}-cakey.pem, {name}-key.pem, {name}-csr.pem, {name}-cert.pem and
+// the bundle/ca-{name}.pem and bundle/device-{name}.pem bundles.
+func GenerateDevice(dir, name string, opts Options) (*CertificateSet, error) {
+	set := newCertificateSet(dir, name, fmt.Sprintf("device-%v.pem", name))
+
+	profile := DeviceProfile(opts.DeviceHosts()...)
+	if err := set.generate(opts.DeviceSubject(name), profile, opts); err != nil {
+		return nil, fmt.Errorf("device %v: %w", name, err)
+	}
+
+	return set, nil
+
+} //  End of function  GenerateDevice.
+
+// Generate the whole TLS config tree in a directory - the service,
+// bootstrap and device sub-directories (see DEVICE_NAMES for the
+// default devices).
+func Generate(dir string, opts Options, devices ...string) (*Tree, error) {
+	if len(devices) == 0 {
+		devices = DEVICE_NAMES
+	}
+
+	service, err := GenerateService(filepath.Join(dir, SERVICE_DIR), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrap, err := GenerateDevice(filepath.Join(dir, BOOTSTRAP_DIR),
+		BOOTSTRAP_NAME, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &Tree{
+		Service:   service,
+		Bootstrap: bootstrap,
+		Devices:   map[string]*CertificateSet{},
+	}
+
+	for _, name := range devices {
+		set, err := GenerateDevice(filepath.Join(dir, DEVICE_DIR), name, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		tree.Devices[name] = set
+	}
+
+	return tree, nil
+
+} //  End of function  Generate.
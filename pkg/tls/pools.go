@@ -0,0 +1,315 @@
+package tls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Client CA pools a peer certificate can chain to.
+const (
+	POOL_NONE      = ""
+	POOL_BOOTSTRAP = "bootstrap"
+	POOL_DEVICE    = "device"
+)
+
+const (
+	// Max number of peer certificate verdicts remembered.
+	VERDICT_CACHE_SIZE = 1024
+)
+
+var (
+	// Peer certificate doesn't chain to a bootstrap or device CA.
+	ErrUnknownAuthority = errors.New("certificate not issued by a bootstrap or device CA")
+)
+
+// Returns the glob expanded list of files matching the patterns.
+func ExpandPatterns(patterns ...string) ([]string, error) {
+	paths := []string{}
+
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+
+} //  End of function  ExpandPatterns.
+
+// Adds the valid CA certificates from the files to a pool.
+// Returns the number of CA certificates added.
+func addCACerts(pool *x509.CertPool, paths []string) (int, []error) {
+	count := 0
+	errs := []error{}
+
+	for _, zpath := range paths {
+		cacerts, err := LoadCACerts(zpath)
+		if err != nil {
+			slog.Error("adding CA to cert pool", "file", zpath,
+				"error", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, cert := range cacerts {
+			pool.AddCert(cert)
+			count++
+		}
+	}
+
+	return count, errs
+
+} //  End of function  addCACerts.
+
+// Creates a [CA] certificate pool loaded with the valid CA certificates
+// from the files matching the patterns - see CreateCACertPool.
+func CreateCACertPoolFromPatterns(patterns ...string) (*x509.CertPool, error) {
+	paths, err := ExpandPatterns(patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateCACertPool(paths)
+
+} //  End of function  CreateCACertPoolFromPatterns.
+
+// Separate bootstrap and device client CA pools. Only the CA certificates
+// from the pattern matched files are trusted - no system roots.
+type ClientCAPools struct {
+	Bootstrap *x509.CertPool
+	Device    *x509.CertPool
+
+	// Both sets of CA certificates - sent to clients as acceptable CAs.
+	All *x509.CertPool
+
+	// Revocation lists of the client CAs.
+	Revoked *RevocationLists
+
+	count    int
+	mutex    sync.Mutex
+	verdicts map[[sha256.Size]byte]string
+}
+
+// Creates the bootstrap and device client CA pools and the revocation
+// lists from the files matching the CA certificates patterns.
+// Error indicates one or more assets failed to be loaded but the pools
+// still contain all the valid CA certificates.
+func NewClientCAPools(patterns config.CACertificatesPattern) (*ClientCAPools, error) {
+	bootstrapPaths, err := ExpandPatterns(patterns.Bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePaths, err := ExpandPatterns(patterns.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ClientCAPools{
+		Bootstrap: x509.NewCertPool(),
+		Device:    x509.NewCertPool(),
+		All:       x509.NewCertPool(),
+		verdicts:  make(map[[sha256.Size]byte]string),
+	}
+
+	n, errs := addCACerts(p.Bootstrap, bootstrapPaths)
+	p.count += n
+
+	n, deviceErrs := addCACerts(p.Device, devicePaths)
+	p.count += n
+	errs = append(errs, deviceErrs...)
+
+	addCACerts(p.All, append(bootstrapPaths, devicePaths...))
+
+	revoked, err := NewRevocationLists(patterns.CRL)
+	if revoked == nil {
+		return nil, err
+	}
+
+	p.Revoked = revoked
+	if loadErrs, ok := err.(*LoadAssetErrors); ok {
+		errs = append(errs, loadErrs.Errors...)
+	}
+
+	if len(errs) > 0 {
+		return p, &LoadAssetErrors{Errors: errs}
+	}
+
+	return p, nil
+
+} //  End of function  NewClientCAPools.
+
+// Returns the number of client CA certificates in the pools.
+func (p *ClientCAPools) Len() int {
+	return p.count
+
+} //  End of  ClientCAPools.Len
+
+// Returns the pool a certificate chain (leaf first) verifies against.
+// Device CAs win for certificates that chain to both pools. Certificates
+// revoked by their issuer don't verify against any pool.
+func (p *ClientCAPools) Classify(certs []*x509.Certificate) (string, error) {
+	if len(certs) == 0 {
+		return POOL_NONE, fmt.Errorf("%w: no certificate", ErrUnknownAuthority)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, pool := range []string{POOL_DEVICE, POOL_BOOTSTRAP} {
+		opts.Roots = p.Device
+		if pool == POOL_BOOTSTRAP {
+			opts.Roots = p.Bootstrap
+		}
+
+		chains, err := certs[0].Verify(opts)
+		if err != nil {
+			continue
+		}
+
+		// Revoked in any of the chains is revoked.
+		for _, chain := range chains {
+			if err := p.Revoked.Check(chain); err != nil {
+				return POOL_NONE, err
+			}
+		}
+
+		return pool, nil
+	}
+
+	return POOL_NONE, fmt.Errorf("%w: %v", ErrUnknownAuthority,
+		certs[0].Subject)
+
+} //  End of  ClientCAPools.Classify
+
+// Remember the pool a peer certificate verified against.
+func (p *ClientCAPools) remember(cert *x509.Certificate, pool string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// No need for anything fancy - just start over when full.
+	if len(p.verdicts) >= VERDICT_CACHE_SIZE {
+		clear(p.verdicts)
+	}
+
+	p.verdicts[sha256.Sum256(cert.Raw)] = pool
+
+} //  End of  ClientCAPools.remember
+
+// TLS VerifyPeerCertificate hook - verifies the client certificate chain
+// against the bootstrap and device pools and remembers which one it
+// chained to (see Pool).
+func (p *ClientCAPools) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	pool, err := p.Classify(certs)
+	if err != nil {
+		slog.Warn("rejecting client certificate", "error", err)
+		return err
+	}
+
+	p.remember(certs[0], pool)
+	return nil
+
+} //  End of  ClientCAPools.VerifyPeerCertificate
+
+// Returns the pool a verified peer certificate chain (leaf first)
+// chained to, or POOL_NONE if it didn't. The intermediates are needed to
+// verify the chain again once the verdict has been forgotten.
+func (p *ClientCAPools) Pool(certs ...*x509.Certificate) string {
+	if len(certs) == 0 || certs[0] == nil {
+		return POOL_NONE
+	}
+
+	p.mutex.Lock()
+	pool, ok := p.verdicts[sha256.Sum256(certs[0].Raw)]
+	p.mutex.Unlock()
+
+	if ok {
+		return pool
+	}
+
+	// Forgotten - verify the chain again.
+	pool, _ = p.Classify(certs)
+	return pool
+
+} //  End of  ClientCAPools.Pool
+
+// Returns the pool the peer certificate chain of a connection chained to
+// - the verified chain if the handshake verified one and the chain the
+// peer sent otherwise.
+func (p *ClientCAPools) ConnectionPool(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) > 0 {
+		return p.Pool(state.VerifiedChains[0]...)
+	}
+
+	return p.Pool(state.PeerCertificates...)
+
+} //  End of  ClientCAPools.ConnectionPool
+
+// Create secure service config with client CA pools built from the CA
+// certificates patterns. Client certificates are required if there are
+// any client CAs and are verified by the pools hook.
+func ServiceConfigFromPatterns(certPath, keyPath string, passphrase PassphraseFunc,
+	patterns config.CACertificatesPattern) (*tls.Config, *ClientCAPools, error) {
+
+	pools, err := NewClientCAPools(patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{},
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if pools.Len() > 0 {
+		// The hook does the verification against the separate
+		// pools, so don't have the handshake verify the chain.
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.ClientCAs = pools.All
+		cfg.VerifyPeerCertificate = pools.VerifyPeerCertificate
+	}
+
+	if len(certPath) > 0 || len(keyPath) > 0 {
+		cert, err := LoadCertKeyPair(certPath, keyPath, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	return cfg, pools, nil
+
+} // End of function  ServiceConfigFromPatterns.
@@ -0,0 +1,262 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Returns a client certificate for a name issued by a test CA.
+func testClientCert(t *testing.T, name string, caCert *x509.Certificate, caKey crypto.Signer) *x509.Certificate {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	data, err := CreateCertificateRequest(name, key)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	csr, err := ParseCertificateRequest(data)
+	if err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+
+	cert, err := SignCertificateRequest(csr, caCert, caKey, time.Hour)
+	if err != nil {
+		t.Fatalf("signing request: %v", err)
+	}
+
+	return cert
+
+} //  End of  testClientCert
+
+// Test ExpandPatterns function.
+func TestExpandPatterns(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a-cacert.pem", "b-cacert.pem", "c-key.pem"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{}, 0o600)
+	}
+
+	tests := []struct {
+		patterns []string
+		count    int
+		err      bool
+	}{
+		{patterns: []string{}, count: 0},
+		{patterns: []string{""}, count: 0},
+		{patterns: []string{filepath.Join(dir, "*-cacert.pem")}, count: 2},
+		{patterns: []string{filepath.Join(dir, "*")}, count: 3},
+		{patterns: []string{filepath.Join(dir, "a-*"), filepath.Join(dir, "c-*")}, count: 2},
+		{patterns: []string{filepath.Join(dir, "404-*")}, count: 0},
+		{patterns: []string{"[-]"}, err: true},
+	}
+
+	for idx, step := range tests {
+		paths, err := ExpandPatterns(step.patterns...)
+		if step.err {
+			if err == nil {
+				t.Errorf("test %v expected an error", idx)
+			}
+
+			continue
+		}
+
+		if err != nil || len(paths) != step.count {
+			t.Errorf("test %v expected %v paths, got %v %v", idx,
+				step.count, paths, err)
+		}
+	}
+
+} //  End of  TestExpandPatterns
+
+// Test ClientCAPools functions.
+func TestClientCAPools(t *testing.T) {
+	dir := t.TempDir()
+
+	bootstrapCA, bootstrapKey := testCA(t, "bootstrap-ca")
+	deviceCA, deviceKey := testCA(t, "device-ca")
+	otherCA, otherKey := testCA(t, "other-ca")
+
+	os.MkdirAll(filepath.Join(dir, "bootstrap"), 0o700)
+	os.MkdirAll(filepath.Join(dir, "device"), 0o700)
+
+	os.WriteFile(filepath.Join(dir, "bootstrap", "bootstrap-cacert.pem"),
+		EncodeCertificates(bootstrapCA), 0o600)
+	os.WriteFile(filepath.Join(dir, "device", "device-cacert.pem"),
+		EncodeCertificates(deviceCA), 0o600)
+
+	patterns := config.CACertificatesPattern{
+		Bootstrap: filepath.Join(dir, "bootstrap", "*-cacert.pem"),
+		Device:    filepath.Join(dir, "device", "*-cacert.pem"),
+	}
+
+	pools, err := NewClientCAPools(patterns)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pools.Len() != 2 {
+		t.Errorf("expected 2 client CAs, got %v", pools.Len())
+	}
+
+	tests := []struct {
+		cert *x509.Certificate
+		pool string
+	}{
+		{cert: testClientCert(t, "bootstrap", bootstrapCA, bootstrapKey), pool: POOL_BOOTSTRAP},
+		{cert: testClientCert(t, "device", deviceCA, deviceKey), pool: POOL_DEVICE},
+		{cert: testClientCert(t, "other", otherCA, otherKey), pool: POOL_NONE},
+	}
+
+	for idx, step := range tests {
+		pool, err := pools.Classify([]*x509.Certificate{step.cert})
+		if pool != step.pool {
+			t.Errorf("test %v expected pool %q, got %q", idx, step.pool, pool)
+		}
+
+		err = pools.VerifyPeerCertificate([][]byte{step.cert.Raw}, nil)
+		if step.pool == POOL_NONE {
+			if !errors.Is(err, ErrUnknownAuthority) {
+				t.Errorf("test %v expected unknown authority, got %v", idx, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %v unexpected error: %v", idx, err)
+		}
+
+		if pool := pools.Pool(step.cert); pool != step.pool {
+			t.Errorf("test %v expected verdict %q, got %q", idx, step.pool, pool)
+		}
+	}
+
+	if _, err := pools.Classify(nil); !errors.Is(err, ErrUnknownAuthority) {
+		t.Errorf("expected an error for no certificates, got %v", err)
+	}
+
+	if err := pools.VerifyPeerCertificate([][]byte{[]byte("junk")}, nil); err == nil {
+		t.Errorf("expected an error for an unparsable certificate")
+	}
+
+	if pool := pools.Pool(nil); pool != POOL_NONE {
+		t.Errorf("expected no pool for no certificate, got %q", pool)
+	}
+
+	// Forgotten verdicts are verified again with the intermediates.
+	interCA, interKey := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "intermediate-ca"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, bootstrapCA, bootstrapKey)
+
+	leaf := testClientCert(t, "bootstrap", interCA, interKey)
+
+	if err := pools.VerifyPeerCertificate([][]byte{leaf.Raw, interCA.Raw}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	clear(pools.verdicts)
+
+	if pool := pools.Pool(leaf); pool != POOL_NONE {
+		t.Errorf("expected no pool without the intermediates, got %q", pool)
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, interCA}}
+	if pool := pools.ConnectionPool(state); pool != POOL_BOOTSTRAP {
+		t.Errorf("expected bootstrap pool, got %q", pool)
+	}
+
+	state.VerifiedChains = [][]*x509.Certificate{{leaf, interCA, bootstrapCA}}
+	if pool := pools.ConnectionPool(state); pool != POOL_BOOTSTRAP {
+		t.Errorf("expected bootstrap pool for the verified chain, got %q", pool)
+	}
+
+	if pool := pools.ConnectionPool(tls.ConnectionState{}); pool != POOL_NONE {
+		t.Errorf("expected no pool for no certificates, got %q", pool)
+	}
+
+	// A CA in both pools counts as a device CA.
+	both := patterns
+	both.Bootstrap = filepath.Join(dir, "*", "*-cacert.pem")
+
+	pools, err = NewClientCAPools(both)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pool := pools.Pool(tests[1].cert); pool != POOL_DEVICE {
+		t.Errorf("expected device pool, got %q", pool)
+	}
+
+	// Bad files are reported, but the good ones still make it in.
+	os.WriteFile(filepath.Join(dir, "device", "bad-cacert.pem"), []byte("bad"), 0o600)
+
+	pools, err = NewClientCAPools(patterns)
+	if _, ok := err.(*LoadAssetErrors); !ok || pools == nil || pools.Len() != 2 {
+		t.Errorf("expected load asset errors and pools, got %v %v", pools, err)
+	}
+
+	if _, err := NewClientCAPools(config.CACertificatesPattern{Device: "[-]"}); err == nil {
+		t.Errorf("expected an error for a bad pattern")
+	}
+
+} //  End of  TestClientCAPools
+
+// Test ServiceConfigFromPatterns function.
+func TestServiceConfigFromPatterns(t *testing.T) {
+	dir := t.TempDir()
+
+	deviceCA, _ := testCA(t, "device-ca")
+	os.WriteFile(filepath.Join(dir, "device-cacert.pem"),
+		EncodeCertificates(deviceCA), 0o600)
+
+	certPath := getPath(SERVICE, "cert.pem")
+	keyPath := getPath(SERVICE, "key.pem")
+
+	tests := []struct {
+		patterns   config.CACertificatesPattern
+		clientAuth tls.ClientAuthType
+	}{
+		{
+			patterns:   config.CACertificatesPattern{},
+			clientAuth: tls.NoClientCert,
+		},
+		{
+			patterns: config.CACertificatesPattern{
+				Bootstrap: filepath.Join(dir, "404-*.pem"),
+				Device:    filepath.Join(dir, "*-cacert.pem"),
+			},
+			clientAuth: tls.RequireAnyClientCert,
+		},
+	}
+
+	for idx, step := range tests {
+		cfg, pools, err := ServiceConfigFromPatterns(certPath, keyPath, nil, step.patterns)
+		if err != nil {
+			t.Fatalf("test %v unexpected error: %v", idx, err)
+		}
+
+		if cfg.ClientAuth != step.clientAuth || len(cfg.Certificates) != 1 || pools == nil {
+			t.Errorf("test %v unexpected config %v %v", idx, cfg, pools)
+		}
+
+		hooked := cfg.VerifyPeerCertificate != nil
+		if hooked != (step.clientAuth != tls.NoClientCert) {
+			t.Errorf("test %v unexpected verify hook %v", idx, hooked)
+		}
+	}
+
+	if _, _, err := ServiceConfigFromPatterns(certPath, "", nil, tests[0].patterns); err == nil {
+		t.Errorf("expected an error for a missing key")
+	}
+
+} //  End of  TestServiceConfigFromPatterns
@@ -0,0 +1,356 @@
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+const (
+	// ALPN protocol for gRPC - configs handed out per client hello need
+	// it, as the gRPC transport only sets it on the base config.
+	ALPN_PROTO_H2 = "h2"
+)
+
+var (
+	// No certificate loaded.
+	ErrNoCertificate = errors.New("no certificate loaded")
+)
+
+// Loads a TLS config from the watched files.
+type Loader func() (*tls.Config, error)
+
+// Watched file state - a file changed if its stamp did.
+type FileStamp struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// Reloader hands out the TLS certificates and CAs loaded from a set of
+// files (patterns) and reloads them when the files change, so that
+// rotated certificates are used without a restart.
+// A failed reload keeps the current TLS config.
+type Reloader struct {
+	name     string
+	patterns []string
+	loader   Loader
+	interval time.Duration
+
+	current atomic.Pointer[tls.Config]
+	pools   atomic.Pointer[ClientCAPools]
+
+	mutex   sync.Mutex
+	checked time.Time
+	stamps  map[string]FileStamp
+}
+
+// Returns a new reloader for the config the loader loads from the files
+// matching the patterns. The files are checked for changes at most every
+// `interval` - zero turns reloading off.
+func NewReloader(name string, loader Loader, interval time.Duration, patterns ...string) (*Reloader, error) {
+	r := &Reloader{
+		name:     name,
+		patterns: patterns,
+		loader:   loader,
+		interval: interval,
+	}
+
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+
+} //  End of function  NewReloader.
+
+// Returns a new service reloader for the certificate, key (decrypted with
+// the passphrase source) and the client CA pools (and revocation lists)
+// built from the CA certificates patterns.
+func NewServiceReloader(certPath, keyPath string, passphrase PassphraseFunc,
+	patterns config.CACertificatesPattern, interval time.Duration) (*Reloader, error) {
+
+	r := &Reloader{
+		name:     "service",
+		patterns: []string{certPath, keyPath, patterns.Bootstrap, patterns.Device, patterns.CRL},
+		interval: interval,
+	}
+
+	r.loader = func() (*tls.Config, error) {
+		cfg, pools, err := ServiceConfigFromPatterns(certPath, keyPath, passphrase, patterns)
+		if err != nil {
+			return nil, err
+		}
+
+		r.pools.Store(pools)
+		return cfg, nil
+	}
+
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+
+} //  End of function  NewServiceReloader.
+
+// Returns a new device reloader for the certificate, key (decrypted with
+// the passphrase source) and the service CA certificates.
+func NewDeviceReloader(certPath, keyPath string, passphrase PassphraseFunc,
+	caCertPaths []string, interval time.Duration) (*Reloader, error) {
+
+	loader := func() (*tls.Config, error) {
+		return DeviceConfig(certPath, keyPath, passphrase, caCertPaths)
+	}
+
+	patterns := append([]string{certPath, keyPath}, caCertPaths...)
+	return NewReloader("device", loader, interval, patterns...)
+
+} //  End of function  NewDeviceReloader.
+
+// Returns the state of a file.
+func StatFile(path string) (FileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FileStamp{}, err
+	}
+
+	return FileStamp{ModTime: fi.ModTime(), Size: fi.Size()}, nil
+
+} //  End of function  StatFile.
+
+// Initial load.
+func (r *Reloader) init() error {
+	cfg, err := r.loader()
+	if err != nil {
+		return err
+	}
+
+	r.current.Store(cfg)
+	r.checked = time.Now()
+	r.stamps = r.stat()
+
+	return nil
+
+} //  End of  Reloader.init
+
+// Returns the state of the watched files.
+func (r *Reloader) stat() map[string]FileStamp {
+	stamps := make(map[string]FileStamp)
+
+	paths, err := ExpandPatterns(r.patterns...)
+	if err != nil {
+		return stamps
+	}
+
+	for _, path := range paths {
+		if stamp, err := StatFile(path); err == nil {
+			stamps[path] = stamp
+		}
+	}
+
+	return stamps
+
+} //  End of  Reloader.stat
+
+// Returns the current TLS config.
+func (r *Reloader) Config() *tls.Config {
+	return r.current.Load()
+
+} //  End of  Reloader.Config
+
+// Returns the current client CA pools - only for service reloaders.
+func (r *Reloader) Pools() *ClientCAPools {
+	return r.pools.Load()
+
+} //  End of  Reloader.Pools
+
+// Check the watched files and reload if any of them changed, were added
+// or were removed. Returns true if the config was reloaded.
+func (r *Reloader) Check() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.checked = time.Now()
+
+	stamps := r.stat()
+	if maps.Equal(stamps, r.stamps) {
+		return false, nil
+	}
+
+	changed := []string{}
+	for path, stamp := range stamps {
+		if old, ok := r.stamps[path]; !ok || old != stamp {
+			changed = append(changed, path)
+		}
+	}
+
+	for path := range r.stamps {
+		if _, ok := stamps[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+
+	slices.Sort(changed)
+	slog.Info("tls files changed", "name", r.name, "files", changed)
+
+	cfg, err := r.loader()
+	if err != nil {
+		// Keep the current config - and retry on the next check, the
+		// files could be half way through being rotated.
+		slog.Error("reloading tls config", "name", r.name, "error", err)
+		return false, err
+	}
+
+	r.current.Store(cfg)
+	r.stamps = stamps
+
+	slog.Info("reloaded tls config", "name", r.name,
+		"certificates", len(cfg.Certificates))
+
+	return true, nil
+
+} //  End of  Reloader.Check
+
+// Check the watched files if the reload interval has passed.
+func (r *Reloader) refresh() {
+	if r.interval <= 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	due := time.Since(r.checked) >= r.interval
+	r.mutex.Unlock()
+
+	if due {
+		r.Check()
+	}
+
+} //  End of  Reloader.refresh
+
+// Watch the files, checking them every reload interval until the context
+// is done.
+func (r *Reloader) Watch(ctx context.Context) {
+	if r.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			r.Check()
+		}
+	}
+
+} //  End of  Reloader.Watch
+
+// Returns the current certificate.
+func (r *Reloader) certificate() (*tls.Certificate, error) {
+	r.refresh()
+
+	cfg := r.Config()
+	if len(cfg.Certificates) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	return &cfg.Certificates[0], nil
+
+} //  End of  Reloader.certificate
+
+// TLS GetCertificate hook - returns the current (server) certificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+
+} //  End of  Reloader.GetCertificate
+
+// TLS GetClientCertificate hook - returns the current client certificate,
+// or no certificate if there's none loaded.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := r.certificate()
+	if errors.Is(err, ErrNoCertificate) {
+		return &tls.Certificate{}, nil
+	}
+
+	return cert, err
+
+} //  End of  Reloader.GetClientCertificate
+
+// TLS GetConfigForClient hook - returns the current (server) config.
+func (r *Reloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.refresh()
+
+	cfg := r.Config().Clone()
+	cfg.NextProtos = []string{ALPN_PROTO_H2}
+
+	return cfg, nil
+
+} //  End of  Reloader.GetConfigForClient
+
+// Verify the service certificate chain for a server name against the
+// current root CAs.
+func (r *Reloader) verifyConnection(serverName string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrNoCertificate
+	}
+
+	if len(serverName) == 0 {
+		serverName = cs.ServerName
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         r.Config().RootCAs,
+		Intermediates: intermediates,
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+
+} //  End of  Reloader.verifyConnection
+
+// Returns a server TLS config handing out the current config per client.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate:     r.GetCertificate,
+		GetConfigForClient: r.GetConfigForClient,
+	}
+
+} //  End of  Reloader.ServerConfig
+
+// Returns a client TLS config using the current certificate and root CAs.
+// The root CAs can't be swapped in a static config, so the certificate of
+// the service (`serverName`) is verified by hand against the current root
+// CAs. The server name has to be passed in as it is not sent for IP
+// addresses.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	verify := func(cs tls.ConnectionState) error {
+		return r.verifyConnection(serverName, cs)
+	}
+
+	return &tls.Config{
+		GetClientCertificate: r.GetClientCertificate,
+		InsecureSkipVerify:   true,
+		VerifyConnection:     verify,
+	}
+
+} //  End of  Reloader.ClientConfig
@@ -0,0 +1,289 @@
+package tls
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Write a leaf certificate and key for a name issued by a test CA.
+// Server certificates are for localhost. Returns the certificate.
+func writeTestCert(t *testing.T, certPath, keyPath, name string, caCert *x509.Certificate,
+	caKey crypto.Signer, server bool) *x509.Certificate {
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+	}
+
+	cert, key := issueTestCert(t, template, caCert, caKey)
+	data, _ := EncodePrivateKey(key)
+
+	if err := os.WriteFile(certPath, EncodeCertificates(cert), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+
+	if err := os.WriteFile(keyPath, data, 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+
+	// Make sure the change is visible whatever the file system time
+	// granularity.
+	later := time.Now().Add(time.Duration(cert.SerialNumber.Int64() % 1000))
+	os.Chtimes(certPath, later, later)
+	os.Chtimes(keyPath, later, later)
+
+	return cert
+
+} //  End of  writeTestCert
+
+// Handshake between a server and a client config over a pipe.
+// Returns the certificates the client and the server saw.
+func testHandshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, *x509.Certificate, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := tls.Server(serverConn, server)
+	cli := tls.Client(clientConn, client)
+
+	errs := make(chan error, 1)
+	go func() {
+		err := srv.HandshakeContext(ctx)
+		if err != nil {
+			clientConn.Close()
+		}
+
+		errs <- err
+	}()
+
+	if err := cli.HandshakeContext(ctx); err != nil {
+		serverConn.Close()
+		<-errs
+		return nil, nil, err
+	}
+
+	// Drain the pipe - the server could still be sending an alert about
+	// the client certificate.
+	go io.Copy(io.Discard, clientConn)
+
+	if err := <-errs; err != nil {
+		return nil, nil, err
+	}
+
+	var seen *x509.Certificate
+	if certs := srv.ConnectionState().PeerCertificates; len(certs) > 0 {
+		seen = certs[0]
+	}
+
+	return cli.ConnectionState().PeerCertificates[0], seen, nil
+
+} //  End of  testHandshake
+
+// Test Reloader functions.
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testCA(t, "test-ca")
+
+	caPath := filepath.Join(dir, "cacert.pem")
+	os.WriteFile(caPath, EncodeCertificates(caCert), 0o600)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certPath, keyPath, "device", caCert, caKey, false)
+
+	reloader, err := NewDeviceReloader(certPath, keyPath, nil, []string{caPath}, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cert, err := reloader.GetClientCertificate(nil)
+	if err != nil || !first.Equal(leaf(t, cert)) {
+		t.Errorf("expected first certificate, got %v", err)
+	}
+
+	if changed, err := reloader.Check(); changed || err != nil {
+		t.Errorf("expected no changes, got %v %v", changed, err)
+	}
+
+	second := writeTestCert(t, certPath, keyPath, "device", caCert, caKey, false)
+	if changed, err := reloader.Check(); !changed || err != nil {
+		t.Errorf("expected a reload, got %v %v", changed, err)
+	}
+
+	cert, _ = reloader.GetClientCertificate(nil)
+	if !second.Equal(leaf(t, cert)) {
+		t.Errorf("expected rotated certificate")
+	}
+
+	// Half rotated (or broken) files keep the current config.
+	os.WriteFile(keyPath, []byte("not a key"), 0o600)
+	if changed, err := reloader.Check(); changed || err == nil {
+		t.Errorf("expected a failed reload, got %v %v", changed, err)
+	}
+
+	cert, _ = reloader.GetClientCertificate(nil)
+	if !second.Equal(leaf(t, cert)) {
+		t.Errorf("expected current certificate to be kept")
+	}
+
+	if _, err := NewDeviceReloader(certPath, keyPath, nil, nil, 0); err == nil {
+		t.Errorf("expected an error for a bad key")
+	}
+
+	// No certificate.
+	empty, err := NewDeviceReloader("", "", nil, []string{caPath}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cert, err := empty.GetClientCertificate(nil); err != nil || len(cert.Certificate) > 0 {
+		t.Errorf("expected an empty client certificate, got %v %v", cert, err)
+	}
+
+	if _, err := empty.GetCertificate(nil); !errors.Is(err, ErrNoCertificate) {
+		t.Errorf("expected no certificate error, got %v", err)
+	}
+
+} //  End of  TestReloader
+
+// Test StatFile function.
+func TestStatFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	if stamp, err := StatFile(path); err == nil || stamp != (FileStamp{}) {
+		t.Errorf("expected an error and no stamp for a missing file, got %v %v", stamp, err)
+	}
+
+	os.WriteFile(path, []byte("allow"), 0o600)
+	stamp, err := StatFile(path)
+	if err != nil || stamp.Size != 5 || stamp.ModTime.IsZero() {
+		t.Fatalf("unexpected stamp %v %v", stamp, err)
+	}
+
+	os.WriteFile(path, []byte("deny all"), 0o600)
+	if changed, _ := StatFile(path); changed == stamp {
+		t.Errorf("expected the stamp to change with the file")
+	}
+
+} //  End of  TestStatFile
+
+// Returns the leaf of a TLS certificate.
+func leaf(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+
+	return parsed
+
+} //  End of  leaf
+
+// Test rotating certificates and CAs under live TLS configs.
+func TestReloaderRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	serviceCA, serviceKey := testCA(t, "service-ca")
+	deviceCA, deviceKey := testCA(t, "device-ca")
+	rotatedCA, rotatedKey := testCA(t, "rotated-ca")
+
+	serviceCAPath := filepath.Join(dir, "service-cacert.pem")
+	os.WriteFile(serviceCAPath, EncodeCertificates(serviceCA), 0o600)
+	os.MkdirAll(filepath.Join(dir, "device"), 0o700)
+	os.WriteFile(filepath.Join(dir, "device", "device-cacert.pem"),
+		EncodeCertificates(deviceCA), 0o600)
+
+	serviceCert := filepath.Join(dir, "service-cert.pem")
+	serviceKeyPath := filepath.Join(dir, "service-key.pem")
+	first := writeTestCert(t, serviceCert, serviceKeyPath, "service", serviceCA, serviceKey, true)
+
+	deviceCert := filepath.Join(dir, "device-cert.pem")
+	deviceKeyPath := filepath.Join(dir, "device-key.pem")
+	device := writeTestCert(t, deviceCert, deviceKeyPath, "device", deviceCA, deviceKey, false)
+
+	patterns := config.CACertificatesPattern{
+		Device: filepath.Join(dir, "device", "*-cacert.pem"),
+	}
+
+	// Short interval - the handshakes pick up the changes.
+	interval := time.Millisecond
+
+	service, err := NewServiceReloader(serviceCert, serviceKeyPath, nil, patterns, interval)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client, err := NewDeviceReloader(deviceCert, deviceKeyPath, nil, []string{serviceCAPath}, interval)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	seen, peer, err := testHandshake(t, service.ServerConfig(), client.ClientConfig("localhost"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !seen.Equal(first) || !peer.Equal(device) {
+		t.Errorf("expected initial certificates")
+	}
+
+	if pool := service.Pools().Pool(peer); pool != POOL_DEVICE {
+		t.Errorf("expected device pool, got %q", pool)
+	}
+
+	// Wrong server name.
+	if _, _, err := testHandshake(t, service.ServerConfig(), client.ClientConfig("example.com")); err == nil {
+		t.Errorf("expected server name mismatch")
+	}
+
+	// Rotate the service certificate.
+	second := writeTestCert(t, serviceCert, serviceKeyPath, "service", serviceCA, serviceKey, true)
+	time.Sleep(2 * interval)
+
+	seen, _, err = testHandshake(t, service.ServerConfig(), client.ClientConfig("localhost"))
+	if err != nil || !seen.Equal(second) {
+		t.Errorf("expected rotated service certificate, got %v", err)
+	}
+
+	// Rotate the device CA - the old device certificate is rejected and
+	// the new one accepted.
+	os.WriteFile(filepath.Join(dir, "device", "device-cacert.pem"),
+		EncodeCertificates(rotatedCA), 0o600)
+	time.Sleep(2 * interval)
+
+	if _, _, err := testHandshake(t, service.ServerConfig(), client.ClientConfig("localhost")); err == nil {
+		t.Errorf("expected device certificate from the old CA to be rejected")
+	}
+
+	rotated := writeTestCert(t, deviceCert, deviceKeyPath, "device", rotatedCA, rotatedKey, false)
+	time.Sleep(2 * interval)
+
+	_, peer, err = testHandshake(t, service.ServerConfig(), client.ClientConfig("localhost"))
+	if err != nil || !peer.Equal(rotated) {
+		t.Errorf("expected rotated device certificate, got %v", err)
+	}
+
+} //  End of  TestReloaderRotation
@@ -7,14 +7,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strings"
 )
 
 const (
-	CERTIFICATE     = "CERTIFICATE"
-	EC_PRIVATE_KEY  = "EC PRIVATE KEY"
-	RSA_PRIVATE_KEY = "RSA PRIVATE KEY"
-	PRIVATE_KEY     = "PRIVATE KEY"
+	CERTIFICATE           = "CERTIFICATE"
+	CERTIFICATE_REQUEST   = "CERTIFICATE REQUEST"
+	EC_PRIVATE_KEY        = "EC PRIVATE KEY"
+	RSA_PRIVATE_KEY       = "RSA PRIVATE KEY"
+	PRIVATE_KEY           = "PRIVATE KEY"
+	ENCRYPTED_PRIVATE_KEY = "ENCRYPTED PRIVATE KEY"
+	X509_CRL              = "X509 CRL"
 )
 
 // Errors loading secure assets.
@@ -33,8 +37,14 @@ func (e *LoadAssetErrors) Error() string {
 
 } //  End of  LoadAssetErrors.Error
 
-// Finds matching PEM blocks for a specific type.
-func findBlocks(path, kind string) ([]*pem.Block, error) {
+// Returns the individual load asset errors - for errors.Is and errors.As.
+func (e *LoadAssetErrors) Unwrap() []error {
+	return e.Errors
+
+} //  End of  LoadAssetErrors.Unwrap
+
+// Finds matching PEM blocks for specific types.
+func findBlocks(path string, kinds ...string) ([]*pem.Block, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -51,7 +61,7 @@ func findBlocks(path, kind string) ([]*pem.Block, error) {
 
 		remaining = rest
 
-		if block.Type == kind {
+		if slices.Contains(kinds, block.Type) {
 			matched = append(matched, block)
 		}
 	}
@@ -60,7 +70,7 @@ func findBlocks(path, kind string) ([]*pem.Block, error) {
 		return matched, nil
 	}
 
-	return nil, fmt.Errorf(fmt.Sprintf("no matching %v blocks", kind))
+	return nil, fmt.Errorf("no matching %v blocks", strings.Join(kinds, "/"))
 
 } //  End of function  findBlocks.
 
@@ -112,8 +122,8 @@ func ValidateCACerts(path string) error {
 
 } //  End of function  ValidateCACerts.
 
-// Parse a private key from a PEM block.
-func parsePrivateKey(block *pem.Block) (any, error) {
+// Parse a private key from a PEM block (from a file).
+func parsePrivateKey(path string, block *pem.Block, passphrase PassphraseFunc) (any, error) {
 	switch block.Type {
 	case EC_PRIVATE_KEY:
 		return x509.ParseECPrivateKey(block.Bytes)
@@ -123,24 +133,34 @@ func parsePrivateKey(block *pem.Block) (any, error) {
 
 	case PRIVATE_KEY:
 		return x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	case ENCRYPTED_PRIVATE_KEY:
+		decrypted, err := decryptBlock(path, block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		return x509.ParsePKCS8PrivateKey(decrypted.Bytes)
 	}
 
 	return nil, fmt.Errorf("unsupported PEM type: %v", block.Type)
 
 } //  End of function  parsePrivateKey.
 
-// Loads all PEM format private keys from a file.
-func LoadPrivateKeys(path string) ([]any, error) {
+// Loads all PEM format private keys (PKCS#1 RSA, SEC 1 EC, PKCS#8 RSA, EC
+// and Ed25519 - plain or encrypted) from a file. Encrypted private keys
+// are decrypted with the passphrase source (if any).
+func LoadPrivateKeys(path string, passphrase PassphraseFunc) ([]any, error) {
 	privateKeys := []any{}
 	errs := []error{}
 
-	blocks, err := findBlocks(path, PRIVATE_KEY)
+	blocks, err := findBlocks(path, privateKeyTypes...)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, block := range blocks {
-		zkey, err := parsePrivateKey(block)
+		zkey, err := parsePrivateKey(path, block, passphrase)
 		if err == nil {
 			privateKeys = append(privateKeys, zkey)
 		} else {
@@ -156,22 +176,40 @@ func LoadPrivateKeys(path string) ([]any, error) {
 
 } //  End of function  LoadPrivateKeys.
 
-// Validate all PEM format private keys in a file.
-func ValidatePrivateKeys(path string) error {
-	_, err := LoadPrivateKeys(path)
+// Validate all PEM format private keys in a file - encrypted ones are
+// decrypted with the passphrase source.
+func ValidatePrivateKeys(path string, passphrase PassphraseFunc) error {
+	_, err := LoadPrivateKeys(path, passphrase)
 	return err
 
 } //  End of function  ValidatePrivateKeys.
 
-// Load Certificate and Key pair from given paths.
-func LoadCertKeyPair(certPath, keyPath string) (tls.Certificate, error) {
-	return tls.LoadX509KeyPair(certPath, keyPath)
+// Load Certificate and Key pair from given paths. Encrypted private keys
+// are decrypted with the passphrase source (see ConfigPassphrase).
+func LoadCertKeyPair(certPath, keyPath string, passphrase PassphraseFunc) (tls.Certificate, error) {
+	blocks, err := findBlocks(keyPath, ENCRYPTED_PRIVATE_KEY)
+	if err != nil {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	decrypted, err := decryptBlock(keyPath, blocks[0], passphrase)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, pem.EncodeToMemory(decrypted))
 
 } //  End of function  LoadCertKeyPair.
 
-// Validate a Certificate and Key pair.
-func ValidateCertKeyPair(certPath, keyPath string) error {
-	_, err := LoadCertKeyPair(certPath, keyPath)
+// Validate a Certificate and Key pair - an encrypted key is decrypted
+// with the passphrase source.
+func ValidateCertKeyPair(certPath, keyPath string, passphrase PassphraseFunc) error {
+	_, err := LoadCertKeyPair(certPath, keyPath, passphrase)
 	return err
 
 } //  End of function  ValidateCertKeyPair.
@@ -216,7 +254,7 @@ func CreateCACertPool(caCertPaths []string) (*x509.CertPool, error) {
 // Create secure device TLS config.
 // Normally, this is the client side config but in a tower workflow, it
 // would be the "service in the middle" attack!
-func DeviceConfig(certPath, keyPath string,
+func DeviceConfig(certPath, keyPath string, passphrase PassphraseFunc,
 	caCertPaths []string) (*tls.Config, error) {
 
 	pool, err := CreateCACertPool(caCertPaths)
@@ -226,7 +264,7 @@ func DeviceConfig(certPath, keyPath string,
 
 	certs := []tls.Certificate{}
 	if len(certPath) > 0 || len(keyPath) > 0 {
-		cert, err := LoadCertKeyPair(certPath, keyPath)
+		cert, err := LoadCertKeyPair(certPath, keyPath, passphrase)
 		if err != nil {
 			return nil, err
 		}
@@ -239,8 +277,8 @@ func DeviceConfig(certPath, keyPath string,
 } // End of function DeviceConfig.
 
 // Create secure service config.
-func ServiceConfig(certPath, keyPath string, clientCACertPaths []string,
-	clientAuth tls.ClientAuthType) (*tls.Config, error) {
+func ServiceConfig(certPath, keyPath string, passphrase PassphraseFunc,
+	clientCACertPaths []string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
 
 	pool, err := CreateCACertPool(clientCACertPaths)
 	if err != nil {
@@ -254,7 +292,7 @@ func ServiceConfig(certPath, keyPath string, clientCACertPaths []string,
 	}
 
 	if len(certPath) > 0 || len(keyPath) > 0 {
-		cert, err := LoadCertKeyPair(certPath, keyPath)
+		cert, err := LoadCertKeyPair(certPath, keyPath, passphrase)
 		if err != nil {
 			return nil, err
 		}
@@ -795,7 +795,7 @@ func TestValidateCACerts(t *testing.T) {
 // Test LoadPrivateKeys function.
 func TestLoadPrivateKeys(t *testing.T) {
 	for _, tc := range generateTestCases() {
-		privKeys, err := LoadPrivateKeys(tc.keypath)
+		privKeys, err := LoadPrivateKeys(tc.keypath, nil)
 		if tc.nkeys > 0 {
 			if err != nil {
 				t.Errorf("test %v unexpected error: %v",
@@ -829,7 +829,7 @@ func TestLoadPrivateKeys(t *testing.T) {
 // Test ValidatePrivateKeys function.
 func TestValidatePrivateKeys(t *testing.T) {
 	for _, tc := range generateTestCases() {
-		err := ValidatePrivateKeys(tc.keypath)
+		err := ValidatePrivateKeys(tc.keypath, nil)
 		if tc.nkeys > 0 {
 			if err != nil {
 				t.Errorf("test %v unexpected error: %v",
@@ -850,7 +850,7 @@ func TestValidatePrivateKeys(t *testing.T) {
 // Test LoadCertKeyPair function.
 func TestLoadCertKeyPair(t *testing.T) {
 	for _, tc := range generateTestCases() {
-		cert, err := LoadCertKeyPair(tc.certpath, tc.keypath)
+		cert, err := LoadCertKeyPair(tc.certpath, tc.keypath, nil)
 		if !tc.loadErr {
 			if err != nil {
 				t.Errorf("test %v unexpected error: %v",
@@ -883,7 +883,7 @@ func TestLoadCertKeyPair(t *testing.T) {
 // Test ValidateCertKeyPair function.
 func TestValidateCertKeyPair(t *testing.T) {
 	for _, tc := range generateTestCases() {
-		err := ValidateCertKeyPair(tc.certpath, tc.keypath)
+		err := ValidateCertKeyPair(tc.certpath, tc.keypath, nil)
 		if !tc.loadErr {
 			if err != nil {
 				t.Errorf("test %v unexpected error: %v",
@@ -1067,7 +1067,7 @@ func TestCreateCACertPool(t *testing.T) {
 // Check device config.
 func checkDeviceConfig(tc tlsTestCase, step tlsCATestCase, t *testing.T) {
 	name := fmt.Sprintf("test %v + %v", tc.name, step.name)
-	cfg, err := DeviceConfig(tc.certpath, tc.keypath, step.cacerts)
+	cfg, err := DeviceConfig(tc.certpath, tc.keypath, nil, step.cacerts)
 	if tc.loadErr || step.loadError {
 		// we expect errors.
 		if err == nil {
@@ -1109,7 +1109,7 @@ func checkServiceConfig(tc tlsTestCase, step tlsCATestCase, t *testing.T) {
 
 	for _, clientAuth := range authTypes {
 		name := fmt.Sprintf("test %v with %v", tc.name, step.name)
-		cfg, err := ServiceConfig(tc.certpath, tc.keypath,
+		cfg, err := ServiceConfig(tc.certpath, tc.keypath, nil,
 			step.cacerts, clientAuth)
 		if tc.loadErr || step.loadError {
 			// we expect errors.
@@ -0,0 +1,187 @@
+package tls
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+var (
+	// Certificate doesn't chain to the configured CAs.
+	ErrUntrustedChain = errors.New("certificate does not chain to the configured CAs")
+
+	// Certificate extended key usage doesn't allow the role.
+	ErrKeyUsageMismatch = errors.New("certificate extended key usage does not match role")
+
+	// Certificate subject alternative names don't cover an address.
+	ErrNameMismatch = errors.New("certificate does not cover address")
+)
+
+// Returns true if an address needs to be covered by the service
+// certificate - unspecified (listen on all interfaces) addresses don't.
+func coveredAddress(host string) bool {
+	ip := net.ParseIP(host)
+	return len(host) > 0 && (ip == nil || !ip.IsUnspecified())
+
+} //  End of function  coveredAddress.
+
+// Returns a pool with only the CA certificates in the files - nil if
+// there are none.
+func rootsPool(paths []string) (*x509.CertPool, []error) {
+	pool := x509.NewCertPool()
+
+	count, errs := addCACerts(pool, paths)
+	if count == 0 {
+		return nil, errs
+	}
+
+	return pool, errs
+
+} //  End of function  rootsPool.
+
+// Verify the leaf certificate in a file (followed by any intermediates)
+// can be used for a role (extended key usage), chains to the roots (if
+// any) and covers all the hosts. Returns every problem found.
+func VerifyLeaf(path string, roots *x509.CertPool, usage x509.ExtKeyUsage, hosts ...string) []error {
+	certs, err := LoadCertificates(path)
+	if len(certs) == 0 {
+		return []error{fmt.Errorf("%v: %w", path, err)}
+	}
+
+	leaf := certs[0]
+	errs := []error{}
+
+	// No extended key usage means any usage.
+	usages := leaf.ExtKeyUsage
+	if len(usages) > 0 && !slices.Contains(usages, usage) &&
+		!slices.Contains(usages, x509.ExtKeyUsageAny) {
+		errs = append(errs, fmt.Errorf("%v: %w: %v", path,
+			ErrKeyUsageMismatch, leaf.Subject))
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+
+		if _, err := leaf.Verify(opts); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w: %v", path,
+				ErrUntrustedChain, err))
+		}
+	}
+
+	for _, host := range hosts {
+		if err := leaf.VerifyHostname(host); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w %q: %v", path,
+				ErrNameMismatch, host, leaf.Subject))
+		}
+	}
+
+	return errs
+
+} //  End of function  VerifyLeaf.
+
+// Collects the errors of a config validation.
+func validationErrors(err error) []error {
+	var loadErrs *LoadAssetErrors
+	if errors.As(err, &loadErrs) {
+		return loadErrs.Errors
+	}
+
+	if err != nil {
+		return []error{err}
+	}
+
+	return []error{}
+
+} //  End of function  validationErrors.
+
+// Validate the service TLS config artifacts if the config asks for it
+// (see ValidateConfig). Additionally, the service certificate needs to be
+// usable as a server certificate (serverAuth), chain to the CA certificate
+// it is issued by (if any) and cover the bind address.
+func ValidateServiceConfig(cfg *config.Config) error {
+	if !cfg.Settings.ValidateTLS {
+		return nil
+	}
+
+	errs := validationErrors(ValidateConfig(cfg))
+
+	if zpath := cfg.Settings.Cert; len(zpath) > 0 {
+		var roots *x509.CertPool
+		if caPath := cfg.Service.CACert; len(caPath) > 0 {
+			pool, rootErrs := rootsPool([]string{caPath})
+			roots = pool
+			errs = append(errs, rootErrs...)
+		}
+
+		hosts := []string{}
+		if host := cfg.Service.BindAddress; coveredAddress(host) {
+			hosts = append(hosts, host)
+		}
+
+		errs = append(errs, VerifyLeaf(zpath, roots,
+			x509.ExtKeyUsageServerAuth, hosts...)...)
+	}
+
+	if len(errs) > 0 {
+		return &LoadAssetErrors{Errors: errs}
+	}
+
+	return nil
+
+} //  End of function  ValidateServiceConfig.
+
+// Validate the device TLS config artifacts if the config asks for it
+// (see ValidateConfig). Additionally, the device (and enrolled)
+// certificates need to be usable as client certificates (clientAuth) and
+// chain to the bootstrap or device CA certificates (if any).
+func ValidateDeviceConfig(cfg *config.Config) error {
+	if !cfg.Settings.ValidateTLS {
+		return nil
+	}
+
+	errs := validationErrors(ValidateConfig(cfg))
+
+	patterns := cfg.Service.CACertPatterns
+	paths, err := ExpandPatterns(patterns.Bootstrap, patterns.Device)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	roots, rootErrs := rootsPool(paths)
+	errs = append(errs, rootErrs...)
+
+	certs := []string{cfg.Settings.Cert}
+	if zpath := cfg.Device.EnrolledCert; len(zpath) > 0 {
+		if _, err := os.Stat(zpath); err == nil {
+			certs = append(certs, zpath)
+		}
+	}
+
+	for _, zpath := range certs {
+		if len(zpath) > 0 {
+			errs = append(errs, VerifyLeaf(zpath, roots,
+				x509.ExtKeyUsageClientAuth)...)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &LoadAssetErrors{Errors: errs}
+	}
+
+	return nil
+
+} //  End of function  ValidateDeviceConfig.
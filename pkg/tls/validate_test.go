@@ -0,0 +1,193 @@
+package tls
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biota/go-grpc-telegraph/pkg/config"
+)
+
+// Test VerifyLeaf function.
+func TestVerifyLeaf(t *testing.T) {
+	dir := t.TempDir()
+
+	caCert, caKey := testCA(t, "test-ca")
+	otherCA, _ := testCA(t, "other-ca")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	others := x509.NewCertPool()
+	others.AddCert(otherCA)
+
+	serverCert := filepath.Join(dir, "server-cert.pem")
+	writeTestCert(t, serverCert, filepath.Join(dir, "server-key.pem"), "service",
+		caCert, caKey, true)
+
+	clientCert := filepath.Join(dir, "client-cert.pem")
+	writeTestCert(t, clientCert, filepath.Join(dir, "client-key.pem"), "device",
+		caCert, caKey, false)
+
+	tests := []struct {
+		path  string
+		roots *x509.CertPool
+		usage x509.ExtKeyUsage
+		hosts []string
+		errs  []error
+	}{
+		{path: serverCert, roots: roots, usage: x509.ExtKeyUsageServerAuth, hosts: []string{"localhost"}},
+		{path: serverCert, usage: x509.ExtKeyUsageServerAuth},
+		{path: clientCert, roots: roots, usage: x509.ExtKeyUsageClientAuth},
+		{
+			path:  serverCert,
+			roots: roots,
+			usage: x509.ExtKeyUsageClientAuth,
+			errs:  []error{ErrKeyUsageMismatch},
+		},
+		{
+			path:  clientCert,
+			roots: others,
+			usage: x509.ExtKeyUsageClientAuth,
+			errs:  []error{ErrUntrustedChain},
+		},
+		{
+			path:  serverCert,
+			roots: roots,
+			usage: x509.ExtKeyUsageServerAuth,
+			hosts: []string{"localhost", "127.0.0.1"},
+			errs:  []error{ErrNameMismatch},
+		},
+		{
+			path:  clientCert,
+			roots: others,
+			usage: x509.ExtKeyUsageServerAuth,
+			hosts: []string{"localhost"},
+			errs:  []error{ErrKeyUsageMismatch, ErrUntrustedChain, ErrNameMismatch},
+		},
+	}
+
+	for idx, step := range tests {
+		errs := VerifyLeaf(step.path, step.roots, step.usage, step.hosts...)
+		if len(errs) != len(step.errs) {
+			t.Errorf("test %v expected %v errors, got %v", idx, len(step.errs), errs)
+			continue
+		}
+
+		for n, err := range errs {
+			if !errors.Is(err, step.errs[n]) {
+				t.Errorf("test %v expected error %v, got %v", idx, step.errs[n], err)
+			}
+		}
+	}
+
+	if errs := VerifyLeaf(filepath.Join(dir, "404.pem"), roots, x509.ExtKeyUsageAny); len(errs) != 1 {
+		t.Errorf("expected an error for a missing certificate, got %v", errs)
+	}
+
+} //  End of  TestVerifyLeaf
+
+// Test ValidateServiceConfig and ValidateDeviceConfig functions.
+func TestValidateRoleConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	caCert, caKey := testCA(t, "test-ca")
+	otherCA, _ := testCA(t, "other-ca")
+
+	os.MkdirAll(filepath.Join(dir, "ca"), 0o700)
+	os.MkdirAll(filepath.Join(dir, "other"), 0o700)
+
+	caPath := filepath.Join(dir, "ca", "test-cacert.pem")
+	os.WriteFile(caPath, EncodeCertificates(caCert), 0o600)
+
+	otherPath := filepath.Join(dir, "other", "other-cacert.pem")
+	os.WriteFile(otherPath, EncodeCertificates(otherCA), 0o600)
+
+	serverCert := filepath.Join(dir, "server-cert.pem")
+	writeTestCert(t, serverCert, filepath.Join(dir, "server-key.pem"), "service",
+		caCert, caKey, true)
+
+	clientCert := filepath.Join(dir, "client-cert.pem")
+	writeTestCert(t, clientCert, filepath.Join(dir, "client-key.pem"), "device",
+		caCert, caKey, false)
+
+	newConfig := func(validate bool, cert, caPath, pattern, bind string) *config.Config {
+		cfg, _ := config.NewConfig("TLS_TEST", "")
+		cfg.Settings.ValidateTLS = validate
+		cfg.Settings.CertExpiryWarning = 0
+		cfg.Settings.Cert = cert
+		cfg.Service.CACert = caPath
+		cfg.Service.CACertPatterns.Device = pattern
+		cfg.Service.BindAddress = bind
+		return cfg
+	}
+
+	// The upstream service CA (for relaying) is not the one the service
+	// certificate is issued by.
+	relay := newConfig(true, serverCert, caPath, "", "localhost")
+	relay.Device.ServiceCACert = otherPath
+
+	tests := []struct {
+		cfg    *config.Config
+		device bool
+		errs   []error
+	}{
+		{cfg: newConfig(true, serverCert, caPath, "", "localhost")},
+		{cfg: relay},
+		{cfg: newConfig(true, serverCert, "", "", "0.0.0.0")},
+		{cfg: newConfig(false, clientCert, otherPath, "", "127.0.0.1")},
+		{
+			cfg:  newConfig(true, serverCert, caPath, "", "127.0.0.1"),
+			errs: []error{ErrNameMismatch},
+		},
+		{
+			cfg:  newConfig(true, clientCert, otherPath, "", "localhost"),
+			errs: []error{ErrKeyUsageMismatch, ErrUntrustedChain, ErrNameMismatch},
+		},
+		{cfg: newConfig(true, clientCert, "", filepath.Join(dir, "ca", "*.pem"), ""), device: true},
+		{cfg: newConfig(true, clientCert, "", "", ""), device: true},
+		{
+			cfg:    newConfig(true, serverCert, "", filepath.Join(dir, "ca", "*.pem"), ""),
+			device: true,
+			errs:   []error{ErrKeyUsageMismatch},
+		},
+		{
+			cfg:    newConfig(true, clientCert, "", filepath.Join(dir, "other", "*.pem"), ""),
+			device: true,
+			errs:   []error{ErrUntrustedChain},
+		},
+	}
+
+	for idx, step := range tests {
+		var err error
+		if step.device {
+			err = ValidateDeviceConfig(step.cfg)
+		} else {
+			err = ValidateServiceConfig(step.cfg)
+		}
+
+		if len(step.errs) == 0 {
+			if err != nil {
+				t.Errorf("test %v unexpected error: %v", idx, err)
+			}
+
+			continue
+		}
+
+		loadErrs, ok := err.(*LoadAssetErrors)
+		if !ok || len(loadErrs.Errors) != len(step.errs) {
+			t.Errorf("test %v expected %v load asset errors, got %v", idx,
+				len(step.errs), err)
+			continue
+		}
+
+		for _, expected := range step.errs {
+			if !errors.Is(err, expected) {
+				t.Errorf("test %v expected error %v, got %v", idx, expected, err)
+			}
+		}
+	}
+
+} //  End of  TestValidateRoleConfig
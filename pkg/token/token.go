@@ -0,0 +1,372 @@
+// Package token mints and verifies the compact signed bearer tokens the
+// service issues in membership permits - JWT style, signed with Ed25519
+// (EdDSA) or HMAC-SHA256 (HS256).
+package token
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	"github.com/biota/go-grpc-telegraph/pkg/topic"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+// Signing algorithms.
+const (
+	ALG_EDDSA = "EdDSA"
+	ALG_HS256 = "HS256"
+
+	TOKEN_TYPE = "JWT"
+
+	// Min size (in bytes) of HMAC keys.
+	HMAC_MIN_KEY_SIZE = 32
+
+	// PEM block type for public keys.
+	PUBLIC_KEY = "PUBLIC KEY"
+)
+
+var (
+	// Not a (valid) signed token.
+	ErrInvalidToken = errors.New("invalid token")
+
+	// Token past its expiry.
+	ErrTokenExpired = errors.New("token expired")
+
+	// Token signed with another algorithm or key type we don't do.
+	ErrUnsupportedAlgorithm = errors.New("unsupported token algorithm")
+
+	// Key can only verify tokens.
+	ErrVerifyOnly = errors.New("key can only verify tokens")
+
+	// HMAC key too short to be any good.
+	ErrWeakKey = errors.New("key too short")
+)
+
+// Token scopes - the topics (filters) a device can subscribe to and the
+// categories of records it can send. No topics or categories means no
+// restrictions.
+type Scopes struct {
+	Topics     []string `json:"topics,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// Token claims.
+type Claims struct {
+	Device   string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+
+	Scopes
+}
+
+// Token header.
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// Token signing (and verification) key.
+type Key struct {
+	algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// Returns the category name for a category (name) - accepts the names
+// with or without the CATEGORY_ prefix, any case.
+func CategoryName(category string) (string, error) {
+	name := strings.ToUpper(category)
+	if !strings.HasPrefix(name, "CATEGORY_") {
+		name = "CATEGORY_" + name
+	}
+
+	if _, ok := pb.Category_value[name]; !ok {
+		return "", fmt.Errorf("unknown category %q", category)
+	}
+
+	return name, nil
+
+} // End of function  CategoryName.
+
+// Returns the issue time.
+func (c *Claims) IssuedTime() time.Time {
+	return time.Unix(c.IssuedAt, 0)
+
+} //  End of  Claims.IssuedTime
+
+// Returns the expiry time.
+func (c *Claims) ExpiryTime() time.Time {
+	return time.Unix(c.Expires, 0)
+
+} //  End of  Claims.ExpiryTime
+
+// Returns true if the token expired as of `now`.
+func (c *Claims) Expired(now time.Time) bool {
+	return !now.Before(c.ExpiryTime())
+
+} //  End of  Claims.Expired
+
+// Returns the time to refresh the token at - with a quarter of its
+// lifetime left.
+func (c *Claims) RefreshTime() time.Time {
+	lifetime := c.Expires - c.IssuedAt
+	return time.Unix(c.Expires-lifetime/4, 0)
+
+} //  End of  Claims.RefreshTime
+
+// Returns true if the scopes allow subscribing to a (valid) topic filter
+// - the filter needs to be within one of the topic scopes.
+func (s Scopes) AllowsTopic(filter string) bool {
+	if topic.ValidateFilter(filter) != nil {
+		return false
+	}
+
+	if len(s.Topics) == 0 {
+		return true
+	}
+
+	for _, scope := range s.Topics {
+		if topic.Within(filter, scope) {
+			return true
+		}
+	}
+
+	return false
+
+} //  End of  Scopes.AllowsTopic
+
+// Returns true if the scopes allow a category of records.
+func (s Scopes) AllowsCategory(category pb.Category) bool {
+	if len(s.Categories) == 0 {
+		return true
+	}
+
+	return slices.Contains(s.Categories, category.String())
+
+} //  End of  Scopes.AllowsCategory
+
+// Returns a new HMAC-SHA256 key.
+func NewHMACKey(secret []byte) (*Key, error) {
+	if len(secret) < HMAC_MIN_KEY_SIZE {
+		return nil, fmt.Errorf("%w: %v bytes, need %v", ErrWeakKey,
+			len(secret), HMAC_MIN_KEY_SIZE)
+	}
+
+	return &Key{algorithm: ALG_HS256, secret: bytes.Clone(secret)}, nil
+
+} // End of function  NewHMACKey.
+
+// Returns a new Ed25519 signing key.
+func NewEd25519Key(private ed25519.PrivateKey) *Key {
+	return &Key{
+		algorithm: ALG_EDDSA,
+		private:   private,
+		public:    private.Public().(ed25519.PublicKey),
+	}
+
+} // End of function  NewEd25519Key.
+
+// Returns a new Ed25519 key that can only verify tokens.
+func NewEd25519VerifyKey(public ed25519.PublicKey) *Key {
+	return &Key{algorithm: ALG_EDDSA, public: public}
+
+} // End of function  NewEd25519VerifyKey.
+
+// Load a key from a file - a PEM encoded Ed25519 private key (PKCS #8,
+// can be encrypted - decrypted with the passphrase source) or public key
+// (verify only), anything else is an HMAC secret.
+func LoadKey(path string, passphrase ptls.PassphraseFunc) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return NewHMACKey(bytes.TrimSpace(data))
+	}
+
+	if block.Type == PUBLIC_KEY {
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+
+		if key, ok := public.(ed25519.PublicKey); ok {
+			return NewEd25519VerifyKey(key), nil
+		}
+
+		return nil, fmt.Errorf("%w: %v %T", ErrUnsupportedAlgorithm, path, public)
+	}
+
+	keys, err := ptls.LoadPrivateKeys(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, ok := keys[0].(ed25519.PrivateKey); ok {
+		return NewEd25519Key(key), nil
+	}
+
+	return nil, fmt.Errorf("%w: %v %v", ErrUnsupportedAlgorithm, path,
+		ptls.KeyType(keys[0]))
+
+} // End of function  LoadKey.
+
+// Returns the key algorithm.
+func (k *Key) Algorithm() string {
+	return k.algorithm
+
+} //  End of  Key.Algorithm
+
+// Returns the signature for the signing input.
+func (k *Key) sign(input []byte) ([]byte, error) {
+	if k.algorithm == ALG_HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	}
+
+	if k.private == nil {
+		return nil, ErrVerifyOnly
+	}
+
+	return ed25519.Sign(k.private, input), nil
+
+} //  End of  Key.sign
+
+// Sign the claims - returns the token.
+func (k *Key) Sign(claims *Claims) (string, error) {
+	encoding := base64.RawURLEncoding
+
+	head, err := json.Marshal(header{Algorithm: k.algorithm, Type: TOKEN_TYPE})
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(head) + "." + encoding.EncodeToString(body)
+
+	signature, err := k.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + encoding.EncodeToString(signature), nil
+
+} //  End of  Key.Sign
+
+// Issue a token for a device valid for `lifetime` with the scopes.
+// Returns the token and its claims.
+func (k *Key) Issue(device string, lifetime time.Duration, scopes Scopes) (string, *Claims, error) {
+	now := time.Now()
+
+	claims := &Claims{
+		Device:   device,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(lifetime).Unix(),
+		Scopes:   scopes,
+	}
+
+	token, err := k.Sign(claims)
+	return token, claims, err
+
+} //  End of  Key.Issue
+
+// Returns the decoded parts of a token - the header, claims, signing
+// input and signature.
+func decode(token string) (*header, *Claims, []byte, []byte, error) {
+	encoding := base64.RawURLEncoding
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+
+	head := &header{}
+	claims := &Claims{}
+	decoded := [][]byte{}
+
+	for _, part := range parts {
+		data, err := encoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+
+		decoded = append(decoded, data)
+	}
+
+	if err := json.Unmarshal(decoded[0], head); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if err := json.Unmarshal(decoded[1], claims); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if len(claims.Device) == 0 || claims.Expires == 0 {
+		return nil, nil, nil, nil, fmt.Errorf("%w: missing claims", ErrInvalidToken)
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	return head, claims, input, decoded[2], nil
+
+} // End of function  decode.
+
+// Returns the claims of a token without verifying it - for devices to
+// know when to refresh their tokens. Never trust the claims returned.
+func Parse(token string) (*Claims, error) {
+	_, claims, _, _, err := decode(token)
+	return claims, err
+
+} // End of function  Parse.
+
+// Verify a token signature and expiry - returns the claims.
+func (k *Key) Verify(token string, now time.Time) (*Claims, error) {
+	head, claims, input, signature, err := decode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if head.Algorithm != k.algorithm {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, head.Algorithm)
+	}
+
+	valid := false
+	if k.algorithm == ALG_HS256 {
+		expected, _ := k.sign(input)
+		valid = hmac.Equal(signature, expected)
+	} else {
+		valid = ed25519.Verify(k.public, input, signature)
+	}
+
+	if !valid {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	if claims.Expired(now) {
+		return nil, fmt.Errorf("%w: %q at %v", ErrTokenExpired, claims.Device,
+			claims.ExpiryTime())
+	}
+
+	return claims, nil
+
+} //  End of  Key.Verify
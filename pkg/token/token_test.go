@@ -0,0 +1,262 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ptls "github.com/biota/go-grpc-telegraph/pkg/tls"
+	pb "github.com/biota/go-grpc-telegraph/proto"
+)
+
+// HMAC key for the tests.
+const TEST_HMAC_KEY = "0123456789abcdef0123456789abcdef"
+
+// Test CategoryName function.
+func TestCategoryName(t *testing.T) {
+	tests := []struct {
+		category string
+		name     string
+	}{
+		{category: "METRICS", name: "CATEGORY_METRICS"},
+		{category: "logs", name: "CATEGORY_LOGS"},
+		{category: "CATEGORY_MANAGEMENT", name: "CATEGORY_MANAGEMENT"},
+		{category: "gossip"},
+		{category: ""},
+	}
+
+	for idx, step := range tests {
+		name, err := CategoryName(step.category)
+		if len(step.name) == 0 {
+			if err == nil {
+				t.Errorf("test %v expected an error for %q", idx, step.category)
+			}
+
+			continue
+		}
+
+		if err != nil || name != step.name {
+			t.Errorf("test %v expected %v, got %v %v", idx, step.name, name, err)
+		}
+	}
+
+} //  End of  TestCategoryName
+
+// Test Scopes functions.
+func TestScopes(t *testing.T) {
+	scopes := Scopes{
+		Topics:     []string{"news/#", "weather/+/today", "alchemy"},
+		Categories: []string{"CATEGORY_METRICS", "CATEGORY_LOGS"},
+	}
+
+	tests := []struct {
+		filter  string
+		allowed bool
+	}{
+		{filter: "news", allowed: true},
+		{filter: "news/sports", allowed: true},
+		{filter: "news/#", allowed: true},
+		{filter: "news/+/today", allowed: true},
+		{filter: "weather/ankh/today", allowed: true},
+		{filter: "weather/+/today", allowed: true},
+		{filter: "alchemy", allowed: true},
+		{filter: "weather/#"},
+		{filter: "weather/ankh"},
+		{filter: "weather/ankh/today/noon"},
+		{filter: "alchemy/gold"},
+		{filter: "+"},
+		{filter: "#"},
+		{filter: "gossip"},
+		{filter: "$sys/uptime"},
+	}
+
+	for idx, step := range tests {
+		if allowed := scopes.AllowsTopic(step.filter); allowed != step.allowed {
+			t.Errorf("test %v expected %v for %q, got %v", idx, step.allowed,
+				step.filter, allowed)
+		}
+
+		if !(Scopes{}).AllowsTopic(step.filter) {
+			t.Errorf("test %v expected no scopes to allow %q", idx, step.filter)
+		}
+	}
+
+	// Invalid filters are never allowed.
+	for _, filter := range []string{"", "news/#/sports", "news/sport+"} {
+		if (Scopes{}).AllowsTopic(filter) || (Scopes{Topics: []string{"#"}}).AllowsTopic(filter) {
+			t.Errorf("expected invalid filter %q to be denied", filter)
+		}
+	}
+
+	if !(Scopes{Topics: []string{"$sys/#"}}).AllowsTopic("$sys/uptime") ||
+		(Scopes{Topics: []string{"#"}}).AllowsTopic("$sys/uptime") {
+		t.Errorf("expected reserved topics to need a reserved scope")
+	}
+
+	if !scopes.AllowsCategory(pb.Category_CATEGORY_METRICS) {
+		t.Errorf("expected metrics to be allowed")
+	}
+
+	if scopes.AllowsCategory(pb.Category_CATEGORY_INCIDENTS) {
+		t.Errorf("expected incidents to be denied")
+	}
+
+	if !(Scopes{}).AllowsCategory(pb.Category_CATEGORY_INCIDENTS) {
+		t.Errorf("expected no scopes to allow incidents")
+	}
+
+} //  End of  TestScopes
+
+// Test signing and verifying tokens.
+func TestSignVerify(t *testing.T) {
+	hmacKey, err := NewHMACKey([]byte(TEST_HMAC_KEY))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := NewHMACKey([]byte("short")); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("expected weak key error, got %v", err)
+	}
+
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	edKey := NewEd25519Key(private)
+	verifyKey := NewEd25519VerifyKey(private.Public().(ed25519.PublicKey))
+
+	if _, _, err := verifyKey.Issue("news", time.Hour, Scopes{}); !errors.Is(err, ErrVerifyOnly) {
+		t.Errorf("expected verify only error, got %v", err)
+	}
+
+	scopes := Scopes{Topics: []string{"news/#"}}
+	now := time.Now()
+
+	for _, key := range []*Key{hmacKey, edKey} {
+		verifier := key
+		if key == edKey {
+			verifier = verifyKey
+		}
+
+		token, claims, err := key.Issue("news", time.Hour, scopes)
+		if err != nil {
+			t.Fatalf("%v unexpected error: %v", key.Algorithm(), err)
+		}
+
+		verified, err := verifier.Verify(token, now)
+		if err != nil {
+			t.Errorf("%v unexpected error: %v", key.Algorithm(), err)
+			continue
+		}
+
+		if verified.Device != "news" || verified.Expires != claims.Expires ||
+			!verified.AllowsTopic("news/sports") || verified.AllowsTopic("gossip") {
+			t.Errorf("%v unexpected claims %+v", key.Algorithm(), verified)
+		}
+
+		parsed, err := Parse(token)
+		if err != nil || parsed.Device != "news" {
+			t.Errorf("%v unexpected parse %+v %v", key.Algorithm(), parsed, err)
+		}
+
+		if !claims.RefreshTime().After(now) || !claims.RefreshTime().Before(claims.ExpiryTime()) {
+			t.Errorf("%v unexpected refresh time %v", key.Algorithm(), claims.RefreshTime())
+		}
+
+		if _, err := verifier.Verify(token, now.Add(2*time.Hour)); !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("%v expected expired token, got %v", key.Algorithm(), err)
+		}
+
+		parts := strings.Split(token, ".")
+		forged, _ := Parse(token)
+		forged.Device = "alchemy"
+		forgedToken, _ := hmacKey.Sign(forged)
+		forgedParts := strings.Split(forgedToken, ".")
+
+		bad := []string{
+			"",
+			"junk",
+			parts[0] + "." + parts[1],
+			parts[0] + "." + forgedParts[1] + "." + parts[2],
+			parts[0] + "." + parts[1] + ".c2lnbmF0dXJl",
+			parts[0] + ".!!." + parts[2],
+		}
+
+		for idx, b := range bad {
+			if _, err := verifier.Verify(b, now); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%v test %v expected invalid token, got %v", key.Algorithm(), idx, err)
+			}
+		}
+	}
+
+	// No switching algorithms.
+	token, _, _ := hmacKey.Issue("news", time.Hour, Scopes{})
+	if _, err := verifyKey.Verify(token, now); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("expected unsupported algorithm, got %v", err)
+	}
+
+} //  End of  TestSignVerify
+
+// Test LoadKey function.
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	ecKey, _ := ptls.GenerateKey()
+	ecPEM, _ := ptls.EncodePrivateKey(ecKey)
+
+	files := map[string][]byte{
+		"hmac.key":    []byte(TEST_HMAC_KEY + "\n"),
+		"weak.key":    []byte("short\n"),
+		"ed25519.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		"public.pem":  pem.EncodeToMemory(&pem.Block{Type: PUBLIC_KEY, Bytes: publicDER}),
+		"ecdsa.pem":   ecPEM,
+	}
+
+	for name, data := range files {
+		os.WriteFile(filepath.Join(dir, name), data, 0o600)
+	}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		signs     bool
+		fails     bool
+	}{
+		{name: "hmac.key", algorithm: ALG_HS256, signs: true},
+		{name: "ed25519.pem", algorithm: ALG_EDDSA, signs: true},
+		{name: "public.pem", algorithm: ALG_EDDSA},
+		{name: "weak.key", fails: true},
+		{name: "ecdsa.pem", fails: true},
+		{name: "404", fails: true},
+	}
+
+	for idx, step := range tests {
+		key, err := LoadKey(filepath.Join(dir, step.name), nil)
+		if step.fails {
+			if err == nil {
+				t.Errorf("test %v expected an error", idx)
+			}
+
+			continue
+		}
+
+		if err != nil || key.Algorithm() != step.algorithm {
+			t.Errorf("test %v unexpected %v %v", idx, key, err)
+			continue
+		}
+
+		_, _, err = key.Issue("news", time.Hour, Scopes{})
+		if signs := err == nil; signs != step.signs {
+			t.Errorf("test %v expected signs %v, got %v", idx, step.signs, err)
+		}
+	}
+
+} //  End of  TestLoadKey
@@ -0,0 +1,148 @@
+// Package topic has the MQTT-style hierarchical topic rules shared by the
+// service broker and the token scopes.
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MQTT-style hierarchical topics ala "tasks/site-7/reboot".
+// Subscription topic filters can use wildcards:
+//
+//	"+" matches exactly one level  - "config/+/sensors"
+//	"#" matches any remaining levels (including none) - "tasks/site-7/#"
+//
+// Topics starting with "$" are reserved and are not matched by a leading
+// wildcard.
+const (
+	SEPARATOR       = "/"
+	WILDCARD_SINGLE = "+"
+	WILDCARD_MULTI  = "#"
+	RESERVED_PREFIX = "$"
+)
+
+var (
+	// Invalid topic or topic filter.
+	ErrInvalidTopic = errors.New("invalid topic")
+)
+
+// Validate a topic filter used in a subscription.
+func ValidateFilter(filter string) error {
+	if len(filter) == 0 {
+		return fmt.Errorf("%w: empty topic filter", ErrInvalidTopic)
+	}
+
+	if strings.ContainsRune(filter, 0) {
+		return fmt.Errorf("%w: %q contains a NUL character",
+			ErrInvalidTopic, filter)
+	}
+
+	levels := strings.Split(filter, SEPARATOR)
+	for idx, level := range levels {
+		if level == WILDCARD_SINGLE {
+			continue
+		}
+
+		if level == WILDCARD_MULTI {
+			if idx != len(levels)-1 {
+				return fmt.Errorf("%w: %q has %q before the last level",
+					ErrInvalidTopic, filter, WILDCARD_MULTI)
+			}
+
+			continue
+		}
+
+		if strings.ContainsAny(level, WILDCARD_SINGLE+WILDCARD_MULTI) {
+			return fmt.Errorf("%w: %q level %q mixes wildcards and text",
+				ErrInvalidTopic, filter, level)
+		}
+	}
+
+	return nil
+
+} // End of function  ValidateFilter.
+
+// Validate a topic used to publish - no wildcards allowed.
+func Validate(topic string) error {
+	if len(topic) == 0 {
+		return fmt.Errorf("%w: empty topic", ErrInvalidTopic)
+	}
+
+	if strings.ContainsRune(topic, 0) {
+		return fmt.Errorf("%w: %q contains a NUL character",
+			ErrInvalidTopic, topic)
+	}
+
+	if strings.ContainsAny(topic, WILDCARD_SINGLE+WILDCARD_MULTI) {
+		return fmt.Errorf("%w: %q contains wildcards", ErrInvalidTopic,
+			topic)
+	}
+
+	return nil
+
+} // End of function  Validate.
+
+// Returns true if a topic matches a (valid) topic filter.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, RESERVED_PREFIX) &&
+		!strings.HasPrefix(filter, RESERVED_PREFIX) {
+		return false
+	}
+
+	filters := strings.Split(filter, SEPARATOR)
+	levels := strings.Split(topic, SEPARATOR)
+
+	for idx, f := range filters {
+		if f == WILDCARD_MULTI {
+			return true
+		}
+
+		if idx >= len(levels) {
+			return false
+		}
+
+		if f != WILDCARD_SINGLE && f != levels[idx] {
+			return false
+		}
+	}
+
+	return len(filters) == len(levels)
+
+} // End of function  Match.
+
+// Returns true if every topic a filter matches is also matched by the
+// scope filter - false if either filter is invalid.
+func Within(filter, scope string) bool {
+	if ValidateFilter(filter) != nil || ValidateFilter(scope) != nil {
+		return false
+	}
+
+	// Reserved topics are only within scopes that name them.
+	if strings.HasPrefix(filter, RESERVED_PREFIX) &&
+		!strings.HasPrefix(scope, RESERVED_PREFIX) {
+		return false
+	}
+
+	filters := strings.Split(filter, SEPARATOR)
+	scopes := strings.Split(scope, SEPARATOR)
+
+	for idx, s := range scopes {
+		if s == WILDCARD_MULTI {
+			return true
+		}
+
+		if idx >= len(filters) {
+			return false
+		}
+
+		f := filters[idx]
+		if f == WILDCARD_MULTI || (s != WILDCARD_SINGLE && s != f) {
+			return false
+		}
+	}
+
+	return len(scopes) == len(filters)
+
+} // End of function  Within.
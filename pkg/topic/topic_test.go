@@ -0,0 +1,128 @@
+package topic
+
+import (
+	"errors"
+	"testing"
+)
+
+// Test ValidateFilter and Validate functions.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		topic  string
+		filter bool
+		valid  bool
+	}{
+		{topic: "news", filter: true, valid: true},
+		{topic: "tasks/site-7/#", filter: true, valid: true},
+		{topic: "config/+/sensors", filter: true, valid: true},
+		{topic: "+", filter: true, valid: true},
+		{topic: "#", filter: true, valid: true},
+		{topic: "+/+/#", filter: true, valid: true},
+		{topic: "/leading/and/trailing/", filter: true, valid: true},
+		{topic: "", filter: true},
+		{topic: "tasks/#/reboot", filter: true},
+		{topic: "tasks/site+/reboot", filter: true},
+		{topic: "tasks/site-7#", filter: true},
+		{topic: "nul/\x00", filter: true},
+
+		{topic: "tasks/site-7/reboot", valid: true},
+		{topic: "$sys/uptime", valid: true},
+		{topic: ""},
+		{topic: "tasks/+/reboot"},
+		{topic: "tasks/#"},
+		{topic: "nul\x00"},
+	}
+
+	for _, step := range tests {
+		validate := Validate
+		if step.filter {
+			validate = ValidateFilter
+		}
+
+		err := validate(step.topic)
+		if step.valid && err != nil {
+			t.Errorf("topic %q unexpected error: %v", step.topic, err)
+		}
+
+		if !step.valid && !errors.Is(err, ErrInvalidTopic) {
+			t.Errorf("topic %q expected an invalid topic error, got %v",
+				step.topic, err)
+		}
+	}
+
+} //  End of  TestValidate
+
+// Test Match function.
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{filter: "news", topic: "news", matches: true},
+		{filter: "news", topic: "news/local"},
+		{filter: "news/local", topic: "news"},
+		{filter: "tasks/site-7/#", topic: "tasks/site-7/reboot", matches: true},
+		{filter: "tasks/site-7/#", topic: "tasks/site-7/a/b/c", matches: true},
+		{filter: "tasks/site-7/#", topic: "tasks/site-7", matches: true},
+		{filter: "tasks/site-7/#", topic: "tasks/site-8/reboot"},
+		{filter: "config/+/sensors", topic: "config/site-7/sensors", matches: true},
+		{filter: "config/+/sensors", topic: "config/site-7/lights"},
+		{filter: "config/+/sensors", topic: "config/sensors"},
+		{filter: "config/+/sensors", topic: "config/a/b/sensors"},
+		{filter: "+", topic: "news", matches: true},
+		{filter: "+", topic: "news/local"},
+		{filter: "+/+", topic: "/news", matches: true},
+		{filter: "#", topic: "any/thing/at/all", matches: true},
+		{filter: "#", topic: "$sys/uptime"},
+		{filter: "+/uptime", topic: "$sys/uptime"},
+		{filter: "$sys/#", topic: "$sys/uptime", matches: true},
+	}
+
+	for _, step := range tests {
+		if m := Match(step.filter, step.topic); m != step.matches {
+			t.Errorf("filter %q topic %q expected match %v, got %v",
+				step.filter, step.topic, step.matches, m)
+		}
+	}
+
+} //  End of  TestMatch
+
+// Test Within function.
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		filter string
+		scope  string
+		within bool
+	}{
+		{filter: "news", scope: "news", within: true},
+		{filter: "news/sports", scope: "news/#", within: true},
+		{filter: "news", scope: "news/#", within: true},
+		{filter: "news/#", scope: "news/#", within: true},
+		{filter: "news/+/today", scope: "news/#", within: true},
+		{filter: "weather/ankh/today", scope: "weather/+/today", within: true},
+		{filter: "weather/+/today", scope: "weather/+/today", within: true},
+		{filter: "anything/at/all", scope: "#", within: true},
+		{filter: "+/uptime", scope: "#", within: true},
+		{filter: "$sys/uptime", scope: "$sys/#", within: true},
+		{filter: "news/sports", scope: "news"},
+		{filter: "weather/#", scope: "weather/+/today"},
+		{filter: "weather/ankh", scope: "weather/+/today"},
+		{filter: "+", scope: "news"},
+		{filter: "#", scope: "news/#"},
+		{filter: "$sys/uptime", scope: "#"},
+		{filter: "$sys/uptime", scope: "+/uptime"},
+		{filter: "news/#/sports", scope: "#"},
+		{filter: "news/sport+", scope: "news/#"},
+		{filter: "", scope: "#"},
+		{filter: "news", scope: "news/#/x"},
+	}
+
+	for idx, step := range tests {
+		if within := Within(step.filter, step.scope); within != step.within {
+			t.Errorf("test %v filter %q scope %q expected %v, got %v", idx,
+				step.filter, step.scope, step.within, within)
+		}
+	}
+
+} //  End of  TestWithin
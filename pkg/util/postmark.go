@@ -0,0 +1,61 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// Size of a postmark tag value (in bytes).
+	TAG_SIZE = 16
+)
+
+// Returns a new unique tag. Panics if the system random source fails -
+// there's no unique tag to be had without it.
+func NewTag() *pb.Tag {
+	value := make([]byte, TAG_SIZE)
+
+	if _, err := rand.Read(value); err != nil {
+		panic("reading random tag: " + err.Error())
+	}
+
+	return &pb.Tag{Value: value}
+
+} // End of function  NewTag.
+
+// Returns a new postmark with a unique tag stamped with the current time.
+func NewPostmark() *pb.Postmark {
+	return &pb.Postmark{Tag: NewTag(), When: timestamppb.Now()}
+
+} // End of function  NewPostmark.
+
+// Returns the hex encoded value of a tag or an empty string for no tag.
+func TagString(tag *pb.Tag) string {
+	return hex.EncodeToString(tag.GetValue())
+
+} // End of function  TagString.
+
+// Checks if two tags have the same value.
+func SameTag(a, b *pb.Tag) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return bytes.Equal(a.GetValue(), b.GetValue())
+
+} // End of function  SameTag.
+
+// Returns the postmark time or the zero time if there is none.
+func PostmarkTime(postmark *pb.Postmark) time.Time {
+	if postmark.GetWhen() == nil {
+		return time.Time{}
+	}
+
+	return postmark.GetWhen().AsTime()
+
+} // End of function  PostmarkTime.
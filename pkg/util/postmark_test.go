@@ -0,0 +1,97 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/biota/go-grpc-telegraph/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Test NewTag function.
+func TestNewTag(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for idx := 0; idx < 100; idx++ {
+		tag := NewTag()
+		if len(tag.GetValue()) != TAG_SIZE {
+			t.Errorf("expected tag size %v, got %v", TAG_SIZE,
+				len(tag.GetValue()))
+		}
+
+		key := TagString(tag)
+		if seen[key] {
+			t.Errorf("duplicate tag %v", key)
+		}
+
+		seen[key] = true
+	}
+
+} // End of function  TestNewTag.
+
+// Test NewPostmark function.
+func TestNewPostmark(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	postmark := NewPostmark()
+
+	if postmark.GetTag() == nil {
+		t.Errorf("expected postmark tag, got none")
+	}
+
+	when := PostmarkTime(postmark)
+	if when.Before(before) || when.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected postmark time %v", when)
+	}
+
+} // End of function  TestNewPostmark.
+
+// Test TagString and SameTag functions.
+func TestSameTag(t *testing.T) {
+	tag := NewTag()
+	other := NewTag()
+	copied := &pb.Tag{Value: append([]byte{}, tag.GetValue()...)}
+
+	tests := []struct {
+		name     string
+		a        *pb.Tag
+		b        *pb.Tag
+		expected bool
+	}{
+		{name: "same", a: tag, b: tag, expected: true},
+		{name: "copied", a: tag, b: copied, expected: true},
+		{name: "different", a: tag, b: other, expected: false},
+		{name: "nil first", a: nil, b: tag, expected: false},
+		{name: "nil second", a: tag, b: nil, expected: false},
+		{name: "both nil", a: nil, b: nil, expected: true},
+	}
+
+	for _, step := range tests {
+		if v := SameTag(step.a, step.b); v != step.expected {
+			t.Errorf("test %v expected %v, got %v", step.name,
+				step.expected, v)
+		}
+	}
+
+	if s := TagString(nil); s != "" {
+		t.Errorf("expected empty tag string, got %v", s)
+	}
+
+	if s := TagString(&pb.Tag{Value: []byte{0xca, 0xfe}}); s != "cafe" {
+		t.Errorf("expected tag string cafe, got %v", s)
+	}
+
+} // End of function  TestSameTag.
+
+// Test PostmarkTime function.
+func TestPostmarkTime(t *testing.T) {
+	if v := PostmarkTime(nil); !v.IsZero() {
+		t.Errorf("expected zero time for nil postmark, got %v", v)
+	}
+
+	when := time.Unix(610003162, 0)
+	postmark := &pb.Postmark{When: timestamppb.New(when)}
+	if v := PostmarkTime(postmark); !v.Equal(when) {
+		t.Errorf("expected %v, got %v", when, v)
+	}
+
+} // End of function  TestPostmarkTime.